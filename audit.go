@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Имя журнала аудита в каталоге данных
+const auditLogFile = "audit.log"
+
+// Запись журнала аудита
+type auditEntry struct {
+	Time time.Time `json:"time"`
+	// Кто выполнил действие: пользователь, "token", "anonymous", "relay" или "system".
+	// У пользователей пространства имён впереди имя пространства: "lab/token".
+	Identity string `json:"identity"`
+	// Адрес клиента
+	Remote string `json:"remote,omitempty"`
+	// Действие: settings, command, portOpen, portClose, имя действия клиента или HTTP-запрос
+	Action  string      `json:"action"`
+	Port    string      `json:"port,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+var (
+	// Открытый для дополнения журнал аудита
+	auditFile *os.File
+	// Мьютекс для синхронизации записи в журнал аудита
+	auditMutex = &sync.Mutex{}
+)
+
+func init() {
+	http.HandleFunc("GET /audit", handleAuditLog)
+}
+
+// Запись действия в журнал аудита. Журнал только дополняется.
+func auditLog(identity, remote, action, port string, details interface{}) {
+	entry := auditEntry{
+		Time:     time.Now(),
+		Identity: identity,
+		Remote:   remote,
+		Action:   action,
+		Port:     port,
+		Details:  details,
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Ошибка при маршалинге записи аудита: %v", err)
+		return
+	}
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	if auditFile == nil {
+		if err := os.MkdirAll(dataDir, 0755); err != nil {
+			log.Printf("Ошибка открытия журнала аудита: %v", err)
+			return
+		}
+		auditFile, err = os.OpenFile(dataPath(auditLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			log.Printf("Ошибка открытия журнала аудита: %v", err)
+			return
+		}
+	}
+	if _, err := auditFile.Write(append(data, '\n')); err != nil {
+		log.Printf("Ошибка записи журнала аудита: %v", err)
+		return
+	}
+	if err := auditFile.Sync(); err != nil {
+		log.Printf("Ошибка записи журнала аудита: %v", err)
+	}
+}
+
+// Запись действия клиента WebSocket в журнал аудита
+func auditClientAction(ws *websocket.Conn, action, port string, details interface{}) {
+	identity, remote := "system", ""
+	if client := getWSClient(ws); client != nil {
+		identity, remote = client.identity, client.remote
+	}
+	auditLog(identity, remote, action, port, details)
+}
+
+// Запись изменяющих HTTP-запросов в журнал аудита
+func auditHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			auditLog(requestIdentity(r), r.RemoteAddr, r.Method+" "+r.URL.Path, "", nil)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Записи журнала аудита: ?since=<RFC 3339>&limit=<число> (последние записи)
+func handleAuditLog(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "неверное время since"})
+			return
+		}
+	}
+	limit := 1000
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "неверное число limit"})
+			return
+		}
+	}
+
+	entries, err := readAuditLog(since, limit, requestNamespace(r))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// Чтение последних limit записей журнала аудита не раньше since. Для пространства
+// имён - только записи его пользователей и его портов.
+func readAuditLog(since time.Time, limit int, ns *namespace) ([]json.RawMessage, error) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	file, err := os.Open(dataPath(auditLogFile))
+	if os.IsNotExist(err) {
+		return []json.RawMessage{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := []json.RawMessage{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("повреждённая запись журнала аудита: %v", err)
+		}
+		if entry.Time.Before(since) {
+			continue
+		}
+		if ns != nil && !strings.HasPrefix(entry.Identity, ns.Name+"/") && (entry.Port == "" || !ns.allowsPort(entry.Port)) {
+			continue
+		}
+		entries = append(entries, json.RawMessage(append([]byte(nil), scanner.Bytes()...)))
+		if len(entries) > limit {
+			entries = entries[1:]
+		}
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Файл паролей в формате htpasswd
+var htpasswdPath string
+
+// Проверка имени и пароля (HTTP Basic) по файлу htpasswd. Поддерживаются
+// хеши {SHA} и MD5 ($apr1$, $1$). Файл перечитывается при изменении.
+type htpasswdAuth struct {
+	path    string
+	users   map[string]string
+	modTime time.Time
+	mutex   sync.Mutex
+}
+
+func newHtpasswdAuth(path string) (*htpasswdAuth, error) {
+	if path == "" {
+		return nil, errors.New("не указан файл паролей (-htpasswd)")
+	}
+	a := &htpasswdAuth{path: path}
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *htpasswdAuth) authenticate(r *http.Request) (string, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", errors.New("не переданы имя и пароль")
+	}
+	if err := a.reload(); err != nil {
+		log.Printf("Ошибка чтения файла паролей: %v", err)
+	}
+
+	a.mutex.Lock()
+	hash, ok := a.users[user]
+	a.mutex.Unlock()
+
+	if !ok || !checkHtpasswdHash(hash, password) {
+		return "", errors.New("неверное имя или пароль")
+	}
+	return user, nil
+}
+
+func (a *htpasswdAuth) challenge() string {
+	return `Basic realm="serial-monitor"`
+}
+
+// Чтение файла паролей, если он изменился
+func (a *htpasswdAuth) reload() error {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if info.ModTime().Equal(a.modTime) && a.users != nil {
+		return nil
+	}
+	file, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		if strings.HasPrefix(hash, "$2") {
+			log.Printf("Файл паролей: хеш bcrypt пользователя %s не поддерживается, используйте htpasswd -m или -s", user)
+			continue
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	a.users = users
+	a.modTime = info.ModTime()
+	return nil
+}
+
+// Проверка пароля по хешу из файла htpasswd
+func checkHtpasswdHash(hash, password string) bool {
+	var computed string
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "$apr1$"):
+		computed = md5Crypt(password, hashSalt(hash, "$apr1$"), "$apr1$")
+	case strings.HasPrefix(hash, "$1$"):
+		computed = md5Crypt(password, hashSalt(hash, "$1$"), "$1$")
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
+
+// Соль из хеша вида $magic$salt$hash
+func hashSalt(hash, magic string) string {
+	salt, _, _ := strings.Cut(strings.TrimPrefix(hash, magic), "$")
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	return salt
+}
+
+// Алгоритм MD5-crypt (Poul-Henning Kamp), который использует htpasswd -m
+func md5Crypt(password, salt, magic string) string {
+	pw := []byte(password)
+
+	alternate := md5.New()
+	alternate.Write(pw)
+	alternate.Write([]byte(salt))
+	alternate.Write(pw)
+	alternateSum := alternate.Sum(nil)
+
+	d := md5.New()
+	d.Write(pw)
+	d.Write([]byte(magic))
+	d.Write([]byte(salt))
+	for i := len(pw); i > 0; i -= 16 {
+		d.Write(alternateSum[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+	sum := d.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(sum)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(sum)
+		} else {
+			round.Write(pw)
+		}
+		sum = round.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out []byte
+	encode := func(a, b, c byte, n int) {
+		v := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	encode(sum[0], sum[6], sum[12], 4)
+	encode(sum[1], sum[7], sum[13], 4)
+	encode(sum[2], sum[8], sum[14], 4)
+	encode(sum[3], sum[9], sum[15], 4)
+	encode(sum[4], sum[10], sum[5], 4)
+	encode(0, 0, sum[11], 2)
+	return magic + salt + "$" + string(out)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Как часто можно перечитывать ключи поставщика, если пришёл токен с неизвестным ключом
+const jwksRefreshInterval = time.Minute
+
+var (
+	// Адрес поставщика OpenID Connect и ожидаемый получатель токена
+	oidcIssuer   string
+	oidcAudience string
+)
+
+// Проверка токенов OpenID Connect (JWT, подписанных RS256 или ES256) по ключам поставщика
+type oidcAuth struct {
+	issuer   string
+	audience string
+	jwksURL  string
+	// Открытые ключи поставщика, ключ - идентификатор ключа (kid)
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	mutex     sync.Mutex
+}
+
+// Набор ключей поставщика (JWKS)
+type jsonWebKeySet struct {
+	Keys []struct {
+		Kid string `json:"kid"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	} `json:"keys"`
+}
+
+// Утверждения токена, которые проверяет монитор
+type oidcClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"`
+	ExpiresAt         int64           `json:"exp"`
+	NotBefore         int64           `json:"nbf"`
+	PreferredUsername string          `json:"preferred_username"`
+	Email             string          `json:"email"`
+}
+
+func newOIDCAuth(issuer, audience string) (*oidcAuth, error) {
+	if issuer == "" {
+		return nil, errors.New("не указан адрес поставщика OpenID Connect (-oidc-issuer)")
+	}
+	// Без проверки получателя подошёл бы токен, выданный поставщиком любому другому приложению
+	if audience == "" {
+		return nil, errors.New("не указан получатель токена OpenID Connect (-oidc-audience)")
+	}
+	issuer = strings.TrimSuffix(issuer, "/")
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURL string `json:"jwks_uri"`
+	}
+	if err := fetchJSON(issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("не удалось получить настройки поставщика: %v", err)
+	}
+	if discovery.JWKSURL == "" {
+		return nil, errors.New("поставщик не сообщил адрес ключей (jwks_uri)")
+	}
+	a := &oidcAuth{issuer: issuer, audience: audience, jwksURL: discovery.JWKSURL}
+	if discovery.Issuer != "" {
+		a.issuer = discovery.Issuer
+	}
+	if err := a.refreshKeys(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *oidcAuth) authenticate(r *http.Request) (string, error) {
+	token := requestToken(r)
+	if token == "" {
+		return "", errors.New("не передан токен")
+	}
+	claims, err := a.verify(token)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range []string{claims.PreferredUsername, claims.Email, claims.Subject} {
+		if name != "" {
+			return name, nil
+		}
+	}
+	return "", errors.New("в токене нет имени пользователя")
+}
+
+func (a *oidcAuth) challenge() string {
+	return "Bearer"
+}
+
+// Проверка подписи и утверждений токена
+func (a *oidcAuth) verify(token string) (*oidcClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("токен не в формате JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("неверная подпись токена")
+	}
+	key, err := a.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) != nil {
+			return nil, errors.New("подпись токена не прошла проверку")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 ||
+			!ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+			return nil, errors.New("подпись токена не прошла проверку")
+		}
+	default:
+		return nil, errors.New("неподдерживаемый тип ключа")
+	}
+
+	var claims oidcClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	if claims.ExpiresAt == 0 || now >= claims.ExpiresAt {
+		return nil, errors.New("срок действия токена истёк")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, errors.New("токен ещё не действует")
+	}
+	if claims.Issuer != a.issuer {
+		return nil, fmt.Errorf("токен выдан другим поставщиком %q", claims.Issuer)
+	}
+	if !audienceContains(claims.Audience, a.audience) {
+		return nil, errors.New("токен выдан для другого получателя")
+	}
+	return &claims, nil
+}
+
+// Получатель токена может быть строкой или списком строк
+func audienceContains(raw json.RawMessage, audience string) bool {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return single == audience
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		for _, aud := range list {
+			if aud == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Открытый ключ по идентификатору. Если ключ неизвестен, ключи перечитываются:
+// поставщик мог сменить ключ подписи.
+func (a *oidcAuth) key(kid string) (crypto.PublicKey, error) {
+	a.mutex.Lock()
+	key, ok := a.keys[kid]
+	stale := time.Since(a.fetchedAt) > jwksRefreshInterval
+	a.mutex.Unlock()
+
+	if ok {
+		return key, nil
+	}
+	if stale {
+		if err := a.refreshKeys(); err != nil {
+			return nil, err
+		}
+		a.mutex.Lock()
+		key, ok = a.keys[kid]
+		a.mutex.Unlock()
+		if ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("неизвестный ключ подписи %q", kid)
+}
+
+// Загрузка ключей поставщика
+func (a *oidcAuth) refreshKeys() error {
+	var set jsonWebKeySet
+	if err := fetchJSON(a.jwksURL, &set); err != nil {
+		return fmt.Errorf("не удалось получить ключи поставщика: %v", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if k.Crv != "P-256" || errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.keys = keys
+	a.fetchedAt = time.Now()
+	return nil
+}
+
+// Разбор части JWT в кодировке base64url
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("неверная кодировка токена")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("неверное содержимое токена")
+	}
+	return nil
+}
+
+// Загрузка JSON по HTTP
+func fetchJSON(url string, v interface{}) error {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
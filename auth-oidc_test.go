@@ -0,0 +1,23 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Получатель токена обязателен: без него подошёл бы токен любого приложения поставщика
+func TestOIDCAudienceRequired(t *testing.T) {
+	if _, err := newOIDCAuth("https://issuer.example", ""); err == nil {
+		t.Error("принята настройка без -oidc-audience")
+	}
+	for _, aud := range []string{`"other"`, `["other", "another"]`, `null`} {
+		if audienceContains(json.RawMessage(aud), "monitor") {
+			t.Errorf("получатель %s принят", aud)
+		}
+	}
+	for _, aud := range []string{`"monitor"`, `["other", "monitor"]`} {
+		if !audienceContains(json.RawMessage(aud), "monitor") {
+			t.Errorf("получатель %s не принят", aud)
+		}
+	}
+}
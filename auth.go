@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Способ проверки подлинности клиентов
+type authBackend interface {
+	// Проверка запроса. Возвращает имя пользователя.
+	authenticate(r *http.Request) (string, error)
+	// Заголовок WWW-Authenticate для отказа
+	challenge() string
+}
+
+// Ключ контекста запроса, под которым хранится имя пользователя
+type identityKey struct{}
+
+var (
+	// Способ проверки подлинности: token, oidc, proxy или htpasswd
+	authMode string
+	// Токен доступа к серверу для способа token
+	accessToken string
+	// Заголовок с именем пользователя от обратного прокси и сети, которым он доверяется
+	authProxyHeader  string
+	authProxyTrusted string
+	// Действующий способ проверки подлинности. Если nil, доступ не ограничен.
+	auth authBackend
+)
+
+// Выбор способа проверки подлинности по флагам запуска
+func setupAuth() {
+	if authMode == "" && accessToken != "" {
+		authMode = "token"
+	}
+	var err error
+	switch authMode {
+	case "":
+		return
+	case "token":
+		if accessToken == "" {
+			err = errors.New("не указан токен доступа (-token)")
+		}
+		auth = tokenAuth{}
+	case "oidc":
+		auth, err = newOIDCAuth(oidcIssuer, oidcAudience)
+	case "proxy":
+		auth, err = newProxyAuth(authProxyHeader, authProxyTrusted)
+	case "htpasswd":
+		auth, err = newHtpasswdAuth(htpasswdPath)
+	default:
+		err = fmt.Errorf("неизвестный способ проверки подлинности %q", authMode)
+	}
+	if err != nil {
+		log.Fatalf("Ошибка настройки проверки подлинности: %v", err)
+	}
+	log.Printf("Проверка подлинности клиентов: %s", authMode)
+}
+
+// Проверка подлинности для всех запросов к серверу. Подключение по ссылке
+// совместного просмотра проверяется отдельно при подключении клиента.
+// Токен пространства имён допускается при любом способе проверки.
+func requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ns := namespaceByToken(requestToken(r)); ns != nil {
+			next.ServeHTTP(w, withIdentity(r, "token", ns))
+			return
+		}
+		if auth == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		identity, err := auth.authenticate(r)
+		if err == nil {
+			next.ServeHTTP(w, withIdentity(r, identity, namespaceByUser(identity)))
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/serialmonitor") && r.URL.Query().Get("share") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		log.Printf("Отказ в доступе клиенту %s: %v", r.RemoteAddr, err)
+		w.Header().Set("WWW-Authenticate", auth.challenge())
+		http.Error(w, "требуется проверка подлинности", http.StatusUnauthorized)
+	})
+}
+
+// Кто выполняет запрос: имя пользователя после проверки подлинности или "anonymous"
+func requestIdentity(r *http.Request) string {
+	if identity, ok := r.Context().Value(identityKey{}).(string); ok {
+		return identity
+	}
+	return "anonymous"
+}
+
+// Токен из заголовка Authorization или параметра token. Браузер не может
+// передать заголовок при подключении WebSocket, поэтому нужен и параметр.
+func requestToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+// Проверка общего токена доступа
+type tokenAuth struct{}
+
+func (tokenAuth) authenticate(r *http.Request) (string, error) {
+	if subtle.ConstantTimeCompare([]byte(requestToken(r)), []byte(accessToken)) != 1 {
+		return "", errors.New("неверный токен доступа")
+	}
+	return "token", nil
+}
+
+func (tokenAuth) challenge() string {
+	return "Bearer"
+}
+
+// Доверие заголовку с именем пользователя, который выставляет обратный прокси
+// после собственной проверки подлинности (например, oauth2-proxy)
+type proxyAuth struct {
+	header  string
+	trusted []*net.IPNet
+}
+
+func newProxyAuth(header, trusted string) (*proxyAuth, error) {
+	if header == "" {
+		return nil, errors.New("не указан заголовок с именем пользователя")
+	}
+	a := &proxyAuth{header: header}
+	for _, cidr := range splitList(trusted) {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("неверная сеть прокси %q", cidr)
+		}
+		a.trusted = append(a.trusted, network)
+	}
+	if len(a.trusted) == 0 {
+		return nil, errors.New("не указаны сети, из которых принимается заголовок прокси (-auth-proxy-trusted)")
+	}
+	return a, nil
+}
+
+func (a *proxyAuth) authenticate(r *http.Request) (string, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "", err
+	}
+	ip := net.ParseIP(host)
+	trusted := false
+	for _, network := range a.trusted {
+		if network.Contains(ip) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return "", fmt.Errorf("запрос пришёл не от доверенного прокси")
+	}
+	user := r.Header.Get(a.header)
+	if user == "" {
+		return "", fmt.Errorf("прокси не передал заголовок %s", a.header)
+	}
+	return user, nil
+}
+
+func (a *proxyAuth) challenge() string {
+	return "Bearer"
+}
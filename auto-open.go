@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Правило автоматического подключения устройства при его появлении
+type autoOpenRule struct {
+	// Часть постоянного идентификатора устройства (например, серийный номер)
+	Device string `json:"device"`
+	// Имя порта, если устройство определяется по порту
+	Port     string `json:"port"`
+	BaudRate int    `json:"baudRate"`
+	// Формат кадра ("8N1", "7E1", "8M1"), пустая строка - 8N1
+	Framing string `json:"framing"`
+	// Файл журнала, в который записываются строки устройства
+	LogFile string `json:"logFile"`
+	// Расписание окон записи в формате cron и длительность окна ("8h").
+	// Вне окна порт не открывается и остаётся свободным для работы вручную.
+	Schedule string `json:"schedule"`
+	Duration string `json:"duration"`
+	// Запись начала работы устройства при каждом его появлении: длительность
+	// ("10s") и/или объём в байтах. Каждая загрузка сохраняется в свой файл.
+	BootCapture      string `json:"bootCapture"`
+	BootCaptureBytes int    `json:"bootCaptureBytes"`
+
+	schedule *cronSchedule
+	duration time.Duration
+}
+
+// Период опроса списка портов, если есть правила записи начала работы:
+// устройство нужно открыть раньше, чем оно начнёт выдавать данные
+const bootPortPollInterval = 200 * time.Millisecond
+
+// Паузы между повторными попытками открыть порт по расписанию после ошибки:
+// пауза удваивается с каждой неудачей до наибольшей
+const (
+	autoOpenRetryMin = 30 * time.Second
+	autoOpenRetryMax = 30 * time.Minute
+)
+
+// Неудачные попытки открыть порт подряд
+type autoOpenFailure struct {
+	count   int
+	retryAt time.Time
+	// Текст последней ошибки: об ошибке сообщается, только если он изменился
+	err string
+}
+
+var (
+	// путь к файлу с правилами автоматического подключения
+	autoOpenRulesPath string
+	// Правила автоматического подключения
+	autoOpenRules []autoOpenRule
+	// Порты, открытые по расписанию: в конце окна закрываются только они
+	scheduledPorts = make(map[string]*managedPort)
+	// Неудачные попытки автоматического подключения, ключ - имя порта
+	autoOpenFailures = make(map[string]*autoOpenFailure)
+	// Мьютекс для синхронизации доступа к scheduledPorts и autoOpenFailures
+	scheduledPortsMutex = &sync.Mutex{}
+	// Есть ли правила с записью начала работы устройства
+	bootCaptureRules bool
+)
+
+// Загрузка правил автоматического подключения при запуске
+func loadAutoOpenRules() {
+	if autoOpenRulesPath == "" {
+		return
+	}
+	data, err := os.ReadFile(autoOpenRulesPath)
+	if err != nil {
+		log.Fatalf("Ошибка чтения правил автоматического подключения: %v", err)
+	}
+	if err := json.Unmarshal(data, &autoOpenRules); err != nil {
+		log.Fatalf("Ошибка разбора правил автоматического подключения: %v", err)
+	}
+
+	scheduled := false
+	for i := range autoOpenRules {
+		rule := &autoOpenRules[i]
+		if _, err := parseFraming(rule.Framing); err != nil {
+			log.Fatalf("Ошибка в правиле %d: %v", i+1, err)
+		}
+		if rule.bootCapture() {
+			if d, err := parseOptionalDuration(rule.BootCapture); err != nil || d < 0 || rule.BootCaptureBytes < 0 || rule.BootCaptureBytes > maxCaptureBytes {
+				log.Fatalf("Неверная запись начала работы в правиле %d: %q, %d байт", i+1, rule.BootCapture, rule.BootCaptureBytes)
+			}
+			bootCaptureRules = true
+		}
+		if rule.Schedule == "" {
+			continue
+		}
+		if rule.schedule, err = parseCron(rule.Schedule); err != nil {
+			log.Fatalf("Ошибка разбора расписания правила %d: %v", i+1, err)
+		}
+		if rule.duration, err = time.ParseDuration(rule.Duration); err != nil || rule.duration <= 0 {
+			log.Fatalf("Неверная длительность окна записи в правиле %d: %q", i+1, rule.Duration)
+		}
+		scheduled = true
+	}
+	log.Printf("Загружено правил автоматического подключения: %d", len(autoOpenRules))
+
+	if scheduled {
+		go runCaptureSchedule()
+	}
+}
+
+// Период опроса списка портов
+func portPollPeriod() time.Duration {
+	if bootCaptureRules {
+		return bootPortPollInterval
+	}
+	return portPollInterval
+}
+
+// Записывается ли начало работы устройства
+func (rule autoOpenRule) bootCapture() bool {
+	return rule.BootCapture != "" || rule.BootCaptureBytes > 0
+}
+
+// Проверяем, действует ли правило в момент t
+func (rule autoOpenRule) activeAt(t time.Time) bool {
+	return rule.schedule == nil || rule.schedule.activeAt(t, rule.duration)
+}
+
+// Проверяем, подходит ли правило устройству на порту
+func (rule autoOpenRule) matches(port, deviceID string) bool {
+	if rule.Port != "" && rule.Port != port {
+		return false
+	}
+	if rule.Device != "" && !strings.Contains(deviceID, rule.Device) {
+		return false
+	}
+	return rule.Port != "" || rule.Device != ""
+}
+
+// Подключение появившихся устройств, для которых есть правила
+func applyAutoOpenRules(ports []string) {
+	for _, port := range ports {
+		deviceID := stableDeviceID(port)
+		for _, rule := range autoOpenRules {
+			if rule.matches(port, deviceID) && rule.activeAt(time.Now()) {
+				// Устройство подключено заново - ошибки прошлого подключения не в счёт
+				clearAutoOpenFailure(port)
+				if p := autoOpenPort(port, rule); p != nil && rule.schedule != nil {
+					setPortScheduled(port, p)
+				}
+				break
+			}
+		}
+	}
+}
+
+// Открываем порт по правилу и начинаем журнал, если он указан. Возвращает
+// порт, если его открыл этот вызов, и nil, если открыть не удалось или порт
+// уже был открыт другими: такой порт правило не трогает.
+func autoOpenPort(port string, rule autoOpenRule) *managedPort {
+	// Запись начинается до открытия порта, чтобы не потерять первые байты
+	var capture *portCapture
+	if rule.bootCapture() {
+		var err error
+		capture, err = startCapture(captureRequest{
+			Port:     port,
+			Duration: rule.BootCapture,
+			Bytes:    rule.BootCaptureBytes,
+			Name:     bootCaptureName(port),
+		}, true)
+		if err != nil {
+			broadcast <- fmt.Sprintf("Ошибка записи начала работы устройства на порту %s: %v", port, err)
+		}
+	}
+	p, opened, err := acquireManagedPort(port, rule.BaudRate, rule.Framing)
+	if err != nil || !opened {
+		if capture != nil {
+			cancelCapture(capture)
+		}
+		if err != nil && recordAutoOpenFailure(port, err) {
+			broadcast <- fmt.Sprintf("Ошибка автоматического подключения к порту %s: %v. Попытки будут повторяться с растущими паузами, об этой ошибке больше не сообщается.", port, err)
+		}
+		return nil
+	}
+	clearAutoOpenFailure(port)
+	if rule.LogFile != "" {
+		if err := startPortLog(port, rule.LogFile); err != nil {
+			broadcast <- fmt.Sprintf("Ошибка открытия журнала порта %s: %v", port, err)
+		}
+	}
+	broadcast <- fmt.Sprintf("Автоматическое подключение к порту %s со скоростью %d выполнено.", port, rule.BaudRate)
+	if capture != nil {
+		broadcast <- fmt.Sprintf("Записывается начало работы устройства на порту %s.", port)
+	}
+	return p
+}
+
+// Имя файла записи одной загрузки устройства: идентификатор устройства и время появления
+func bootCaptureName(port string) string {
+	return fmt.Sprintf("boot_%s_%s.bin",
+		unsafeFileChars.ReplaceAllString(filepath.Base(stableDeviceID(port)), "_"),
+		time.Now().Format("20060102-150405.000"))
+}
+
+// Открытие и закрытие портов по расписанию окон записи
+func runCaptureSchedule() {
+	for {
+		now := time.Now()
+		for _, port := range getPortNames() {
+			deviceID := stableDeviceID(port)
+			for _, rule := range autoOpenRules {
+				if rule.schedule == nil || !rule.matches(port, deviceID) {
+					continue
+				}
+				active := rule.activeAt(now)
+				if active && getManagedPort(port) == nil && autoOpenDue(port, now) {
+					if p := autoOpenPort(port, rule); p != nil {
+						setPortScheduled(port, p)
+						broadcast <- fmt.Sprintf("Начато окно записи порта %s по расписанию %q.", port, rule.Schedule)
+					}
+				} else if !active {
+					clearAutoOpenFailure(port)
+					// Порт, открытый не по расписанию или открытый заново
+					// другими, остаётся открытым
+					if p := scheduledPort(port); p != nil {
+						setPortScheduled(port, nil)
+						if closeOwnedManagedPort(p) {
+							broadcast <- fmt.Sprintf("Окно записи порта %s завершено, порт освобождён.", port)
+						}
+					}
+				}
+				break
+			}
+		}
+		time.Sleep(30 * time.Second)
+	}
+}
+
+// Отмечаем, что порт открыт по расписанию (nil - больше не открыт)
+func setPortScheduled(port string, p *managedPort) {
+	scheduledPortsMutex.Lock()
+	defer scheduledPortsMutex.Unlock()
+
+	if p != nil {
+		scheduledPorts[port] = p
+	} else {
+		delete(scheduledPorts, port)
+	}
+}
+
+// Порт, открытый по расписанию, или nil
+func scheduledPort(port string) *managedPort {
+	scheduledPortsMutex.Lock()
+	defer scheduledPortsMutex.Unlock()
+
+	return scheduledPorts[port]
+}
+
+// Учитываем неудачную попытку открыть порт и откладываем следующую.
+// Возвращает true, если об ошибке нужно сообщить: это первая ошибка подряд
+// или ошибка изменилась.
+func recordAutoOpenFailure(port string, err error) bool {
+	scheduledPortsMutex.Lock()
+	defer scheduledPortsMutex.Unlock()
+
+	f := autoOpenFailures[port]
+	if f == nil {
+		f = &autoOpenFailure{}
+		autoOpenFailures[port] = f
+	}
+	f.count++
+	delay := autoOpenRetryMax
+	if f.count <= 6 {
+		delay = min(autoOpenRetryMin<<(f.count-1), autoOpenRetryMax)
+	}
+	f.retryAt = time.Now().Add(delay)
+
+	report := f.err != err.Error()
+	f.err = err.Error()
+	return report
+}
+
+// Пора ли снова пытаться открыть порт после ошибок
+func autoOpenDue(port string, now time.Time) bool {
+	scheduledPortsMutex.Lock()
+	defer scheduledPortsMutex.Unlock()
+
+	f := autoOpenFailures[port]
+	return f == nil || !now.Before(f.retryAt)
+}
+
+// Забываем ошибки открытия порта
+func clearAutoOpenFailure(port string) {
+	scheduledPortsMutex.Lock()
+	defer scheduledPortsMutex.Unlock()
+
+	delete(autoOpenFailures, port)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Повторяющаяся ошибка сообщается один раз, а попытки откладываются всё дольше
+func TestAutoOpenFailureBackoff(t *testing.T) {
+	const port = "/dev/ttyTEST0"
+	t.Cleanup(func() { clearAutoOpenFailure(port) })
+
+	busy := errors.New("порт занят")
+	if !recordAutoOpenFailure(port, busy) {
+		t.Error("о первой ошибке не сообщено")
+	}
+	if autoOpenDue(port, time.Now()) {
+		t.Error("повторная попытка сразу после ошибки")
+	}
+	if !autoOpenDue(port, time.Now().Add(autoOpenRetryMin)) {
+		t.Errorf("нет повторной попытки через %s", autoOpenRetryMin)
+	}
+
+	for range 20 {
+		if recordAutoOpenFailure(port, busy) {
+			t.Fatal("о той же ошибке сообщено повторно")
+		}
+	}
+	if autoOpenDue(port, time.Now().Add(autoOpenRetryMax-time.Second)) {
+		t.Error("пауза не выросла до наибольшей")
+	}
+	if !autoOpenDue(port, time.Now().Add(autoOpenRetryMax+time.Second)) {
+		t.Error("пауза больше наибольшей")
+	}
+	if !recordAutoOpenFailure(port, errors.New("нет доступа")) {
+		t.Error("о новой ошибке не сообщено")
+	}
+
+	clearAutoOpenFailure(port)
+	if !autoOpenDue(port, time.Now()) || !recordAutoOpenFailure(port, busy) {
+		t.Error("ошибки не забыты")
+	}
+}
+
+// Порт, который открыли заново другие, не закрывается от имени прежнего владельца
+func TestCloseOwnedManagedPortKeepsOthers(t *testing.T) {
+	const name = "/dev/ttyTEST1"
+	other := &managedPort{name: name}
+	managedPortsMutex.Lock()
+	managedPorts[name] = other
+	managedPortsMutex.Unlock()
+	t.Cleanup(func() {
+		managedPortsMutex.Lock()
+		delete(managedPorts, name)
+		managedPortsMutex.Unlock()
+	})
+
+	if closeOwnedManagedPort(&managedPort{name: name}) {
+		t.Error("закрыт порт, открытый другими")
+	}
+	if getManagedPort(name) != other {
+		t.Error("порт, открытый другими, удалён")
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Журнал смены состояний устройств в каталоге данных
+const availabilityLogFile = "availability.log"
+
+// Состояния устройства для отчёта о доступности
+const (
+	// Устройства нет в списке портов
+	availabilityAbsent = "absent"
+	// Устройство подключено, порт не открыт
+	availabilityPresent = "present"
+	// Порт устройства открыт
+	availabilityOpen = "open"
+	// Порт не открылся или чтение прервалось с ошибкой
+	availabilityError = "error"
+	// Сервер не работал, состояние неизвестно
+	availabilityUnknown = "unknown"
+)
+
+// Как часто отмечается, что сервер работает. По отметке после перезапуска
+// определяется, с какого момента состояние устройств неизвестно.
+const availabilityHeartbeat = time.Minute
+
+// Смена состояния устройства
+type availabilityEvent struct {
+	Time     time.Time `json:"time"`
+	DeviceID string    `json:"deviceId"`
+	Port     string    `json:"port"`
+	State    string    `json:"state"`
+	// Устройство пропало из списка портов
+	Removed bool `json:"removed,omitempty"`
+}
+
+// Текущее состояние устройства
+type deviceAvailability struct {
+	port     string
+	present  bool
+	open     bool
+	erroring bool
+	state    string
+}
+
+// Доступность одного устройства за период отчёта
+type availabilityReport struct {
+	DeviceID string `json:"deviceId"`
+	Port     string `json:"port"`
+	State    string `json:"state"`
+	// Время в каждом состоянии, с
+	Seconds map[string]float64 `json:"seconds"`
+	// Доля времени в каждом состоянии, %, без времени, когда сервер не работал
+	Percent map[string]float64 `json:"percent"`
+	// Сколько раз устройство пропадало из списка портов и сколько раз возникали ошибки
+	Disconnects int `json:"disconnects"`
+	Errors      int `json:"errors"`
+	// Устройство стоит проверить или заменить
+	Flaky bool `json:"flaky"`
+}
+
+var (
+	// Состояния устройств, ключ - постоянный идентификатор устройства
+	devicesAvailability = make(map[string]*deviceAvailability)
+	// Устройство на порту. Нужно, чтобы узнать устройство после его отключения.
+	portDevices = make(map[string]string)
+	// Мьютекс для синхронизации доступа к devicesAvailability, portDevices и журналу
+	availabilityMutex = &sync.Mutex{}
+)
+
+func init() {
+	http.HandleFunc("GET /availability", handleAvailabilityReport)
+}
+
+// Подготовка учёта доступности при запуске: с последней отметки работы сервера
+// до запуска состояние устройств неизвестно
+func loadAvailability() {
+	path := dataPath(availabilityLogFile)
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	events, err := readAvailabilityEvents()
+	if err != nil {
+		log.Printf("Ошибка чтения журнала доступности: %v", err)
+		return
+	}
+	last := make(map[string]availabilityEvent)
+	for _, e := range events {
+		last[e.DeviceID] = e
+	}
+
+	availabilityMutex.Lock()
+	defer availabilityMutex.Unlock()
+
+	for id, e := range last {
+		if e.State == availabilityAbsent || e.State == availabilityUnknown {
+			continue
+		}
+		stoppedAt := info.ModTime()
+		if stoppedAt.Before(e.Time) {
+			stoppedAt = e.Time
+		}
+		appendAvailabilityEvent(availabilityEvent{Time: stoppedAt, DeviceID: id, Port: e.Port, State: availabilityUnknown})
+	}
+}
+
+// Отметка, что сервер работает
+func runAvailabilityHeartbeat() {
+	for {
+		time.Sleep(availabilityHeartbeat)
+		now := time.Now()
+		availabilityMutex.Lock()
+		os.Chtimes(dataPath(availabilityLogFile), now, now)
+		availabilityMutex.Unlock()
+	}
+}
+
+// Учёт нового списка портов
+func recordPresence(ports []string) {
+	ids := make(map[string]string, len(ports))
+	for _, port := range ports {
+		ids[port] = stableDeviceID(port)
+	}
+
+	availabilityMutex.Lock()
+	defer availabilityMutex.Unlock()
+
+	present := make(map[string]bool, len(ports))
+	for port, id := range ids {
+		portDevices[port] = id
+		present[id] = true
+		d := deviceAvailabilityLocked(id, port)
+		d.port = port
+		d.present = true
+		d.updateLocked(id, false)
+	}
+	for id, d := range devicesAvailability {
+		if d.present && !present[id] {
+			d.present, d.open, d.erroring = false, false, false
+			d.updateLocked(id, true)
+		}
+	}
+}
+
+// Учёт открытия и закрытия порта
+func recordPortOpen(port string, open bool) {
+	availabilityMutex.Lock()
+	defer availabilityMutex.Unlock()
+
+	id := portDeviceLocked(port)
+	d := deviceAvailabilityLocked(id, port)
+	d.open = open
+	d.erroring = false
+	d.updateLocked(id, false)
+}
+
+// Учёт ошибки порта: не открылся или чтение прервалось
+func recordPortError(port string) {
+	availabilityMutex.Lock()
+	defer availabilityMutex.Unlock()
+
+	id := portDeviceLocked(port)
+	d := deviceAvailabilityLocked(id, port)
+	d.open = false
+	d.erroring = true
+	d.updateLocked(id, false)
+}
+
+// Устройство на порту. Вызывается под availabilityMutex.
+func portDeviceLocked(port string) string {
+	if id, ok := portDevices[port]; ok {
+		return id
+	}
+	return port
+}
+
+// Состояние устройства, создаётся при первом обращении. Вызывается под availabilityMutex.
+func deviceAvailabilityLocked(id, port string) *deviceAvailability {
+	d := devicesAvailability[id]
+	if d == nil {
+		d = &deviceAvailability{port: port}
+		devicesAvailability[id] = d
+	}
+	return d
+}
+
+// Запись смены состояния в журнал. Вызывается под availabilityMutex.
+func (d *deviceAvailability) updateLocked(id string, removed bool) {
+	state := availabilityPresent
+	switch {
+	case d.erroring:
+		state = availabilityError
+	case !d.present && !d.open:
+		state = availabilityAbsent
+	case d.open:
+		state = availabilityOpen
+	}
+	if state == d.state {
+		return
+	}
+	d.state = state
+	now := time.Now()
+	appendAvailabilityEvent(availabilityEvent{Time: now, DeviceID: id, Port: d.port, State: state, Removed: removed})
+	publishEvent(publishedEvent{Type: eventStatus, Time: now, Port: d.port, DeviceID: id, State: state, Removed: removed})
+}
+
+// Дописывание события в журнал доступности. Вызывается под availabilityMutex.
+func appendAvailabilityEvent(e availabilityEvent) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		log.Printf("Ошибка записи журнала доступности: %v", err)
+		return
+	}
+	file, err := os.OpenFile(dataPath(availabilityLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("Ошибка записи журнала доступности: %v", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		log.Printf("Ошибка записи журнала доступности: %v", err)
+	}
+}
+
+// Чтение всех событий журнала доступности
+func readAvailabilityEvents() ([]availabilityEvent, error) {
+	file, err := os.Open(dataPath(availabilityLogFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []availabilityEvent
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e availabilityEvent
+		// Недописанная при сбое строка пропускается
+		if json.Unmarshal(scanner.Bytes(), &e) == nil {
+			events = append(events, e)
+		}
+	}
+	return events, scanner.Err()
+}
+
+// Отчёт о доступности устройств с момента since. Устройство считается
+// ненадёжным, если пропадало или давало ошибку не меньше flakyThreshold раз.
+func buildAvailabilityReport(events []availabilityEvent, since, now time.Time, flakyThreshold int) []*availabilityReport {
+	reports := make(map[string]*availabilityReport)
+	current := make(map[string]availabilityEvent)
+
+	account := func(r *availabilityReport, state string, from, to time.Time) {
+		if from.Before(since) {
+			from = since
+		}
+		if to.After(from) {
+			r.Seconds[state] += to.Sub(from).Seconds()
+		}
+	}
+	for _, e := range events {
+		r := reports[e.DeviceID]
+		if r == nil {
+			r = &availabilityReport{DeviceID: e.DeviceID, Seconds: make(map[string]float64), Percent: make(map[string]float64)}
+			reports[e.DeviceID] = r
+		}
+		if prev, ok := current[e.DeviceID]; ok {
+			account(r, prev.State, prev.Time, e.Time)
+		}
+		if !e.Time.Before(since) {
+			if e.Removed {
+				r.Disconnects++
+			}
+			if e.State == availabilityError {
+				r.Errors++
+			}
+		}
+		current[e.DeviceID] = e
+		r.Port = e.Port
+		r.State = e.State
+	}
+
+	list := make([]*availabilityReport, 0, len(reports))
+	for id, r := range reports {
+		account(r, current[id].State, current[id].Time, now)
+		var known float64
+		for state, seconds := range r.Seconds {
+			if state != availabilityUnknown {
+				known += seconds
+			}
+		}
+		for state, seconds := range r.Seconds {
+			if state != availabilityUnknown && known > 0 {
+				r.Percent[state] = seconds * 100 / known
+			}
+		}
+		r.Flaky = r.Disconnects+r.Errors >= flakyThreshold
+		if len(r.Seconds) > 0 {
+			list = append(list, r)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i].Disconnects+list[i].Errors, list[j].Disconnects+list[j].Errors
+		if a != b {
+			return a > b
+		}
+		return list[i].DeviceID < list[j].DeviceID
+	})
+	return list
+}
+
+// GET /availability?period=24h&flaky=3 - доступность устройств за период
+// (по умолчанию 7 дней), самые ненадёжные устройства в начале списка
+func handleAvailabilityReport(w http.ResponseWriter, r *http.Request) {
+	period := 7 * 24 * time.Hour
+	if v := r.URL.Query().Get("period"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "неверное значение period", http.StatusBadRequest)
+			return
+		}
+		period = d
+	}
+	flakyThreshold := 3
+	if v := r.URL.Query().Get("flaky"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "неверное значение flaky", http.StatusBadRequest)
+			return
+		}
+		flakyThreshold = n
+	}
+
+	availabilityMutex.Lock()
+	events, err := readAvailabilityEvents()
+	availabilityMutex.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	ns := requestNamespace(r)
+	list := []*availabilityReport{}
+	for _, report := range buildAvailabilityReport(events, now.Add(-period), now, flakyThreshold) {
+		if ns.allowsPort(report.Port) {
+			list = append(list, report)
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Запрос на запись интервалов между байтами
+type timingRequest struct {
+	Port    string `json:"port"`
+	Enabled bool   `json:"enabled"`
+}
+
+// Нарушение интервала внутри кадра Modbus RTU: пауза больше 1,5 и меньше 3,5 символов
+type timingViolation struct {
+	Type      string    `json:"type"`
+	Port      string    `json:"port"`
+	Time      time.Time `json:"time"`
+	GapMicros int64     `json:"gapMicros"`
+	T15Micros int64     `json:"t15Micros"`
+	T35Micros int64     `json:"t35Micros"`
+}
+
+// Запись времени прихода байтов порта
+type byteTiming struct {
+	// Время передачи одного символа на линии
+	charTime time.Duration
+	// Пороги паузы t1.5 и t3.5 протокола Modbus RTU
+	t15, t35 time.Duration
+	// Оценка времени прихода последнего байта
+	last  time.Time
+	mutex sync.Mutex
+}
+
+func init() {
+	clientActions["timingCapture"] = processTimingCapture
+}
+
+// Включение и выключение записи интервалов между байтами порта
+func processTimingCapture(ws *websocket.Conn, message map[string]interface{}) {
+	var request timingRequest
+	if err := decodeAction(message, &request); err != nil {
+		broadcast <- fmt.Sprintf("Ошибка: неверный формат запроса записи интервалов: %v", err)
+		return
+	}
+	if request.Port == "" {
+		request.Port = currentSettings.Port
+	}
+	session := getPortSession(request.Port)
+	baudRate, framingName, ok := getPortSettings(request.Port)
+	if session == nil || !ok {
+		broadcast <- fmt.Sprintf("Ошибка: порт %s не открыт.", request.Port)
+		return
+	}
+
+	if !request.Enabled {
+		session.setTiming(nil)
+		broadcast <- fmt.Sprintf("Запись интервалов между байтами порта %s выключена.", request.Port)
+		return
+	}
+	f, err := parseFraming(framingName)
+	if err != nil {
+		broadcast <- fmt.Sprintf("Ошибка: %v", err)
+		return
+	}
+	timing := newByteTiming(baudRate, f)
+	session.setTiming(timing)
+	broadcast <- fmt.Sprintf("Запись интервалов между байтами порта %s включена: символ %d мкс, t1.5 %d мкс, t3.5 %d мкс.",
+		request.Port, timing.charTime.Microseconds(), timing.t15.Microseconds(), timing.t35.Microseconds())
+}
+
+// Включение записи интервалов для сеанса (nil - выключение)
+func (s *portSession) setTiming(timing *byteTiming) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.timing = timing
+}
+
+// Интервалы для заданной скорости и формата кадра
+func newByteTiming(baudRate int, f framing) *byteTiming {
+	t := &byteTiming{charTime: f.charTime(baudRate)}
+	// Выше 19200 бод стандарт Modbus задаёт фиксированные пороги
+	if baudRate > 19200 {
+		t.t15, t.t35 = 750*time.Microsecond, 1750*time.Microsecond
+	} else {
+		t.t15, t.t35 = t.charTime*3/2, t.charTime*7/2
+	}
+	return t
+}
+
+// Запись порции байтов, прочитанной в момент now. Все байты порции пришли не
+// позже now, поэтому время прихода каждого оценивается назад от now по времени символа.
+func (t *byteTiming) record(port string, data []byte, now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	gaps := make([]string, len(data))
+	for i := range data {
+		arrival := now.Add(-time.Duration(len(data)-1-i) * t.charTime)
+		if t.last.IsZero() {
+			gaps[i] = "-"
+		} else {
+			// Пауза - время между концом предыдущего символа и концом текущего за вычетом самого символа
+			gap := max(0, arrival.Sub(t.last)-t.charTime)
+			gaps[i] = strconv.FormatInt(gap.Microseconds(), 10)
+			if gap > t.t15 && gap < t.t35 {
+				t.reportViolation(port, arrival, gap)
+			}
+		}
+		if arrival.After(t.last) {
+			t.last = arrival
+		}
+	}
+	writePortLog(port, fmt.Sprintf("timing %s gaps=%s", hex.EncodeToString(data), strings.Join(gaps, ",")))
+}
+
+// Сообщение клиентам о нарушении интервала внутри кадра
+func (t *byteTiming) reportViolation(port string, at time.Time, gap time.Duration) {
+	violation := timingViolation{
+		Type:      "timingViolation",
+		Port:      port,
+		Time:      at,
+		GapMicros: gap.Microseconds(),
+		T15Micros: t.t15.Microseconds(),
+		T35Micros: t.t35.Microseconds(),
+	}
+	data, err := json.Marshal(violation)
+	if err != nil {
+		log.Printf("Ошибка при маршалинге нарушения интервала: %v", err)
+		return
+	}
+	sendPortMessage(port, string(data))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+
+	"github.com/gorilla/websocket"
+)
+
+// Возможности узла, на котором работает монитор. Отправляются клиенту при
+// подключении, чтобы IDE скрывала настройки, которые платформа не выполнит.
+type hostCapabilities struct {
+	Type     string `json:"type"`
+	OS       string `json:"os"`
+	Arch     string `json:"arch"`
+	Instance string `json:"instance,omitempty"`
+	// Способы работы с портами: serial (библиотека), termios2 (собственный
+	// драйвер Linux), remote (порты удалённых мониторов)
+	Backends []string `json:"backends"`
+	// Появление и отключение устройств отслеживается опросом списка портов
+	Hotplug         bool   `json:"hotplug"`
+	HotplugMethod   string `json:"hotplugMethod"`
+	HotplugInterval string `json:"hotplugInterval"`
+	// Наибольшая проверенная скорость и можно ли задать нестандартную
+	MaxBaudRate int  `json:"maxBaudRate"`
+	CustomBaud  bool `json:"customBaud"`
+	// Поддерживаемые чётности и управление потоком
+	Parities    []string `json:"parities"`
+	FlowControl []string `json:"flowControl"`
+	// Передача сигнала break
+	Break bool `json:"break"`
+	// Версии протокола обмена
+	Protocols []int `json:"protocols"`
+	// Запущен ли сервер в контейнере
+	Container string `json:"container,omitempty"`
+}
+
+func init() {
+	http.HandleFunc("GET /capabilities", handleCapabilities)
+}
+
+// Возможности этого узла
+func currentCapabilities() hostCapabilities {
+	caps := hostCapabilities{
+		Type:            "capabilities",
+		OS:              runtime.GOOS,
+		Arch:            runtime.GOARCH,
+		Instance:        instanceName,
+		Backends:        []string{"serial"},
+		Hotplug:         true,
+		HotplugMethod:   "poll",
+		HotplugInterval: portPollPeriod().String(),
+		MaxBaudRate:     115200,
+		Parities:        []string{"none", "odd", "even"},
+		// Ни библиотека serial, ни собственный драйвер не включают RTS/CTS и XON/XOFF
+		FlowControl: []string{"none"},
+		Protocols:   supportedProtocols,
+	}
+	switch runtime.GOOS {
+	case "linux":
+		caps.Backends = append(caps.Backends, "termios2")
+		caps.MaxBaudRate = 4000000
+		caps.CustomBaud = true
+		caps.Parities = append(caps.Parities, "mark", "space")
+		caps.Break = true
+	case "windows":
+		caps.MaxBaudRate = 921600
+		caps.CustomBaud = true
+		caps.Parities = append(caps.Parities, "mark", "space")
+	case "darwin":
+		caps.MaxBaudRate = 230400
+	}
+	if len(remoteMonitorFlags) > 0 {
+		caps.Backends = append(caps.Backends, "remote")
+	}
+	if d := detectContainer(); d != nil {
+		caps.Container = d.Runtime
+	}
+	return caps
+}
+
+// Отправка возможностей узла клиенту при подключении
+func sendCapabilities(ws *websocket.Conn) {
+	data, err := json.Marshal(currentCapabilities())
+	if err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка при маршалинге возможностей узла: %v", err)}
+		return
+	}
+	directMessages <- clientMessage{ws, string(data)}
+}
+
+// GET /capabilities - возможности узла
+func handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentCapabilities())
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Признаки перезапуска устройства: загрузчики, сторожевой таймер, просадка питания
+const defaultResetPattern = `(?i)(\breset\b|\breboot|\bboot(ing|loader)?\b|rst:0x|brownout|watchdog|\bwdt\b|guru meditation|\bpanic\b)`
+
+// Признаки ошибок в строках устройства
+const defaultErrorPattern = `(?i)\b(error|err|fail(ed|ure)?|fault|exception|assert(ion)?|abort(ed)?|timeout)\b`
+
+// Сколько примеров и самых длинных пауз показывать
+const summaryExamples = 10
+
+// Настройки разбора записи сеанса
+type summaryOptions struct {
+	resetPattern *regexp.Regexp
+	errorPattern *regexp.Regexp
+	// Интервал подсчёта скорости потока строк
+	bucket time.Duration
+	// Во сколько раз должна измениться скорость, чтобы это попало в сводку
+	rateFactor float64
+	// Паузы короче этой в сводку не попадают
+	minSilence time.Duration
+}
+
+// Строка записи, попавшая в сводку
+type summaryLine struct {
+	Time time.Time `json:"time"`
+	Line string    `json:"line"`
+}
+
+// Найденные строки одного вида: сколько всего и первые примеры
+type summaryMatches struct {
+	Count    int           `json:"count"`
+	Examples []summaryLine `json:"examples"`
+}
+
+// Пауза между строками
+type summarySilence struct {
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Duration string    `json:"duration"`
+
+	duration time.Duration
+}
+
+// Изменение скорости потока строк, строк в минуту
+type summaryRateChange struct {
+	Time   time.Time `json:"time"`
+	Before float64   `json:"before"`
+	After  float64   `json:"after"`
+}
+
+// Сводка по записи сеанса
+type sessionSummary struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration string    `json:"duration"`
+	Lines    int       `json:"lines"`
+	// Средняя скорость, строк в минуту
+	Rate float64 `json:"rate"`
+	// Служебные строки журнала ("# ...")
+	Comments    int                 `json:"comments"`
+	Resets      summaryMatches      `json:"resets"`
+	Errors      summaryMatches      `json:"errors"`
+	Silences    []summarySilence    `json:"silences"`
+	RateChanges []summaryRateChange `json:"rateChanges"`
+}
+
+func init() {
+	http.HandleFunc("GET /summary/{id...}", handleSessionSummary)
+}
+
+func defaultSummaryOptions() summaryOptions {
+	return summaryOptions{
+		resetPattern: regexp.MustCompile(defaultResetPattern),
+		errorPattern: regexp.MustCompile(defaultErrorPattern),
+		bucket:       time.Minute,
+		rateFactor:   3,
+		minSilence:   5 * time.Second,
+	}
+}
+
+func (m *summaryMatches) add(t time.Time, line string) {
+	m.Count++
+	if len(m.Examples) < summaryExamples {
+		m.Examples = append(m.Examples, summaryLine{Time: t, Line: line})
+	}
+}
+
+// Разбор записи сеанса: строки "время<TAB>текст" в формате журнала порта
+func summarizeSession(input io.Reader, opts summaryOptions) (*sessionSummary, error) {
+	s := &sessionSummary{
+		Resets:      summaryMatches{Examples: []summaryLine{}},
+		Errors:      summaryMatches{Examples: []summaryLine{}},
+		Silences:    []summarySilence{},
+		RateChanges: []summaryRateChange{},
+	}
+	var previous time.Time
+	// Число строк в текущем интервале и в предыдущих (с последнего изменения скорости).
+	// Интервалы, на которые пришлась долгая пауза, со средней не сравниваются:
+	// скорость в них говорит о паузе, а не о смене режима работы.
+	var bucketStart time.Time
+	bucketCount := 0
+	bucketPaused := false
+	var baseline []int
+
+	closeBucket := func(next time.Time, paused bool) {
+		for !bucketStart.IsZero() && !next.Before(bucketStart.Add(opts.bucket)) {
+			if bucketPaused {
+				baseline = baseline[:0]
+			} else {
+				s.checkRate(bucketStart, bucketCount, &baseline, opts)
+			}
+			bucketStart = bucketStart.Add(opts.bucket)
+			bucketCount = 0
+			bucketPaused = paused
+		}
+	}
+
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		stamp, text, ok := strings.Cut(scanner.Text(), "\t")
+		if !ok {
+			continue
+		}
+		t, err := time.Parse(logTimeFormat, stamp)
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(text, "# ") {
+			s.Comments++
+			continue
+		}
+
+		if s.Lines == 0 {
+			s.Start = t
+			bucketStart = t
+		}
+		s.Lines++
+		s.End = t
+		paused := false
+		if !previous.IsZero() && t.After(previous) {
+			gap := t.Sub(previous)
+			if gap >= opts.minSilence {
+				s.addSilence(previous, t)
+			}
+			if paused = gap >= opts.bucket/2; paused {
+				bucketPaused = true
+			}
+		}
+		previous = t
+
+		closeBucket(t, paused)
+		bucketCount++
+
+		if opts.resetPattern.MatchString(text) {
+			s.Resets.add(t, text)
+		} else if opts.errorPattern.MatchString(text) {
+			s.Errors.add(t, text)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	duration := s.End.Sub(s.Start)
+	s.Duration = duration.Round(time.Second).String()
+	if duration > 0 {
+		s.Rate = float64(s.Lines) / duration.Minutes()
+	}
+	for i := range s.Silences {
+		s.Silences[i].Duration = s.Silences[i].duration.Round(time.Millisecond).String()
+	}
+	return s, nil
+}
+
+// Учёт паузы: хранятся только самые длинные
+func (s *sessionSummary) addSilence(from, to time.Time) {
+	d := to.Sub(from)
+	if len(s.Silences) == summaryExamples && d <= s.Silences[len(s.Silences)-1].duration {
+		return
+	}
+	s.Silences = append(s.Silences, summarySilence{From: from, To: to, duration: d})
+	sort.SliceStable(s.Silences, func(i, j int) bool { return s.Silences[i].duration > s.Silences[j].duration })
+	if len(s.Silences) > summaryExamples {
+		s.Silences = s.Silences[:summaryExamples]
+	}
+}
+
+// Сравнение скорости в закрытом интервале со средней за предыдущие.
+// Падение до нуля не учитывается: его показывают паузы.
+func (s *sessionSummary) checkRate(start time.Time, count int, baseline *[]int, opts summaryOptions) {
+	const window = 5
+	// Слишком мало строк, чтобы говорить о скорости
+	const minLines = 10
+
+	if len(*baseline) > 0 && count > 0 {
+		sum := 0
+		for _, c := range *baseline {
+			sum += c
+		}
+		mean := float64(sum) / float64(len(*baseline))
+		current := float64(count)
+		if mean > 0 && (current >= mean*opts.rateFactor || current <= mean/opts.rateFactor) &&
+			(current >= minLines || mean >= minLines) {
+			perMinute := time.Minute.Minutes() / opts.bucket.Minutes()
+			s.RateChanges = append(s.RateChanges, summaryRateChange{
+				Time:   start,
+				Before: mean * perMinute,
+				After:  current * perMinute,
+			})
+			*baseline = (*baseline)[:0]
+		}
+	}
+	if count > 0 {
+		*baseline = append(*baseline, count)
+		if len(*baseline) > window {
+			*baseline = (*baseline)[1:]
+		}
+	}
+}
+
+// Текстовая сводка для консоли
+func (s *sessionSummary) text() string {
+	var b strings.Builder
+	timeFormat := "2006-01-02 15:04:05.000"
+	fmt.Fprintf(&b, "Запись: %s - %s (%s), строк: %d, в среднем %.1f в минуту\n",
+		s.Start.Format(timeFormat), s.End.Format(timeFormat), s.Duration, s.Lines, s.Rate)
+
+	matches := func(title string, m summaryMatches) {
+		fmt.Fprintf(&b, "\n%s: %d\n", title, m.Count)
+		for _, e := range m.Examples {
+			fmt.Fprintf(&b, "  %s  %s\n", e.Time.Format(timeFormat), e.Line)
+		}
+		if m.Count > len(m.Examples) {
+			fmt.Fprintf(&b, "  ... ещё %d\n", m.Count-len(m.Examples))
+		}
+	}
+	matches("Перезапуски", s.Resets)
+	matches("Ошибки", s.Errors)
+
+	fmt.Fprintf(&b, "\nСамые длинные паузы:\n")
+	for _, silence := range s.Silences {
+		fmt.Fprintf(&b, "  %10s  %s - %s\n", silence.Duration, silence.From.Format(timeFormat), silence.To.Format(timeFormat))
+	}
+	fmt.Fprintf(&b, "\nИзменения скорости: %d\n", len(s.RateChanges))
+	for _, change := range s.RateChanges {
+		fmt.Fprintf(&b, "  %s  %.1f -> %.1f строк в минуту\n", change.Time.Format(timeFormat), change.Before, change.After)
+	}
+	return b.String()
+}
+
+// Сводка по записи сеанса из командной строки
+//
+//	serial-monitor summarize serial-monitor-data/sessions/robot.log
+//	serial-monitor summarize -json -errors 'E\d{3}' -encryption-key key.hex night.log
+func runSummarizeMode(args []string) int {
+	flags := flag.NewFlagSet("summarize", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "вывести сводку в формате JSON")
+	resets := flags.String("resets", defaultResetPattern, "регулярное выражение для строк перезапуска")
+	errorLines := flags.String("errors", defaultErrorPattern, "регулярное выражение для строк с ошибками")
+	bucket := flags.Duration("bucket", time.Minute, "интервал подсчёта скорости потока строк")
+	minSilence := flags.Duration("min-silence", 5*time.Second, "наименьшая пауза, которая попадает в сводку")
+	flags.StringVar(&encryptionKeyPath, "encryption-key", "", "ключ для чтения зашифрованной записи")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Использование: serial-monitor summarize [параметры] файл")
+		flags.Usage()
+		return exitError
+	}
+	opts := defaultSummaryOptions()
+	var err error
+	if opts.resetPattern, err = regexp.Compile(*resets); err != nil {
+		log.Printf("Неверное выражение -resets: %v", err)
+		return exitError
+	}
+	if opts.errorPattern, err = regexp.Compile(*errorLines); err != nil {
+		log.Printf("Неверное выражение -errors: %v", err)
+		return exitError
+	}
+	if *bucket <= 0 {
+		log.Println("Интервал -bucket должен быть положительным.")
+		return exitError
+	}
+	opts.bucket = *bucket
+	opts.minSilence = *minSilence
+	loadEncryptionKey()
+
+	file, err := openStoredFile(flags.Arg(0))
+	if err != nil {
+		log.Printf("Ошибка открытия записи: %v", err)
+		return exitError
+	}
+	defer file.Close()
+	summary, err := summarizeSession(file, opts)
+	if err != nil {
+		log.Printf("Ошибка чтения записи: %v", err)
+		return exitError
+	}
+	if *asJSON {
+		data, _ := json.MarshalIndent(summary, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		fmt.Print(summary.text())
+	}
+	return exitPass
+}
+
+// GET /summary/{id} - сводка по сохранённой записи сеанса
+func handleSessionSummary(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	path, err := storedSessionPath(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !requestNamespace(r).allowsStoredFile(id) {
+		http.Error(w, "сеанс не найден", http.StatusNotFound)
+		return
+	}
+	file, err := openStoredFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "сеанс не найден", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	defer file.Close()
+
+	summary, err := summarizeSession(file, defaultSummaryOptions())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
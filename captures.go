@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Каталог с записями порций данных портов внутри каталога данных
+const capturesDir = "captures"
+
+// Наибольший объём одной записи и наибольшая длительность записи,
+// если задан только объём
+const (
+	maxCaptureBytes    = 64 << 20
+	maxCaptureDuration = time.Minute
+)
+
+// Причины завершения записи
+const (
+	captureByDuration = "duration"
+	captureByBytes    = "bytes"
+	captureByClose    = "closed"
+	captureByStop     = "stopped"
+)
+
+// Запрос на запись порции данных порта. Запись останавливается через
+// Duration или после Bytes байтов - что наступит раньше.
+type captureRequest struct {
+	Port     string `json:"port"`
+	Duration string `json:"duration,omitempty"`
+	Bytes    int    `json:"bytes,omitempty"`
+	// Имя файла в каталоге записей (необязательно)
+	Name string `json:"name,omitempty"`
+}
+
+// Итог записи. Файл скачивается через GET /sessions/{id}.
+type captureResult struct {
+	Type      string    `json:"type"`
+	Port      string    `json:"port"`
+	ID        string    `json:"id,omitempty"`
+	Bytes     int       `json:"bytes"`
+	StartedAt time.Time `json:"startedAt"`
+	EndedAt   time.Time `json:"endedAt"`
+	// Причина остановки: duration, bytes, closed или stopped
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Идущая запись порта
+type portCapture struct {
+	port    string
+	path    string
+	limit   int
+	started time.Time
+	data    []byte
+	timer   *time.Timer
+	// Закрывается, когда файл записан; итог - в result
+	done   chan struct{}
+	result captureResult
+}
+
+var (
+	// Идущие записи, ключ - имя порта
+	portCaptures = make(map[string]*portCapture)
+	// Мьютекс для синхронизации доступа к portCaptures
+	portCapturesMutex = &sync.Mutex{}
+)
+
+func init() {
+	clientActions["capture"] = processCapture
+	clientActions["captureStop"] = processCaptureStop
+	http.HandleFunc("POST /captures", handlePostCapture)
+}
+
+// Начало записи порции данных порта. Если opening, порт ещё открывается
+// (запись начала работы устройства) и записывается с первого байта.
+func startCapture(request captureRequest, opening bool) (*portCapture, error) {
+	duration, err := parseOptionalDuration(request.Duration)
+	if err != nil {
+		return nil, err
+	}
+	if duration < 0 || request.Bytes < 0 {
+		return nil, errors.New("длительность и объём записи не могут быть отрицательными")
+	}
+	if duration == 0 && request.Bytes == 0 {
+		return nil, errors.New("укажите длительность (duration) или объём записи (bytes)")
+	}
+	if request.Bytes > maxCaptureBytes {
+		return nil, fmt.Errorf("объём записи больше предельного (%d байт)", maxCaptureBytes)
+	}
+	if duration == 0 {
+		duration = maxCaptureDuration
+	}
+	limit := request.Bytes
+	if limit == 0 {
+		limit = maxCaptureBytes
+	}
+	if !opening && getPortSession(request.Port) == nil {
+		return nil, fmt.Errorf("порт %s не открыт", request.Port)
+	}
+	if err := diskWriteAllowed(); err != nil {
+		return nil, err
+	}
+	if err := portNamespace(request.Port).checkStorageQuota(); err != nil {
+		return nil, err
+	}
+
+	name := request.Name
+	if name == "" {
+		name = fmt.Sprintf("capture_%s_%s.bin",
+			unsafeFileChars.ReplaceAllString(filepath.Base(request.Port), "_"),
+			time.Now().Format("20060102-150405.000"))
+	}
+	name = unsafeFileChars.ReplaceAllString(filepath.Base(name), "_")
+
+	c := &portCapture{
+		port:    request.Port,
+		path:    dataPath(filepath.Join(namespacedDir(capturesDir, request.Port), name)),
+		limit:   limit,
+		started: time.Now(),
+		done:    make(chan struct{}),
+	}
+
+	portCapturesMutex.Lock()
+	if portCaptures[c.port] != nil {
+		portCapturesMutex.Unlock()
+		return nil, fmt.Errorf("запись порта %s уже идёт", c.port)
+	}
+	portCaptures[c.port] = c
+	c.timer = time.AfterFunc(duration, func() { endCapture(c.port, c, captureByDuration) })
+	portCapturesMutex.Unlock()
+
+	return c, nil
+}
+
+// Байты, прочитанные из порта. Вызывается из portSession.feed.
+func recordCapture(port string, data []byte) {
+	portCapturesMutex.Lock()
+	c := portCaptures[port]
+	if c == nil {
+		portCapturesMutex.Unlock()
+		return
+	}
+	n := min(len(data), c.limit-len(c.data))
+	c.data = append(c.data, data[:n]...)
+	full := len(c.data) >= c.limit
+	portCapturesMutex.Unlock()
+
+	if full {
+		endCapture(port, c, captureByBytes)
+	}
+}
+
+// Остановка записи порта. Если c не nil, останавливается только эта запись.
+func endCapture(port string, c *portCapture, reason string) *portCapture {
+	portCapturesMutex.Lock()
+	current := portCaptures[port]
+	if current == nil || (c != nil && current != c) {
+		portCapturesMutex.Unlock()
+		return nil
+	}
+	delete(portCaptures, port)
+	current.timer.Stop()
+	portCapturesMutex.Unlock()
+
+	// Запись файла не должна задерживать чтение из порта
+	go current.save(reason)
+	return current
+}
+
+// Отмена записи без сохранения, например если порт так и не открылся
+func cancelCapture(c *portCapture) {
+	portCapturesMutex.Lock()
+	defer portCapturesMutex.Unlock()
+
+	if portCaptures[c.port] == c {
+		delete(portCaptures, c.port)
+		c.timer.Stop()
+	}
+}
+
+// Сохранение записанных байтов и уведомление клиентов
+func (c *portCapture) save(reason string) {
+	c.result = captureResult{
+		Type:      "capture",
+		Port:      c.port,
+		Bytes:     len(c.data),
+		StartedAt: c.started,
+		EndedAt:   time.Now(),
+		Reason:    reason,
+	}
+	err := os.MkdirAll(filepath.Dir(c.path), 0755)
+	if err == nil {
+		err = writeStoredFile(c.path, redactBytes(c.data))
+	}
+	if err == nil {
+		if rel, relErr := filepath.Rel(dataDir, c.path); relErr == nil {
+			c.result.ID = filepath.ToSlash(rel)
+		}
+	} else {
+		c.result.Error = err.Error()
+	}
+	close(c.done)
+
+	if data, err := json.Marshal(c.result); err == nil {
+		portMessages <- portMessage{port: c.port, text: string(data)}
+	}
+}
+
+// Запись порции данных по запросу клиента
+func processCapture(ws *websocket.Conn, message map[string]interface{}) {
+	var request captureRequest
+	if err := decodeAction(message, &request); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неверный формат запроса записи: %v", err)}
+		return
+	}
+	if request.Port == "" {
+		request.Port = currentSettings.Port
+	}
+	if _, err := startCapture(request, false); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: %v.", err)}
+		return
+	}
+	directMessages <- clientMessage{ws, fmt.Sprintf("Начата запись порта %s.", request.Port)}
+}
+
+// Досрочная остановка записи по запросу клиента
+func processCaptureStop(ws *websocket.Conn, message map[string]interface{}) {
+	var request captureRequest
+	if err := decodeAction(message, &request); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неверный формат запроса записи: %v", err)}
+		return
+	}
+	if request.Port == "" {
+		request.Port = currentSettings.Port
+	}
+	if endCapture(request.Port, nil, captureByStop) == nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Запись порта %s не идёт.", request.Port)}
+	}
+}
+
+// POST /captures - запись порции данных порта с ожиданием её окончания:
+//
+//	{"port": "/dev/ttyUSB0", "duration": "10s"}
+//	{"port": "/dev/ttyUSB0", "bytes": 4096}
+//
+// Ответ - итог записи; файл скачивается через GET /sessions/{id}.
+func handlePostCapture(w http.ResponseWriter, r *http.Request) {
+	var request captureRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "неверный формат запроса записи: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Port == "" {
+		request.Port = currentSettings.Port
+	}
+	if ns := requestNamespace(r); !ns.allowsPort(request.Port) {
+		http.Error(w, fmt.Sprintf("порт %s недоступен в пространстве %s", request.Port, ns.Name), http.StatusForbidden)
+		return
+	}
+	if err := checkReservation(requestIdentity(r), request.Port); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	c, err := startCapture(request, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	select {
+	case <-c.done:
+	case <-r.Context().Done():
+		// Клиент не дождался - запись всё равно сохраняется
+		endCapture(c.port, c, captureByStop)
+		return
+	}
+	status := http.StatusOK
+	if c.result.Error != "" {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, c.result)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Сколько придержанное сообщение может ждать следующего, прежде чем уйдёт само
+const chaosHoldLimit = time.Second
+
+// Отладочные сбои соединений WebSocket, чтобы разработчики клиентов могли
+// проверить переподключение и восстановление состояния. Вероятности
+// применяются к каждому сообщению, отправляемому клиенту.
+type chaosConfig struct {
+	// Вероятность оборвать соединение без закрывающего кадра
+	Disconnect float64 `json:"disconnect"`
+	// Вероятность задержать сообщение на случайное время до MaxDelay
+	Delay    float64 `json:"delay"`
+	MaxDelay string  `json:"maxDelay,omitempty"`
+	// Вероятность придержать сообщение и отправить его после следующего
+	Reorder float64 `json:"reorder"`
+
+	maxDelay time.Duration
+}
+
+var (
+	// Описание сбоев из параметра -chaos
+	chaosSpec string
+	// Действующие настройки сбоев, nil - сбоев нет
+	chaos atomic.Pointer[chaosConfig]
+	// Источник случайных чисел для сбоев
+	chaosRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	// Мьютекс для синхронизации доступа к chaosRand
+	chaosRandMutex = &sync.Mutex{}
+)
+
+func init() {
+	http.HandleFunc("GET /debug/chaos", handleGetChaos)
+	http.HandleFunc("PUT /debug/chaos", handleSetChaos)
+}
+
+// Разбор параметра -chaos при запуске:
+// "disconnect=0.01,delay=0.1,maxDelay=2s,reorder=0.05"
+func loadChaos() {
+	if chaosSpec == "" {
+		return
+	}
+	config, err := parseChaosSpec(chaosSpec)
+	if err != nil {
+		log.Fatalf("Ошибка в параметре -chaos: %v", err)
+	}
+	chaos.Store(config)
+	log.Printf("Внимание: включены отладочные сбои соединений WebSocket: %s", chaosSpec)
+}
+
+func parseChaosSpec(spec string) (*chaosConfig, error) {
+	config := &chaosConfig{}
+	for _, item := range splitList(spec) {
+		key, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("ожидается ключ=значение, получено %q", item)
+		}
+		var target *float64
+		switch key {
+		case "disconnect":
+			target = &config.Disconnect
+		case "delay":
+			target = &config.Delay
+		case "reorder":
+			target = &config.Reorder
+		case "maxDelay":
+			config.MaxDelay = value
+			continue
+		default:
+			return nil, fmt.Errorf("неизвестный вид сбоя %q", key)
+		}
+		p, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("неверная вероятность %q", item)
+		}
+		*target = p
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *chaosConfig) validate() error {
+	for _, p := range []float64{c.Disconnect, c.Delay, c.Reorder} {
+		if p < 0 || p > 1 {
+			return fmt.Errorf("вероятность %v вне диапазона от 0 до 1", p)
+		}
+	}
+	var err error
+	if c.maxDelay, err = parseOptionalDuration(c.MaxDelay); err != nil {
+		return err
+	}
+	if c.MaxDelay == "" {
+		c.maxDelay = 2 * time.Second
+	}
+	return nil
+}
+
+// Выпало ли событие с вероятностью p
+func chaosHappens(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	chaosRandMutex.Lock()
+	defer chaosRandMutex.Unlock()
+	return chaosRand.Float64() < p
+}
+
+// Случайная задержка до max
+func chaosDelay(max time.Duration) time.Duration {
+	chaosRandMutex.Lock()
+	defer chaosRandMutex.Unlock()
+	return time.Duration(chaosRand.Int63n(int64(max) + 1))
+}
+
+// Отправка сообщения клиенту с отладочными сбоями. Вызывается только из run.
+func (c *wsClient) writeChaos(msg string) error {
+	config := chaos.Load()
+	if config == nil {
+		return c.write(msg)
+	}
+	if chaosHappens(config.Disconnect) {
+		log.Printf("Отладочный сбой: соединение с клиентом %s оборвано.", c.remote)
+		c.conn.Close()
+		return fmt.Errorf("соединение оборвано отладочным сбоем")
+	}
+	if chaosHappens(config.Delay) {
+		time.Sleep(chaosDelay(config.maxDelay))
+	}
+	if c.chaosHeld == "" && chaosHappens(config.Reorder) {
+		c.chaosHeld = msg
+		c.chaosHeldAt = time.Now()
+		return nil
+	}
+	if err := c.write(msg); err != nil {
+		return err
+	}
+	return c.releaseChaosHeld(false)
+}
+
+// Отправка придержанного сообщения: после следующего сообщения или,
+// если его долго нет, само по себе
+func (c *wsClient) releaseChaosHeld(onlyExpired bool) error {
+	if c.chaosHeld == "" || onlyExpired && time.Since(c.chaosHeldAt) < chaosHoldLimit {
+		return nil
+	}
+	msg := c.chaosHeld
+	c.chaosHeld = ""
+	return c.write(msg)
+}
+
+// GET /debug/chaos - действующие настройки отладочных сбоев
+func handleGetChaos(w http.ResponseWriter, r *http.Request) {
+	config := chaos.Load()
+	if config == nil {
+		config = &chaosConfig{}
+	}
+	writeJSON(w, http.StatusOK, config)
+}
+
+// PUT /debug/chaos - включение или изменение отладочных сбоев на ходу.
+// Пустой объект или нулевые вероятности отключают сбои.
+func handleSetChaos(w http.ResponseWriter, r *http.Request) {
+	if ns := requestNamespace(r); ns != nil {
+		http.Error(w, fmt.Sprintf("отладочные сбои недоступны в пространстве %s", ns.Name), http.StatusForbidden)
+		return
+	}
+	config := &chaosConfig{}
+	if err := json.NewDecoder(r.Body).Decode(config); err != nil {
+		http.Error(w, fmt.Sprintf("неверный формат настроек: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := config.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if config.Disconnect == 0 && config.Delay == 0 && config.Reorder == 0 {
+		chaos.Store(nil)
+		log.Println("Отладочные сбои соединений WebSocket отключены.")
+	} else {
+		chaos.Store(config)
+		log.Printf("Внимание: отладочные сбои соединений WebSocket изменены: %+v", *config)
+	}
+	writeJSON(w, http.StatusOK, config)
+}
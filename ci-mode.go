@@ -0,0 +1,184 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Коды завершения режима CI
+const (
+	exitPass  = 0
+	exitFail  = 1
+	exitError = 2
+)
+
+// Режим CI: подключиться к портам, выполнить последовательность на всех устройствах
+// одновременно, сохранить отчёт и завершиться с ненулевым кодом при неудаче.
+//
+//	serial-monitor run --port /dev/ttyACM0 --baud 115200 --script test.json --report report.xml
+//	serial-monitor run --match 2341:0043 --script test.json --report report.xml
+func runCIMode(args []string) int {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	port := flags.String("port", "", "порт устройства (по умолчанию из сценария)")
+	ports := flags.String("ports", "", "список портов через запятую")
+	match := flags.String("match", "", "все устройства с указанными VID:PID (через запятую)")
+	serials := flags.String("serials", "", "все устройства с указанными серийными номерами (через запятую)")
+	baudRate := flags.Int("baud", 115200, "скорость передачи")
+	framing := flags.String("framing", "", "формат кадра: 8N1, 7E1, 8M1 и т.п. (по умолчанию 8N1)")
+	script := flags.String("script", "", "файл сценария (последовательность в формате JSON)")
+	report := flags.String("report", "", "файл отчёта")
+	format := flags.String("format", "", "формат отчёта: json или junit (по умолчанию по расширению файла отчёта)")
+	verbose := flags.Bool("verbose", false, "выводить строки устройства и служебные сообщения")
+	flags.Parse(args)
+
+	if *script == "" {
+		fmt.Fprintln(os.Stderr, "Не указан файл сценария (--script).")
+		flags.Usage()
+		return exitError
+	}
+	seq, err := loadSequenceFile(*script)
+	if err != nil {
+		log.Printf("Ошибка чтения сценария: %v", err)
+		return exitError
+	}
+	targets := selectCIPorts(*ports, *match, *serials)
+	if *port != "" {
+		targets = append(targets, *port)
+	}
+	if len(targets) == 0 && (*ports != "" || *match != "" || *serials != "") {
+		log.Println("Не найдено ни одного подходящего устройства.")
+		return exitError
+	}
+	if len(targets) == 0 && seq.Port != "" {
+		targets = []string{seq.Port}
+	}
+	if len(targets) == 0 {
+		log.Println("Порт не указан ни в сценарии, ни в параметрах.")
+		return exitError
+	}
+	if *format == "" && strings.HasSuffix(*report, ".xml") {
+		*format = reportFormatJUnit
+	}
+
+	// Сообщения для клиентов WebSocket в этом режиме выводятся в консоль
+	go printBroadcasts(*verbose)
+
+	for _, target := range targets {
+		if _, err := openManagedPortFramed(target, *baudRate, *framing); err != nil {
+			log.Printf("Ошибка открытия порта %s: %v", target, err)
+			return exitError
+		}
+		defer closeManagedPort(target)
+	}
+
+	startedAt := time.Now()
+	results := make([]*sequenceReport, len(targets))
+	wg := &sync.WaitGroup{}
+	for i, target := range targets {
+		deviceSeq := *seq
+		deviceSeq.Port = target
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = runSequence(&deviceSeq)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, result := range results {
+		printSequenceReport(result)
+	}
+	farm := newFarmReport(seq.Name, startedAt, results)
+	if len(results) > 1 {
+		fmt.Printf("Итого устройств: %d, успешно %d, с ошибками %d\n", len(results), farm.Passed, farm.Failed)
+	}
+
+	if *report != "" {
+		if _, err := saveSequenceReports(results, *format, *report); err != nil {
+			log.Printf("Ошибка сохранения отчёта: %v", err)
+			return exitError
+		}
+	}
+	if farm.Verdict != verdictPass {
+		return exitFail
+	}
+	return exitPass
+}
+
+// Выбор портов для режима CI по списку, VID:PID и серийным номерам
+func selectCIPorts(ports, match, serials string) []string {
+	var selected []string
+	add := func(port string) {
+		if !stringInSlice(port, selected) {
+			selected = append(selected, port)
+		}
+	}
+	for _, port := range splitList(ports) {
+		add(port)
+	}
+
+	vidPIDs := splitList(strings.ToLower(match))
+	serialList := splitList(serials)
+	if len(vidPIDs) == 0 && len(serialList) == 0 {
+		return selected
+	}
+	for _, port := range getPortNames() {
+		if vid, pid := usbVIDPID(port); vid != "" && stringInSlice(vid+":"+pid, vidPIDs) {
+			add(port)
+			continue
+		}
+		deviceID := stableDeviceID(port)
+		for _, serial := range serialList {
+			if strings.Contains(deviceID, serial) {
+				add(port)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// Разбор списка через запятую без пустых элементов
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Вывод в консоль сообщений, предназначенных клиентам
+func printBroadcasts(verbose bool) {
+	for {
+		select {
+		case msg := <-broadcast:
+			if verbose {
+				log.Println(msg)
+			}
+		case msg := <-portMessages:
+			if verbose {
+				log.Println(msg.text)
+			}
+		case <-directMessages:
+		}
+	}
+}
+
+// Краткий вывод отчёта в консоль
+func printSequenceReport(report *sequenceReport) {
+	for _, step := range report.Steps {
+		line := fmt.Sprintf("[%s] %-8s %s (%d мс)", report.Port, strings.ToUpper(step.Verdict), step.Name, step.DurationMs)
+		if step.Message != "" {
+			line += ": " + step.Message
+		}
+		fmt.Println(line)
+	}
+	fmt.Printf("[%s] %s: %s за %d мс\n", report.Port, report.Name, strings.ToUpper(report.Verdict), report.DurationMs)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Справка по командам отладочного клиента
+const clientModeHelp = `Строки без "/" отправляются командой в основной порт.
+  /port ПОРТ СКОРОСТЬ [ФОРМАТ]  выбрать основной порт
+  /ДЕЙСТВИЕ [JSON]             отправить действие, например /reserve {"duration":"1h"}
+  {...}                        отправить JSON-сообщение как есть
+  //текст                      отправить в порт строку, начинающуюся с "/"
+  /raw                         включить или выключить вывод сообщений без разбора
+  /help                        эта справка
+  /quit                        выйти`
+
+// Отладочный клиент: подключиться к работающему монитору, выводить его сообщения
+// в читаемом виде и отправлять команды из консоли. Помогает понять, где ошибка -
+// в сервере или в клиенте Lapki IDE.
+//
+//	serial-monitor client --url ws://localhost:8080/serialmonitor --token secret
+//	echo '/listTriggers' | serial-monitor client --wait 2s
+func runClientMode(args []string) int {
+	flags := flag.NewFlagSet("client", flag.ExitOnError)
+	address := flags.String("url", "ws://localhost:8080/serialmonitor", "адрес монитора")
+	token := flags.String("token", "", "токен доступа к серверу")
+	raw := flags.Bool("raw", false, "выводить сообщения сервера без разбора")
+	wait := flags.Duration("wait", time.Second, "сколько ждать ответов после окончания ввода")
+	flags.Parse(args)
+
+	target, err := url.Parse(*address)
+	if err != nil {
+		log.Printf("Неверный адрес монитора: %v", err)
+		return exitError
+	}
+	// Типизированный протокол: у каждого сообщения есть тип
+	query := target.Query()
+	query.Set("protocol", fmt.Sprint(protocolTyped))
+	target.RawQuery = query.Encode()
+
+	header := http.Header{}
+	if *token != "" {
+		header.Set("Authorization", "Bearer "+*token)
+	}
+	ws, resp, err := websocket.DefaultDialer.Dial(target.String(), header)
+	if err != nil {
+		if resp != nil {
+			err = fmt.Errorf("%v (%s)", err, resp.Status)
+		}
+		log.Printf("Ошибка подключения к монитору: %v", err)
+		return exitError
+	}
+	defer ws.Close()
+	fmt.Fprintf(os.Stderr, "Подключено к %s. /help - справка.\n", *address)
+
+	closed := make(chan struct{})
+	var quitting, showRaw atomic.Bool
+	showRaw.Store(*raw)
+	// Закрытие соединения по инициативе клиента: ответа сервера ждём недолго
+	quit := func() int {
+		quitting.Store(true)
+		ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+		}
+		return exitPass
+	}
+	go func() {
+		defer close(closed)
+		for {
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				if !quitting.Load() && !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					fmt.Fprintf(os.Stderr, "Соединение прервано: %v\n", err)
+				}
+				return
+			}
+			if showRaw.Load() {
+				fmt.Printf("%s %s\n", time.Now().Format("15:04:05.000"), data)
+				continue
+			}
+			for _, line := range formatServerMessage(data) {
+				fmt.Printf("%s %s\n", time.Now().Format("15:04:05.000"), line)
+			}
+		}
+	}()
+
+	input := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			input <- scanner.Text()
+		}
+		close(input)
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return exitError
+		case line, ok := <-input:
+			if !ok {
+				select {
+				case <-closed:
+					return exitError
+				case <-time.After(*wait):
+				}
+				return quit()
+			}
+			switch strings.TrimSpace(line) {
+			case "":
+				continue
+			case "/quit":
+				return quit()
+			case "/help":
+				fmt.Fprintln(os.Stderr, clientModeHelp)
+				continue
+			case "/raw":
+				showRaw.Store(!showRaw.Load())
+				continue
+			}
+			message, err := parseClientInput(line)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Ошибка: %v\n", err)
+				continue
+			}
+			if err := ws.WriteMessage(websocket.TextMessage, message); err != nil {
+				fmt.Fprintf(os.Stderr, "Ошибка отправки: %v\n", err)
+				return exitError
+			}
+		}
+	}
+}
+
+// Преобразование строки, введённой в отладочном клиенте, в сообщение для сервера
+func parseClientInput(line string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(line, "{"):
+		var message map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &message); err != nil {
+			return nil, fmt.Errorf("неверный JSON: %v", err)
+		}
+		return []byte(line), nil
+	case strings.HasPrefix(line, "//"):
+		return json.Marshal(map[string]string{"command": line[1:]})
+	case strings.HasPrefix(line, "/port "):
+		fields := strings.Fields(line)
+		if len(fields) < 3 || len(fields) > 4 {
+			return nil, fmt.Errorf("формат: /port ПОРТ СКОРОСТЬ [ФОРМАТ]")
+		}
+		message := map[string]string{"port": fields[1], "baudRate": fields[2]}
+		if len(fields) == 4 {
+			message["framing"] = fields[3]
+		}
+		return json.Marshal(message)
+	case strings.HasPrefix(line, "/"):
+		action, params, _ := strings.Cut(line[1:], " ")
+		message := make(map[string]interface{})
+		if params = strings.TrimSpace(params); params != "" {
+			if err := json.Unmarshal([]byte(params), &message); err != nil {
+				return nil, fmt.Errorf("параметры действия должны быть JSON-объектом: %v", err)
+			}
+		}
+		message["action"] = action
+		return json.Marshal(message)
+	}
+	return json.Marshal(map[string]string{"command": line})
+}
+
+// Читаемое представление сообщения сервера типизированного протокола
+func formatServerMessage(data []byte) []string {
+	var message map[string]json.RawMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return []string{string(data)}
+	}
+	var messageType string
+	json.Unmarshal(message["type"], &messageType)
+	text := func() string {
+		var s string
+		json.Unmarshal(message["text"], &s)
+		return strings.TrimRight(s, "\r\n")
+	}
+
+	switch messageType {
+	case "text":
+		return []string{text()}
+	case "error":
+		return []string{"ОШИБКА: " + text()}
+	case "ports":
+		var ports []string
+		json.Unmarshal(message["ports"], &ports)
+		if len(ports) == 0 {
+			return []string{"порты: нет"}
+		}
+		return []string{"порты: " + strings.Join(ports, ", ")}
+	case "batch":
+		var batch []json.RawMessage
+		json.Unmarshal(message["messages"], &batch)
+		var lines []string
+		for _, item := range batch {
+			lines = append(lines, formatServerMessage(item)...)
+		}
+		return lines
+	case "data":
+		return []string{"данные: " + string(message["data"])}
+	case "portLine":
+		var line portLineMessage
+		json.Unmarshal(data, &line)
+		name := line.Port
+		if line.Label != "" {
+			name = line.Label
+		}
+		return []string{fmt.Sprintf("[%s] %s", name, line.Line)}
+	}
+	// Прочие события: тип и поля без поля type
+	delete(message, "type")
+	fields, _ := json.Marshal(message)
+	if messageType == "" {
+		return []string{string(data)}
+	}
+	return []string{fmt.Sprintf("<%s> %s", messageType, fields)}
+}
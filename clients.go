@@ -0,0 +1,343 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Размер очереди сообщений одного клиента
+const clientQueueSize = 1024
+
+// Место в очереди, которое данные портов не занимают, чтобы служебные
+// сообщения не терялись, когда клиент не успевает за данными
+const clientControlReserve = 64
+
+// Таймаут записи сообщения клиенту
+const clientWriteTimeout = 10 * time.Second
+
+// Режимы передачи данных клиенту
+const (
+	// Каждое сообщение отправляется сразу
+	streamNormal int32 = iota
+	// Сообщения собираются и отправляются пачкой раз в секунду
+	streamBatched
+	// Вместо сообщений раз в 5 секунд отправляется сводка
+	streamSummary
+	// Раз в 15 секунд отправляется только уведомление о новых данных
+	streamNotify
+)
+
+// Названия режимов передачи
+var streamModeNames = map[int32]string{
+	streamNormal:  "normal",
+	streamBatched: "batched",
+	streamSummary: "summary",
+	streamNotify:  "notify",
+}
+
+// Периоды отправки в режимах с накоплением
+var streamFlushIntervals = map[int32]time.Duration{
+	streamBatched: time.Second,
+	streamSummary: 5 * time.Second,
+	streamNotify:  15 * time.Second,
+}
+
+// Пороги задержки подтверждения (ping/pong) и длины очереди для режимов передачи
+var streamThresholds = []struct {
+	mode    int32
+	maxRTT  time.Duration
+	backlog int
+}{
+	{streamNormal, 300 * time.Millisecond, 50},
+	{streamBatched, time.Second, 200},
+	{streamSummary, 3 * time.Second, 500},
+}
+
+// Запрос на выбор режима передачи
+type streamModeRequest struct {
+	// Режим или "auto" для автоматического выбора
+	Mode string `json:"mode"`
+}
+
+// Сообщение в очереди клиента. В режимах с накоплением копятся только данные
+// портов; служебные сообщения (ответы на действия, состояние портов, ошибки)
+// отправляются сразу в любом режиме.
+type queuedMessage struct {
+	text string
+	data bool
+}
+
+// Подключённый клиент WebSocket со своей очередью сообщений, чтобы медленный
+// клиент не задерживал остальных
+type wsClient struct {
+	conn  *websocket.Conn
+	queue chan queuedMessage
+	done  chan struct{}
+
+	// Текущий режим передачи и признак того, что его выбрал сам клиент
+	mode  atomic.Int32
+	fixed atomic.Bool
+	// Последняя измеренная задержка подтверждения, мкс
+	rttMicros atomic.Int64
+	// Число сообщений, потерянных из-за переполнения очереди
+	dropped atomic.Int64
+	// Токен совместного просмотра, если клиент подключён по ссылке
+	share *shareToken
+	// Версия протокола обмена (см. protocol.go)
+	protocol atomic.Int32
+	// Пространство имён клиента, nil - весь сервер
+	namespace *namespace
+	// Окно квоты, о превышении которой клиент уже уведомлён.
+	// Используется только в handleMessages.
+	quotaNoticeAt time.Time
+	// Кто подключён и откуда, для журнала аудита
+	identity string
+	remote   string
+	// Сообщение, придержанное отладочным сбоем (см. chaos.go), и когда.
+	// Используются только в run.
+	chaosHeld   string
+	chaosHeldAt time.Time
+	// Сообщения, накопленные до подключения (см. no-clients.go). Отправляются
+	// раньше сообщений очереди. Используется только в run.
+	backlog []string
+}
+
+var (
+	// Выбирать ли режим передачи автоматически по задержке клиента
+	adaptiveStreaming bool
+	// Период измерения задержки клиента
+	adaptivePingInterval = 5 * time.Second
+	// Мьютекс для синхронизации доступа к clients
+	clientsMutex = &sync.Mutex{}
+)
+
+func init() {
+	clientActions["setStreamMode"] = processSetStreamMode
+}
+
+func newWSClient(conn *websocket.Conn, identity string, protocol int) *wsClient {
+	c := &wsClient{
+		conn:     conn,
+		queue:    make(chan queuedMessage, clientQueueSize),
+		done:     make(chan struct{}),
+		identity: identity,
+		remote:   conn.RemoteAddr().String(),
+	}
+	c.protocol.Store(int32(protocol))
+	// В ping передаётся время отправки, по pong вычисляется задержка
+	conn.SetPongHandler(func(data string) error {
+		if sent, err := strconv.ParseInt(data, 10, 64); err == nil {
+			c.rttMicros.Store(time.Since(time.Unix(0, sent)).Microseconds())
+		}
+		return nil
+	})
+	return c
+}
+
+// Получаем клиента по соединению
+func getWSClient(conn *websocket.Conn) *wsClient {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+
+	return clients[conn]
+}
+
+// Кто подключён по соединению, для проверок доступа и журнала аудита
+func clientIdentity(conn *websocket.Conn) string {
+	if client := getWSClient(conn); client != nil {
+		return client.identity
+	}
+	return "system"
+}
+
+// Постановка служебного сообщения в очередь клиента. При переполнении сообщение теряется.
+func (c *wsClient) enqueue(msg string) {
+	select {
+	case c.queue <- queuedMessage{text: msg}:
+	default:
+		c.dropped.Add(1)
+	}
+}
+
+// Постановка данных порта в очередь клиента. Данные теряются раньше служебных
+// сообщений: последние clientControlReserve мест очереди оставлены для них.
+// Вызывается только из handleMessages, поэтому проверка длины не устаревает.
+func (c *wsClient) enqueueData(msg string) {
+	if len(c.queue) >= clientQueueSize-clientControlReserve {
+		c.dropped.Add(1)
+		return
+	}
+	c.queue <- queuedMessage{text: msg, data: true}
+}
+
+// Остановка отправки сообщений клиенту
+func (c *wsClient) stop() {
+	close(c.done)
+}
+
+// Отправка сообщений из очереди клиенту до его отключения
+func (c *wsClient) run() {
+	flushTicker := time.NewTicker(time.Second)
+	defer flushTicker.Stop()
+	pingTicker := time.NewTicker(adaptivePingInterval)
+	defer pingTicker.Stop()
+
+	// Накопленные сообщения (в режиме сводки хранится только последнее) и их число
+	var pending []string
+	pendingCount := 0
+	lastFlush := time.Now()
+
+	for _, msg := range c.backlog {
+		if err := c.write(msg); err != nil {
+			log.Printf("Ошибка записи сообщения клиенту: %v", err)
+			c.conn.Close()
+			return
+		}
+	}
+	c.backlog = nil
+
+	flush := func(mode int32) error {
+		lastFlush = time.Now()
+		if pendingCount == 0 {
+			return nil
+		}
+		var msg string
+		switch mode {
+		case streamBatched:
+			if c.protocol.Load() >= protocolTyped {
+				msg = typedBatch(pending)
+			} else {
+				msg = strings.Join(pending, "\n")
+			}
+		case streamSummary:
+			msg = fmt.Sprintf("Сводка: получено сообщений: %d. Последнее: %s", pendingCount, pending[len(pending)-1])
+		default:
+			msg = fmt.Sprintf("Есть новые данные: сообщений: %d.", pendingCount)
+		}
+		pending = pending[:0]
+		pendingCount = 0
+		return c.write(msg)
+	}
+
+	for {
+		var err error
+		select {
+		case <-c.done:
+			return
+		case msg := <-c.queue:
+			mode := c.mode.Load()
+			switch {
+			case mode == streamNormal:
+				err = c.writeChaos(msg.text)
+			case !msg.data:
+				// Служебные сообщения не копятся; в пачке они идут после уже накопленных данных
+				if mode == streamBatched {
+					err = flush(mode)
+				}
+				if err == nil {
+					err = c.write(msg.text)
+				}
+			default:
+				if mode != streamBatched {
+					pending = pending[:0]
+				}
+				pending = append(pending, msg.text)
+				pendingCount++
+			}
+		case <-flushTicker.C:
+			mode := c.mode.Load()
+			if mode != streamNormal && time.Since(lastFlush) >= streamFlushIntervals[mode] {
+				err = flush(mode)
+			}
+			if err == nil {
+				err = c.releaseChaosHeld(true)
+			}
+		case <-pingTicker.C:
+			deadline := time.Now().Add(clientWriteTimeout)
+			err = c.conn.WriteControl(websocket.PingMessage, []byte(strconv.FormatInt(time.Now().UnixNano(), 10)), deadline)
+			if err == nil {
+				if mode, changed := c.adapt(); changed {
+					if err = flush(c.mode.Load()); err == nil {
+						c.mode.Store(mode)
+						err = c.write(fmt.Sprintf("Режим передачи изменён на %s (задержка %d мс).", streamModeNames[mode], c.rttMicros.Load()/1000))
+					}
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("Ошибка записи сообщения клиенту: %v", err)
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// Запись сообщения в соединение
+func (c *wsClient) write(msg string) error {
+	if c.protocol.Load() >= protocolTyped {
+		msg = typedMessage(msg)
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+	return c.conn.WriteMessage(websocket.TextMessage, []byte(msg))
+}
+
+// Выбор режима передачи по задержке и длине очереди. Клиенты прежнего
+// протокола не отличат пачку от сообщения, поэтому им режим не меняется.
+func (c *wsClient) adapt() (int32, bool) {
+	if !adaptiveStreaming || c.fixed.Load() || c.protocol.Load() < protocolTyped {
+		return 0, false
+	}
+	rtt := time.Duration(c.rttMicros.Load()) * time.Microsecond
+	backlog := len(c.queue)
+
+	mode := streamNotify
+	for _, t := range streamThresholds {
+		if rtt < t.maxRTT && backlog < t.backlog {
+			mode = t.mode
+			break
+		}
+	}
+	return mode, mode != c.mode.Load()
+}
+
+// Выбор режима передачи клиентом
+func processSetStreamMode(ws *websocket.Conn, message map[string]interface{}) {
+	var request streamModeRequest
+	if err := decodeAction(message, &request); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неверный формат запроса режима: %v", err)}
+		return
+	}
+	c := getWSClient(ws)
+	if c == nil {
+		return
+	}
+	if request.Mode == "auto" {
+		if !adaptiveStreaming {
+			directMessages <- clientMessage{ws, "Ошибка: автоматический выбор режима передачи отключён (-adaptive)."}
+			return
+		}
+		c.fixed.Store(false)
+		directMessages <- clientMessage{ws, "Режим передачи выбирается автоматически."}
+		return
+	}
+	for mode, name := range streamModeNames {
+		if name == request.Mode {
+			if mode != streamNormal && c.protocol.Load() < protocolTyped {
+				directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: режим передачи %s доступен только с протоколом %d.", name, protocolTyped)}
+				return
+			}
+			c.fixed.Store(true)
+			c.mode.Store(mode)
+			directMessages <- clientMessage{ws, fmt.Sprintf("Режим передачи изменён на %s.", name)}
+			return
+		}
+	}
+	directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неизвестный режим передачи %q.", request.Mode)}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Клиент на сервере и соединение с ним со стороны браузера
+func testClient(t *testing.T, protocol int) (*wsClient, *websocket.Conn) {
+	clients := make(chan *wsClient, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		clients <- newWSClient(conn, "test", protocol)
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := <-clients
+	t.Cleanup(c.stop)
+	return c, conn
+}
+
+// В режимах с накоплением служебные сообщения не копятся и не заменяются сводкой
+func TestStreamModesKeepControlMessages(t *testing.T) {
+	for _, mode := range []int32{streamBatched, streamSummary, streamNotify} {
+		c, conn := testClient(t, protocolTyped)
+		c.mode.Store(mode)
+		c.fixed.Store(true)
+		go c.run()
+
+		c.enqueueData("TEMP 23.5")
+		c.enqueueData("TEMP 23.6")
+		c.enqueue("Ошибка: порт не открыт.")
+
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		var received []string
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				break
+			}
+			received = append(received, string(data))
+		}
+		last := ""
+		if len(received) > 0 {
+			last = received[len(received)-1]
+		}
+		if !strings.Contains(last, `"type":"error"`) || !strings.Contains(last, "порт не открыт") {
+			t.Errorf("режим %s: служебное сообщение не отправлено сразу: %q", streamModeNames[mode], received)
+		}
+		// В режиме пачек накопленные данные уходят раньше служебного сообщения
+		if mode == streamBatched && (len(received) != 2 || !strings.Contains(received[0], "TEMP 23.6")) {
+			t.Errorf("режим пачек: %q", received)
+		}
+	}
+}
+
+// Данные портов не занимают место, оставленное служебным сообщениям
+func TestEnqueueDataKeepsControlReserve(t *testing.T) {
+	c, _ := testClient(t, protocolLegacy)
+	for i := 0; i < clientQueueSize; i++ {
+		c.enqueueData("data")
+	}
+	if len(c.queue) != clientQueueSize-clientControlReserve {
+		t.Fatalf("данных в очереди %d", len(c.queue))
+	}
+	for i := 0; i < clientControlReserve; i++ {
+		c.enqueue("control")
+	}
+	if len(c.queue) != clientQueueSize || c.dropped.Load() != clientControlReserve {
+		t.Fatalf("в очереди %d, потеряно %d", len(c.queue), c.dropped.Load())
+	}
+}
+
+// Клиенты прежнего протокола остаются в обычном режиме передачи
+func TestAdaptSkipsLegacyClients(t *testing.T) {
+	previous := adaptiveStreaming
+	adaptiveStreaming = true
+	t.Cleanup(func() { adaptiveStreaming = previous })
+
+	legacy, _ := testClient(t, protocolLegacy)
+	legacy.rttMicros.Store(10 * time.Second.Microseconds())
+	if _, changed := legacy.adapt(); changed {
+		t.Fatal("режим клиента прежнего протокола изменён")
+	}
+	typed, _ := testClient(t, protocolTyped)
+	typed.rttMicros.Store(10 * time.Second.Microseconds())
+	if mode, changed := typed.adapt(); !changed || mode != streamNotify {
+		t.Fatalf("режим клиента протокола %d: %s", protocolTyped, streamModeNames[mode])
+	}
+}
+
+// Каталог данных теста: журнал аудита и сохраняемые файлы пишутся в него
+func useTestDataDir(t *testing.T) {
+	previous := dataDir
+	dataDir = t.TempDir()
+	t.Cleanup(func() {
+		auditMutex.Lock()
+		if auditFile != nil {
+			auditFile.Close()
+			auditFile = nil
+		}
+		auditMutex.Unlock()
+		dataDir = previous
+	})
+}
+
+// Клиент, зарегистрированный на сервере под именем identity в пространстве ns
+func registeredTestClient(t *testing.T, identity string, ns *namespace) *websocket.Conn {
+	c, _ := testClient(t, protocolTyped)
+	c.identity = identity
+	c.namespace = ns
+	clientsMutex.Lock()
+	clients[c.conn] = c
+	clientsMutex.Unlock()
+	t.Cleanup(func() {
+		clientsMutex.Lock()
+		delete(clients, c.conn)
+		clientsMutex.Unlock()
+	})
+	return c.conn
+}
+
+// Личный ответ обработчика действия клиенту
+func actionReply(t *testing.T, handler func(*websocket.Conn, map[string]interface{}), ws *websocket.Conn, message map[string]interface{}) string {
+	t.Helper()
+	reply := make(chan string, 1)
+	go func() { reply <- (<-directMessages).text }()
+	handler(ws, message)
+	select {
+	case text := <-reply:
+		return text
+	case <-time.After(time.Second):
+		t.Fatal("обработчик не ответил клиенту")
+		return ""
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Сведения о часах узла, записываемые в журналы, чтобы записи с разных
+// узлов можно было свести на общую шкалу времени
+type clockInfo struct {
+	Host     string    `json:"host"`
+	Instance string    `json:"instance,omitempty"`
+	WallTime time.Time `json:"wallTime"`
+	// Источник тактирования ядра (tsc, hpet, arch_sys_counter и т.д.)
+	ClockSource string `json:"clockSource,omitempty"`
+	// Синхронизированы ли часы службой времени (NTP, PTP через phc2sys, chrony)
+	Synchronized *bool `json:"synchronized,omitempty"`
+	// Текущая поправка часов и оценки погрешности по данным ядра, мкс
+	OffsetMicros   *int64 `json:"offsetMicros,omitempty"`
+	MaxErrorMicros *int64 `json:"maxErrorMicros,omitempty"`
+	EstErrorMicros *int64 `json:"estErrorMicros,omitempty"`
+	// Аппаратные часы PTP, доступные на узле
+	PTPDevices []string `json:"ptpDevices,omitempty"`
+	// Смещение относительно начала записи по монотонным часам, нс
+	MonotonicNs int64 `json:"monotonicNs"`
+}
+
+var (
+	// Имя экземпляра монитора, отличающее его от других на том же узле
+	instanceName string
+	// Период записи меток часов в открытые журналы, 0 - только в начале журнала
+	clockMarkerInterval time.Duration
+)
+
+func init() {
+	http.HandleFunc("GET /clock", handleClock)
+}
+
+// Текущие сведения о часах узла
+func currentClockInfo() clockInfo {
+	host, _ := os.Hostname()
+	info := clockInfo{
+		Host:        host,
+		Instance:    instanceName,
+		WallTime:    time.Now(),
+		MonotonicNs: time.Since(startedAt).Nanoseconds(),
+	}
+	readClockSync(&info)
+	return info
+}
+
+// Сведения о часах в виде строки для служебной записи журнала
+func clockInfoComment() string {
+	data, _ := json.Marshal(currentClockInfo())
+	return "Часы: " + string(data)
+}
+
+// Периодическая запись меток часов во все открытые журналы
+func runClockMarkers() {
+	if clockMarkerInterval <= 0 {
+		return
+	}
+	for {
+		time.Sleep(clockMarkerInterval)
+		comment := clockInfoComment()
+		for _, port := range loggedPorts() {
+			writePortLogComment(port, comment)
+		}
+	}
+}
+
+// GET /clock - сведения о часах узла
+func handleClock(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentClockInfo())
+}
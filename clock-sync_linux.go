@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Флаги состояния часов ядра
+const (
+	staUnsync = 0x0040
+	staNano   = 0x2000
+	// Возвращаемое adjtimex состояние "часы не синхронизированы"
+	timeError = 5
+)
+
+// Сведения о синхронизации часов из ядра Linux
+func readClockSync(info *clockInfo) {
+	if data, err := os.ReadFile("/sys/devices/system/clocksource/clocksource0/current_clocksource"); err == nil {
+		info.ClockSource = strings.TrimSpace(string(data))
+	}
+	info.PTPDevices, _ = filepath.Glob("/dev/ptp*")
+
+	var tx syscall.Timex
+	state, err := syscall.Adjtimex(&tx)
+	if err != nil {
+		return
+	}
+	synchronized := state != timeError && tx.Status&staUnsync == 0
+	offset := int64(tx.Offset)
+	if tx.Status&staNano != 0 {
+		offset /= 1000
+	}
+	maxError, estError := int64(tx.Maxerror), int64(tx.Esterror)
+
+	info.Synchronized = &synchronized
+	info.OffsetMicros = &offset
+	info.MaxErrorMicros = &maxError
+	info.EstErrorMicros = &estError
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+// Сведения о синхронизации часов на этой платформе не определяются
+func readClockSync(info *clockInfo) {
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Команда, поставленная в очередь внешней системой (HTTP, Redis, NATS)
+type ingestedCommand struct {
+	// Идентификатор, который возвращается в подтверждении
+	ID string `json:"id,omitempty"`
+	// Порт, по умолчанию основной
+	Port    string `json:"port,omitempty"`
+	Command string `json:"command"`
+	// Несколько команд, отправляются по порядку
+	Commands []string `json:"commands,omitempty"`
+	// Куда отправить подтверждение: список Redis. В NATS используется адрес ответа сообщения.
+	ReplyTo string `json:"replyTo,omitempty"`
+}
+
+// Подтверждение отправки команды в порт
+type commandAck struct {
+	Type    string     `json:"type"`
+	ID      string     `json:"id,omitempty"`
+	Port    string     `json:"port"`
+	Command string     `json:"command"`
+	Sent    bool       `json:"sent"`
+	SentAt  *time.Time `json:"sentAt,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+func init() {
+	http.HandleFunc("POST /commands", handlePostCommands)
+}
+
+// Разбор сообщения очереди: JSON-объект или просто текст команды для основного порта
+func parseIngestedCommand(data []byte) (*ingestedCommand, error) {
+	text := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(text, "{") {
+		if text == "" {
+			return nil, errors.New("пустая команда")
+		}
+		return &ingestedCommand{Command: text}, nil
+	}
+	request := &ingestedCommand{}
+	if err := json.Unmarshal(data, request); err != nil {
+		return nil, fmt.Errorf("неверный формат команды: %v", err)
+	}
+	return request, request.validate()
+}
+
+func (c *ingestedCommand) validate() error {
+	if c.Command == "" && len(c.Commands) == 0 {
+		return errors.New("не указана команда")
+	}
+	if c.Command != "" && len(c.Commands) > 0 {
+		return errors.New("укажите command или commands, но не оба")
+	}
+	for _, command := range c.list() {
+		if strings.TrimSpace(command) == "" {
+			return errors.New("пустая команда")
+		}
+	}
+	return nil
+}
+
+// Команды запроса по порядку
+func (c *ingestedCommand) list() []string {
+	if len(c.Commands) > 0 {
+		return c.Commands
+	}
+	return []string{c.Command}
+}
+
+// Проверка прав и отправка команд в порт. Отправка прекращается на первой ошибке,
+// оставшиеся команды получают подтверждение с ошибкой.
+func forwardIngestedCommand(c *ingestedCommand, identity, remote string, ns *namespace) []commandAck {
+	port := c.Port
+	if port == "" {
+		port = currentSettings.Port
+	}
+	var failure error
+	if !ns.allowsPort(port) {
+		failure = fmt.Errorf("порт %s недоступен в пространстве %s", port, ns.Name)
+	} else if err := checkReservation(identity, port); err != nil {
+		failure = err
+	}
+
+	acks := make([]commandAck, 0, len(c.list()))
+	for _, command := range c.list() {
+		ack := commandAck{Type: "commandAck", ID: c.ID, Port: port, Command: command}
+		if failure == nil {
+			auditLog(identity, remote, "command", port, redactLine(command))
+			failure = sendPortCommand(port, command)
+			if failure == nil {
+				now := time.Now()
+				ack.Sent, ack.SentAt = true, &now
+			}
+		}
+		if failure != nil {
+			ack.Error = failure.Error()
+		}
+		acks = append(acks, ack)
+	}
+	return acks
+}
+
+// Отправка команды в порт с обычным подтверждением для клиентов WebSocket.
+// В отличие от команд клиентов, ошибка возвращается отправителю.
+func sendPortCommand(port, command string) error {
+	if remote, _, ok := parseRemotePort(port); ok {
+		if port != currentSettings.Port {
+			return fmt.Errorf("удалённый порт %s должен быть выбран основным", port)
+		}
+		return remote.sendCommand(command)
+	}
+	if port == "" {
+		return errors.New("порт не выбран")
+	}
+	msg := command + "\n"
+	if err := writeToPort(port, []byte(msg)); err != nil {
+		return err
+	}
+	sendPortMessage(port, "Отправлено на последовательный порт: "+redactLine(command)+"\n")
+	return nil
+}
+
+// POST /commands - отправка команд в порт для систем автоматизации без WebSocket:
+//
+//	{"port": "/dev/ttyUSB0", "command": "reset", "id": "job-17"}
+//	{"port": "/dev/ttyUSB0", "commands": ["stop", "calibrate"]}
+//
+// Ответ - подтверждения по каждой команде; 409, если какая-либо не отправлена.
+func handlePostCommands(w http.ResponseWriter, r *http.Request) {
+	var request ingestedCommand
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "неверный формат команды: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := request.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	acks := forwardIngestedCommand(&request, requestIdentity(r), r.RemoteAddr, requestNamespace(r))
+	status := http.StatusOK
+	if !acks[len(acks)-1].Sent {
+		status = http.StatusConflict
+	}
+	writeJSON(w, status, acks)
+}
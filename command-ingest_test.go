@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Команды из очереди или POST /commands: разобранная команда содержит хотя бы
+// одну непустую команду, а простой текст отправляется в основной порт как есть
+func FuzzParseIngestedCommand(f *testing.F) {
+	for _, seed := range []string{
+		"reset",
+		"  temp \n",
+		"",
+		`{"port": "/dev/ttyUSB0", "command": "reset", "id": "job-17"}`,
+		`{"commands": ["stop", "calibrate"], "replyTo": "acks"}`,
+		`{"command": "a", "commands": ["b"]}`,
+		`{"commands": ["", " "]}`,
+		`{"commands": "stop"}`,
+		`{"command": null}`,
+		`{`,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c, err := parseIngestedCommand(data)
+		if err != nil {
+			return
+		}
+		if c == nil {
+			t.Fatalf("%q: нет ни команды, ни ошибки", data)
+		}
+		list := c.list()
+		if len(list) == 0 {
+			t.Fatalf("%q: разобрано без команд", data)
+		}
+		for _, command := range list {
+			if strings.TrimSpace(command) == "" {
+				t.Fatalf("%q: принята пустая команда", data)
+			}
+		}
+		text := strings.TrimSpace(string(data))
+		if !strings.HasPrefix(text, "{") && (c.Command != text || c.Port != "") {
+			t.Fatalf("%q: простой текст разобран как %+v", data, c)
+		}
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Составное устройство: несколько портов (интерфейсов CDC, каналов FTDI)
+// одного физического устройства USB
+type compositeDevice struct {
+	Device   string          `json:"device"`
+	Name     string          `json:"name,omitempty"`
+	Channels []deviceChannel `json:"channels"`
+}
+
+// Канал составного устройства
+type deviceChannel struct {
+	Port      string `json:"port"`
+	Interface string `json:"interface,omitempty"`
+	Label     string `json:"label"`
+}
+
+// Группировка портов по физическим устройствам. В результат попадают только
+// устройства с несколькими портами.
+func groupCompositeDevices(ports map[string]portMetadataEntry) []compositeDevice {
+	byDevice := make(map[string]*compositeDevice)
+	for port, entry := range ports {
+		if entry.portLocation == nil || entry.Device == "" {
+			continue
+		}
+		device := byDevice[entry.Device]
+		if device == nil {
+			device = &compositeDevice{Device: entry.Device, Name: entry.FriendlyName}
+			byDevice[entry.Device] = device
+		}
+		device.Channels = append(device.Channels, deviceChannel{
+			Port:      port,
+			Interface: entry.Interface,
+			Label:     channelLabel(entry),
+		})
+	}
+
+	devices := []compositeDevice{}
+	for _, device := range byDevice {
+		if len(device.Channels) < 2 {
+			continue
+		}
+		sort.Slice(device.Channels, func(i, j int) bool {
+			a, b := device.Channels[i], device.Channels[j]
+			if a.Interface != b.Interface {
+				return a.Interface < b.Interface
+			}
+			return a.Port < b.Port
+		})
+		devices = append(devices, *device)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Channels[0].Port < devices[j].Channels[0].Port })
+	return devices
+}
+
+// Подпись канала: метка пользователя, описание интерфейса из дескриптора
+// устройства или номер интерфейса
+func channelLabel(entry portMetadataEntry) string {
+	switch {
+	case entry.Label != "":
+		return entry.Label
+	case entry.Channel != "":
+		return entry.Channel
+	case entry.Interface != "":
+		return "Интерфейс " + entry.Interface
+	}
+	return "Канал"
+}
+
+// Пояснение для клиентов, если порт - один из каналов составного устройства
+func describeChannel(port string) string {
+	data := make(map[string]portMetadataEntry)
+	locations := portLocations()
+	for name, location := range locations {
+		data[name] = portMetadataEntry{portMetadata: getPortMetadata(name), portLocation: location}
+	}
+	for _, device := range groupCompositeDevices(data) {
+		for _, channel := range device.Channels {
+			if channel.Port != port {
+				continue
+			}
+			name := device.Name
+			if name == "" {
+				name = device.Device
+			}
+			return fmt.Sprintf("Порт %s - канал «%s» устройства %s (каналов: %d).", port, channel.Label, name, len(device.Channels))
+		}
+	}
+	return ""
+}
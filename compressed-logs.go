@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Сжатые журналы сеансов (файлы *.gz). Строки накапливаются в памяти и
+// записываются блоками, каждый блок - отдельный член gzip, поэтому файл
+// целиком читается обычным gzip -dc. Как в формате BGZF, в заголовке каждого
+// блока (поле FEXTRA) хранятся его размер и время первой и последней строки:
+// переходя от заголовка к заголовку, можно построить оглавление многогигабайтного
+// файла, не распаковывая его, и распаковывать только нужные блоки.
+
+const (
+	// Подполе "SM" заголовка gzip: размер блока, размер строк в нём,
+	// время первой и последней строки (Unix, наносекунды)
+	chunkFieldLen = 24
+	// Заголовок блока: 10 байтов gzip, XLEN и подполе с его заголовком
+	chunkHeaderSize = 10 + 2 + 4 + chunkFieldLen
+	// Окончание блока: CRC32 и размер распакованных данных
+	chunkTrailerSize = 8
+)
+
+var (
+	// Размер несжатых строк в блоке, КБ
+	logChunkKB = 256
+	// Наибольшее время, которое строки ждут в памяти до записи блока
+	logChunkAge = 10 * time.Second
+)
+
+// Блок сжатого журнала в оглавлении
+type logChunk struct {
+	// Положение блока в файле
+	offset, size int64
+	// Положение строк блока в распакованных данных
+	dataOffset, dataSize int64
+	// Время первой и последней строки блока
+	start, end time.Time
+}
+
+// Распакованный блок, который недавно читали
+type cachedChunk struct {
+	index int
+	data  []byte
+}
+
+// Чтение распакованных данных сжатого журнала с произвольного места.
+// Последние прочитанные блоки хранятся распакованными: поиск и листание
+// обращаются к одному блоку много раз подряд.
+type chunkedLog struct {
+	file   *os.File
+	chunks []logChunk
+	// Размер распакованных данных
+	size  int64
+	cache [2]cachedChunk
+	// Ячейка кэша для следующего распакованного блока
+	nextSlot int
+}
+
+// Должен ли журнал по этому пути записываться сжатым
+func isCompressedLogPath(path string) bool {
+	return strings.HasSuffix(strings.ToLower(path), ".gz")
+}
+
+// Сжат ли файл (gzip)
+func isCompressedFile(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(file, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return header[0] == 0x1f && header[1] == 0x8b, nil
+}
+
+// Сжатие строк в блок
+func encodeLogChunk(data []byte, start, end time.Time) ([]byte, error) {
+	var body bytes.Buffer
+	writer, err := flate.NewWriter(&body, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	size := chunkHeaderSize + body.Len() + chunkTrailerSize
+	out := make([]byte, 0, size)
+	// ID1 ID2 CM=deflate FLG=FEXTRA MTIME XFL OS=неизвестна
+	out = append(out, 0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 255)
+	out = binary.LittleEndian.AppendUint16(out, 4+chunkFieldLen)
+	out = append(out, 'S', 'M')
+	out = binary.LittleEndian.AppendUint16(out, chunkFieldLen)
+	out = binary.LittleEndian.AppendUint32(out, uint32(size))
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(data)))
+	out = binary.LittleEndian.AppendUint64(out, uint64(start.UnixNano()))
+	out = binary.LittleEndian.AppendUint64(out, uint64(end.UnixNano()))
+	out = append(out, body.Bytes()...)
+	out = binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(data))
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(data)))
+	return out, nil
+}
+
+// Разбор заголовка блока. Члены gzip, записанные не монитором, не принимаются.
+func parseChunkHeader(h []byte) (logChunk, bool) {
+	if len(h) < chunkHeaderSize || h[0] != 0x1f || h[1] != 0x8b || h[2] != 8 || h[3] != 4 ||
+		binary.LittleEndian.Uint16(h[10:]) != 4+chunkFieldLen ||
+		h[12] != 'S' || h[13] != 'M' || binary.LittleEndian.Uint16(h[14:]) != chunkFieldLen {
+		return logChunk{}, false
+	}
+	field := h[16:]
+	c := logChunk{
+		size:     int64(binary.LittleEndian.Uint32(field)),
+		dataSize: int64(binary.LittleEndian.Uint32(field[4:])),
+		start:    time.Unix(0, int64(binary.LittleEndian.Uint64(field[8:]))),
+		end:      time.Unix(0, int64(binary.LittleEndian.Uint64(field[16:]))),
+	}
+	return c, c.size >= chunkHeaderSize+chunkTrailerSize
+}
+
+// Похожи ли байты на начало (возможно, недописанного) блока журнала.
+// Нулевые байты остаются, если файловая система не успела записать данные.
+func chunkHeaderPrefix(h []byte) bool {
+	if !bytes.ContainsFunc(h, func(r rune) bool { return r != 0 }) {
+		return true
+	}
+	var expected [chunkHeaderSize]byte
+	copy(expected[:], []byte{0x1f, 0x8b, 8, 4})
+	binary.LittleEndian.PutUint16(expected[10:], 4+chunkFieldLen)
+	copy(expected[12:], "SM")
+	binary.LittleEndian.PutUint16(expected[14:], chunkFieldLen)
+	for i, b := range h[:min(len(h), 16)] {
+		if (i < 4 || i >= 10) && b != expected[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Оглавление сжатого журнала по заголовкам блоков. Возвращает блоки и конец
+// последнего из них; недописанный блок в конце файла в оглавление не попадает.
+func readChunkIndex(file io.ReaderAt, fileSize int64) ([]logChunk, int64, error) {
+	var chunks []logChunk
+	var offset, dataOffset int64
+	header := make([]byte, chunkHeaderSize)
+	for offset+chunkHeaderSize <= fileSize {
+		if _, err := file.ReadAt(header, offset); err != nil {
+			return nil, 0, err
+		}
+		c, ok := parseChunkHeader(header)
+		if !ok || offset+c.size > fileSize {
+			break
+		}
+		c.offset, c.dataOffset = offset, dataOffset
+		chunks = append(chunks, c)
+		offset += c.size
+		dataOffset += c.dataSize
+	}
+	return chunks, offset, nil
+}
+
+// Распаковка блока с проверкой контрольной суммы
+func readChunk(file io.ReaderAt, c logChunk) ([]byte, error) {
+	member := make([]byte, c.size)
+	if _, err := file.ReadAt(member, c.offset); err != nil {
+		return nil, err
+	}
+	body := member[chunkHeaderSize : c.size-chunkTrailerSize]
+	// Распаковывается не больше заявленного объёма, чтобы повреждённый блок
+	// не разворачивался в память без предела
+	data, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(body)), c.dataSize+1))
+	trailer := member[c.size-chunkTrailerSize:]
+	if err == nil && (crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(trailer) ||
+		uint32(len(data)) != binary.LittleEndian.Uint32(trailer[4:]) || int64(len(data)) != c.dataSize) {
+		err = errors.New("неверная контрольная сумма")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("блок журнала по смещению %d повреждён: %v", c.offset, err)
+	}
+	return data, nil
+}
+
+func openChunkedLog(path string) (*chunkedLog, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	chunks, _, err := readChunkIndex(file, info.Size())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if len(chunks) == 0 && info.Size() >= chunkHeaderSize {
+		file.Close()
+		return nil, fmt.Errorf("файл %s не является сжатым журналом монитора", path)
+	}
+	l := &chunkedLog{file: file, chunks: chunks}
+	for i := range l.cache {
+		l.cache[i].index = -1
+	}
+	if len(chunks) > 0 {
+		last := chunks[len(chunks)-1]
+		l.size = last.dataOffset + last.dataSize
+	}
+	return l, nil
+}
+
+func (l *chunkedLog) Close() error {
+	return l.file.Close()
+}
+
+// Распакованный блок, из кэша или с диска
+func (l *chunkedLog) chunk(i int) ([]byte, error) {
+	for _, cached := range l.cache {
+		if cached.index == i {
+			return cached.data, nil
+		}
+	}
+	data, err := readChunk(l.file, l.chunks[i])
+	if err != nil {
+		return nil, err
+	}
+	l.cache[l.nextSlot] = cachedChunk{index: i, data: data}
+	l.nextSlot = (l.nextSlot + 1) % len(l.cache)
+	return data, nil
+}
+
+// Чтение распакованных данных начиная с off
+func (l *chunkedLog) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= l.size {
+			return n, io.EOF
+		}
+		i := sort.Search(len(l.chunks), func(i int) bool {
+			return l.chunks[i].dataOffset+l.chunks[i].dataSize > pos
+		})
+		data, err := l.chunk(i)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data[pos-l.chunks[i].dataOffset:])
+	}
+	return n, nil
+}
+
+// Участок распакованных данных, в котором находится первая запись не раньше t.
+// Время строк не убывает, поэтому это первый блок, закончившийся не раньше t.
+func (l *chunkedLog) seekRange(t time.Time) (int64, int64) {
+	i := sort.Search(len(l.chunks), func(i int) bool { return !l.chunks[i].end.Before(t) })
+	if i == len(l.chunks) {
+		return l.size, l.size
+	}
+	return l.chunks[i].dataOffset, l.chunks[i].dataOffset + l.chunks[i].dataSize
+}
+
+// Чтение сжатого файла целиком: блоки читаются подряд как один поток gzip
+type compressedFileReader struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (r *compressedFileReader) Close() error {
+	r.Reader.Close()
+	return r.file.Close()
+}
+
+func openCompressedFile(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &compressedFileReader{Reader: reader, file: file}, nil
+}
+
+// Подготовка сжатого журнала, открытого для дозаписи
+func prepareCompressedLog(path string, file *os.File) error {
+	if storageCipher != nil {
+		return fmt.Errorf("журнал %s: сжатые журналы не шифруются, уберите расширение .gz или -encryption-key", path)
+	}
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	compressed, err := isCompressedFile(path)
+	if err != nil {
+		return err
+	}
+	if !compressed {
+		return fmt.Errorf("журнал %s не сжат, дописывать в него сжатые блоки нельзя", path)
+	}
+	return nil
+}
+
+// Приведение сжатого журнала к последнему целому блоку после сбоя.
+// Возвращает число отброшенных байтов.
+func recoverCompressedLog(path string) (int64, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return 0, err
+	}
+	size := info.Size()
+	chunks, end, err := readChunkIndex(file, size)
+	if err != nil {
+		return 0, err
+	}
+	if len(chunks) == 0 {
+		header := make([]byte, min(size, chunkHeaderSize))
+		if _, err := file.ReadAt(header, 0); err != nil {
+			return 0, err
+		}
+		if !chunkHeaderPrefix(header) {
+			// Чужой файл не трогаем
+			return 0, fmt.Errorf("файл не является сжатым журналом монитора")
+		}
+	}
+	// Заголовок последнего блока мог попасть на диск раньше его данных
+	for len(chunks) > 0 {
+		last := chunks[len(chunks)-1]
+		if _, err := readChunk(file, last); err == nil {
+			break
+		}
+		chunks = chunks[:len(chunks)-1]
+		end = last.offset
+	}
+	dropped := size - end
+	if dropped == 0 {
+		return 0, nil
+	}
+
+	if err := file.Truncate(end); err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	record := fmt.Sprintf("%s\t# Восстановлено после сбоя: отброшено недописанных байтов: %d\n", now.Format(logTimeFormat), dropped)
+	chunk, err := encodeLogChunk([]byte(record), now, now)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := file.WriteAt(chunk, end); err != nil {
+		return 0, err
+	}
+	if err := file.Sync(); err != nil {
+		return 0, err
+	}
+	log.Printf("Журнал %s восстановлен после сбоя: отброшено %d байт.", path, dropped)
+	return dropped, nil
+}
+
+// Добавление записи в текущий блок журнала, вызывается под l.mutex
+func (l *portLog) appendChunk(record string, t time.Time) error {
+	if l.chunk.Len() == 0 {
+		l.chunkStart = t
+	}
+	l.chunkEnd = t
+	l.chunk.WriteString(record)
+	// При -fsync=always каждая строка пишется своим блоком и сразу
+	// сбрасывается на диск: строка в несжатом блоке в памяти не сохранена
+	if l.chunk.Len() >= logChunkKB*1024 || fsyncAlways {
+		return l.writeChunk()
+	}
+	return nil
+}
+
+// Сжатие и запись накопленного блока, вызывается под l.mutex
+func (l *portLog) writeChunk() error {
+	if l.chunk.Len() == 0 {
+		return nil
+	}
+	data, err := encodeLogChunk(l.chunk.Bytes(), l.chunkStart, l.chunkEnd)
+	if err != nil {
+		return err
+	}
+	n, err := l.file.Write(data)
+	if err != nil {
+		// Недописанный блок убираем, чтобы следующие блоки остались читаемыми
+		if info, statErr := l.file.Stat(); statErr == nil && n > 0 {
+			l.file.Truncate(info.Size() - int64(n))
+		}
+		return err
+	}
+	if l.namespace != nil {
+		l.namespace.storageUsed.Add(int64(n))
+	}
+	l.chunk.Reset()
+	l.dirty = true
+	if fsyncAlways {
+		return l.sync()
+	}
+	return nil
+}
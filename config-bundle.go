@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Версия формата файла конфигурации
+const configBundleVersion = 1
+
+// Файлы каталога данных, которые входят в конфигурацию. Состояние работы
+// (резервирования, журналы, доступность) не переносится.
+var configBundleFiles = []string{
+	portMetadataFile, deviceNotesFile, triggersFile, redactionRulesFile,
+	keepAliveProbesFile, peripheralProfilesFile, preferencesFile,
+}
+
+// Полная конфигурация сервера в одном файле для переноса на другой экземпляр.
+// Содержит токены пространств и пароли оповещений, его нужно хранить как секрет.
+type configBundle struct {
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exportedAt"`
+	Instance   string    `json:"instance,omitempty"`
+	// Файлы каталога данных, ключ - имя файла
+	Files map[string]json.RawMessage `json:"files"`
+	// Содержимое файлов, заданных параметрами -rules, -namespaces и -notify
+	AutoOpenRules json.RawMessage `json:"autoOpenRules,omitempty"`
+	Namespaces    json.RawMessage `json:"namespaces,omitempty"`
+	Notify        json.RawMessage `json:"notify,omitempty"`
+}
+
+func init() {
+	http.HandleFunc("GET /config/export", handleConfigExport)
+}
+
+// Сбор конфигурации из каталога данных и файлов настроек
+func buildConfigBundle() (*configBundle, error) {
+	bundle := &configBundle{
+		Version:    configBundleVersion,
+		ExportedAt: time.Now(),
+		Instance:   instanceName,
+		Files:      make(map[string]json.RawMessage),
+	}
+	for _, name := range configBundleFiles {
+		data, err := readOptionalFile(dataPath(name))
+		if err != nil {
+			return nil, err
+		}
+		if data != nil {
+			bundle.Files[name] = data
+		}
+	}
+	var err error
+	if bundle.AutoOpenRules, err = readOptionalFile(autoOpenRulesPath); err != nil {
+		return nil, err
+	}
+	if bundle.Namespaces, err = readOptionalFile(namespacesPath); err != nil {
+		return nil, err
+	}
+	if bundle.Notify, err = readOptionalFile(notifyConfigPath); err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+// Содержимое JSON-файла или nil, если путь не задан или файла нет
+func readOptionalFile(path string) (json.RawMessage, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("файл %s не является JSON", path)
+	}
+	return data, nil
+}
+
+// Проверка конфигурации перед импортом
+func (b *configBundle) validate() error {
+	if b.Version != configBundleVersion {
+		return fmt.Errorf("неподдерживаемая версия конфигурации %d", b.Version)
+	}
+	for name, data := range b.Files {
+		if !stringInSlice(name, configBundleFiles) {
+			return fmt.Errorf("неизвестный файл конфигурации %q", name)
+		}
+		if !json.Valid(data) {
+			return fmt.Errorf("файл %s не является JSON", name)
+		}
+	}
+	if b.AutoOpenRules != nil {
+		var rules []autoOpenRule
+		if err := json.Unmarshal(b.AutoOpenRules, &rules); err != nil {
+			return fmt.Errorf("правила автоматического подключения: %v", err)
+		}
+	}
+	if b.Namespaces != nil {
+		var list []*namespace
+		err := json.Unmarshal(b.Namespaces, &list)
+		if err == nil {
+			err = validateNamespaces(list)
+		}
+		if err != nil {
+			return fmt.Errorf("пространства имён: %v", err)
+		}
+	}
+	if b.Notify != nil {
+		config := &notifyConfig{}
+		err := json.Unmarshal(b.Notify, config)
+		if err == nil {
+			err = config.validate()
+		}
+		if err != nil {
+			return fmt.Errorf("настройки оповещений: %v", err)
+		}
+	}
+	return nil
+}
+
+// GET /config/export - выгрузка конфигурации работающего сервера
+func handleConfigExport(w http.ResponseWriter, r *http.Request) {
+	if ns := requestNamespace(r); ns != nil {
+		http.Error(w, fmt.Sprintf("выгрузка конфигурации недоступна в пространстве %s", ns.Name), http.StatusForbidden)
+		return
+	}
+	bundle, err := buildConfigBundle()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="serial-monitor-config.json"`)
+	writeJSON(w, http.StatusOK, bundle)
+}
+
+// Выгрузка и загрузка конфигурации из командной строки. Загрузка выполняется
+// при остановленном сервере: работающий сервер перезаписал бы файлы своими данными.
+//
+//	serial-monitor config export -data /var/lib/serial-monitor -rules rules.json -o lab.json
+//	serial-monitor config import -data /var/lib/serial-monitor -rules rules.json lab.json
+func runConfigMode(args []string) int {
+	if len(args) == 0 || args[0] != "export" && args[0] != "import" {
+		fmt.Fprintln(os.Stderr, "Использование: serial-monitor config export|import [параметры] [файл]")
+		return exitError
+	}
+	command := args[0]
+	flags := flag.NewFlagSet("config "+command, flag.ExitOnError)
+	flags.StringVar(&dataDir, "data", "serial-monitor-data", "каталог данных сервера")
+	flags.StringVar(&autoOpenRulesPath, "rules", "", "файл правил автоматического подключения")
+	flags.StringVar(&namespacesPath, "namespaces", "", "файл описания пространств имён")
+	flags.StringVar(&notifyConfigPath, "notify", "", "файл настроек оповещений")
+	output := flags.String("o", "", "файл для выгрузки (по умолчанию стандартный вывод)")
+	force := flags.Bool("force", false, "заменять существующие файлы при загрузке")
+	flags.Parse(args[1:])
+
+	if command == "export" {
+		bundle, err := buildConfigBundle()
+		if err != nil {
+			log.Printf("Ошибка выгрузки конфигурации: %v", err)
+			return exitError
+		}
+		data, err := json.MarshalIndent(bundle, "", "  ")
+		if err != nil {
+			log.Printf("Ошибка выгрузки конфигурации: %v", err)
+			return exitError
+		}
+		data = append(data, '\n')
+		if *output == "" {
+			os.Stdout.Write(data)
+		} else if err := os.WriteFile(*output, data, 0600); err != nil {
+			log.Printf("Ошибка записи файла конфигурации: %v", err)
+			return exitError
+		}
+		return exitPass
+	}
+
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Не указан файл конфигурации для загрузки.")
+		return exitError
+	}
+	if err := importConfigBundle(flags.Arg(0), *force); err != nil {
+		log.Printf("Ошибка загрузки конфигурации: %v", err)
+		return exitError
+	}
+	return exitPass
+}
+
+// Загрузка конфигурации из файла в каталог данных и файлы настроек
+func importConfigBundle(path string, force bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	bundle := &configBundle{}
+	if err := json.Unmarshal(data, bundle); err != nil {
+		return err
+	}
+	if err := bundle.validate(); err != nil {
+		return err
+	}
+
+	// Куда записывается каждая часть конфигурации
+	targets := make(map[string]json.RawMessage)
+	for name, content := range bundle.Files {
+		targets[dataPath(name)] = content
+	}
+	for _, part := range []struct {
+		content json.RawMessage
+		path    string
+		flag    string
+	}{
+		{bundle.AutoOpenRules, autoOpenRulesPath, "-rules"},
+		{bundle.Namespaces, namespacesPath, "-namespaces"},
+		{bundle.Notify, notifyConfigPath, "-notify"},
+	} {
+		if part.content == nil {
+			continue
+		}
+		if part.path == "" {
+			log.Printf("Пропущено: для загрузки части конфигурации укажите файл параметром %s.", part.flag)
+			continue
+		}
+		targets[part.path] = part.content
+	}
+
+	paths := make([]string, 0, len(targets))
+	for target := range targets {
+		paths = append(paths, target)
+	}
+	sort.Strings(paths)
+	if !force {
+		for _, target := range paths {
+			if _, err := os.Stat(target); err == nil {
+				return fmt.Errorf("файл %s уже существует (для замены укажите -force)", target)
+			}
+		}
+	}
+	for _, target := range paths {
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		// Файлы могут содержать токены и пароли
+		if err := os.WriteFile(target, targets[target], 0600); err != nil {
+			return err
+		}
+		log.Printf("Записан %s", target)
+	}
+	return nil
+}
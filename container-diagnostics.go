@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+)
+
+// Сведения о запуске в контейнере: проброшены ли последовательные устройства
+// и хватает ли прав на них. Без этого в контейнере видно только пустой список
+// портов, и непонятно, что исправлять в параметрах запуска.
+type containerDiagnostics struct {
+	// Среда контейнера: docker, podman, kubernetes, containerd или lxc
+	Runtime string `json:"runtime"`
+	// Связан ли /dev контейнера с /dev узла (-v /dev:/dev). Только тогда
+	// появляются устройства, подключённые после запуска контейнера.
+	HostDev bool `json:"hostDev"`
+	// Устройства, которые есть на узле, но не проброшены в /dev контейнера
+	Unmapped []string `json:"unmapped,omitempty"`
+	// Устройства в /dev, на которые у процесса нет прав чтения и записи
+	NoAccess []string `json:"noAccess,omitempty"`
+	// Устройства, доступ к которым запрещён контроллером устройств cgroup
+	Denied []string `json:"denied,omitempty"`
+	// Что исправить в параметрах запуска контейнера
+	Hints []string `json:"hints"`
+}
+
+// Сообщение о сведениях контейнера при запуске сервера
+func logContainerDiagnostics() {
+	d := detectContainer()
+	if d == nil {
+		return
+	}
+	log.Printf("Сервер запущен в контейнере (%s).", d.Runtime)
+	for _, hint := range d.Hints {
+		log.Printf("Контейнер: %s", hint)
+	}
+}
+
+// Подсказки для клиентов, когда последовательных портов не найдено
+func containerPortHints() []string {
+	d := detectContainer()
+	if d == nil {
+		return nil
+	}
+	hints := make([]string, 0, len(d.Hints))
+	for _, hint := range d.Hints {
+		hints = append(hints, "Контейнер: "+hint)
+	}
+	return hints
+}
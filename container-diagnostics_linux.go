@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Классы последовательных устройств в sysfs, которые ищутся на узле
+var containerTTYPatterns = []string{"ttyUSB*", "ttyACM*", "ttyAMA*"}
+
+// Разрешения контроллера устройств cgroup v1. В cgroup v2 разрешения
+// задаются программой eBPF и изнутри контейнера не читаются.
+const cgroupDevicesList = "/sys/fs/cgroup/devices/devices.list"
+
+// Проверка запуска в контейнере и доступа к последовательным устройствам.
+// Возвращает nil, если сервер запущен не в контейнере.
+func detectContainer() *containerDiagnostics {
+	runtime := containerRuntime()
+	if runtime == "" {
+		return nil
+	}
+	d := &containerDiagnostics{Runtime: runtime, HostDev: hostDevMounted(), Hints: []string{}}
+
+	// sysfs в контейнере показывает устройства узла, даже если в /dev их нет
+	var host []string
+	for _, pattern := range containerTTYPatterns {
+		matches, _ := filepath.Glob(filepath.Join("/sys/class/tty", pattern))
+		host = append(host, matches...)
+	}
+	rules := readCgroupDeviceRules()
+	for _, entry := range host {
+		name := filepath.Base(entry)
+		dev := "/dev/" + name
+		number := ttyDeviceNumber(entry)
+		if _, err := os.Stat(dev); err != nil {
+			d.Unmapped = append(d.Unmapped, dev)
+			d.Hints = append(d.Hints, fmt.Sprintf("устройство %s есть на узле, но не проброшено в контейнер: добавьте --device=%s", dev, dev))
+			continue
+		}
+		if rules != nil && number != "" && !cgroupAllows(rules, number) {
+			d.Denied = append(d.Denied, dev)
+			major, _, _ := strings.Cut(number, ":")
+			d.Hints = append(d.Hints, fmt.Sprintf("контроллер устройств cgroup запрещает доступ к %s: добавьте --device=%s или --device-cgroup-rule='c %s:* rmw'", dev, dev, major))
+			continue
+		}
+		if err := unix.Access(dev, unix.R_OK|unix.W_OK); err != nil {
+			d.NoAccess = append(d.NoAccess, dev)
+			d.Hints = append(d.Hints, noAccessHint(dev))
+		}
+	}
+
+	if len(host) == 0 {
+		d.Hints = append(d.Hints, "последовательные устройства не найдены и на узле: проверьте подключение устройства и драйвер на узле")
+	}
+	if !d.HostDev {
+		d.Hints = append(d.Hints, "устройства, подключённые после запуска контейнера, в нём не появятся: для горячего подключения запускайте с -v /dev:/dev и --device-cgroup-rule для нужных устройств")
+	}
+	return d
+}
+
+// Определение среды контейнера по её служебным файлам и группам cgroup процесса 1
+func containerRuntime() string {
+	if _, err := os.Stat("/.dockerenv"); err == nil {
+		return "docker"
+	}
+	if _, err := os.Stat("/run/.containerenv"); err == nil {
+		return "podman"
+	}
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return "kubernetes"
+	}
+	data, err := os.ReadFile("/proc/1/cgroup")
+	if err != nil {
+		return ""
+	}
+	cgroups := string(data)
+	switch {
+	case strings.Contains(cgroups, "kubepods"):
+		return "kubernetes"
+	case strings.Contains(cgroups, "docker"):
+		return "docker"
+	case strings.Contains(cgroups, "containerd"):
+		return "containerd"
+	case strings.Contains(cgroups, "lxc"):
+		return "lxc"
+	}
+	return ""
+}
+
+// Смонтирован ли в /dev devtmpfs узла. Собственный /dev контейнера - это tmpfs
+// с отдельно созданными файлами устройств.
+func hostDevMounted() bool {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// 25 28 0:6 / /dev rw,relatime - devtmpfs devtmpfs rw
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[4] != "/dev" {
+			continue
+		}
+		for i, field := range fields {
+			if field == "-" && i+1 < len(fields) {
+				return fields[i+1] == "devtmpfs"
+			}
+		}
+	}
+	return false
+}
+
+// Номер устройства "старший:младший" из sysfs
+func ttyDeviceNumber(sysPath string) string {
+	data, err := os.ReadFile(filepath.Join(sysPath, "dev"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Правила контроллера устройств cgroup v1: "c 188:* rwm". nil - правила недоступны.
+func readCgroupDeviceRules() [][]string {
+	data, err := os.ReadFile(cgroupDevicesList)
+	if err != nil {
+		return nil
+	}
+	rules := [][]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) == 3 {
+			rules = append(rules, fields)
+		}
+	}
+	return rules
+}
+
+// Разрешены ли правилами чтение и запись символьного устройства с номером number
+func cgroupAllows(rules [][]string, number string) bool {
+	major, minor, _ := strings.Cut(number, ":")
+	for _, rule := range rules {
+		if rule[0] != "a" && rule[0] != "c" {
+			continue
+		}
+		ruleMajor, ruleMinor, _ := strings.Cut(rule[1], ":")
+		if (ruleMajor == "*" || ruleMajor == major) && (ruleMinor == "*" || ruleMinor == minor) &&
+			strings.Contains(rule[2], "r") && strings.Contains(rule[2], "w") {
+			return true
+		}
+	}
+	return false
+}
+
+// Подсказка для устройства без прав: группа-владелец устройства, которую нужно добавить процессу
+func noAccessHint(dev string) string {
+	info, err := os.Stat(dev)
+	if err != nil {
+		return fmt.Sprintf("нет прав на чтение и запись %s", dev)
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Sprintf("нет прав на чтение и запись %s", dev)
+	}
+	return fmt.Sprintf("нет прав на чтение и запись %s (группа-владелец %d): добавьте --group-add %d или запускайте процесс от пользователя этой группы", dev, stat.Gid, stat.Gid)
+}
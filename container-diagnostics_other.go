@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// Контейнеры с последовательными устройствами поддерживаются только в Linux
+func detectContainer() *containerDiagnostics {
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Расписание в формате cron: минута, час, день месяца, месяц, день недели
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays map[int]bool
+	// Ограничены ли дни месяца и дни недели (не "*")
+	daysRestricted, weekdaysRestricted bool
+}
+
+// Разбор расписания в формате cron из пяти полей
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("расписание %q должно состоять из пяти полей", expr)
+	}
+
+	var s cronSchedule
+	var err error
+	if s.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if s.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if s.days, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if s.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if s.weekdays, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// Воскресенье можно записать и как 0, и как 7
+	if s.weekdays[7] {
+		s.weekdays[0] = true
+	}
+	s.daysRestricted = fields[2] != "*"
+	s.weekdaysRestricted = fields[4] != "*"
+
+	return &s, nil
+}
+
+// Разбор одного поля: списки через запятую, диапазоны и шаг ("1-5", "*/15", "8-18/2")
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	values := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rangePart = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return nil, fmt.Errorf("неверный шаг в поле расписания %q", field)
+			}
+		}
+
+		from, to := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("неверное значение в поле расписания %q", field)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("неверное значение в поле расписания %q", field)
+				}
+			} else if step > 1 {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, fmt.Errorf("значение вне допустимого диапазона в поле расписания %q", field)
+		}
+
+		for v := from; v <= to; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// Проверяем, совпадает ли минута t с расписанием
+func (s *cronSchedule) matches(t time.Time) bool {
+	if !s.minutes[t.Minute()] || !s.hours[t.Hour()] || !s.months[int(t.Month())] {
+		return false
+	}
+	dayMatch := s.days[t.Day()]
+	weekdayMatch := s.weekdays[int(t.Weekday())]
+	// Как в cron: если ограничены оба поля, достаточно совпадения любого из них
+	if s.daysRestricted && s.weekdaysRestricted {
+		return dayMatch || weekdayMatch
+	}
+	return dayMatch && weekdayMatch
+}
+
+// Проверяем, попадает ли момент t в окно длительностью duration,
+// которое начинается в одну из минут расписания
+func (s *cronSchedule) activeAt(t time.Time, duration time.Duration) bool {
+	start := t.Truncate(time.Minute)
+	for m := start; t.Sub(m) < duration; m = m.Add(-time.Minute) {
+		if s.matches(m) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Группа устройств, которыми управляют совместно
+type deviceGroup struct {
+	name     string
+	ports    []string
+	baudRate int
+	// Порты, которые открыла сама группа: при закрытии группы закрываются
+	// только они, а порты, открытые до группы, остаются открытыми
+	owned []*managedPort
+}
+
+// Запрос на открытие группы устройств
+type groupOpenRequest struct {
+	Group    string   `json:"group"`
+	Ports    []string `json:"ports"`
+	BaudRate string   `json:"baudRate"`
+	Framing  string   `json:"framing"`
+}
+
+// Запрос на отправку команды или закрытие группы
+type groupRequest struct {
+	Group   string `json:"group"`
+	Command string `json:"command"`
+	// Синхронная отправка: команда уходит на все порты одновременно
+	Sync bool `json:"sync"`
+}
+
+// Подтверждение синхронной отправки команды группе
+type groupDispatchAck struct {
+	Type      string           `json:"type"`
+	Group     string           `json:"group"`
+	Command   string           `json:"command"`
+	ReleaseAt time.Time        `json:"releaseAt"`
+	Devices   []deviceDispatch `json:"devices"`
+	// Разброс моментов начала записи между устройствами, мкс
+	JitterMicros int64 `json:"jitterMicros"`
+}
+
+// Время отправки команды на одно устройство группы
+type deviceDispatch struct {
+	Port         string    `json:"port"`
+	DispatchedAt time.Time `json:"dispatchedAt"`
+	// Задержка начала записи относительно момента отпускания барьера, мкс
+	OffsetMicros int64 `json:"offsetMicros"`
+	// Длительность записи в порт, мкс
+	WriteMicros int64  `json:"writeMicros"`
+	Error       string `json:"error,omitempty"`
+}
+
+var (
+	// Открытые группы устройств, ключ - имя группы
+	deviceGroups = make(map[string]*deviceGroup)
+	// Мьютекс для синхронизации доступа к deviceGroups
+	deviceGroupsMutex = &sync.Mutex{}
+)
+
+func init() {
+	clientActions["groupOpen"] = processGroupOpen
+	clientActions["groupCommand"] = processGroupCommand
+	clientActions["groupClose"] = processGroupClose
+}
+
+// Открытие всех портов группы. Если хотя бы один порт не открылся, группа не создаётся.
+func processGroupOpen(ws *websocket.Conn, message map[string]interface{}) {
+	var request groupOpenRequest
+	if err := decodeAction(message, &request); err != nil {
+		broadcast <- fmt.Sprintf("Ошибка: неверный формат запроса группы: %v", err)
+		return
+	}
+	if request.Group == "" || len(request.Ports) == 0 {
+		broadcast <- "Ошибка: не указано имя группы или список портов."
+		return
+	}
+	baudRate, err := strconv.Atoi(request.BaudRate)
+	if err != nil {
+		broadcast <- "Ошибка преобразования скорости передачи."
+		return
+	}
+
+	deviceGroupsMutex.Lock()
+	defer deviceGroupsMutex.Unlock()
+
+	if _, ok := deviceGroups[request.Group]; ok {
+		broadcast <- fmt.Sprintf("Ошибка: группа %s уже открыта.", request.Group)
+		return
+	}
+
+	var opened []string
+	var owned []*managedPort
+	for _, portName := range request.Ports {
+		p, ownedPort, err := acquireManagedPort(portName, baudRate, request.Framing)
+		if err != nil {
+			broadcast <- fmt.Sprintf("Ошибка: не удалось открыть порт %s группы %s: %v", portName, request.Group, err)
+			for _, p := range owned {
+				closeOwnedManagedPort(p)
+			}
+			return
+		}
+		opened = append(opened, portName)
+		if ownedPort {
+			owned = append(owned, p)
+		}
+	}
+
+	deviceGroups[request.Group] = &deviceGroup{
+		name:     request.Group,
+		ports:    opened,
+		baudRate: baudRate,
+		owned:    owned,
+	}
+	broadcast <- fmt.Sprintf("Группа %s открыта: %s, скорость передачи %d", request.Group, strings.Join(opened, ", "), baudRate)
+}
+
+// Отправка команды всем устройствам группы
+func processGroupCommand(ws *websocket.Conn, message map[string]interface{}) {
+	var request groupRequest
+	if err := decodeAction(message, &request); err != nil {
+		broadcast <- fmt.Sprintf("Ошибка: неверный формат запроса группы: %v", err)
+		return
+	}
+	group := getDeviceGroup(request.Group)
+	if group == nil {
+		broadcast <- fmt.Sprintf("Ошибка: группа %s не открыта.", request.Group)
+		return
+	}
+	if request.Sync {
+		dispatchGroupSync(group, request.Command)
+		return
+	}
+
+	sent := 0
+	for _, portName := range group.ports {
+		if err := getManagedPort(portName).write([]byte(request.Command + "\n")); err != nil {
+			broadcast <- fmt.Sprintf("Ошибка записи в порт %s группы %s: %v", portName, group.name, err)
+			continue
+		}
+		sent++
+	}
+	broadcast <- fmt.Sprintf("Отправлено группе %s (%d из %d устройств): %s", group.name, sent, len(group.ports), redactLine(request.Command))
+}
+
+// Синхронная отправка команды: все горутины записи ждут общего барьера,
+// после чего одновременно пишут в свои порты
+func dispatchGroupSync(group *deviceGroup, command string) {
+	data := []byte(command + "\n")
+	devices := make([]deviceDispatch, len(group.ports))
+	release := make(chan struct{})
+	ready := &sync.WaitGroup{}
+	done := &sync.WaitGroup{}
+
+	for i, portName := range group.ports {
+		port := getManagedPort(portName)
+		ready.Add(1)
+		done.Add(1)
+		go func(i int, portName string, port *managedPort) {
+			defer done.Done()
+			ready.Done()
+			<-release
+
+			dispatchedAt := time.Now()
+			err := port.write(data)
+			devices[i] = deviceDispatch{
+				Port:         portName,
+				DispatchedAt: dispatchedAt,
+				WriteMicros:  time.Since(dispatchedAt).Microseconds(),
+			}
+			if err != nil {
+				devices[i].Error = err.Error()
+			}
+		}(i, portName, port)
+	}
+
+	// Отпускаем барьер только когда все горутины готовы к записи
+	ready.Wait()
+	releaseAt := time.Now()
+	close(release)
+	done.Wait()
+
+	ack := groupDispatchAck{
+		Type:      "groupDispatch",
+		Group:     group.name,
+		Command:   redactLine(command),
+		ReleaseAt: releaseAt,
+		Devices:   devices,
+	}
+	var first, last time.Time
+	for i := range devices {
+		devices[i].OffsetMicros = devices[i].DispatchedAt.Sub(releaseAt).Microseconds()
+		if first.IsZero() || devices[i].DispatchedAt.Before(first) {
+			first = devices[i].DispatchedAt
+		}
+		if devices[i].DispatchedAt.After(last) {
+			last = devices[i].DispatchedAt
+		}
+	}
+	ack.JitterMicros = last.Sub(first).Microseconds()
+
+	ackData, err := json.Marshal(ack)
+	if err != nil {
+		broadcast <- fmt.Sprintf("Ошибка при маршалинге подтверждения отправки: %v", err)
+		return
+	}
+	broadcast <- string(ackData)
+}
+
+// Закрытие всех портов группы
+func processGroupClose(ws *websocket.Conn, message map[string]interface{}) {
+	var request groupRequest
+	if err := decodeAction(message, &request); err != nil {
+		broadcast <- fmt.Sprintf("Ошибка: неверный формат запроса группы: %v", err)
+		return
+	}
+
+	deviceGroupsMutex.Lock()
+	group, ok := deviceGroups[request.Group]
+	delete(deviceGroups, request.Group)
+	deviceGroupsMutex.Unlock()
+
+	if !ok {
+		broadcast <- fmt.Sprintf("Ошибка: группа %s не открыта.", request.Group)
+		return
+	}
+	for _, p := range group.owned {
+		closeOwnedManagedPort(p)
+	}
+	broadcast <- fmt.Sprintf("Группа %s закрыта.", group.name)
+}
+
+// Получаем открытую группу по имени
+func getDeviceGroup(name string) *deviceGroup {
+	deviceGroupsMutex.Lock()
+	defer deviceGroupsMutex.Unlock()
+
+	return deviceGroups[name]
+}
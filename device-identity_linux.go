@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Каталог с постоянными именами последовательных устройств
+const serialByIDDir = "/dev/serial/by-id"
+
+// Постоянный идентификатор устройства на порту. В Linux это имя ссылки
+// в /dev/serial/by-id, которое содержит серийный номер устройства и не зависит
+// от порядка подключения. Если ссылки нет, используется имя порта.
+func stableDeviceID(port string) string {
+	target, err := filepath.EvalSymlinks(port)
+	if err != nil {
+		return port
+	}
+	entries, err := os.ReadDir(serialByIDDir)
+	if err != nil {
+		return port
+	}
+	for _, entry := range entries {
+		linkTarget, err := filepath.EvalSymlinks(filepath.Join(serialByIDDir, entry.Name()))
+		if err == nil && linkTarget == target {
+			return entry.Name()
+		}
+	}
+	return port
+}
+
+// Идентификаторы производителя и устройства USB (VID и PID в шестнадцатеричном
+// виде), к которому относится порт. Для портов не на USB возвращаются пустые строки.
+func usbVIDPID(port string) (string, string) {
+	device, err := filepath.EvalSymlinks(filepath.Join("/sys/class/tty", filepath.Base(port), "device"))
+	if err != nil {
+		return "", ""
+	}
+	// Поднимаемся от интерфейса к самому устройству USB, у которого есть idVendor
+	for dir := device; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		vid, err := os.ReadFile(filepath.Join(dir, "idVendor"))
+		if err != nil {
+			continue
+		}
+		pid, _ := os.ReadFile(filepath.Join(dir, "idProduct"))
+		return strings.TrimSpace(string(vid)), strings.TrimSpace(string(pid))
+	}
+	return "", ""
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+// Постоянный идентификатор устройства на порту. На этой платформе
+// идентификатор не определяется, поэтому используется имя порта.
+func stableDeviceID(port string) string {
+	return port
+}
+
+// Идентификаторы производителя и устройства USB. На этой платформе не определяются.
+func usbVIDPID(port string) (string, string) {
+	return "", ""
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Имя файла с заметками об устройствах в каталоге данных
+const deviceNotesFile = "device-notes.json"
+
+// Запрос на изменение заметки об устройстве
+type deviceNoteRequest struct {
+	// Порт, на котором сейчас находится устройство
+	Port string `json:"port"`
+	// Постоянный идентификатор устройства, если порт не указан
+	DeviceID string `json:"deviceId"`
+	Note     string `json:"note"`
+}
+
+var (
+	// Заметки об устройствах, ключ - постоянный идентификатор устройства
+	deviceNotes = make(map[string]string)
+	// Мьютекс для синхронизации доступа к deviceNotes
+	deviceNotesMutex = &sync.Mutex{}
+)
+
+func init() {
+	clientActions["setDeviceNote"] = processSetDeviceNote
+}
+
+// Загрузка сохранённых заметок при запуске
+func loadDeviceNotes() {
+	deviceNotesMutex.Lock()
+	defer deviceNotesMutex.Unlock()
+
+	if err := loadJSONFile(deviceNotesFile, &deviceNotes); err != nil {
+		log.Printf("Ошибка загрузки заметок об устройствах: %v", err)
+	}
+}
+
+// Получаем заметку об устройстве по его постоянному идентификатору
+func getDeviceNote(deviceID string) string {
+	deviceNotesMutex.Lock()
+	defer deviceNotesMutex.Unlock()
+
+	return deviceNotes[deviceID]
+}
+
+// Изменение заметки об устройстве. Пустая заметка удаляет запись.
+func processSetDeviceNote(ws *websocket.Conn, message map[string]interface{}) {
+	var request deviceNoteRequest
+	if err := decodeAction(message, &request); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неверный формат запроса заметки: %v", err)}
+		return
+	}
+	deviceID := request.DeviceID
+	if request.Port != "" {
+		deviceID = stableDeviceID(request.Port)
+	}
+	if deviceID == "" {
+		directMessages <- clientMessage{ws, "Ошибка: не указан порт или идентификатор устройства."}
+		return
+	}
+
+	deviceNotesMutex.Lock()
+	if request.Note == "" {
+		delete(deviceNotes, deviceID)
+	} else {
+		deviceNotes[deviceID] = request.Note
+	}
+	err := saveJSONFile(deviceNotesFile, deviceNotes)
+	deviceNotesMutex.Unlock()
+
+	if err != nil {
+		broadcast <- fmt.Sprintf("Ошибка сохранения заметок об устройствах: %v", err)
+	}
+	if data, err := marshalPortMetadata(); err == nil {
+		broadcast <- data
+	}
+}
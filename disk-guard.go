@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Период проверки свободного места
+const diskGuardInterval = 10 * time.Second
+
+var (
+	// Минимальный объём свободного места на диске с данными, МБ. 0 - проверка отключена.
+	minFreeDiskMB uint64
+	// Запись журналов приостановлена из-за нехватки места
+	loggingSuspended atomic.Bool
+	// Число строк, не записанных в журналы из-за нехватки места
+	droppedLogLines atomic.Int64
+)
+
+// Проверяем, достаточно ли места для записи. При нехватке запись журналов
+// приостанавливается, а передача данных клиентам продолжается.
+func checkDiskSpace() error {
+	if minFreeDiskMB == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return err
+	}
+	free, err := diskFreeBytes(dataDir)
+	if err != nil {
+		return err
+	}
+	freeMB := free / 1024 / 1024
+
+	// Возобновляем запись с запасом в 10%, чтобы не переключаться туда и обратно
+	switch {
+	case freeMB < minFreeDiskMB && !loggingSuspended.Load():
+		loggingSuspended.Store(true)
+		msg := fmt.Sprintf("Внимание: свободно %d МБ (порог %d МБ). Запись журналов приостановлена, данные продолжают передаваться клиентам.", freeMB, minFreeDiskMB)
+		log.Println(msg)
+		broadcast <- msg
+	case freeMB >= minFreeDiskMB+minFreeDiskMB/10 && loggingSuspended.Load():
+		loggingSuspended.Store(false)
+		msg := fmt.Sprintf("Свободно %d МБ. Запись журналов возобновлена, пропущено строк: %d.", freeMB, droppedLogLines.Swap(0))
+		log.Println(msg)
+		broadcast <- msg
+	}
+	return nil
+}
+
+// Периодическая проверка свободного места
+func runDiskGuard() {
+	if minFreeDiskMB == 0 {
+		return
+	}
+	for {
+		if err := checkDiskSpace(); err != nil {
+			log.Printf("Ошибка проверки свободного места: %v", err)
+		}
+		time.Sleep(diskGuardInterval)
+	}
+}
+
+// Ошибка, если запись на диск сейчас приостановлена
+func diskWriteAllowed() error {
+	if loggingSuspended.Load() {
+		return fmt.Errorf("недостаточно места на диске (порог %d МБ)", minFreeDiskMB)
+	}
+	return nil
+}
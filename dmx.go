@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Параметры линии DMX512: 250000 бод, 8 бит данных, 2 стоп-бита
+const (
+	dmxBaudRate = 250000
+	dmxFraming  = "8N2"
+	dmxSlots    = 512
+	// Длительность break и mark-after-break (стандарт: не менее 92 и 12 мкс)
+	dmxBreak            = 176 * time.Microsecond
+	dmxMarkAfterBreak   = 12 * time.Microsecond
+	dmxMinFrameInterval = 1204 * time.Microsecond
+)
+
+// Запрос на установку значений каналов DMX
+type dmxRequest struct {
+	Port string `json:"port"`
+	// Значения каналов подряд, начиная с первого
+	Values []int `json:"values"`
+	// Значения отдельных каналов, ключ - номер канала от 1 до 512
+	Channels map[string]int `json:"channels"`
+	// Стартовый код кадра, 0 - данные для световых приборов
+	StartCode int `json:"startCode"`
+	// Период повторной передачи кадра ("25ms"). Пусто - кадр передаётся один раз.
+	Refresh string `json:"refresh"`
+}
+
+// Состояние линии DMX на одном порту
+type dmxUniverse struct {
+	port      string
+	startCode byte
+	slots     [dmxSlots]byte
+	// Число передаваемых каналов
+	length int
+	// Остановка повторной передачи
+	stop chan struct{}
+	// Мьютекс для синхронизации доступа к значениям каналов
+	mutex sync.Mutex
+}
+
+var (
+	// Линии DMX, ключ - имя порта
+	dmxUniverses = make(map[string]*dmxUniverse)
+	// Мьютекс для синхронизации доступа к dmxUniverses
+	dmxUniversesMutex = &sync.Mutex{}
+)
+
+func init() {
+	clientActions["dmxSet"] = processDMXSet
+	clientActions["dmxStop"] = processDMXStop
+}
+
+// Установка значений каналов и передача кадра DMX
+func processDMXSet(ws *websocket.Conn, message map[string]interface{}) {
+	var request dmxRequest
+	if err := decodeAction(message, &request); err != nil {
+		broadcast <- fmt.Sprintf("Ошибка: неверный формат запроса DMX: %v", err)
+		return
+	}
+	if request.Port == "" {
+		request.Port = currentSettings.Port
+	}
+	if err := checkBusPort(request.Port, dmxBaudRate, dmxFraming); err != nil {
+		broadcast <- fmt.Sprintf("Ошибка DMX: %v", err)
+		return
+	}
+	refresh, err := parseOptionalDuration(request.Refresh)
+	if err != nil {
+		broadcast <- fmt.Sprintf("Ошибка: неверный период передачи DMX: %v", err)
+		return
+	}
+	if refresh > 0 && refresh < dmxMinFrameInterval {
+		refresh = dmxMinFrameInterval
+	}
+
+	universe := getDMXUniverse(request.Port)
+	if err := universe.set(request); err != nil {
+		broadcast <- fmt.Sprintf("Ошибка DMX: %v", err)
+		return
+	}
+	if err := universe.send(); err != nil {
+		broadcast <- fmt.Sprintf("Ошибка передачи кадра DMX в порт %s: %v", request.Port, err)
+		return
+	}
+	if refresh > 0 {
+		universe.startRefresh(refresh)
+		broadcast <- fmt.Sprintf("Кадры DMX передаются в порт %s каждые %s.", request.Port, refresh)
+	}
+}
+
+// Остановка повторной передачи кадров DMX
+func processDMXStop(ws *websocket.Conn, message map[string]interface{}) {
+	var request dmxRequest
+	if err := decodeAction(message, &request); err != nil {
+		broadcast <- fmt.Sprintf("Ошибка: неверный формат запроса DMX: %v", err)
+		return
+	}
+	if request.Port == "" {
+		request.Port = currentSettings.Port
+	}
+
+	dmxUniversesMutex.Lock()
+	universe := dmxUniverses[request.Port]
+	delete(dmxUniverses, request.Port)
+	dmxUniversesMutex.Unlock()
+
+	if universe == nil {
+		broadcast <- fmt.Sprintf("Ошибка: передача DMX в порт %s не ведётся.", request.Port)
+		return
+	}
+	universe.stopRefresh()
+	broadcast <- fmt.Sprintf("Передача DMX в порт %s остановлена.", request.Port)
+}
+
+// Проверка того, что порт открыт со скоростью и форматом кадра, которых требует шина
+func checkBusPort(port string, baudRate int, framingName string) error {
+	actualBaudRate, actualFraming, ok := getPortSettings(port)
+	if !ok {
+		return fmt.Errorf("порт %s не открыт", port)
+	}
+	if actualFraming == "" {
+		actualFraming = defaultFraming
+	}
+	if actualBaudRate != baudRate || actualFraming != framingName {
+		return fmt.Errorf("порт %s должен быть открыт со скоростью %d и форматом кадра %s", port, baudRate, framingName)
+	}
+	return nil
+}
+
+// Получаем линию DMX порта, создавая её при необходимости
+func getDMXUniverse(port string) *dmxUniverse {
+	dmxUniversesMutex.Lock()
+	defer dmxUniversesMutex.Unlock()
+
+	universe := dmxUniverses[port]
+	if universe == nil {
+		universe = &dmxUniverse{port: port}
+		dmxUniverses[port] = universe
+	}
+	return universe
+}
+
+// Изменение значений каналов
+func (u *dmxUniverse) set(request dmxRequest) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if request.StartCode < 0 || request.StartCode > 255 {
+		return fmt.Errorf("неверный стартовый код %d", request.StartCode)
+	}
+	if len(request.Values) > dmxSlots {
+		return fmt.Errorf("каналов больше %d", dmxSlots)
+	}
+	u.startCode = byte(request.StartCode)
+	for i, value := range request.Values {
+		if value < 0 || value > 255 {
+			return fmt.Errorf("неверное значение канала %d: %d", i+1, value)
+		}
+		u.slots[i] = byte(value)
+		u.length = max(u.length, i+1)
+	}
+	for key, value := range request.Channels {
+		channel, err := strconv.Atoi(key)
+		if err != nil || channel < 1 || channel > dmxSlots {
+			return fmt.Errorf("неверный номер канала %q", key)
+		}
+		if value < 0 || value > 255 {
+			return fmt.Errorf("неверное значение канала %d: %d", channel, value)
+		}
+		u.slots[channel-1] = byte(value)
+		u.length = max(u.length, channel)
+	}
+	return nil
+}
+
+// Передача кадра: break, mark-after-break, стартовый код и значения каналов
+func (u *dmxUniverse) send() error {
+	u.mutex.Lock()
+	frame := make([]byte, 0, u.length+1)
+	frame = append(frame, u.startCode)
+	frame = append(frame, u.slots[:u.length]...)
+	u.mutex.Unlock()
+
+	// Break и кадр передаются одной операцией, чтобы между ними не вклинилась другая запись
+	return usePortWriter(u.port, len(frame), dmxBreak+dmxMarkAfterBreak, func(conn serialConn) (int, error) {
+		if err := sendBreak(conn, dmxBreak); err != nil {
+			return 0, err
+		}
+		time.Sleep(dmxMarkAfterBreak)
+		return conn.Write(frame)
+	})
+}
+
+// Запуск повторной передачи кадров с заданным периодом
+func (u *dmxUniverse) startRefresh(interval time.Duration) {
+	u.stopRefresh()
+
+	stop := make(chan struct{})
+	u.mutex.Lock()
+	u.stop = stop
+	u.mutex.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := u.send(); err != nil {
+					broadcast <- fmt.Sprintf("Ошибка передачи кадра DMX в порт %s: %v. Передача остановлена.", u.port, err)
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Остановка повторной передачи кадров
+func (u *dmxUniverse) stopRefresh() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.stop != nil {
+		close(u.stop)
+		u.stop = nil
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// Первая строка зашифрованного файла. Каждая следующая строка - отдельная
+// запись: base64 от nonce и зашифрованной AES-GCM строки исходного файла.
+// Поэтому журнал можно дописывать построчно, не перешифровывая его.
+const encryptedFileMagic = "SMENC1"
+
+var (
+	// Файл с ключом шифрования (32 байта в шестнадцатеричном виде)
+	encryptionKeyPath string
+	// Шифр для сохраняемых файлов. Если nil, файлы не шифруются.
+	storageCipher cipher.AEAD
+)
+
+// Загрузка ключа шифрования при запуске
+func loadEncryptionKey() {
+	if encryptionKeyPath == "" {
+		return
+	}
+	data, err := os.ReadFile(encryptionKeyPath)
+	if err != nil {
+		log.Fatalf("Ошибка чтения ключа шифрования: %v", err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		log.Fatal("Ключ шифрования должен содержать 32 байта в шестнадцатеричном виде (например, вывод openssl rand -hex 32).")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		log.Fatalf("Ошибка ключа шифрования: %v", err)
+	}
+	if storageCipher, err = cipher.NewGCM(block); err != nil {
+		log.Fatalf("Ошибка ключа шифрования: %v", err)
+	}
+	log.Println("Сохраняемые журналы, снимки и отчёты шифруются.")
+}
+
+// Шифрование одной строки в запись зашифрованного файла (без перевода строки)
+func encryptRecord(plain []byte) (string, error) {
+	nonce := make([]byte, storageCipher.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(storageCipher.Seal(nonce, nonce, plain, nil)), nil
+}
+
+// Расшифровка одной записи
+func decryptRecord(record string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(record)
+	if err != nil || len(data) < storageCipher.NonceSize() {
+		return nil, errors.New("повреждённая запись зашифрованного файла")
+	}
+	nonce, sealed := data[:storageCipher.NonceSize()], data[storageCipher.NonceSize():]
+	plain, err := storageCipher.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, errors.New("запись не расшифровывается: неверный ключ или файл изменён")
+	}
+	return plain, nil
+}
+
+// Запись сохраняемого файла целиком, с шифрованием, если оно включено
+func writeStoredFile(path string, data []byte) error {
+	if storageCipher == nil {
+		return writeFileSynced(path, data, 0644)
+	}
+	var out bytes.Buffer
+	out.WriteString(encryptedFileMagic + "\n")
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		record, err := encryptRecord(line)
+		if err != nil {
+			return err
+		}
+		out.WriteString(record + "\n")
+	}
+	return writeFileSynced(path, out.Bytes(), 0600)
+}
+
+// Зашифрован ли файл
+func isEncryptedFile(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	header := make([]byte, len(encryptedFileMagic)+1)
+	n, err := io.ReadFull(file, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return string(header[:n]) == encryptedFileMagic+"\n", nil
+}
+
+// Открытие сохранённого файла для чтения. Зашифрованный или сжатый файл
+// расшифровывается и распаковывается на лету.
+func openStoredFile(path string) (io.ReadCloser, error) {
+	if compressed, err := isCompressedFile(path); err != nil {
+		return nil, err
+	} else if compressed {
+		return openCompressedFile(path)
+	}
+	encrypted, err := isEncryptedFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !encrypted {
+		return file, nil
+	}
+	if storageCipher == nil {
+		file.Close()
+		return nil, fmt.Errorf("файл %s зашифрован, а ключ шифрования не задан", path)
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+		scanner.Scan() // заголовок
+		for scanner.Scan() {
+			plain, err := decryptRecord(scanner.Text())
+			if err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+			if _, err := writer.Write(plain); err != nil {
+				return
+			}
+		}
+		writer.CloseWithError(scanner.Err())
+	}()
+	return reader, nil
+}
+
+// Подготовка журнала, открытого для дозаписи. Новый файл при включённом
+// шифровании начинается с заголовка. Дописывать открытые строки в
+// зашифрованный файл и наоборот нельзя.
+func prepareLogEncryption(path string, file *os.File) (bool, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.Size() == 0 {
+		if storageCipher == nil {
+			return false, nil
+		}
+		if err := file.Chmod(0600); err != nil {
+			return false, err
+		}
+		_, err := file.WriteString(encryptedFileMagic + "\n")
+		return err == nil, err
+	}
+
+	encrypted, err := isEncryptedFile(path)
+	if err != nil {
+		return false, err
+	}
+	if encrypted && storageCipher == nil {
+		return false, fmt.Errorf("журнал %s зашифрован, а ключ шифрования не задан", path)
+	}
+	if !encrypted && storageCipher != nil {
+		return false, fmt.Errorf("журнал %s не зашифрован, дописывать его при включённом шифровании нельзя", path)
+	}
+	return encrypted, nil
+}
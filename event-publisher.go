@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Очередь событий для публикации в каталоге данных и положение в ней
+// последнего события, получение которого подтвердил брокер
+const (
+	eventSpoolFile      = "event-spool.jsonl"
+	eventSpoolStateFile = "event-spool.json"
+)
+
+// Типы публикуемых событий
+const (
+	eventData    = "data"
+	eventStatus  = "status"
+	eventTrigger = "trigger"
+)
+
+// Сколько событий отправляется брокеру за раз
+const eventBatchSize = 500
+
+// Обработанная очередь очищается, когда вырастает больше этого размера
+const eventSpoolCompactSize = 1 << 20
+
+// Событие для внешних систем. Доставка - «хотя бы один раз»: после сбоя
+// связи или перезапуска событие может прийти повторно с тем же seq.
+type publishedEvent struct {
+	// Сквозной номер события, по нему потребитель отбрасывает повторы
+	Seq      uint64    `json:"seq"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Instance string    `json:"instance,omitempty"`
+	Port     string    `json:"port"`
+	// Строка порта (data) или строка, на которой сработал триггер (trigger)
+	Line    string `json:"line,omitempty"`
+	Trigger string `json:"trigger,omitempty"`
+	// Состояние устройства (status): absent, present, open, error
+	DeviceID string `json:"deviceId,omitempty"`
+	State    string `json:"state,omitempty"`
+	Removed  bool   `json:"removed,omitempty"`
+}
+
+// Положение в очереди событий
+type eventSpoolState struct {
+	// Смещение первого неподтверждённого события
+	Offset int64 `json:"offset"`
+	// Номер последнего события в очереди
+	Seq uint64 `json:"seq"`
+}
+
+// Брокер, которому публикуются события. publish возвращается без ошибки,
+// только когда брокер подтвердил получение всех событий.
+type eventTarget interface {
+	connect() error
+	publish(events []publishedEvent, payloads [][]byte) error
+	close()
+}
+
+var (
+	// Адреса брокеров для публикации событий
+	natsPublishURL  string
+	redisPublishURL string
+	// Публикуемые типы событий через запятую
+	publishEventTypes = "data,status,trigger"
+	// Наибольший размер очереди неотправленных событий, МБ
+	eventSpoolMaxMB int64 = 100
+
+	publishTypes = make(map[string]bool)
+	// Файл очереди, его размер и номер последнего события
+	eventSpool     *os.File
+	eventSpoolSize int64
+	eventSeq       uint64
+	// Мьютекс для синхронизации доступа к очереди событий
+	eventSpoolMutex = &sync.Mutex{}
+	// Сигнал публикатору о новых событиях
+	eventSpoolSignal = make(chan struct{}, 1)
+	// Сколько событий отброшено из-за переполнения очереди
+	droppedEvents atomic.Int64
+)
+
+// Подготовка очереди событий при запуске, если задан брокер
+func loadEventPublisher() {
+	if natsPublishURL == "" && redisPublishURL == "" {
+		return
+	}
+	if natsPublishURL != "" && redisPublishURL != "" {
+		log.Fatal("Укажите только один из параметров -publish-nats и -publish-redis.")
+	}
+	for _, t := range strings.Split(publishEventTypes, ",") {
+		t = strings.TrimSpace(t)
+		if t != eventData && t != eventStatus && t != eventTrigger {
+			log.Fatalf("Неизвестный тип события %q в -publish-events (data, status, trigger).", t)
+		}
+		publishTypes[t] = true
+	}
+
+	var state eventSpoolState
+	if err := loadJSONFile(eventSpoolStateFile, &state); err != nil {
+		log.Fatalf("Ошибка чтения состояния очереди событий: %v", err)
+	}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		log.Fatalf("Ошибка открытия очереди событий: %v", err)
+	}
+	file, err := os.OpenFile(dataPath(eventSpoolFile), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatalf("Ошибка открытия очереди событий: %v", err)
+	}
+	size, seq, err := recoverEventSpool(file, state.Offset)
+	if err != nil {
+		log.Fatalf("Ошибка чтения очереди событий: %v", err)
+	}
+	eventSpool, eventSpoolSize, eventSeq = file, size, max(seq, state.Seq)
+	if state.Offset > size {
+		state.Offset = 0
+		saveJSONFile(eventSpoolStateFile, state)
+	}
+	if pending := size - state.Offset; pending > 0 {
+		log.Printf("В очереди событий %d байт неотправленных событий.", pending)
+	}
+}
+
+// Обрезка недописанного при сбое события и номер последнего события после offset
+func recoverEventSpool(file *os.File, offset int64) (int64, uint64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	if offset > info.Size() {
+		offset = 0
+	}
+	data := make([]byte, info.Size()-offset)
+	if _, err := file.ReadAt(data, offset); err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+	end := bytes.LastIndexByte(data, '\n') + 1
+	if int64(end) < int64(len(data)) {
+		if err := file.Truncate(offset + int64(end)); err != nil {
+			return 0, 0, err
+		}
+	}
+	var seq uint64
+	if end > 0 {
+		last := data[bytes.LastIndexByte(data[:end-1], '\n')+1 : end]
+		var e publishedEvent
+		if json.Unmarshal(last, &e) == nil {
+			seq = e.Seq
+		}
+	}
+	return offset + int64(end), seq, nil
+}
+
+// Постановка события в очередь публикации
+func publishEvent(e publishedEvent) {
+	if eventSpool == nil || !publishTypes[e.Type] {
+		return
+	}
+	e.Instance = instanceName
+
+	eventSpoolMutex.Lock()
+	eventSeq++
+	e.Seq = eventSeq
+	data, err := json.Marshal(e)
+	if err == nil && eventSpoolSize+int64(len(data))+1 > eventSpoolMaxMB<<20 {
+		err = errors.New("очередь переполнена")
+	}
+	if err == nil {
+		var n int
+		n, err = eventSpool.Write(append(data, '\n'))
+		eventSpoolSize += int64(n)
+	}
+	eventSpoolMutex.Unlock()
+
+	if err != nil {
+		if droppedEvents.Add(1) == 1 {
+			log.Printf("Событие не поставлено в очередь публикации: %v", err)
+		}
+		return
+	}
+	select {
+	case eventSpoolSignal <- struct{}{}:
+	default:
+	}
+}
+
+// Чтение до n событий очереди начиная с offset. Возвращает события, их
+// исходный текст и смещение после последнего из них.
+func readEventBatch(offset int64, n int) ([]publishedEvent, [][]byte, int64, error) {
+	eventSpoolMutex.Lock()
+	size := eventSpoolSize
+	eventSpoolMutex.Unlock()
+	if offset >= size {
+		return nil, nil, offset, nil
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(eventSpool, offset, size-offset))
+	var events []publishedEvent
+	var payloads [][]byte
+	for len(events) < n {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		offset += int64(len(line))
+		var e publishedEvent
+		if err := json.Unmarshal(line, &e); err != nil {
+			log.Printf("Пропущено повреждённое событие в очереди: %v", err)
+			continue
+		}
+		events = append(events, e)
+		payloads = append(payloads, bytes.TrimSuffix(line, []byte("\n")))
+	}
+	return events, payloads, offset, nil
+}
+
+// Очистка полностью отправленной очереди
+func compactEventSpool(state *eventSpoolState) {
+	eventSpoolMutex.Lock()
+	defer eventSpoolMutex.Unlock()
+
+	if state.Offset != eventSpoolSize || eventSpoolSize < eventSpoolCompactSize {
+		return
+	}
+	if err := eventSpool.Truncate(0); err != nil {
+		log.Printf("Ошибка очистки очереди событий: %v", err)
+		return
+	}
+	eventSpoolSize = 0
+	state.Offset = 0
+	state.Seq = eventSeq
+	if err := saveJSONFile(eventSpoolStateFile, state); err != nil {
+		log.Printf("Ошибка сохранения состояния очереди событий: %v", err)
+	}
+}
+
+// Публикация событий из очереди. Положение в очереди сдвигается только после
+// подтверждения брокера, поэтому при обрыве связи события отправляются повторно.
+func runEventPublisher() {
+	if eventSpool == nil {
+		return
+	}
+	var target eventTarget
+	var name string
+	if natsPublishURL != "" {
+		u, err := parseNATSURL(natsPublishURL)
+		if err != nil {
+			log.Fatalf("Неверный адрес -publish-nats: %v", err)
+		}
+		target, name = newNATSEventTarget(u), "NATS "+u.Host
+	} else {
+		u, err := parseRedisURL(redisPublishURL)
+		if err != nil {
+			log.Fatalf("Неверный адрес -publish-redis: %v", err)
+		}
+		redisTarget := newRedisEventTarget(u)
+		if n, err := strconv.Atoi(redisTarget.maxLen); redisTarget.maxLen != "" && (err != nil || n <= 0) {
+			log.Fatalf("Неверное значение maxlen в -publish-redis: %q", redisTarget.maxLen)
+		}
+		target, name = redisTarget, "Redis "+u.Host
+	}
+
+	var state eventSpoolState
+	loadJSONFile(eventSpoolStateFile, &state)
+	delay := ingestReconnectDelay
+	for {
+		if err := target.connect(); err != nil {
+			log.Printf("Публикация событий в %s: %v", name, err)
+			time.Sleep(delay)
+			delay = min(delay*2, maxIngestReconnectDelay)
+			continue
+		}
+		delay = ingestReconnectDelay
+		log.Printf("Публикация событий в %s.", name)
+		err := publishSpool(target, &state)
+		target.close()
+		log.Printf("Публикация событий в %s прервана: %v", name, err)
+		time.Sleep(delay)
+	}
+}
+
+// Отправка очереди брокеру до ошибки соединения
+func publishSpool(target eventTarget, state *eventSpoolState) error {
+	for {
+		events, payloads, next, err := readEventBatch(state.Offset, eventBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(payloads) == 0 {
+			if next != state.Offset {
+				state.Offset = next
+				saveJSONFile(eventSpoolStateFile, state)
+			}
+			compactEventSpool(state)
+			select {
+			case <-eventSpoolSignal:
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		if err := target.publish(events, payloads); err != nil {
+			return err
+		}
+		state.Offset = next
+		state.Seq = events[len(events)-1].Seq
+		if err := saveJSONFile(eventSpoolStateFile, state); err != nil {
+			log.Printf("Ошибка сохранения состояния очереди событий: %v", err)
+		}
+	}
+}
+
+// Публикация в NATS: каждый тип событий - в свою тему (<subject>.data и т. д.).
+// Без JetStream получение подтверждает ответ сервера на PING после пачки
+// событий; с jetstream=1 - подтверждение потока для каждого события.
+type natsEventTarget struct {
+	u         *url.URL
+	subject   string
+	jetstream bool
+	conn      net.Conn
+	reader    *bufio.Reader
+	inbox     string
+}
+
+func newNATSEventTarget(u *url.URL) *natsEventTarget {
+	subject := u.Query().Get("subject")
+	if subject == "" {
+		subject = "serial-monitor.events"
+	}
+	return &natsEventTarget{u: u, subject: subject, jetstream: u.Query().Get("jetstream") == "1"}
+}
+
+func (t *natsEventTarget) connect() error {
+	conn, reader, err := dialNATS(t.u)
+	if err != nil {
+		return err
+	}
+	t.conn, t.reader = conn, reader
+	if t.jetstream {
+		buf := make([]byte, 8)
+		rand.Read(buf)
+		t.inbox = "_INBOX." + hex.EncodeToString(buf)
+		if _, err := io.WriteString(conn, "SUB "+t.inbox+".* 1\r\n"); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *natsEventTarget) close() {
+	t.conn.Close()
+}
+
+func (t *natsEventTarget) publish(events []publishedEvent, payloads [][]byte) error {
+	var b bytes.Buffer
+	for i, e := range events {
+		if t.jetstream {
+			fmt.Fprintf(&b, "PUB %s.%s %s.%d %d\r\n", t.subject, e.Type, t.inbox, i, len(payloads[i]))
+		} else {
+			fmt.Fprintf(&b, "PUB %s.%s %d\r\n", t.subject, e.Type, len(payloads[i]))
+		}
+		b.Write(payloads[i])
+		b.WriteString("\r\n")
+	}
+	b.WriteString("PING\r\n")
+	t.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err := t.conn.Write(b.Bytes()); err != nil {
+		return err
+	}
+
+	pong := false
+	acked := make(map[string]bool)
+	for !pong || t.jetstream && len(acked) < len(events) {
+		line, err := t.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "PONG":
+			pong = true
+		case "PING":
+			if _, err := io.WriteString(t.conn, "PONG\r\n"); err != nil {
+				return err
+			}
+		case "-ERR":
+			return fmt.Errorf("ошибка NATS: %s", strings.TrimSpace(strings.TrimPrefix(line, fields[0])))
+		case "MSG":
+			// Подтверждение JetStream: MSG <адрес ответа> <sid> <размер>
+			if len(fields) != 4 {
+				return fmt.Errorf("неверное сообщение NATS %q", strings.TrimSpace(line))
+			}
+			size, err := strconv.Atoi(fields[3])
+			if err != nil || size < 0 || size > maxNATSPayload {
+				return fmt.Errorf("неверный размер сообщения NATS %q", strings.TrimSpace(line))
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(t.reader, payload); err != nil {
+				return err
+			}
+			var ack struct {
+				Error *struct {
+					Description string `json:"description"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(payload[:size], &ack); err != nil || ack.Error != nil {
+				if ack.Error != nil {
+					err = errors.New(ack.Error.Description)
+				}
+				return fmt.Errorf("JetStream не принял событие: %v", err)
+			}
+			acked[fields[1]] = true
+		}
+	}
+	return nil
+}
+
+// Публикация в поток Redis (XADD): поля type и event с JSON события.
+// Получение подтверждает идентификатор записи в ответе на каждую команду.
+type redisEventTarget struct {
+	u      *url.URL
+	stream string
+	// Приблизительная наибольшая длина потока (MAXLEN ~), 0 - без ограничения
+	maxLen string
+	conn   *redisConn
+}
+
+func newRedisEventTarget(u *url.URL) *redisEventTarget {
+	stream := u.Query().Get("stream")
+	if stream == "" {
+		stream = "serial-monitor:events"
+	}
+	return &redisEventTarget{u: u, stream: stream, maxLen: u.Query().Get("maxlen")}
+}
+
+func (t *redisEventTarget) connect() error {
+	conn, err := dialRedis(t.u)
+	if err != nil {
+		return err
+	}
+	t.conn = conn
+	return nil
+}
+
+func (t *redisEventTarget) close() {
+	t.conn.conn.Close()
+}
+
+func (t *redisEventTarget) publish(events []publishedEvent, payloads [][]byte) error {
+	// Команды отправляются одной пачкой, ответы читаются по порядку
+	var b strings.Builder
+	for i, e := range events {
+		args := []string{"XADD", t.stream}
+		if t.maxLen != "" {
+			args = append(args, "MAXLEN", "~", t.maxLen)
+		}
+		args = append(args, "*", "type", e.Type, "event", string(payloads[i]))
+		fmt.Fprintf(&b, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	t.conn.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err := io.WriteString(t.conn.conn, b.String()); err != nil {
+		return err
+	}
+	for range events {
+		if _, err := t.conn.read(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Размер очереди строк одного подписчика
+const lineSubscriptionBuffer = 1024
+
+// Подписка на строки порта. Строки копятся в очереди, пока их не прочитают,
+// поэтому ответ устройства не теряется, даже если пришёл раньше вызова expect.
+type lineSubscription struct {
+	port  string
+	lines chan string
+}
+
+var (
+	// Подписчики на строки портов, ключ - имя порта
+	lineSubscriptions = make(map[string]map[*lineSubscription]bool)
+	// Мьютекс для синхронизации доступа к lineSubscriptions
+	lineSubscriptionsMutex = &sync.Mutex{}
+)
+
+// Подписываемся на строки порта
+func subscribeLines(port string) *lineSubscription {
+	sub := &lineSubscription{port: port, lines: make(chan string, lineSubscriptionBuffer)}
+
+	lineSubscriptionsMutex.Lock()
+	defer lineSubscriptionsMutex.Unlock()
+
+	if lineSubscriptions[port] == nil {
+		lineSubscriptions[port] = make(map[*lineSubscription]bool)
+	}
+	lineSubscriptions[port][sub] = true
+	return sub
+}
+
+// Отменяем подписку на строки порта
+func (sub *lineSubscription) close() {
+	lineSubscriptionsMutex.Lock()
+	defer lineSubscriptionsMutex.Unlock()
+
+	delete(lineSubscriptions[sub.port], sub)
+	if len(lineSubscriptions[sub.port]) == 0 {
+		delete(lineSubscriptions, sub.port)
+	}
+}
+
+// Передаём строку порта подписчикам. Если очередь подписчика заполнена, строка для него теряется.
+func dispatchLineSubscriptions(port, line string) {
+	lineSubscriptionsMutex.Lock()
+	defer lineSubscriptionsMutex.Unlock()
+
+	for sub := range lineSubscriptions[port] {
+		select {
+		case sub.lines <- line:
+		default:
+		}
+	}
+}
+
+// Ожидание строки, совпадающей с регулярным выражением. Несовпадающие строки пропускаются.
+// Возвращает строку и группы совпадения.
+func (sub *lineSubscription) expect(re *regexp.Regexp, timeout time.Duration) (string, []string, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		select {
+		case line := <-sub.lines:
+			if match := re.FindStringSubmatch(line); match != nil {
+				return line, match, nil
+			}
+		case <-deadline.C:
+			return "", nil, fmt.Errorf("за %v не получена строка, совпадающая с %q", timeout, re.String())
+		}
+	}
+}
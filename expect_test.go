@@ -0,0 +1,48 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+// Шаг с ожиданием строки: любое выражение и любая строка дают вердикт, а не
+// панику; совпавшая строка принимается, значение вне границ - нет
+func FuzzExpectStep(f *testing.F) {
+	f.Add(`TEMP (\d+\.\d+)`, "TEMP 23.5", true, 20.0, 30.0)
+	f.Add(`TEMP (\d+)`, "TEMP 99", true, 0.0, 50.0)
+	f.Add(`READY`, "ECHO READY", false, 0.0, 0.0)
+	f.Add(`(`, "x", false, 0.0, 0.0)
+	f.Add(`(?P<v>.*)`, "", true, -1.0, 1.0)
+	f.Fuzz(func(t *testing.T, pattern, line string, bounds bool, low, high float64) {
+		const port = "fuzz-expect"
+		sub := subscribeLines(port)
+		defer sub.close()
+		dispatchLineSubscriptions(port, line)
+
+		step := testStep{Expect: pattern, Timeout: "10ms"}
+		if bounds {
+			step.Min, step.Max = &low, &high
+		}
+		result := runStep(sub, port, step)
+		if result.Verdict != verdictPass && result.Verdict != verdictFail {
+			t.Fatalf("неизвестный вердикт %q", result.Verdict)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			if pattern != "" && result.Verdict != verdictFail {
+				t.Fatalf("неверное выражение %q принято", pattern)
+			}
+			return
+		}
+		matched := pattern == "" || re.MatchString(line)
+		if !matched && result.Verdict == verdictPass {
+			t.Fatalf("строка %q не совпадает с %q, но шаг пройден", line, pattern)
+		}
+		if matched && !bounds && result.Verdict != verdictPass {
+			t.Fatalf("строка %q совпадает с %q, но шаг не пройден: %s", line, pattern, result.Message)
+		}
+		if result.Verdict == verdictPass && result.Value != nil && (*result.Value < low || *result.Value > high) {
+			t.Fatalf("значение %g вне границ [%g, %g] принято", *result.Value, low, high)
+		}
+	})
+}
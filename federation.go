@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Пауза перед повторным подключением к удалённому монитору
+const remoteReconnectDelay = 5 * time.Second
+
+// Удалённый экземпляр монитора, порты которого показываются рядом с локальными
+type remoteMonitor struct {
+	name string
+	url  string
+
+	// Соединение и список портов удалённого монитора
+	conn  *websocket.Conn
+	ports []string
+	mutex sync.Mutex
+	// Мьютекс для синхронизации записи в соединение
+	writeMutex sync.Mutex
+}
+
+// Список удалённых мониторов из параметров запуска ("lab2=ws://host:8080/serialmonitor")
+type remoteFlags []string
+
+func (f *remoteFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *remoteFlags) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return fmt.Errorf("ожидается имя=адрес, получено %q", value)
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+var (
+	// Удалённые мониторы из параметров запуска
+	remoteMonitorFlags remoteFlags
+	// Удалённые мониторы, ключ - имя
+	remoteMonitors = make(map[string]*remoteMonitor)
+)
+
+// Запуск подключений к удалённым мониторам
+func startRemoteMonitors() {
+	for _, value := range remoteMonitorFlags {
+		name, url, _ := strings.Cut(value, "=")
+		remote := &remoteMonitor{name: name, url: url}
+		remoteMonitors[name] = remote
+		go remote.run()
+	}
+}
+
+// Имя порта удалённого монитора в общем списке: "COM3@lab2"
+func remotePortName(remote, port string) string {
+	return port + "@" + remote
+}
+
+// Разбор имени порта удалённого монитора
+func parseRemotePort(name string) (*remoteMonitor, string, bool) {
+	i := strings.LastIndex(name, "@")
+	if i < 0 {
+		return nil, "", false
+	}
+	remote, ok := remoteMonitors[name[i+1:]]
+	return remote, name[:i], ok
+}
+
+// Порты всех удалённых мониторов
+func getRemotePortNames() []string {
+	var ports []string
+	for _, remote := range remoteMonitors {
+		remote.mutex.Lock()
+		for _, port := range remote.ports {
+			ports = append(ports, remotePortName(remote.name, port))
+		}
+		remote.mutex.Unlock()
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+// Поддержание подключения к удалённому монитору
+func (r *remoteMonitor) run() {
+	for {
+		conn, _, err := websocket.DefaultDialer.Dial(r.url, nil)
+		if err != nil {
+			log.Printf("Ошибка подключения к удалённому монитору %s: %v", r.name, err)
+			time.Sleep(remoteReconnectDelay)
+			continue
+		}
+		log.Printf("Подключение к удалённому монитору %s установлено.", r.name)
+		r.mutex.Lock()
+		r.conn = conn
+		r.mutex.Unlock()
+
+		r.readMessages(conn)
+
+		r.mutex.Lock()
+		r.conn = nil
+		r.ports = nil
+		r.mutex.Unlock()
+		conn.Close()
+		sendPortList()
+		broadcast <- fmt.Sprintf("Соединение с удалённым монитором %s потеряно.", r.name)
+		time.Sleep(remoteReconnectDelay)
+	}
+}
+
+// Приём сообщений удалённого монитора до разрыва соединения
+func (r *remoteMonitor) readMessages(conn *websocket.Conn) {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			log.Printf("Ошибка чтения от удалённого монитора %s: %v", r.name, err)
+			return
+		}
+		msg := string(data)
+
+		// Список портов удалённый монитор присылает JSON-массивом строк
+		var ports []string
+		if strings.HasPrefix(msg, "[") && json.Unmarshal(data, &ports) == nil {
+			r.mutex.Lock()
+			r.ports = ports
+			r.mutex.Unlock()
+			sendPortList()
+			continue
+		}
+
+		// Если выбран порт этого монитора, его вывод передаётся без изменений,
+		// как вывод локального основного порта. Структурированные сообщения
+		// тоже передаются без изменений, чтобы клиенты могли их разобрать.
+		if remote, _, ok := parseRemotePort(currentSettings.Port); (ok && remote == r) || strings.HasPrefix(msg, "{") {
+			broadcast <- msg
+		} else {
+			broadcast <- fmt.Sprintf("[%s] %s", r.name, msg)
+		}
+	}
+}
+
+// Отправка сообщения удалённому монитору
+func (r *remoteMonitor) send(message map[string]interface{}) error {
+	r.mutex.Lock()
+	conn := r.conn
+	r.mutex.Unlock()
+	if conn == nil {
+		return fmt.Errorf("нет соединения с удалённым монитором %s", r.name)
+	}
+
+	r.writeMutex.Lock()
+	defer r.writeMutex.Unlock()
+
+	return conn.WriteJSON(message)
+}
+
+// Выбор порта и скорости на удалённом мониторе
+func (r *remoteMonitor) openPort(port string, baudRate int) error {
+	return r.send(map[string]interface{}{"port": port, "baudRate": strconv.Itoa(baudRate)})
+}
+
+// Отправка команды в выбранный порт удалённого монитора
+func (r *remoteMonitor) sendCommand(command string) error {
+	return r.send(map[string]interface{}{"command": command})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// Фрагмент необработанных данных порта
+type flightChunk struct {
+	time time.Time
+	data []byte
+}
+
+// Кольцевой буфер необработанных данных одного порта
+type flightBuffer struct {
+	chunks []flightChunk
+	size   int
+}
+
+// Запрос на сохранение буфера порта
+type flightDumpRequest struct {
+	Port string `json:"port"`
+}
+
+var (
+	// Режим «бортового самописца»: сколько последних данных каждого порта
+	// хранить в памяти (0 - режим выключен) и наибольший размер буфера порта, МБ
+	flightWindow time.Duration
+	flightMaxMB  int64
+	// Буферы портов, ключ - имя порта
+	flightBuffers = make(map[string]*flightBuffer)
+	// Мьютекс для синхронизации доступа к flightBuffers
+	flightMutex = &sync.Mutex{}
+)
+
+func init() {
+	clientActions["flightDump"] = processFlightDump
+}
+
+// Запоминаем прочитанные из порта байты до обработки сеансом
+func recordFlight(port string, data []byte, t time.Time) {
+	if flightWindow == 0 {
+		return
+	}
+	flightMutex.Lock()
+	defer flightMutex.Unlock()
+
+	b := flightBuffers[port]
+	if b == nil {
+		b = &flightBuffer{}
+		flightBuffers[port] = b
+	}
+	b.chunks = append(b.chunks, flightChunk{time: t, data: append([]byte(nil), data...)})
+	b.size += len(data)
+
+	// Отбрасываем данные старше окна и сверх предельного размера
+	first := 0
+	for first < len(b.chunks)-1 && (t.Sub(b.chunks[first].time) > flightWindow || b.size > int(flightMaxMB)<<20) {
+		b.size -= len(b.chunks[first].data)
+		first++
+	}
+	b.chunks = b.chunks[first:]
+}
+
+// Сохранение буфера порта на диск при срабатывании триггера, отключении
+// устройства или ошибке чтения. Сохранённые данные из буфера удаляются,
+// поэтому повторное событие сохраняет только новые данные.
+func dumpFlightRecorder(port, reason string) {
+	if flightWindow == 0 {
+		return
+	}
+	flightMutex.Lock()
+	b := flightBuffers[port]
+	delete(flightBuffers, port)
+	flightMutex.Unlock()
+
+	if b == nil || len(b.chunks) == 0 {
+		return
+	}
+	name := fmt.Sprintf("flight_%s_%s.log",
+		unsafeFileChars.ReplaceAllString(filepath.Base(port), "_"),
+		time.Now().Format("20060102-150405.000"))
+	path := dataPath(filepath.Join(namespacedDir(snapshotsDir, port), name))
+	if err := writeFlightFile(path, port, reason, b.chunks); err != nil {
+		broadcast <- fmt.Sprintf("Ошибка сохранения данных самописца порта %s: %v", port, err)
+		return
+	}
+	broadcast <- fmt.Sprintf("Данные самописца порта %s сохранены (%s): %s", port, reason, path)
+}
+
+// Запись буфера в формате журнала порта. Байты собираются в строки; строка
+// получает время фрагмента, которым она завершилась. Буфер хранит байты как
+// есть, поэтому правила скрытия применяются к каждой собранной строке, как
+// к строкам журнала. Непечатаемые байты записываются escape-последовательностями.
+func writeFlightFile(path, port, reason string, chunks []flightChunk) error {
+	if err := diskWriteAllowed(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	w := &bytes.Buffer{}
+	// Служебные строки получают время начала данных, чтобы время в файле не убывало
+	comment := func(text string) {
+		fmt.Fprintf(w, "%s\t# %s\n", chunks[0].time.Format(logTimeFormat), text)
+	}
+	comment(fmt.Sprintf("Самописец: порт %s, причина: %s", port, reason))
+	comment(fmt.Sprintf("Данные с %s по %s", chunks[0].time.Format(logTimeFormat), chunks[len(chunks)-1].time.Format(logTimeFormat)))
+	comment("Идентификаторы сеанса: " + sessionTagsJSON(port))
+	line := func(t time.Time, data []byte) {
+		fmt.Fprintf(w, "%s\t%s\n", t.Format(logTimeFormat), escapeFlightLine([]byte(redactLine(string(data)))))
+	}
+
+	var pending []byte
+	for _, chunk := range chunks {
+		pending = append(pending, chunk.data...)
+		for {
+			i := bytes.IndexByte(pending, '\n')
+			if i < 0 {
+				break
+			}
+			line(chunk.time, bytes.TrimSuffix(pending[:i], []byte("\r")))
+			pending = pending[i+1:]
+		}
+	}
+	if len(pending) > 0 {
+		line(chunks[len(chunks)-1].time, pending)
+	}
+	return writeStoredFile(path, w.Bytes())
+}
+
+// Текст строки с экранированием непечатаемых байтов и неверного UTF-8
+func escapeFlightLine(line []byte) string {
+	if utf8.Valid(line) && !bytes.ContainsFunc(line, func(r rune) bool { return r < 0x20 && r != '\t' || r == 0x7f }) {
+		return string(line)
+	}
+	quoted := strconv.QuoteToGraphic(string(line))
+	return quoted[1 : len(quoted)-1]
+}
+
+// Сохранение буфера порта по запросу клиента
+func processFlightDump(ws *websocket.Conn, message map[string]interface{}) {
+	var request flightDumpRequest
+	if err := decodeAction(message, &request); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неверный формат запроса: %v", err)}
+		return
+	}
+	if flightWindow == 0 {
+		directMessages <- clientMessage{ws, "Ошибка: режим самописца не включён (-flight-recorder)."}
+		return
+	}
+	if request.Port == "" {
+		request.Port = currentSettings.Port
+	}
+	flightMutex.Lock()
+	b := flightBuffers[request.Port]
+	empty := b == nil || len(b.chunks) == 0
+	flightMutex.Unlock()
+	if empty {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Нет данных самописца для порта %s.", request.Port)}
+		return
+	}
+	dumpFlightRecorder(request.Port, "запрос пользователя "+clientIdentity(ws))
+}
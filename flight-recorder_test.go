@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Правило скрытия на время теста
+func useTestRedaction(tb testing.TB, pattern string) {
+	rule := &redactionRule{Name: "test", Pattern: pattern}
+	if err := rule.compile(); err != nil {
+		tb.Fatal(err)
+	}
+	previous := redactionRules
+	redactionRules = []*redactionRule{rule}
+	tb.Cleanup(func() { redactionRules = previous })
+}
+
+// Строки самописца скрываются так же, как строки журнала, даже если
+// конфиденциальные данные пришли в разных фрагментах
+func TestWriteFlightFileRedacts(t *testing.T) {
+	useTestRedaction(t, `password=\S+`)
+	now := time.Now()
+	chunks := []flightChunk{
+		{now, []byte("login pass")},
+		{now, []byte("word=hunter2\r\nok\n")},
+		{now, []byte("password=tail")},
+	}
+	path := filepath.Join(t.TempDir(), "flight.log")
+	if err := writeFlightFile(path, "/dev/ttyUSB0", "test", chunks); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(data)
+	if strings.Contains(text, "hunter2") || strings.Contains(text, "tail") {
+		t.Fatalf("конфиденциальные данные попали в файл самописца:\n%s", text)
+	}
+	if strings.Count(text, defaultRedactionReplacement) != 2 || !strings.Contains(text, "\tok\n") {
+		t.Fatalf("неожиданное содержимое файла самописца:\n%s", text)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tarm/serial"
+)
+
+// Формат кадра по умолчанию
+const defaultFraming = "8N1"
+
+// Запись формата кадра: биты данных, чётность, стоп-биты ("8N1", "7E1", "8M1", "8S2")
+var framingPattern = regexp.MustCompile(`^([5-8])([NOEMS])(1|1\.5|2)$`)
+
+// Формат кадра последовательного порта
+type framing struct {
+	DataBits byte
+	Parity   serial.Parity
+	StopBits serial.StopBits
+}
+
+// Соединение с последовательным портом
+type serialConn interface {
+	io.ReadWriteCloser
+}
+
+// Порт, у которого можно менять чётность без закрытия (для 9-битной адресации)
+type parityController interface {
+	setParity(parity serial.Parity) error
+}
+
+// Порт, у которого можно менять формат кадра без закрытия
+type framingController interface {
+	setFraming(f framing) error
+}
+
+// Порт, умеющий передавать сигнал break
+type breakSender interface {
+	sendBreak(d time.Duration) error
+}
+
+// Запрос на отправку кадра с адресными байтами и управлением линией
+type frameRequest struct {
+	Port string `json:"port"`
+	// Длительность сигнала break перед кадром ("25ms") и пауза после него
+	Break string `json:"break"`
+	Idle  string `json:"idle"`
+	// Адресные байты (9-й бит = 1) и байты данных (9-й бит = 0) в шестнадцатеричном виде
+	Address string `json:"address"`
+	Data    string `json:"data"`
+}
+
+func init() {
+	clientActions["sendFrame"] = processSendFrame
+}
+
+// Разбор формата кадра. Пустая строка означает 8N1.
+func parseFraming(s string) (framing, error) {
+	if s == "" {
+		s = defaultFraming
+	}
+	m := framingPattern.FindStringSubmatch(s)
+	if m == nil {
+		return framing{}, fmt.Errorf("неверный формат кадра %q, ожидается, например, 8N1 или 7E1", s)
+	}
+	dataBits, _ := strconv.Atoi(m[1])
+	f := framing{DataBits: byte(dataBits), Parity: serial.Parity(m[2][0])}
+	switch m[3] {
+	case "1":
+		f.StopBits = serial.Stop1
+	case "1.5":
+		f.StopBits = serial.Stop1Half
+	default:
+		f.StopBits = serial.Stop2
+	}
+	return f, nil
+}
+
+// Время передачи одного символа: стартовый бит, биты данных, бит чётности и стоп-биты
+func (f framing) charTime(baudRate int) time.Duration {
+	bits := 1 + float64(f.DataBits)
+	if f.Parity != serial.ParityNone {
+		bits++
+	}
+	switch f.StopBits {
+	case serial.Stop1Half:
+		bits += 1.5
+	case serial.Stop2:
+		bits += 2
+	default:
+		bits++
+	}
+	return time.Duration(bits * float64(time.Second) / float64(baudRate))
+}
+
+// Используется ли чётность "всегда 1" или "всегда 0"
+func (f framing) stickParity() bool {
+	return f.Parity == serial.ParityMark || f.Parity == serial.ParitySpace
+}
+
+// Открываем последовательный порт с заданным форматом кадра
+func openSerialConn(name string, baudRate int, framingName string, readTimeout time.Duration) (serialConn, error) {
+	f, err := parseFraming(framingName)
+	if err != nil {
+		return nil, err
+	}
+	if nativePortRequired(baudRate, f) {
+		return openNativePort(name, baudRate, f, readTimeout)
+	}
+	return serial.OpenPort(&serial.Config{
+		Name:        name,
+		Baud:        baudRate,
+		Size:        f.DataBits,
+		Parity:      f.Parity,
+		StopBits:    f.StopBits,
+		ReadTimeout: readTimeout,
+	})
+}
+
+// Передача сигнала break, если порт это поддерживает
+func sendBreak(conn serialConn, d time.Duration) error {
+	bs, ok := conn.(breakSender)
+	if !ok {
+		return errors.New("сигнал break на этом порту не поддерживается")
+	}
+	return bs.sendBreak(d)
+}
+
+// Скорость и формат кадра открытого порта
+func getPortSettings(name string) (baudRate int, framing string, ok bool) {
+	if p := getManagedPort(name); p != nil {
+		return p.baudRate, p.framing, true
+	}
+
+	serialPortMutex.Lock()
+	defer serialPortMutex.Unlock()
+
+	if name == currentSettings.Port && serialPort != nil {
+		return currentSettings.BaudRate, currentSettings.Framing, true
+	}
+	return 0, "", false
+}
+
+// Смена формата кадра открытого порта. Если драйвер порта не умеет менять
+// формат на лету, основной порт переоткрывается, а для дополнительного
+// возвращается ошибка.
+func changePortFraming(name, framingName string) (reopened bool, err error) {
+	f, err := parseFraming(framingName)
+	if err != nil {
+		return false, err
+	}
+	if p := getManagedPort(name); p != nil {
+		controller, ok := p.port.(framingController)
+		if !ok {
+			return false, fmt.Errorf("формат кадра порта %s задаётся только при открытии", name)
+		}
+		if err := controller.setFraming(f); err != nil {
+			return false, err
+		}
+		managedPortsMutex.Lock()
+		p.framing = framingName
+		managedPortsMutex.Unlock()
+		return false, nil
+	}
+
+	serialPortMutex.Lock()
+	if name != currentSettings.Port || serialPort == nil {
+		serialPortMutex.Unlock()
+		return false, fmt.Errorf("порт %s не открыт", name)
+	}
+	if controller, ok := serialPort.(framingController); ok {
+		err := controller.setFraming(f)
+		if err == nil {
+			currentSettings.Framing = framingName
+		}
+		serialPortMutex.Unlock()
+		return false, err
+	}
+	serialPortMutex.Unlock()
+
+	currentSettings.Framing = framingName
+	reconnectSerialPort()
+	return true, nil
+}
+
+// Отправка кадра: break, адресные байты с 9-м битом, равным 1, и данные с 9-м битом, равным 0.
+// 9-й бит передаётся битом чётности, поэтому для адресации порт открывается с форматом 8M1 или 8S1.
+func processSendFrame(ws *websocket.Conn, message map[string]interface{}) {
+	var request frameRequest
+	if err := decodeAction(message, &request); err != nil {
+		broadcast <- fmt.Sprintf("Ошибка: неверный формат запроса кадра: %v", err)
+		return
+	}
+	if request.Port == "" {
+		request.Port = currentSettings.Port
+	}
+	if err := sendFrame(request); err != nil {
+		broadcast <- fmt.Sprintf("Ошибка отправки кадра в порт %s: %v", request.Port, err)
+		return
+	}
+	broadcast <- fmt.Sprintf("Кадр отправлен в порт %s.", request.Port)
+}
+
+// Отправка кадра в открытый порт
+func sendFrame(request frameRequest) error {
+	breakDuration, err := parseOptionalDuration(request.Break)
+	if err != nil {
+		return err
+	}
+	idle, err := parseOptionalDuration(request.Idle)
+	if err != nil {
+		return err
+	}
+	address, err := hex.DecodeString(request.Address)
+	if err != nil {
+		return fmt.Errorf("неверные адресные байты: %v", err)
+	}
+	data, err := hex.DecodeString(request.Data)
+	if err != nil {
+		return fmt.Errorf("неверные байты данных: %v", err)
+	}
+
+	// После кадра порту возвращается чётность из его формата кадра, чтобы
+	// следующие записи шли с ней, а не с чётностью байтов данных
+	_, framingName, _ := getPortSettings(request.Port)
+	configured, err := parseFraming(framingName)
+	if err != nil {
+		return err
+	}
+
+	// Break, пауза, адрес и данные передаются одной операцией, чтобы между
+	// ними не вклинилась другая запись в порт
+	return usePortWriter(request.Port, len(address)+len(data), breakDuration+idle, func(conn serialConn) (written int, err error) {
+		pc, ninthBit := conn.(parityController)
+		if len(address) > 0 && !ninthBit {
+			return 0, errors.New("адресация 9-м битом на этом порту не поддерживается, откройте порт с форматом 8M1 или 8S1")
+		}
+
+		if breakDuration > 0 {
+			if err := sendBreak(conn, breakDuration); err != nil {
+				return 0, err
+			}
+		}
+		time.Sleep(idle)
+		if len(address) > 0 {
+			defer func() {
+				if restoreErr := pc.setParity(configured.Parity); restoreErr != nil && err == nil {
+					err = fmt.Errorf("не удалось вернуть чётность порта: %v", restoreErr)
+				}
+			}()
+			if err := pc.setParity(serial.ParityMark); err != nil {
+				return 0, err
+			}
+			n, err := conn.Write(address)
+			written += n
+			if err != nil {
+				return written, err
+			}
+			if err := pc.setParity(serial.ParitySpace); err != nil {
+				return written, err
+			}
+		}
+		if len(data) > 0 {
+			n, err := conn.Write(data)
+			written += n
+			if err != nil {
+				return written, err
+			}
+		}
+		return written, nil
+	})
+}
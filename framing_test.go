@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tarm/serial"
+)
+
+func TestParseFraming(t *testing.T) {
+	tests := []struct {
+		in   string
+		want framing
+	}{
+		{"", framing{8, serial.ParityNone, serial.Stop1}},
+		{"8N1", framing{8, serial.ParityNone, serial.Stop1}},
+		{"7E1", framing{7, serial.ParityEven, serial.Stop1}},
+		{"5O1.5", framing{5, serial.ParityOdd, serial.Stop1Half}},
+		{"8M2", framing{8, serial.ParityMark, serial.Stop2}},
+		{"8S1", framing{8, serial.ParitySpace, serial.Stop1}},
+	}
+	for _, tt := range tests {
+		got, err := parseFraming(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("parseFraming(%q) = %+v, %v; ожидалось %+v", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"9N1", "8X1", "8N3", "8n1", " 8N1", "8N1\n", "8N1.5.1"} {
+		if _, err := parseFraming(in); err == nil {
+			t.Errorf("parseFraming(%q): ожидалась ошибка", in)
+		}
+	}
+}
+
+// Любой принятый формат кадра описывает кадр, который порт может передать
+func FuzzParseFraming(f *testing.F) {
+	for _, seed := range []string{"", "8N1", "7E1", "5O1.5", "8M2", "8S1", "9N1", "8N", "8N1.5x"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		got, err := parseFraming(s)
+		if err != nil {
+			return
+		}
+		if got.DataBits < 5 || got.DataBits > 8 {
+			t.Fatalf("%q: битов данных %d", s, got.DataBits)
+		}
+		switch got.Parity {
+		case serial.ParityNone, serial.ParityOdd, serial.ParityEven, serial.ParityMark, serial.ParitySpace:
+		default:
+			t.Fatalf("%q: неизвестная чётность %q", s, got.Parity)
+		}
+		switch got.StopBits {
+		case serial.Stop1, serial.Stop1Half, serial.Stop2:
+		default:
+			t.Fatalf("%q: неизвестное число стоп-битов %d", s, got.StopBits)
+		}
+		// Символ - от 7 (5N1) до 12 (8E2) битов
+		if ct := got.charTime(1000); ct < 7*1000000 || ct > 12*1000000 {
+			t.Fatalf("%q: время символа на 1000 бод %v", s, ct)
+		}
+	})
+}
+
+// Порт с управляемой чётностью, запись данных в который может завершаться ошибкой
+type parityTestConn struct {
+	parity   serial.Parity
+	failData bool
+}
+
+func (c *parityTestConn) Read(b []byte) (int, error) { return 0, nil }
+func (c *parityTestConn) Close() error               { return nil }
+
+func (c *parityTestConn) Write(b []byte) (int, error) {
+	if c.failData && c.parity == serial.ParitySpace {
+		return 0, errors.New("обрыв линии")
+	}
+	return len(b), nil
+}
+
+func (c *parityTestConn) setParity(parity serial.Parity) error {
+	c.parity = parity
+	return nil
+}
+
+// После кадра с адресными байтами порту возвращается чётность его формата
+// кадра, в том числе когда запись данных не удалась
+func TestSendFrameRestoresParity(t *testing.T) {
+	const name = "/dev/ttyTEST4"
+	conn := &parityTestConn{parity: serial.ParityMark}
+	managedPortsMutex.Lock()
+	managedPorts[name] = &managedPort{name: name, port: conn, framing: "8M1"}
+	managedPortsMutex.Unlock()
+	p := startPortPipeline(name, 0, conn, &portSession{port: name})
+	go p.writeLoop()
+	t.Cleanup(func() {
+		p.stop()
+		managedPortsMutex.Lock()
+		delete(managedPorts, name)
+		managedPortsMutex.Unlock()
+	})
+
+	if err := sendFrame(frameRequest{Port: name, Address: "01", Data: "0203"}); err != nil {
+		t.Fatal(err)
+	}
+	if conn.parity != serial.ParityMark {
+		t.Errorf("после кадра чётность %q", conn.parity)
+	}
+
+	conn.failData = true
+	if err := sendFrame(frameRequest{Port: name, Address: "01", Data: "0203"}); err == nil {
+		t.Error("ошибка записи данных не возвращена")
+	}
+	if conn.parity != serial.ParityMark {
+		t.Errorf("после ошибки чётность %q", conn.parity)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Строка эталонной расшифровки:
+//
+//	текст       - строка должна совпасть точно
+//	re:шаблон   - строка должна совпасть с регулярным выражением
+//	glob:шаблон - шаблон с символами * (любые символы) и ? (один символ)
+//	...         - любое количество строк до совпадения со следующей строкой эталона
+type goldenLine struct {
+	number int
+	source string
+	skip   bool
+	re     *regexp.Regexp
+}
+
+// Запрос на сверку вывода порта с эталоном
+type verifyRequest struct {
+	Port string `json:"port"`
+	// Эталон текстом или путём к файлу
+	Golden     string `json:"golden"`
+	GoldenFile string `json:"goldenFile"`
+	// Время, за которое должен быть получен весь эталон, например "30s"
+	Timeout string `json:"timeout"`
+}
+
+// Результат сверки
+type verifyResult struct {
+	Type   string `json:"type"`
+	Port   string `json:"port"`
+	Status string `json:"status"`
+	// Номер строки эталона, на которой обнаружено расхождение
+	GoldenLine int    `json:"goldenLine,omitempty"`
+	Expected   string `json:"expected,omitempty"`
+	// Полученная строка и её номер среди строк, пришедших с начала сверки
+	Actual       string `json:"actual,omitempty"`
+	ReceivedLine int    `json:"receivedLine,omitempty"`
+	Reason       string `json:"reason,omitempty"`
+	// Идентификаторы изделия, к которому относится результат
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// Сверка вывода одного порта с эталоном
+type goldenVerifier struct {
+	port     string
+	lines    []goldenLine
+	position int
+	received int
+	timer    *time.Timer
+}
+
+var (
+	// Активные сверки, ключ - имя порта
+	goldenVerifiers = make(map[string]*goldenVerifier)
+	// Мьютекс для синхронизации доступа к goldenVerifiers
+	goldenVerifiersMutex = &sync.Mutex{}
+)
+
+func init() {
+	clientActions["verifyStart"] = processVerifyStart
+	clientActions["verifyStop"] = processVerifyStop
+}
+
+// Разбор эталонной расшифровки
+func parseGolden(text string) ([]goldenLine, error) {
+	var lines []goldenLine
+	for i, raw := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		source := strings.TrimSpace(raw)
+		if source == "" {
+			continue
+		}
+		line := goldenLine{number: i + 1, source: source}
+		var err error
+		switch {
+		case source == "...":
+			// Несколько "..." подряд равнозначны одному
+			if len(lines) > 0 && lines[len(lines)-1].skip {
+				continue
+			}
+			line.skip = true
+		case strings.HasPrefix(source, "re:"):
+			line.re, err = regexp.Compile("^(?:" + strings.TrimPrefix(source, "re:") + ")$")
+		case strings.HasPrefix(source, "glob:"):
+			line.re, err = regexp.Compile(globToRegexp(strings.TrimPrefix(source, "glob:")))
+		default:
+			line.re = regexp.MustCompile("^" + regexp.QuoteMeta(source) + "$")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("строка эталона %d: %v", i+1, err)
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// Преобразование шаблона с * и ? в регулярное выражение
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// Проверка очередной строки. Возвращает результат, если сверка завершена.
+func (v *goldenVerifier) step(line string) *verifyResult {
+	v.received++
+	expected := v.lines[v.position]
+	if expected.skip {
+		// "..." в конце эталона означает, что дальнейший вывод не важен
+		if v.position+1 == len(v.lines) {
+			return &verifyResult{Status: "pass"}
+		}
+		if !v.lines[v.position+1].re.MatchString(line) {
+			return nil
+		}
+		v.position += 2
+	} else if expected.re.MatchString(line) {
+		v.position++
+	} else {
+		return &verifyResult{
+			Status:       "fail",
+			GoldenLine:   expected.number,
+			Expected:     expected.source,
+			Actual:       line,
+			ReceivedLine: v.received,
+		}
+	}
+	if v.position >= len(v.lines) {
+		return &verifyResult{Status: "pass"}
+	}
+	return nil
+}
+
+// Начало сверки вывода порта с эталоном
+func processVerifyStart(ws *websocket.Conn, message map[string]interface{}) {
+	var request verifyRequest
+	if err := decodeAction(message, &request); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неверный формат запроса сверки: %v", err)}
+		return
+	}
+	if err := startGoldenVerifier(request); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: %v", err)}
+		return
+	}
+	broadcast <- fmt.Sprintf("Начата сверка вывода порта %s с эталоном.", request.Port)
+}
+
+func startGoldenVerifier(request verifyRequest) error {
+	if request.Port == "" {
+		return fmt.Errorf("не указан порт")
+	}
+	text := request.Golden
+	if request.GoldenFile != "" {
+		data, err := os.ReadFile(request.GoldenFile)
+		if err != nil {
+			return fmt.Errorf("не удалось прочитать эталон: %v", err)
+		}
+		text = string(data)
+	}
+	lines, err := parseGolden(text)
+	if err != nil {
+		return err
+	}
+	if len(lines) == 0 {
+		return fmt.Errorf("эталон пуст")
+	}
+	timeout, err := parseOptionalDuration(request.Timeout)
+	if err != nil {
+		return err
+	}
+
+	v := &goldenVerifier{port: request.Port, lines: lines}
+	goldenVerifiersMutex.Lock()
+	if old := goldenVerifiers[request.Port]; old != nil && old.timer != nil {
+		old.timer.Stop()
+	}
+	goldenVerifiers[request.Port] = v
+	if timeout > 0 {
+		v.timer = time.AfterFunc(timeout, func() {
+			finishGoldenVerifier(v, &verifyResult{Status: "fail", Reason: "истекло время ожидания"})
+		})
+	}
+	goldenVerifiersMutex.Unlock()
+	return nil
+}
+
+// Остановка сверки без результата
+func processVerifyStop(ws *websocket.Conn, message map[string]interface{}) {
+	var request verifyRequest
+	if err := decodeAction(message, &request); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неверный формат запроса сверки: %v", err)}
+		return
+	}
+
+	goldenVerifiersMutex.Lock()
+	v := goldenVerifiers[request.Port]
+	delete(goldenVerifiers, request.Port)
+	goldenVerifiersMutex.Unlock()
+
+	if v == nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: сверка порта %s не ведётся.", request.Port)}
+		return
+	}
+	if v.timer != nil {
+		v.timer.Stop()
+	}
+	broadcast <- fmt.Sprintf("Сверка вывода порта %s остановлена.", request.Port)
+}
+
+// Проверка строки порта активной сверкой
+func checkGoldenVerifier(port, line string) {
+	goldenVerifiersMutex.Lock()
+	v := goldenVerifiers[port]
+	var result *verifyResult
+	if v != nil {
+		result = v.step(line)
+	}
+	goldenVerifiersMutex.Unlock()
+
+	if result != nil {
+		finishGoldenVerifier(v, result)
+	}
+}
+
+// Завершение сверки и отправка результата клиентам
+func finishGoldenVerifier(v *goldenVerifier, result *verifyResult) {
+	goldenVerifiersMutex.Lock()
+	if goldenVerifiers[v.port] != v {
+		// Сверка уже завершена или заменена новой
+		goldenVerifiersMutex.Unlock()
+		return
+	}
+	delete(goldenVerifiers, v.port)
+	if v.timer != nil {
+		v.timer.Stop()
+	}
+	if result.Status == "fail" && result.GoldenLine == 0 && v.position < len(v.lines) {
+		result.GoldenLine = v.lines[v.position].number
+		result.Expected = v.lines[v.position].source
+	}
+	goldenVerifiersMutex.Unlock()
+
+	result.Type = "verifyResult"
+	result.Port = v.port
+	result.Tags = getSessionTags(v.port)
+	data, err := json.Marshal(result)
+	if err != nil {
+		broadcast <- fmt.Sprintf("Ошибка при маршалинге результата сверки: %v", err)
+		return
+	}
+	broadcast <- string(data)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Сведения об аварийно остановленном конвейере порта
+type failedPipeline struct {
+	Port     string    `json:"port"`
+	BaudRate int       `json:"baudRate"`
+	Framing  string    `json:"framing,omitempty"`
+	LogPath  string    `json:"logPath,omitempty"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failedAt"`
+	Restarts int       `json:"restarts"`
+}
+
+// Состояние сервера для самоконтроля
+type healthStatus struct {
+	CheckedAt        time.Time         `json:"checkedAt"`
+	Uptime           string            `json:"uptime"`
+	Goroutines       int               `json:"goroutines"`
+	HeapMB           float64           `json:"heapMB"`
+	SysMB            float64           `json:"sysMB"`
+	LogWriteFailures int64             `json:"logWriteFailures"`
+	FailedPipelines  []*failedPipeline `json:"failedPipelines"`
+	// Конвейеры открытых портов: очереди, счётчики и зависания
+	Pipelines []portPipelineHealth `json:"pipelines"`
+	Anomalies []string             `json:"anomalies"`
+	// Доступ к устройствам, если сервер запущен в контейнере
+	Container *containerDiagnostics `json:"container,omitempty"`
+}
+
+var (
+	// Период самоконтроля, 0 - самоконтроль отключён
+	healthInterval time.Duration
+	// Пороги, превышение которых считается отклонением
+	healthMaxGoroutines int
+	healthMaxMemoryMB   int
+	// Перезапускать ли аварийно остановленные конвейеры портов
+	healthRestartPipelines bool
+
+	// Число неудачных записей в журналы с момента запуска
+	logWriteFailures atomic.Int64
+	// Время запуска сервера
+	startedAt = time.Now()
+	// Аварийно остановленные конвейеры портов, ключ - имя порта
+	failedPipelines = make(map[string]*failedPipeline)
+	// Число перезапусков конвейеров с момента запуска сервера, ключ - имя порта.
+	// Хранится отдельно от failedPipelines: запись о сбое удаляется при перезапуске.
+	pipelineRestarts = make(map[string]int)
+	// Последний результат самоконтроля
+	lastHealth healthStatus
+	// Мьютекс для синхронизации доступа к failedPipelines, pipelineRestarts и lastHealth
+	healthMutex = &sync.Mutex{}
+)
+
+func init() {
+	http.HandleFunc("GET /health", handleHealth)
+}
+
+// Запоминаем, что чтение из порта прервалось с ошибкой
+func recordPipelineFailure(port string, baudRate int, framing, logPath string, err error) {
+	notifyAlert(fmt.Sprintf("Чтение из порта %s прервано", port), err.Error())
+
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+
+	failedPipelines[port] = &failedPipeline{
+		Port:     port,
+		BaudRate: baudRate,
+		Framing:  framing,
+		LogPath:  logPath,
+		Error:    err.Error(),
+		FailedAt: time.Now(),
+		Restarts: pipelineRestarts[port],
+	}
+}
+
+// Периодический самоконтроль
+func runHealthSupervisor() {
+	if healthInterval <= 0 {
+		return
+	}
+	var lastFailures int64
+	for {
+		time.Sleep(healthInterval)
+		status := checkHealth(lastFailures)
+		lastFailures = status.LogWriteFailures
+		for _, anomaly := range status.Anomalies {
+			log.Printf("Самоконтроль: %s", anomaly)
+			broadcast <- "Самоконтроль: " + anomaly
+			notifyAlert("Самоконтроль сервера", anomaly)
+		}
+		if healthRestartPipelines {
+			restartFailedPipelines()
+		}
+	}
+}
+
+// Снятие показателей и поиск отклонений
+func checkHealth(lastFailures int64) healthStatus {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	status := healthStatus{
+		CheckedAt:        time.Now(),
+		Uptime:           time.Since(startedAt).Round(time.Second).String(),
+		Goroutines:       runtime.NumGoroutine(),
+		HeapMB:           float64(mem.HeapAlloc) / 1024 / 1024,
+		SysMB:            float64(mem.Sys) / 1024 / 1024,
+		LogWriteFailures: logWriteFailures.Load(),
+		Pipelines:        portPipelineStatuses(),
+		Anomalies:        []string{},
+		Container:        detectContainer(),
+	}
+	if healthMaxGoroutines > 0 && status.Goroutines > healthMaxGoroutines {
+		status.Anomalies = append(status.Anomalies, fmt.Sprintf("число горутин %d превышает порог %d", status.Goroutines, healthMaxGoroutines))
+	}
+	if healthMaxMemoryMB > 0 && status.HeapMB > float64(healthMaxMemoryMB) {
+		status.Anomalies = append(status.Anomalies, fmt.Sprintf("занятая память %.1f МБ превышает порог %d МБ", status.HeapMB, healthMaxMemoryMB))
+	}
+	if failures := status.LogWriteFailures - lastFailures; failures > 0 {
+		status.Anomalies = append(status.Anomalies, fmt.Sprintf("неудачных записей в журналы с прошлой проверки: %d", failures))
+	}
+	for _, p := range status.Pipelines {
+		switch p.State {
+		case "writeBlocked":
+			status.Anomalies = append(status.Anomalies, fmt.Sprintf("запись в порт %s не завершается уже %s", p.Port, p.WriteBlockedFor))
+		case "stalled":
+			status.Anomalies = append(status.Anomalies, fmt.Sprintf("обработка данных порта %s не успевает за чтением", p.Port))
+		}
+	}
+
+	healthMutex.Lock()
+	status.FailedPipelines = []*failedPipeline{}
+	for _, f := range failedPipelines {
+		copied := *f
+		status.FailedPipelines = append(status.FailedPipelines, &copied)
+	}
+	lastHealth = status
+	healthMutex.Unlock()
+
+	return status
+}
+
+// Повторное открытие портов, чтение из которых прервалось, если устройство снова доступно
+func restartFailedPipelines() {
+	healthMutex.Lock()
+	var pending []*failedPipeline
+	for _, f := range failedPipelines {
+		pending = append(pending, f)
+	}
+	healthMutex.Unlock()
+
+	available := getPortNames()
+	for _, f := range pending {
+		if !stringInSlice(f.Port, available) {
+			continue
+		}
+		if _, err := openManagedPortFramed(f.Port, f.BaudRate, f.Framing); err != nil {
+			log.Printf("Самоконтроль: не удалось перезапустить порт %s: %v", f.Port, err)
+			continue
+		}
+		if f.LogPath != "" {
+			if err := startPortLogPath(f.Port, f.LogPath); err != nil {
+				log.Printf("Самоконтроль: не удалось возобновить журнал порта %s: %v", f.Port, err)
+			}
+		}
+
+		healthMutex.Lock()
+		if failedPipelines[f.Port] == f {
+			delete(failedPipelines, f.Port)
+		}
+		pipelineRestarts[f.Port]++
+		restarts := pipelineRestarts[f.Port]
+		healthMutex.Unlock()
+
+		log.Printf("Самоконтроль: порт %s перезапущен (перезапусков: %d)", f.Port, restarts)
+		broadcast <- fmt.Sprintf("Самоконтроль: порт %s перезапущен после ошибки: %s", f.Port, f.Error)
+	}
+}
+
+// GET /health - текущие показатели самоконтроля. В них порты и состояние всего
+// сервера, поэтому в пространстве имён они недоступны.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	if ns := requestNamespace(r); ns != nil {
+		http.Error(w, fmt.Sprintf("самоконтроль недоступен в пространстве %s", ns.Name), http.StatusForbidden)
+		return
+	}
+	var lastFailures int64
+	healthMutex.Lock()
+	lastFailures = lastHealth.LogWriteFailures
+	healthMutex.Unlock()
+
+	writeJSON(w, http.StatusOK, checkHealth(lastFailures))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Максимальное число строк, хранимых в истории одного порта
+const maxHistoryLines = 100000
+
+// Строка из истории порта
+type historyLine struct {
+	Time time.Time
+	Line string
+}
+
+var (
+	// Сколько последних секунд хранится в истории порта
+	historyRetention = 60 * time.Second
+	// Минимальная глубина истории, которая нужна триггерам
+	historyRequired time.Duration
+	// Недавние строки портов, ключ - имя порта
+	portHistories = make(map[string][]historyLine)
+	// Мьютекс для синхронизации доступа к истории
+	historyMutex = &sync.Mutex{}
+)
+
+// Запоминаем строку порта в кольцевой истории
+func recordHistory(port, line string, t time.Time) {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	keep := historyRetention
+	if historyRequired > keep {
+		keep = historyRequired
+	}
+
+	lines := append(portHistories[port], historyLine{Time: t, Line: line})
+	// Отбрасываем строки старше глубины истории и сверх предельного количества
+	first := 0
+	for first < len(lines) && t.Sub(lines[first].Time) > keep {
+		first++
+	}
+	if len(lines)-first > maxHistoryLines {
+		first = len(lines) - maxHistoryLines
+	}
+	portHistories[port] = lines[first:]
+}
+
+// Строки истории порта в промежутке [from, to]
+func historyWindow(port string, from, to time.Time) []historyLine {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	var window []historyLine
+	for _, l := range portHistories[port] {
+		if !l.Time.Before(from) && !l.Time.After(to) {
+			window = append(window, l)
+		}
+	}
+	return window
+}
+
+// Устанавливаем минимальную глубину истории
+func setHistoryRequired(d time.Duration) {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	historyRequired = d
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Тема NATS с командами по умолчанию
+const defaultNATSCommandSubject = "serial-monitor.commands"
+
+// Наибольший размер сообщения NATS с командой
+const maxNATSPayload = 1 << 20
+
+// Адрес NATS, из темы которого принимаются команды:
+// nats://[пользователь:пароль@|токен@]хост:4222?subject=serial-monitor.commands&queue=группа
+var natsIngestURL string
+
+// Приём команд из темы NATS. Подтверждения отправляются на адрес ответа
+// сообщения, поэтому команду можно отправить запросом (nats request) и
+// дождаться результата. Группа queue распределяет команды между несколькими мониторами.
+func runNATSIngest() {
+	if natsIngestURL == "" {
+		return
+	}
+	u, err := parseNATSURL(natsIngestURL)
+	if err != nil {
+		log.Fatalf("Неверный адрес -ingest-nats: %v", err)
+	}
+	subject := u.Query().Get("subject")
+	if subject == "" {
+		subject = defaultNATSCommandSubject
+	}
+	delay := ingestReconnectDelay
+	for {
+		started := time.Now()
+		err := consumeNATSSubject(u, subject, u.Query().Get("queue"))
+		log.Printf("Очередь команд NATS %s: %v", u.Host, err)
+		if time.Since(started) > maxIngestReconnectDelay {
+			delay = ingestReconnectDelay
+		}
+		time.Sleep(delay)
+		delay = min(delay*2, maxIngestReconnectDelay)
+	}
+}
+
+// Разбор адреса nats://[пользователь:пароль@|токен@]хост[:порт]
+func parseNATSURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "nats" || u.Host == "" {
+		return nil, fmt.Errorf("ожидается nats://хост:порт, получено %q", raw)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Host, "4222")
+	}
+	return u, nil
+}
+
+// Подключение по текстовому протоколу NATS: приветствие сервера и CONNECT
+// с данными входа из адреса. Клиентская библиотека не используется.
+func dialNATS(u *url.URL) (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", u.Host, 10*time.Second)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(conn)
+
+	// Сервер начинает с INFO
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	info, err := reader.ReadString('\n')
+	if err == nil && !strings.HasPrefix(info, "INFO ") {
+		err = fmt.Errorf("неожиданное приветствие сервера %q", strings.TrimSpace(info))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	options := map[string]interface{}{"verbose": false, "pedantic": false, "name": "serial-monitor", "lang": "go", "version": "1"}
+	if password, ok := u.User.Password(); ok {
+		options["user"], options["pass"] = u.User.Username(), password
+	} else if u.User != nil {
+		options["auth_token"] = u.User.Username()
+	}
+	connect, _ := json.Marshal(options)
+	if _, err := io.WriteString(conn, "CONNECT "+string(connect)+"\r\n"); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, reader, nil
+}
+
+// Подключение по текстовому протоколу NATS и приём сообщений до ошибки соединения
+func consumeNATSSubject(u *url.URL, subject, queue string) error {
+	conn, reader, err := dialNATS(u)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	sub := "SUB " + subject + " 1\r\n"
+	if queue != "" {
+		sub = "SUB " + subject + " " + queue + " 1\r\n"
+	}
+	// PING после подписки: ответ PONG (или -ERR) показывает, что сервер принял CONNECT и SUB
+	if _, err := io.WriteString(conn, sub+"PING\r\n"); err != nil {
+		return err
+	}
+	subscribed := false
+
+	for {
+		// Сервер присылает PING раз в несколько минут; тишина дольше - обрыв
+		conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "PING":
+			if _, err := io.WriteString(conn, "PONG\r\n"); err != nil {
+				return err
+			}
+		case "PONG":
+			if !subscribed {
+				subscribed = true
+				log.Printf("Приём команд из темы NATS %s на %s.", subject, u.Host)
+			}
+		case "+OK", "INFO":
+		case "-ERR":
+			return fmt.Errorf("ошибка NATS: %s", strings.TrimPrefix(line, fields[0]+" "))
+		case "MSG":
+			// MSG <тема> <sid> [адрес ответа] <размер>
+			if len(fields) != 4 && len(fields) != 5 {
+				return fmt.Errorf("неверное сообщение NATS %q", line)
+			}
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || size < 0 || size > maxNATSPayload {
+				return fmt.Errorf("неверный размер сообщения NATS %q", line)
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				return err
+			}
+			reply := ""
+			if len(fields) == 5 {
+				reply = fields[3]
+			}
+			if err := handleNATSCommand(conn, u.Host, payload[:size], reply); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("неожиданная строка протокола NATS %q", line)
+		}
+	}
+}
+
+// Отправка команды из сообщения NATS в порт и подтверждение на адрес ответа
+func handleNATSCommand(conn net.Conn, host string, payload []byte, reply string) error {
+	request, err := parseIngestedCommand(payload)
+	var acks []commandAck
+	if err != nil {
+		broadcast <- fmt.Sprintf("Ошибка команды из NATS: %v", err)
+		acks = []commandAck{{Type: "commandAck", Error: err.Error()}}
+	} else {
+		acks = forwardIngestedCommand(request, "nats", host, nil)
+		for _, ack := range acks {
+			if ack.Error != "" {
+				broadcast <- fmt.Sprintf("Ошибка команды из NATS для порта %s: %s", ack.Port, ack.Error)
+			}
+		}
+	}
+	if reply == "" {
+		return nil
+	}
+	data, err := json.Marshal(acks)
+	if err != nil {
+		return errors.New("ошибка формирования подтверждения")
+	}
+	_, err = fmt.Fprintf(conn, "PUB %s %d\r\n%s\r\n", reply, len(data), data)
+	return err
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Список Redis с командами по умолчанию
+const defaultRedisCommandList = "serial-monitor:commands"
+
+// Сколько секунд BLPOP ждёт команду, прежде чем проверить соединение заново
+const redisPopTimeout = 5
+
+// Паузы перед повторным подключением к очереди: начальная и наибольшая
+const (
+	ingestReconnectDelay    = time.Second
+	maxIngestReconnectDelay = 30 * time.Second
+)
+
+// Адрес Redis, из списка которого принимаются команды:
+// redis://[:пароль@]хост:6379[/база]?list=serial-monitor:commands
+var redisIngestURL string
+
+// Соединение с Redis по протоколу RESP. Нужны только несколько команд,
+// поэтому клиентская библиотека не используется.
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Приём команд из списка Redis: внешние системы добавляют их через RPUSH,
+// монитор забирает по одной через BLPOP и отправляет в порт по порядку
+func runRedisIngest() {
+	if redisIngestURL == "" {
+		return
+	}
+	u, list, err := parseRedisIngestURL(redisIngestURL)
+	if err != nil {
+		log.Fatalf("Неверный адрес -ingest-redis: %v", err)
+	}
+	delay := ingestReconnectDelay
+	for {
+		started := time.Now()
+		err := consumeRedisList(u, list)
+		log.Printf("Очередь команд Redis %s: %v", u.Host, err)
+		if time.Since(started) > maxIngestReconnectDelay {
+			delay = ingestReconnectDelay
+		}
+		time.Sleep(delay)
+		delay = min(delay*2, maxIngestReconnectDelay)
+	}
+}
+
+func parseRedisIngestURL(raw string) (*url.URL, string, error) {
+	u, err := parseRedisURL(raw)
+	if err != nil {
+		return nil, "", err
+	}
+	list := u.Query().Get("list")
+	if list == "" {
+		list = defaultRedisCommandList
+	}
+	return u, list, nil
+}
+
+// Разбор адреса redis://[:пароль@]хост[:порт][/база]
+func parseRedisURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("ожидается redis://хост:порт, получено %q", raw)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Host, "6379")
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if _, err := strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("неверный номер базы %q", db)
+		}
+	}
+	return u, nil
+}
+
+// Подключение к Redis с входом и выбором базы из адреса
+func dialRedis(u *url.URL) (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", u.Host, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	r := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if password, ok := u.User.Password(); ok {
+		args := []string{"AUTH", password}
+		if name := u.User.Username(); name != "" {
+			args = []string{"AUTH", name, password}
+		}
+		if _, err := r.do(args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if _, err := r.do("SELECT", db); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Подключение и приём команд до ошибки соединения
+func consumeRedisList(u *url.URL, list string) error {
+	r, err := dialRedis(u)
+	if err != nil {
+		return err
+	}
+	defer r.conn.Close()
+	log.Printf("Приём команд из списка Redis %s на %s.", list, u.Host)
+
+	for {
+		reply, err := r.do("BLPOP", list, strconv.Itoa(redisPopTimeout))
+		if err != nil {
+			return err
+		}
+		// Истёк таймаут - пустой ответ
+		item, ok := reply.([]interface{})
+		if !ok || len(item) != 2 {
+			continue
+		}
+		payload, _ := item[1].(string)
+		request, err := parseIngestedCommand([]byte(payload))
+		if err != nil {
+			broadcast <- fmt.Sprintf("Ошибка команды из Redis: %v", err)
+			continue
+		}
+		acks := forwardIngestedCommand(request, "redis", u.Host, nil)
+		for _, ack := range acks {
+			if ack.Error != "" {
+				broadcast <- fmt.Sprintf("Ошибка команды из Redis для порта %s: %s", ack.Port, ack.Error)
+			}
+		}
+		if request.ReplyTo != "" {
+			data, _ := json.Marshal(acks)
+			if _, err := r.do("RPUSH", request.ReplyTo, string(data)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Выполнение команды Redis и чтение ответа. BLPOP держит соединение до
+// своего таймаута, поэтому срок чтения с запасом больше него.
+func (r *redisConn) do(args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	r.conn.SetDeadline(time.Now().Add((redisPopTimeout + 10) * time.Second))
+	if _, err := io.WriteString(r.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return r.read()
+}
+
+// Чтение ответа RESP: строки, числа, массивы; ошибка Redis возвращается как error
+func (r *redisConn) read() (interface{}, error) {
+	line, err := r.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("пустой ответ Redis")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("ошибка Redis: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = r.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("неожиданный ответ Redis %q", line)
+}
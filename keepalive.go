@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Имя файла с проверками связи в каталоге данных
+const keepAliveProbesFile = "keepalive-probes.json"
+
+// Состояния порта по результатам проверки связи
+const (
+	// Устройство само присылает данные
+	portStatusActive = "active"
+	// Устройство молчит, но отвечает на проверку
+	portStatusSilent = "silent"
+	// Устройство не ответило на проверку
+	portStatusUnresponsive = "unresponsive"
+	// Порт не открыт
+	portStatusClosed = "closed"
+)
+
+// Периодическая проверка связи с устройством: если порт молчит, в него
+// отправляются байты проверки и ожидается любой ответ
+type keepAliveProbe struct {
+	Port string `json:"port"`
+	// Байты проверки: текст или шестнадцатеричная запись
+	Send    string `json:"send,omitempty"`
+	SendHex string `json:"sendHex,omitempty"`
+	// Период проверки и время ожидания ответа, например "30s" и "2s"
+	Interval string `json:"interval"`
+	Timeout  string `json:"timeout"`
+
+	data     []byte
+	interval time.Duration
+	timeout  time.Duration
+	stop     chan struct{}
+}
+
+// Состояние порта для панелей наблюдения
+type portStatus struct {
+	Type           string    `json:"type"`
+	Port           string    `json:"port"`
+	Status         string    `json:"status"`
+	ChangedAt      time.Time `json:"changedAt"`
+	LastDataAt     time.Time `json:"lastDataAt"`
+	LastProbeAt    time.Time `json:"lastProbeAt"`
+	LastResponseAt time.Time `json:"lastResponseAt"`
+}
+
+var (
+	// Проверки связи, ключ - имя порта
+	keepAliveProbes = make(map[string]*keepAliveProbe)
+	// Последние состояния портов, ключ - имя порта
+	portStatuses = make(map[string]*portStatus)
+	// Мьютекс для синхронизации доступа к keepAliveProbes и portStatuses
+	keepAliveMutex = &sync.Mutex{}
+)
+
+func init() {
+	clientActions["addProbe"] = processAddProbe
+	clientActions["removeProbe"] = processRemoveProbe
+	clientActions["listProbes"] = processListProbes
+	http.HandleFunc("GET /ports/status", handlePortStatuses)
+}
+
+// Загрузка сохранённых проверок связи при запуске
+func loadKeepAliveProbes() {
+	var saved []*keepAliveProbe
+	if err := loadJSONFile(keepAliveProbesFile, &saved); err != nil {
+		log.Printf("Ошибка загрузки проверок связи: %v", err)
+		return
+	}
+
+	keepAliveMutex.Lock()
+	defer keepAliveMutex.Unlock()
+
+	for _, probe := range saved {
+		if err := probe.compile(); err != nil {
+			log.Printf("Ошибка загрузки проверки связи порта %s: %v", probe.Port, err)
+			continue
+		}
+		keepAliveProbes[probe.Port] = probe
+		go probe.run()
+	}
+}
+
+// Подготовка проверки: разбор байтов и длительностей
+func (p *keepAliveProbe) compile() error {
+	if p.Port == "" {
+		return fmt.Errorf("не указан порт")
+	}
+	p.data = []byte(p.Send)
+	if p.SendHex != "" {
+		var err error
+		if p.data, err = hex.DecodeString(p.SendHex); err != nil {
+			return fmt.Errorf("неверные байты проверки: %v", err)
+		}
+	}
+	if len(p.data) == 0 {
+		return fmt.Errorf("не указаны байты проверки")
+	}
+	var err error
+	if p.interval, err = parseOptionalDuration(p.Interval); err != nil {
+		return err
+	}
+	if p.timeout, err = parseOptionalDuration(p.Timeout); err != nil {
+		return err
+	}
+	if p.interval == 0 {
+		p.interval = 30 * time.Second
+	}
+	if p.timeout == 0 {
+		p.timeout = 2 * time.Second
+	}
+	if p.timeout >= p.interval {
+		return fmt.Errorf("время ожидания ответа должно быть меньше периода проверки")
+	}
+	p.stop = make(chan struct{})
+	return nil
+}
+
+// Цикл проверки связи до удаления проверки
+func (p *keepAliveProbe) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	// Данные, пришедшие после этого момента, считаются присланными самим устройством
+	since := time.Now()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		session := getPortSession(p.Port)
+		if session == nil {
+			setPortStatus(p.Port, portStatusClosed, nil)
+			since = time.Now()
+			continue
+		}
+		if session.lastData().After(since) {
+			setPortStatus(p.Port, portStatusActive, session)
+			since = time.Now()
+			continue
+		}
+
+		status, probedAt, respondedAt := p.probe(session)
+		setPortStatus(p.Port, status, session, func(s *portStatus) {
+			s.LastProbeAt = probedAt
+			if !respondedAt.IsZero() {
+				s.LastResponseAt = respondedAt
+			}
+		})
+		since = time.Now()
+	}
+}
+
+// Отправка байтов проверки и ожидание любого ответа
+func (p *keepAliveProbe) probe(session *portSession) (string, time.Time, time.Time) {
+	ch := session.subscribeRaw()
+	defer session.unsubscribeRaw(ch)
+
+	probedAt := time.Now()
+	if err := writeToPort(p.Port, p.data); err != nil {
+		return portStatusUnresponsive, probedAt, time.Time{}
+	}
+	select {
+	case <-ch:
+		return portStatusSilent, probedAt, time.Now()
+	case <-time.After(p.timeout):
+		return portStatusUnresponsive, probedAt, time.Time{}
+	case <-p.stop:
+		return portStatusSilent, probedAt, time.Time{}
+	}
+}
+
+// Обновление состояния порта. При смене состояния клиенты получают уведомление.
+func setPortStatus(port, status string, session *portSession, update ...func(s *portStatus)) {
+	keepAliveMutex.Lock()
+	s := portStatuses[port]
+	if s == nil {
+		s = &portStatus{Type: "portStatus", Port: port}
+		portStatuses[port] = s
+	}
+	changed := s.Status != status
+	if changed {
+		s.Status = status
+		s.ChangedAt = time.Now()
+	}
+	if session != nil {
+		s.LastDataAt = session.lastData()
+	}
+	for _, u := range update {
+		u(s)
+	}
+	data, err := json.Marshal(s)
+	keepAliveMutex.Unlock()
+
+	if !changed {
+		return
+	}
+	if status == portStatusUnresponsive {
+		notifyAlert(fmt.Sprintf("Порт %s не отвечает", port), "Устройство не ответило на проверку связи.")
+	}
+	if err != nil {
+		log.Printf("Ошибка при маршалинге состояния порта: %v", err)
+		return
+	}
+	broadcast <- string(data)
+}
+
+// Добавление или замена проверки связи порта
+func processAddProbe(ws *websocket.Conn, message map[string]interface{}) {
+	probe := &keepAliveProbe{}
+	if err := decodeAction(message, probe); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неверный формат проверки связи: %v", err)}
+		return
+	}
+	if err := probe.compile(); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: %v", err)}
+		return
+	}
+
+	keepAliveMutex.Lock()
+	if old := keepAliveProbes[probe.Port]; old != nil {
+		close(old.stop)
+	}
+	keepAliveProbes[probe.Port] = probe
+	err := saveKeepAliveProbes()
+	keepAliveMutex.Unlock()
+
+	go probe.run()
+	if err != nil {
+		broadcast <- fmt.Sprintf("Ошибка сохранения проверок связи: %v", err)
+	}
+	broadcast <- fmt.Sprintf("Проверка связи порта %s установлена: каждые %s, ожидание ответа %s.", probe.Port, probe.interval, probe.timeout)
+}
+
+// Удаление проверки связи порта
+func processRemoveProbe(ws *websocket.Conn, message map[string]interface{}) {
+	var request keepAliveProbe
+	if err := decodeAction(message, &request); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неверный формат запроса: %v", err)}
+		return
+	}
+
+	keepAliveMutex.Lock()
+	probe, ok := keepAliveProbes[request.Port]
+	if ok {
+		close(probe.stop)
+		delete(keepAliveProbes, request.Port)
+		delete(portStatuses, request.Port)
+	}
+	err := saveKeepAliveProbes()
+	keepAliveMutex.Unlock()
+
+	if !ok {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: проверка связи порта %s не найдена.", request.Port)}
+		return
+	}
+	if err != nil {
+		broadcast <- fmt.Sprintf("Ошибка сохранения проверок связи: %v", err)
+	}
+	broadcast <- fmt.Sprintf("Проверка связи порта %s удалена.", request.Port)
+}
+
+// Отправка списка проверок и состояний портов запросившему клиенту
+func processListProbes(ws *websocket.Conn, message map[string]interface{}) {
+	ns := clientNamespace(ws)
+	keepAliveMutex.Lock()
+	probes := make([]*keepAliveProbe, 0, len(keepAliveProbes))
+	for _, probe := range keepAliveProbes {
+		if ns.allowsPort(probe.Port) {
+			probes = append(probes, probe)
+		}
+	}
+	keepAliveMutex.Unlock()
+	sort.Slice(probes, func(i, j int) bool { return probes[i].Port < probes[j].Port })
+
+	data, err := json.Marshal(map[string]interface{}{"type": "probes", "probes": probes, "statuses": sortedPortStatuses(ns)})
+	if err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка при маршалинге проверок связи: %v", err)}
+		return
+	}
+	directMessages <- clientMessage{ws, string(data)}
+}
+
+// Состояния портов для панелей наблюдения
+func handlePortStatuses(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, sortedPortStatuses(requestNamespace(r)))
+}
+
+// Состояния портов пространства, упорядоченные по имени порта
+func sortedPortStatuses(ns *namespace) []portStatus {
+	keepAliveMutex.Lock()
+	defer keepAliveMutex.Unlock()
+
+	list := make([]portStatus, 0, len(portStatuses))
+	for _, s := range portStatuses {
+		if ns.allowsPort(s.Port) {
+			list = append(list, *s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Port < list[j].Port })
+	return list
+}
+
+// Сохранение проверок связи. Вызывается под keepAliveMutex.
+func saveKeepAliveProbes() error {
+	list := make([]*keepAliveProbe, 0, len(keepAliveProbes))
+	for _, probe := range keepAliveProbes {
+		list = append(list, probe)
+	}
+	return saveJSONFile(keepAliveProbesFile, list)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Клиент пространства видит состояния только своих портов, а самоконтроль
+// всего сервера ему недоступен
+func TestMonitoringFilteredByNamespace(t *testing.T) {
+	keepAliveMutex.Lock()
+	previous := portStatuses
+	portStatuses = map[string]*portStatus{
+		"/dev/ttyUSB0": {Type: "portStatus", Port: "/dev/ttyUSB0", Status: "alive"},
+		"/dev/ttyACM0": {Type: "portStatus", Port: "/dev/ttyACM0", Status: "alive"},
+	}
+	keepAliveMutex.Unlock()
+	t.Cleanup(func() {
+		keepAliveMutex.Lock()
+		portStatuses = previous
+		keepAliveMutex.Unlock()
+	})
+	ns := &namespace{Name: "tenant", Devices: []string{"/dev/ttyUSB*"}}
+
+	w := httptest.NewRecorder()
+	handlePortStatuses(w, withIdentity(httptest.NewRequest("GET", "/ports/status", nil), "token", ns))
+	var statuses []portStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &statuses); err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[0].Port != "/dev/ttyUSB0" {
+		t.Errorf("состояния портов пространства: %+v", statuses)
+	}
+
+	w = httptest.NewRecorder()
+	handleHealth(w, withIdentity(httptest.NewRequest("GET", "/health", nil), "token", ns))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("самоконтроль в пространстве: код %d", w.Code)
+	}
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Длина окна проверки синхронизации и допустимая доля ошибок в нём. Если ошибок
+// больше, считается, что приёмник потерял последовательность и синхронизируется заново.
+const (
+	stressSyncWindowBits = 256
+	stressSyncMaxErrors  = 50
+)
+
+// Многочлены PRBS x^n + x^m + 1 (ITU-T O.150)
+var prbsPolynomials = map[string][2]uint{
+	"prbs7":  {7, 6},
+	"prbs9":  {9, 5},
+	"prbs15": {15, 14},
+	"prbs23": {23, 18},
+	"prbs31": {31, 28},
+}
+
+// Запрос на запуск нагрузочной проверки линии
+type stressRequest struct {
+	// Порт, в который передаётся последовательность
+	Port string `json:"port"`
+	// Порт, на котором она принимается. Пусто - тот же порт (перемычка TX-RX).
+	RxPort string `json:"rxPort"`
+	// "counter" или PRBS: "prbs7", "prbs9", "prbs15", "prbs23", "prbs31"
+	Pattern string `json:"pattern"`
+	// Длительность проверки ("10m"). Пусто - до остановки.
+	Duration string `json:"duration"`
+	// Период отчётов ("1s"), по умолчанию 5 секунд
+	Interval string `json:"interval"`
+}
+
+// Показатели проверки за период или с начала проверки
+type stressStats struct {
+	SentBytes     int64   `json:"sentBytes"`
+	ReceivedBytes int64   `json:"receivedBytes"`
+	BitsChecked   int64   `json:"bitsChecked"`
+	BitErrors     int64   `json:"bitErrors"`
+	CharErrors    int64   `json:"charErrors"`
+	BER           float64 `json:"ber"`
+	Resyncs       int64   `json:"resyncs"`
+}
+
+// Отчёт о ходе проверки
+type stressReport struct {
+	Type    string      `json:"type"`
+	Port    string      `json:"port"`
+	RxPort  string      `json:"rxPort"`
+	Pattern string      `json:"pattern"`
+	Time    time.Time   `json:"time"`
+	Elapsed string      `json:"elapsed"`
+	Synced  bool        `json:"synced"`
+	Total   stressStats `json:"total"`
+	// Показатели за последний период
+	Interval *stressStats `json:"interval,omitempty"`
+	// Итоговый отчёт: история показателей по периодам
+	History []stressStats `json:"history,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// Идущая нагрузочная проверка
+type stressTest struct {
+	request stressRequest
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// Проверка принятых символов испытательной последовательности
+type patternVerifier interface {
+	// Возвращает число проверенных битов, ошибочных битов и ошибочных символов
+	verify(data []byte) (checked, bitErrors, charErrors int64)
+	synced() bool
+	resyncs() int64
+}
+
+var (
+	// Идущие нагрузочные проверки, ключ - порт передачи
+	stressTests = make(map[string]*stressTest)
+	// Мьютекс для синхронизации доступа к stressTests
+	stressTestsMutex = &sync.Mutex{}
+)
+
+func init() {
+	clientActions["stressStart"] = processStressStart
+	clientActions["stressStop"] = processStressStop
+}
+
+// Запуск нагрузочной проверки линии
+func processStressStart(ws *websocket.Conn, message map[string]interface{}) {
+	var request stressRequest
+	if err := decodeAction(message, &request); err != nil {
+		broadcast <- fmt.Sprintf("Ошибка: неверный формат запроса проверки: %v", err)
+		return
+	}
+	if request.Port == "" {
+		request.Port = currentSettings.Port
+	}
+	if request.RxPort == "" {
+		request.RxPort = request.Port
+	}
+	if request.Pattern == "" {
+		request.Pattern = "prbs15"
+	}
+	if _, ok := prbsPolynomials[request.Pattern]; !ok && request.Pattern != "counter" {
+		broadcast <- fmt.Sprintf("Ошибка: неизвестная испытательная последовательность %q", request.Pattern)
+		return
+	}
+	duration, err := parseOptionalDuration(request.Duration)
+	if err != nil {
+		broadcast <- fmt.Sprintf("Ошибка: %v", err)
+		return
+	}
+	interval, err := parseOptionalDuration(request.Interval)
+	if err != nil {
+		broadcast <- fmt.Sprintf("Ошибка: %v", err)
+		return
+	}
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	test := &stressTest{request: request, stop: make(chan struct{})}
+	stressTestsMutex.Lock()
+	if stressTests[request.Port] != nil {
+		stressTestsMutex.Unlock()
+		broadcast <- fmt.Sprintf("Ошибка: нагрузочная проверка порта %s уже идёт.", request.Port)
+		return
+	}
+	stressTests[request.Port] = test
+	stressTestsMutex.Unlock()
+
+	if request.RxPort == request.Port {
+		broadcast <- fmt.Sprintf("Нагрузочная проверка порта %s запущена: последовательность %s, перемычка TX-RX.", request.Port, request.Pattern)
+	} else {
+		broadcast <- fmt.Sprintf("Нагрузочная проверка запущена: последовательность %s передаётся в порт %s и принимается портом %s.", request.Pattern, request.Port, request.RxPort)
+	}
+	go func() {
+		test.run(duration, interval)
+
+		stressTestsMutex.Lock()
+		delete(stressTests, request.Port)
+		stressTestsMutex.Unlock()
+	}()
+}
+
+// Остановка нагрузочной проверки
+func processStressStop(ws *websocket.Conn, message map[string]interface{}) {
+	var request stressRequest
+	if err := decodeAction(message, &request); err != nil {
+		broadcast <- fmt.Sprintf("Ошибка: неверный формат запроса: %v", err)
+		return
+	}
+	if request.Port == "" {
+		request.Port = currentSettings.Port
+	}
+
+	stressTestsMutex.Lock()
+	test := stressTests[request.Port]
+	stressTestsMutex.Unlock()
+
+	if test == nil {
+		broadcast <- fmt.Sprintf("Ошибка: нагрузочная проверка порта %s не идёт.", request.Port)
+		return
+	}
+	test.once.Do(func() { close(test.stop) })
+}
+
+// Выполнение проверки: передача последовательности со скоростью линии,
+// проверка принятых символов и отчёты раз в период
+func (t *stressTest) run(duration, interval time.Duration) {
+	request := t.request
+	result := stressReport{Type: "stressResult", Port: request.Port, RxPort: request.RxPort, Pattern: request.Pattern}
+	fail := func(err error) {
+		result.Time = time.Now()
+		result.Error = err.Error()
+		sendStressReport(result)
+		broadcast <- fmt.Sprintf("Ошибка нагрузочной проверки порта %s: %v", request.Port, err)
+	}
+
+	session := getPortSession(request.RxPort)
+	baudRate, framingName, ok := getPortSettings(request.Port)
+	if session == nil || !ok {
+		fail(fmt.Errorf("порт %s или %s не открыт", request.Port, request.RxPort))
+		return
+	}
+	f, err := parseFraming(framingName)
+	if err != nil {
+		fail(err)
+		return
+	}
+	ch, err := session.beginLinkTest()
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer session.endLinkTest(ch)
+
+	generate, verifier := newStressPattern(request.Pattern, uint(f.DataBits))
+	charTime := f.charTime(baudRate)
+	// Порция передачи - около 50 мс на линии
+	chunk := int(min(max(50*time.Millisecond/charTime, 16), 4096))
+
+	var sent atomic.Int64
+	writeErr := make(chan error, 1)
+	done := make(chan struct{})
+	stopWriter := sync.OnceFunc(func() { close(done) })
+	defer stopWriter()
+	go func() {
+		started := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := writeToPort(request.Port, generate(chunk)); err != nil {
+				writeErr <- err
+				return
+			}
+			// Не опережаем скорость линии, чтобы не переполнить буферы адаптера
+			total := sent.Add(int64(chunk))
+			if ahead := time.Until(started.Add(time.Duration(total) * charTime)); ahead > 0 {
+				time.Sleep(ahead)
+			}
+		}
+	}()
+
+	started := time.Now()
+	var deadline <-chan time.Time
+	if duration > 0 {
+		timer := time.NewTimer(duration)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var total, period stressStats
+	var lastSent, lastResyncs int64
+	account := func(data []byte) {
+		checked, bitErrors, charErrors := verifier.verify(data)
+		for _, s := range []*stressStats{&total, &period} {
+			s.ReceivedBytes += int64(len(data))
+			s.BitsChecked += checked
+			s.BitErrors += bitErrors
+			s.CharErrors += charErrors
+		}
+	}
+	report := func() {
+		total.SentBytes, total.Resyncs = sent.Load(), verifier.resyncs()
+		period.SentBytes, period.Resyncs = total.SentBytes-lastSent, total.Resyncs-lastResyncs
+		lastSent, lastResyncs = total.SentBytes, total.Resyncs
+		total.BER, period.BER = bitErrorRate(total), bitErrorRate(period)
+		result.History = append(result.History, period)
+		// Отчёт маршалится сразу, поэтому сбрасывать period после отправки безопасно
+		sendStressReport(stressReport{
+			Type:     "stressReport",
+			Port:     request.Port,
+			RxPort:   request.RxPort,
+			Pattern:  request.Pattern,
+			Time:     time.Now(),
+			Elapsed:  time.Since(started).Round(time.Second).String(),
+			Synced:   verifier.synced(),
+			Total:    total,
+			Interval: &period,
+		})
+		period = stressStats{}
+	}
+
+loop:
+	for {
+		select {
+		case data := <-ch:
+			account(data)
+		case err := <-writeErr:
+			fail(err)
+			return
+		case <-ticker.C:
+			report()
+		case <-t.stop:
+			break loop
+		case <-deadline:
+			break loop
+		}
+	}
+
+	// Дожидаемся байтов, которые ещё в пути
+	stopWriter()
+	drain := time.NewTimer(2*time.Duration(chunk)*charTime + 100*time.Millisecond)
+	defer drain.Stop()
+	for draining := true; draining; {
+		select {
+		case data := <-ch:
+			account(data)
+		case <-drain.C:
+			draining = false
+		}
+	}
+	report()
+
+	result.Time = time.Now()
+	result.Elapsed = time.Since(started).Round(time.Second).String()
+	result.Synced = verifier.synced()
+	result.Total = total
+	sendStressReport(result)
+	broadcast <- fmt.Sprintf("Нагрузочная проверка порта %s завершена за %s: проверено битов %d, ошибок %d, BER %.3g, повторных синхронизаций %d.",
+		request.Port, result.Elapsed, total.BitsChecked, total.BitErrors, total.BER, total.Resyncs)
+}
+
+// Рассылка отчёта о проверке
+func sendStressReport(report stressReport) {
+	data, err := json.Marshal(report)
+	if err != nil {
+		broadcast <- fmt.Sprintf("Ошибка при маршалинге отчёта о проверке: %v", err)
+		return
+	}
+	broadcast <- string(data)
+}
+
+// Доля ошибочных битов
+func bitErrorRate(s stressStats) float64 {
+	if s.BitsChecked == 0 {
+		return 0
+	}
+	return float64(s.BitErrors) / float64(s.BitsChecked)
+}
+
+// Генератор и проверка последовательности для символов с dataBits битами данных
+func newStressPattern(name string, dataBits uint) (func(n int) []byte, patternVerifier) {
+	mask := byte(1<<dataBits - 1)
+	if name == "counter" {
+		var next byte
+		generate := func(n int) []byte {
+			data := make([]byte, n)
+			for i := range data {
+				data[i] = next & mask
+				next++
+			}
+			return data
+		}
+		return generate, &counterVerifier{mask: mask}
+	}
+
+	poly := prbsPolynomials[name]
+	tx := &prbsRegister{n: poly[0], m: poly[1], state: 1<<poly[0] - 1}
+	generate := func(n int) []byte {
+		data := make([]byte, n)
+		for i := range data {
+			data[i] = tx.nextChar(dataBits)
+		}
+		return data
+	}
+	return generate, &prbsVerifier{rx: prbsRegister{n: poly[0], m: poly[1]}, dataBits: dataBits}
+}
+
+// Регистр сдвига PRBS с обратной связью: очередной бит - сумма по модулю 2
+// битов n и m назад. Состояние - последние n битов последовательности.
+type prbsRegister struct {
+	n, m  uint
+	state uint32
+}
+
+// Очередной бит последовательности
+func (r *prbsRegister) nextBit() uint32 {
+	bit := (r.state>>(r.n-1) ^ r.state>>(r.m-1)) & 1
+	r.push(bit)
+	return bit
+}
+
+// Сдвиг бита в регистр
+func (r *prbsRegister) push(bit uint32) {
+	r.state = (r.state<<1 | bit) & (1<<r.n - 1)
+}
+
+// Очередной символ: биты передаются младшим вперёд, как на линии
+func (r *prbsRegister) nextChar(dataBits uint) byte {
+	var c byte
+	for i := uint(0); i < dataBits; i++ {
+		c |= byte(r.nextBit()) << i
+	}
+	return c
+}
+
+// Проверка PRBS. Приёмник заполняет регистр первыми n принятыми битами и дальше
+// сравнивает принятые биты с предсказанными. При большой доле ошибок в окне
+// синхронизация выполняется заново (например, после потери байтов).
+type prbsVerifier struct {
+	rx       prbsRegister
+	dataBits uint
+	// Число битов, собранных для синхронизации
+	filled       uint
+	windowBits   int
+	windowErrors int
+	resyncCount  int64
+}
+
+func (v *prbsVerifier) verify(data []byte) (checked, bitErrors, charErrors int64) {
+	for _, c := range data {
+		charError := false
+		for i := uint(0); i < v.dataBits; i++ {
+			bit := uint32(c>>i) & 1
+			if v.filled < v.rx.n {
+				v.rx.push(bit)
+				v.filled++
+				continue
+			}
+			checked++
+			if v.rx.nextBit() != bit {
+				bitErrors++
+				v.windowErrors++
+				charError = true
+			}
+			if v.windowBits++; v.windowBits == stressSyncWindowBits {
+				if v.windowErrors > stressSyncMaxErrors {
+					v.filled = 0
+					v.resyncCount++
+				}
+				v.windowBits, v.windowErrors = 0, 0
+			}
+		}
+		if charError {
+			charErrors++
+		}
+	}
+	return checked, bitErrors, charErrors
+}
+
+func (v *prbsVerifier) synced() bool {
+	return v.filled >= v.rx.n
+}
+
+func (v *prbsVerifier) resyncs() int64 {
+	return v.resyncCount
+}
+
+// Проверка счётчика: каждый символ на единицу больше предыдущего. После
+// ошибки ожидание продолжается от принятого символа, поэтому потерянный
+// байт даёт одну ошибку, а не сдвиг всей последовательности.
+type counterVerifier struct {
+	mask        byte
+	started     bool
+	expected    byte
+	resyncCount int64
+}
+
+func (v *counterVerifier) verify(data []byte) (checked, bitErrors, charErrors int64) {
+	for _, c := range data {
+		if v.started {
+			checked += int64(bits.OnesCount8(v.mask))
+			if diff := (c ^ v.expected) & v.mask; diff != 0 {
+				bitErrors += int64(bits.OnesCount8(diff))
+				charErrors++
+				v.resyncCount++
+			}
+		}
+		v.started = true
+		v.expected = (c + 1) & v.mask
+	}
+	return checked, bitErrors, charErrors
+}
+
+func (v *counterVerifier) synced() bool {
+	return v.started
+}
+
+func (v *counterVerifier) resyncs() int64 {
+	return v.resyncCount
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Сколько байтов с конца файла просматривается при восстановлении
+const recoveryTailSize = 1 << 20
+
+var (
+	// Размер буфера записи журналов, КБ (0 - каждая строка пишется сразу)
+	logBufferKB int
+	// Наибольшее время, которое строки журнала ждут в буфере
+	logFlushInterval = time.Second
+	// Когда сбрасывать журналы на диск (fsync): "never", "always" или период ("5s")
+	fsyncPolicy = "never"
+	// Разобранная политика: после каждой строки или с периодом (0 - не сбрасывать)
+	fsyncAlways   bool
+	fsyncInterval time.Duration
+)
+
+// Разбор политики записи журналов при запуске
+func loadLogSyncPolicy() {
+	switch fsyncPolicy {
+	case "", "never":
+	case "always":
+		fsyncAlways = true
+	default:
+		d, err := time.ParseDuration(fsyncPolicy)
+		if err != nil || d <= 0 {
+			log.Fatalf("Неверное значение -fsync %q: ожидается never, always или период, например 5s", fsyncPolicy)
+		}
+		fsyncInterval = d
+	}
+	if logChunkKB <= 0 || logChunkAge <= 0 {
+		log.Fatal("Размер -log-chunk и время -log-chunk-age блока сжатых журналов должны быть положительными.")
+	}
+	if logBufferKB < 0 {
+		log.Fatal("Размер буфера журналов -log-buffer не может быть отрицательным.")
+	}
+	if logBufferKB > 0 && logFlushInterval <= 0 {
+		log.Fatal("Период -log-flush должен быть положительным.")
+	}
+}
+
+// Сбрасываются ли данные на диск при какой-либо политике
+func fsyncEnabled() bool {
+	return fsyncAlways || fsyncInterval > 0
+}
+
+// Периодический сброс буферов журналов и fsync по политике
+func runLogFlusher() {
+	// Блоки сжатых журналов записываются не реже -log-chunk-age
+	period := logChunkAge
+	if fsyncInterval > 0 && fsyncInterval < period {
+		period = fsyncInterval
+	}
+	if logBufferKB > 0 && logFlushInterval < period {
+		period = logFlushInterval
+	}
+	for {
+		time.Sleep(period)
+		flushPortLogs(false)
+	}
+}
+
+// Сброс буферов всех открытых журналов; force - с fsync независимо от периода
+func flushPortLogs(force bool) {
+	portLogsMutex.Lock()
+	logs := make([]*portLog, 0, len(portLogs))
+	for _, l := range portLogs {
+		logs = append(logs, l)
+	}
+	portLogsMutex.Unlock()
+
+	for _, l := range logs {
+		if err := l.flush(force); err != nil {
+			logWriteFailures.Add(1)
+			log.Printf("Ошибка сброса журнала %s: %v", l.path, err)
+		}
+	}
+}
+
+// Строки из буферов и несжатые блоки не должны теряться при обычной
+// остановке сервера (Ctrl+C, systemctl stop)
+func flushLogsOnExit() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		flushPortLogs(true)
+		log.Printf("Получен сигнал %v, журналы сброшены на диск, завершаем работу.", sig)
+		os.Exit(0)
+	}()
+}
+
+// Запись файла целиком; при включённой политике -fsync данные сбрасываются на
+// диск до возврата, чтобы последующее переименование не оставило пустой файл
+func writeFileSynced(path string, data []byte, perm os.FileMode) error {
+	if !fsyncEnabled() {
+		return os.WriteFile(path, data, perm)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// fsync каталога, чтобы после сбоя питания в нём остался новый или переименованный файл
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	// Некоторые системы (Windows) не поддерживают fsync каталога
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) && !errors.Is(err, os.ErrPermission) {
+		return err
+	}
+	return nil
+}
+
+// Восстановление журналов сеансов после сбоя питания при запуске
+func recoverSessionLogs() {
+	root := dataPath(sessionsDir)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil || d.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return err
+		}
+		if _, err := recoverLogFile(path); err != nil {
+			log.Printf("Ошибка восстановления журнала %s: %v", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Ошибка проверки журналов сеансов: %v", err)
+	}
+}
+
+// Приведение журнала к последней целой записи: при сбое питания в конце файла
+// может остаться недописанная строка или нулевые байты (файловая система уже
+// увеличила размер, а данные не записала). Обрезанный хвост отмечается
+// служебной строкой. Возвращает число отброшенных байтов. Журнал, в котором
+// недописана единственная запись, обрезается до заголовка. Файл без целых
+// записей, не похожий на такой журнал, и журнал, зашифрованный другим ключом,
+// не меняются.
+func recoverLogFile(path string) (int64, error) {
+	if compressed, err := isCompressedFile(path); isCompressedLogPath(path) || err == nil && compressed {
+		return recoverCompressedLog(path)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return 0, err
+	}
+	encrypted, err := isEncryptedFile(path)
+	if err != nil {
+		return 0, err
+	}
+	dataStart := int64(0)
+	if encrypted {
+		dataStart = int64(len(encryptedFileMagic) + 1)
+	}
+
+	size := info.Size()
+	if size <= dataStart {
+		// Зашифрованный журнал только с заголовком - пустой журнал
+		return 0, nil
+	}
+	tailStart := size - recoveryTailSize
+	if tailStart < dataStart {
+		tailStart = dataStart
+	}
+	tail := make([]byte, size-tailStart)
+	if _, err := file.ReadAt(tail, tailStart); err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	// Конец последней целой строки
+	end := bytes.LastIndexByte(tail, '\n') + 1
+	for end > 0 {
+		lineStart := bytes.LastIndexByte(tail[:end-1], '\n') + 1
+		line := tail[lineStart : end-1]
+		if validLogRecord(line, encrypted) {
+			break
+		}
+		if encrypted && foreignEncryptedRecord(line) {
+			// Целая запись другим ключом - это не недописанный хвост, файл не трогаем
+			return 0, errors.New("запись журнала не расшифровывается: файл зашифрован другим ключом или изменён")
+		}
+		end = lineStart
+	}
+	if end == 0 && (tailStart > dataStart || !tornLogRecord(tail, encrypted)) {
+		// Целой записи нет - это не журнал монитора или он испорчен целиком, файл не трогаем
+		return 0, fmt.Errorf("не найдено целой записи в последних %d байтах", len(tail))
+	}
+	// Если end == 0, недописана единственная запись журнала: он обрезается до
+	// заголовка, как после сбоя при записи первой строки
+	keep := tailStart + int64(end)
+	dropped := size - keep
+	if dropped == 0 {
+		return 0, nil
+	}
+
+	if err := file.Truncate(keep); err != nil {
+		return 0, err
+	}
+	record := fmt.Sprintf("%s\t# Восстановлено после сбоя: отброшено недописанных байтов: %d\n", time.Now().Format(logTimeFormat), dropped)
+	if encrypted {
+		if storageCipher == nil {
+			// Без ключа отметку не записать, но обрезки достаточно
+			record = ""
+		} else if record, err = encryptRecord([]byte(record)); err != nil {
+			return 0, err
+		} else {
+			record += "\n"
+		}
+	}
+	if _, err := file.WriteAt([]byte(record), keep); err != nil {
+		return 0, err
+	}
+	if err := file.Sync(); err != nil {
+		return 0, err
+	}
+	log.Printf("Журнал %s восстановлен после сбоя: отброшено %d байт.", path, dropped)
+	return dropped, nil
+}
+
+// Похожа ли строка на целую запись журнала
+func validLogRecord(line []byte, encrypted bool) bool {
+	if len(line) == 0 {
+		return false
+	}
+	// Нулевые байты допустимы в данных устройства, но не в base64 и не в
+	// отметке времени: нулями заполнен хвост, который система не дописала
+	if encrypted {
+		if bytes.IndexByte(line, 0) >= 0 {
+			return false
+		}
+		if storageCipher == nil {
+			// Без ключа проверяем только, что запись - целый base64
+			return len(line)%4 == 0
+		}
+		_, err := decryptRecord(string(line))
+		return err == nil
+	}
+	stamp, _, ok := strings.Cut(string(line), "\t")
+	if !ok {
+		return false
+	}
+	_, err := time.Parse(logTimeFormat, stamp)
+	return err == nil
+}
+
+// Похожи ли данные журнала без единого перевода строки на начало записи,
+// недописанное при сбое: отметка времени по шаблону logTimeFormat (или
+// base64 в зашифрованном журнале), за которой могут идти нули
+func tornLogRecord(data []byte, encrypted bool) bool {
+	data = bytes.TrimRight(data, "\x00")
+	if bytes.IndexByte(data, '\n') >= 0 {
+		return false
+	}
+	if encrypted {
+		for _, c := range data {
+			if !strings.ContainsRune("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/=", rune(c)) {
+				return false
+			}
+		}
+		return true
+	}
+	stamp, _, ok := bytes.Cut(data, []byte("\t"))
+	if ok {
+		_, err := time.Parse(logTimeFormat, string(stamp))
+		return err == nil
+	}
+	// Начало отметки времени: цифры и разделители на своих местах, затем пояс
+	const shape = "0000-00-00T00:00:00.000000"
+	for i, c := range stamp {
+		switch {
+		case i < len(shape) && shape[i] == '0':
+			if c < '0' || c > '9' {
+				return false
+			}
+		case i < len(shape):
+			if c != shape[i] {
+				return false
+			}
+		case i == len(shape):
+			if c != 'Z' && c != '+' && c != '-' {
+				return false
+			}
+		case i > len(shape)+5 || stamp[len(shape)] == 'Z':
+			return false
+		case c != ':' && (c < '0' || c > '9'):
+			return false
+		}
+	}
+	return true
+}
+
+// Похожа ли строка зашифрованного журнала на целую запись, зашифрованную
+// другим ключом: целый base64, который не расшифровывается текущим ключом
+func foreignEncryptedRecord(line []byte) bool {
+	if storageCipher == nil || bytes.IndexByte(line, 0) >= 0 {
+		return false
+	}
+	if _, err := base64.StdEncoding.DecodeString(string(line)); err != nil {
+		return false
+	}
+	_, err := decryptRecord(string(line))
+	return err != nil
+}
+
+// Буфер записи для нового журнала, если он включён
+func newLogWriter(file *os.File) *bufio.Writer {
+	if logBufferKB == 0 {
+		return nil
+	}
+	return bufio.NewWriterSize(file, logBufferKB*1024)
+}
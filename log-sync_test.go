@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Шифр с постоянным ключом на время теста
+func useTestCipher(tb testing.TB) {
+	block, err := aes.NewCipher(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	previous := storageCipher
+	storageCipher = aead
+	tb.Cleanup(func() { storageCipher = previous })
+}
+
+// Любая запись, которую пишет журнал порта, при восстановлении считается целой:
+// иначе восстановление после сбоя отбросило бы данные устройства
+func FuzzValidLogRecord(f *testing.F) {
+	for _, seed := range []string{"TEMP 23.5", "", "\x00\x00", "a\tb", "\xff", "# комментарий"} {
+		f.Add([]byte(seed))
+	}
+	useTestCipher(f)
+	f.Fuzz(func(t *testing.T, line []byte) {
+		// Произвольные байты не должны приводить к панике
+		validLogRecord(line, false)
+		validLogRecord(line, true)
+
+		text := strings.ReplaceAll(string(line), "\n", " ")
+		record := time.Now().Format(logTimeFormat) + "\t" + text
+		if !validLogRecord([]byte(record), false) {
+			t.Fatalf("запись журнала %q не считается целой", record)
+		}
+		encrypted, err := encryptRecord([]byte(record + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !validLogRecord([]byte(encrypted), true) {
+			t.Fatalf("зашифрованная запись %q не считается целой", encrypted)
+		}
+		if len(encrypted) > 1 && validLogRecord([]byte(encrypted[:len(encrypted)-1]), true) {
+			t.Fatalf("обрезанная зашифрованная запись считается целой")
+		}
+	})
+}
+
+// Недописанный хвост журнала отбрасывается и отмечается служебной записью
+func TestRecoverLogFileTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "port.log")
+	records := "2026-01-02T15:04:05.000000Z\tTEMP 23.5\n2026-01-02T15:04:06.000000Z\tTEMP 23.6\n"
+	if err := os.WriteFile(path, []byte(records+"2026-01-02T15:04:07.0\x00\x00\x00"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dropped, err := recoverLogFile(path)
+	if err != nil || dropped != 24 {
+		t.Fatalf("отброшено %d, ошибка %v", dropped, err)
+	}
+	data, _ := os.ReadFile(path)
+	if !strings.HasPrefix(string(data), records) || !strings.Contains(string(data[len(records):]), "Восстановлено после сбоя") {
+		t.Fatalf("журнал после восстановления: %q", data)
+	}
+}
+
+// Файл, в котором нет ни одной целой записи, не трогается, каким бы маленьким он ни был
+func TestRecoverLogFileForeign(t *testing.T) {
+	for _, content := range []string{"not a log\n", "x", "\x00\x00\x00\n", "2026-01-02 15:04"} {
+		path := filepath.Join(t.TempDir(), "port.log")
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := recoverLogFile(path); err == nil {
+			t.Errorf("%q: ожидалась ошибка", content)
+		}
+		if data, _ := os.ReadFile(path); string(data) != content {
+			t.Errorf("%q: файл изменён: %q", content, data)
+		}
+	}
+}
+
+// Журнал без целых записей после сбоя при записи первой строки и зашифрованный
+// журнал только с заголовком открываются: первый обрезается до заголовка,
+// второй остаётся как есть
+func TestRecoverLogFileTornFirstRecord(t *testing.T) {
+	for _, content := range []string{"2026-01-02T15:04:05.00", "2026-01-02T15:04:05.000000+03:0", "2026-01-02T15:04:05.000000Z\tTE", "2026\x00\x00\x00"} {
+		path := filepath.Join(t.TempDir(), "port.log")
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		dropped, err := recoverLogFile(path)
+		if err != nil || dropped != int64(len(content)) {
+			t.Errorf("%q: отброшено %d, ошибка %v", content, dropped, err)
+		}
+		data, _ := os.ReadFile(path)
+		if lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"); len(lines) != 1 || !validLogRecord([]byte(lines[0]), false) {
+			t.Errorf("%q: после восстановления %q", content, data)
+		}
+	}
+
+	useTestCipher(t)
+	for _, content := range []string{encryptedFileMagic + "\n", encryptedFileMagic + "\nAbCd+/"} {
+		path := filepath.Join(t.TempDir(), "port.log")
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := recoverLogFile(path); err != nil {
+			t.Errorf("%q: %v", content, err)
+		}
+		data, _ := os.ReadFile(path)
+		if !strings.HasPrefix(string(data), encryptedFileMagic+"\n") || strings.Contains(string(data), "AbCd") {
+			t.Errorf("%q: после восстановления %q", content, data)
+		}
+	}
+}
+
+// Журнал, зашифрованный другим ключом, не считается недописанным и не обрезается
+func TestRecoverLogFileOtherKey(t *testing.T) {
+	useTestCipher(t)
+	record, err := encryptRecord([]byte("2026-01-02T15:04:05.000000Z\tTEMP 23.5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := encryptedFileMagic + "\n" + record + "\n" + record + "\n"
+	path := filepath.Join(t.TempDir(), "port.log")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ := aes.NewCipher(bytes.Repeat([]byte{8}, 32))
+	storageCipher, _ = cipher.NewGCM(block)
+	if _, err := recoverLogFile(path); err == nil {
+		t.Fatal("ожидалась ошибка для журнала с другим ключом")
+	}
+	if data, _ := os.ReadFile(path); string(data) != content {
+		t.Fatalf("файл изменён: %q", data)
+	}
+}
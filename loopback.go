@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Размер порции, которой испытательная последовательность записывается в порт
+const linkTestChunk = 256
+
+// Запрос на проверку адаптера с перемычкой TX-RX
+type loopbackRequest struct {
+	Port string `json:"port"`
+	// Число передаваемых байтов, по умолчанию 4096
+	Bytes int `json:"bytes"`
+	// Последовательность: "counter" (0, 1, ... 255 по кругу) или "random"
+	Pattern string `json:"pattern"`
+}
+
+// Итог проверки адаптера
+type loopbackResult struct {
+	Type          string  `json:"type"`
+	Port          string  `json:"port"`
+	BaudRate      int     `json:"baudRate"`
+	Framing       string  `json:"framing"`
+	Pattern       string  `json:"pattern"`
+	Sent          int     `json:"sent"`
+	Received      int     `json:"received"`
+	ByteErrors    int     `json:"byteErrors"`
+	BitErrors     int     `json:"bitErrors"`
+	ByteErrorRate float64 `json:"byteErrorRate"`
+	// Смещение первого неверного байта, -1 - ошибок нет
+	FirstErrorAt int    `json:"firstErrorAt"`
+	DurationMs   int64  `json:"durationMs"`
+	Passed       bool   `json:"passed"`
+	Error        string `json:"error,omitempty"`
+}
+
+func init() {
+	clientActions["loopbackTest"] = processLoopbackTest
+}
+
+// Проверка адаптера: последовательность передаётся в порт и должна вернуться
+// через перемычку TX-RX без изменений
+func processLoopbackTest(ws *websocket.Conn, message map[string]interface{}) {
+	var request loopbackRequest
+	if err := decodeAction(message, &request); err != nil {
+		broadcast <- fmt.Sprintf("Ошибка: неверный формат запроса проверки: %v", err)
+		return
+	}
+	if request.Port == "" {
+		request.Port = currentSettings.Port
+	}
+	if request.Bytes <= 0 {
+		request.Bytes = 4096
+	}
+	if request.Pattern == "" {
+		request.Pattern = "counter"
+	}
+	if _, err := testPattern(request.Pattern, 0, 0); err != nil {
+		broadcast <- fmt.Sprintf("Ошибка: %v", err)
+		return
+	}
+
+	broadcast <- fmt.Sprintf("Проверка порта %s по перемычке TX-RX: передаётся байтов: %d.", request.Port, request.Bytes)
+	go func() {
+		result := runLoopbackTest(request)
+		data, err := json.Marshal(result)
+		if err != nil {
+			broadcast <- fmt.Sprintf("Ошибка при маршалинге итога проверки: %v", err)
+			return
+		}
+		broadcast <- string(data)
+		broadcast <- describeLoopbackResult(result)
+	}()
+}
+
+// Выполнение проверки
+func runLoopbackTest(request loopbackRequest) loopbackResult {
+	result := loopbackResult{Type: "loopbackResult", Port: request.Port, Pattern: request.Pattern, FirstErrorAt: -1}
+	fail := func(err error) loopbackResult {
+		result.Error = err.Error()
+		return result
+	}
+
+	session := getPortSession(request.Port)
+	baudRate, framingName, ok := getPortSettings(request.Port)
+	if session == nil || !ok {
+		return fail(fmt.Errorf("порт %s не открыт", request.Port))
+	}
+	f, err := parseFraming(framingName)
+	if err != nil {
+		return fail(err)
+	}
+	result.BaudRate = baudRate
+	result.Framing = framingName
+	if result.Framing == "" {
+		result.Framing = defaultFraming
+	}
+	// Старшие биты, которых нет в формате кадра, не передаются
+	mask := byte(1<<f.DataBits - 1)
+	pattern, _ := testPattern(request.Pattern, request.Bytes, mask)
+
+	ch, err := session.beginLinkTest()
+	if err != nil {
+		return fail(err)
+	}
+	defer session.endLinkTest(ch)
+
+	started := time.Now()
+	// Запас на задержки адаптера и операционной системы
+	deadline := time.NewTimer(2*time.Duration(len(pattern))*f.charTime(baudRate) + time.Second)
+	defer deadline.Stop()
+
+	writeErr := make(chan error, 1)
+	go func() {
+		for offset := 0; offset < len(pattern); offset += linkTestChunk {
+			if err := writeToPort(request.Port, pattern[offset:min(offset+linkTestChunk, len(pattern))]); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+		writeErr <- nil
+	}()
+
+	var received []byte
+receive:
+	for len(received) < len(pattern) {
+		select {
+		case chunk := <-ch:
+			received = append(received, chunk...)
+		case err := <-writeErr:
+			if err != nil {
+				return fail(err)
+			}
+		case <-deadline.C:
+			break receive
+		}
+	}
+
+	result.DurationMs = time.Since(started).Milliseconds()
+	result.Sent = len(pattern)
+	result.Received = len(received)
+	result.ByteErrors, result.BitErrors, result.FirstErrorAt = compareTestData(pattern, received)
+	result.ByteErrorRate = float64(result.ByteErrors) / float64(result.Sent)
+	result.Passed = result.ByteErrors == 0
+	return result
+}
+
+// Сравнение переданных и полученных байтов. Недостающие байты считаются
+// ошибочными целиком, лишние не учитываются.
+func compareTestData(sent, received []byte) (byteErrors, bitErrors, firstError int) {
+	firstError = -1
+	for i, b := range sent {
+		diff := byte(0xff)
+		if i < len(received) {
+			diff = b ^ received[i]
+		}
+		if diff == 0 {
+			continue
+		}
+		if firstError < 0 {
+			firstError = i
+		}
+		byteErrors++
+		bitErrors += bits.OnesCount8(diff)
+	}
+	return byteErrors, bitErrors, firstError
+}
+
+// Пояснение итога проверки: кто виноват - адаптер или подключённое устройство
+func describeLoopbackResult(result loopbackResult) string {
+	switch {
+	case result.Error != "":
+		return fmt.Sprintf("Ошибка проверки порта %s: %s", result.Port, result.Error)
+	case result.Passed:
+		return fmt.Sprintf("Проверка порта %s пройдена: %d байтов на скорости %d вернулись без ошибок за %d мс. Адаптер исправен.",
+			result.Port, result.Sent, result.BaudRate, result.DurationMs)
+	case result.Received == 0:
+		return fmt.Sprintf("Проверка порта %s не пройдена: данные не вернулись. Проверьте перемычку TX-RX; если она на месте, неисправен адаптер.", result.Port)
+	}
+	return fmt.Sprintf("Проверка порта %s не пройдена: получено %d из %d байтов, ошибочных байтов %d (%.4f%%), первый на смещении %d.",
+		result.Port, result.Received, result.Sent, result.ByteErrors, result.ByteErrorRate*100, result.FirstErrorAt)
+}
+
+// Испытательная последовательность заданной длины. Байты ограничиваются маской
+// числа бит данных. При n == 0 только проверяется имя последовательности.
+func testPattern(name string, n int, mask byte) ([]byte, error) {
+	data := make([]byte, n)
+	switch name {
+	case "counter":
+		for i := range data {
+			data[i] = byte(i)
+		}
+	case "random":
+		rand.New(rand.NewSource(time.Now().UnixNano())).Read(data)
+	default:
+		return nil, fmt.Errorf("неизвестная испытательная последовательность %q", name)
+	}
+	for i := range data {
+		data[i] &= mask
+	}
+	return data, nil
+}
+
+// Начало проверки линии: данные порта перестают выдаваться клиентам как строки
+// и приходят только в возвращаемый канал, чтение идёт без пауз.
+// Одновременно на порту может идти только одна проверка.
+func (s *portSession) beginLinkTest() (chan []byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.linkTest {
+		return nil, fmt.Errorf("на порту %s уже идёт проверка линии", s.port)
+	}
+	s.linkTest = true
+	ch := make(chan []byte, lineSubscriptionBuffer)
+	if s.rawSubscribers == nil {
+		s.rawSubscribers = make(map[chan []byte]bool)
+	}
+	s.rawSubscribers[ch] = true
+	return ch, nil
+}
+
+// Окончание проверки линии
+func (s *portSession) endLinkTest(ch chan []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.rawSubscribers, ch)
+	s.linkTest = false
+	s.pending = s.pending[:0]
+}
+
+// Читать ли порт без пауз: во время записи интервалов и проверки линии
+func (s *portSession) fastRead() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.timing != nil || s.linkTest
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Таймаут одного чтения из порта. Без него закрытие порта ждёт завершения
+// блокирующего чтения, которое может не завершиться никогда.
+const portReadTimeout = 100 * time.Millisecond
+
+// Ошибка чтения из порта, который закрыли намеренно
+var errPortClosed = errors.New("порт закрыт")
+
+// Дополнительный последовательный порт, открытый помимо основного
+// (например, участник группы устройств)
+type managedPort struct {
+	name     string
+	baudRate int
+	port     serialConn
+	// Формат кадра, пустая строка - 8N1
+	framing string
+	// Порт закрыт намеренно
+	closed atomic.Bool
+}
+
+var (
+	// Открытые дополнительные порты, ключ - имя порта
+	managedPorts = make(map[string]*managedPort)
+	// Мьютекс для синхронизации доступа к managedPorts
+	managedPortsMutex = &sync.Mutex{}
+)
+
+// Открываем дополнительный порт с форматом кадра 8N1 и запускаем чтение из него
+func openManagedPort(name string, baudRate int) (*managedPort, error) {
+	return openManagedPortFramed(name, baudRate, "")
+}
+
+// Открываем дополнительный порт с заданным форматом кадра и запускаем чтение из него
+func openManagedPortFramed(name string, baudRate int, framing string) (*managedPort, error) {
+	p, _, err := acquireManagedPort(name, baudRate, framing)
+	return p, err
+}
+
+// Открываем дополнительный порт, если он ещё не открыт с теми же настройками.
+// opened сообщает, открыт ли порт этим вызовом: закрывать порт должен только
+// тот, кто его открыл, а не тот, кто застал его открытым.
+func acquireManagedPort(name string, baudRate int, framing string) (p *managedPort, opened bool, err error) {
+	managedPortsMutex.Lock()
+	defer managedPortsMutex.Unlock()
+
+	if p, ok := managedPorts[name]; ok {
+		if p.baudRate != baudRate {
+			return nil, false, fmt.Errorf("порт %s уже открыт со скоростью %d", name, p.baudRate)
+		}
+		if p.framing != framing {
+			return nil, false, fmt.Errorf("порт %s уже открыт с другим форматом кадра", name)
+		}
+		return p, false, nil
+	}
+	if name == currentSettings.Port && serialPort != nil {
+		return nil, false, fmt.Errorf("порт %s уже открыт как основной", name)
+	}
+	if err := checkPortQuota(name, openPortNamesLocked()); err != nil {
+		return nil, false, err
+	}
+
+	port, err := openSerialConn(name, baudRate, framing, portReadTimeout)
+	if err != nil {
+		recordPortError(name)
+		return nil, false, err
+	}
+	p = &managedPort{name: name, baudRate: baudRate, framing: framing, port: port}
+	managedPorts[name] = p
+	auditLog("system", "", "portOpen", name, map[string]interface{}{"baudRate": baudRate, "framing": framing})
+	rememberPortName(name)
+	recordPortOpen(name, true)
+	// Сеанс регистрируется сразу, чтобы режим можно было сменить до начала чтения
+	session := newPortSession(name, func(line string) {
+		deliverPortLine(name, line)
+	})
+	go p.readLoop(startPortPipeline(name, baudRate, port, session))
+
+	return p, true, nil
+}
+
+// Закрываем дополнительный порт
+func closeManagedPort(name string) {
+	managedPortsMutex.Lock()
+	p, ok := managedPorts[name]
+	delete(managedPorts, name)
+	managedPortsMutex.Unlock()
+
+	if ok {
+		p.shutdown()
+	}
+}
+
+// Закрываем порт, только если открыт всё ещё именно он: его могли закрыть
+// и открыть заново другие. Возвращает false, если порт не закрыт.
+func closeOwnedManagedPort(p *managedPort) bool {
+	managedPortsMutex.Lock()
+	owned := managedPorts[p.name] == p
+	if owned {
+		delete(managedPorts, p.name)
+	}
+	managedPortsMutex.Unlock()
+
+	if owned {
+		p.shutdown()
+	}
+	return owned
+}
+
+// Закрытие порта, уже удалённого из managedPorts
+func (p *managedPort) shutdown() {
+	p.closed.Store(true)
+	p.port.Close()
+	auditLog("system", "", "portClose", p.name, nil)
+	recordPortOpen(p.name, false)
+	stopPortLog(p.name)
+}
+
+// Получаем открытый дополнительный порт по имени
+func getManagedPort(name string) *managedPort {
+	managedPortsMutex.Lock()
+	defer managedPortsMutex.Unlock()
+
+	return managedPorts[name]
+}
+
+// Запись данных в дополнительный порт
+func (p *managedPort) write(data []byte) error {
+	if p == nil {
+		return errors.New("порт не открыт")
+	}
+	return writeToPort(p.name, data)
+}
+
+// Запись данных в любой открытый порт: дополнительный или основной
+func writeToPort(name string, data []byte) error {
+	return usePortWriter(name, len(data), 0, func(conn serialConn) (int, error) {
+		return conn.Write(data)
+	})
+}
+
+// Чтение из порта. Пустые чтения по таймауту повторяются, пока порт не закрыт.
+func (p *managedPort) Read(b []byte) (int, error) {
+	for {
+		n, err := p.port.Read(b)
+		if n > 0 {
+			return n, nil
+		}
+		if p.closed.Load() {
+			return 0, errPortClosed
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+	}
+}
+
+// Чтение данных из дополнительного порта до его закрытия
+func (p *managedPort) readLoop(pipeline *portPipeline) {
+	defer pipeline.stop()
+
+	pipeline.drain()
+	buf := make([]byte, 4096)
+	for {
+		n, err := p.Read(buf)
+		if n > 0 {
+			pipeline.push(buf[:n])
+		}
+		if err != nil {
+			// Если порт закрыли намеренно, он уже удалён из списка
+			if getManagedPort(p.name) == p {
+				broadcast <- fmt.Sprintf("Ошибка при чтении из порта %s: %v", p.name, err)
+				recordPipelineFailure(p.name, p.baudRate, p.framing, portLogPath(p.name), err)
+				closeManagedPort(p.name)
+				recordPortError(p.name)
+				dumpFlightRecorder(p.name, fmt.Sprintf("ошибка чтения: %v", err))
+			}
+			return
+		}
+	}
+}
+
+// Отправляем клиентам строку, полученную из дополнительного порта, с меткой порта
+func deliverPortLine(portName, line string) {
+	sendPortLine(portName, fmt.Sprintf("[%s] %s", portName, line), line)
+	processPortLine(portName, line)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Скорость линии MIDI
+const midiBaudRate = 31250
+
+// Запрос на отправку сообщений MIDI
+type midiRequest struct {
+	Port string `json:"port"`
+	// Сообщения в текстовом виде: "noteOn 1 60 100", "cc 1 7 127", "raw F0 7E 7F F7"
+	Messages []string `json:"messages"`
+}
+
+// Сообщения канала MIDI: байт статуса без номера канала и число байтов данных
+var midiChannelMessages = map[string]struct {
+	status   byte
+	dataSize int
+}{
+	"noteOff":    {0x80, 2},
+	"noteOn":     {0x90, 2},
+	"aftertouch": {0xA0, 2},
+	"cc":         {0xB0, 2},
+	"program":    {0xC0, 1},
+	"pressure":   {0xD0, 1},
+	"pitch":      {0xE0, 2},
+}
+
+// Системные сообщения реального времени
+var midiRealtimeMessages = map[string]byte{
+	"clock":    0xF8,
+	"start":    0xFA,
+	"continue": 0xFB,
+	"stop":     0xFC,
+	"sense":    0xFE,
+	"reset":    0xFF,
+}
+
+var (
+	// Последний отправленный байт статуса (running status), ключ - имя порта
+	midiRunningStatus = make(map[string]byte)
+	// Мьютекс для синхронизации доступа к midiRunningStatus
+	midiMutex = &sync.Mutex{}
+)
+
+func init() {
+	clientActions["midiSend"] = processMIDISend
+}
+
+// Отправка сообщений MIDI. Байт статуса не повторяется, если совпадает с предыдущим.
+func processMIDISend(ws *websocket.Conn, message map[string]interface{}) {
+	var request midiRequest
+	if err := decodeAction(message, &request); err != nil {
+		broadcast <- fmt.Sprintf("Ошибка: неверный формат запроса MIDI: %v", err)
+		return
+	}
+	if request.Port == "" {
+		request.Port = currentSettings.Port
+	}
+	if err := checkBusPort(request.Port, midiBaudRate, defaultFraming); err != nil {
+		broadcast <- fmt.Sprintf("Ошибка MIDI: %v", err)
+		return
+	}
+	if getPortPipeline(request.Port) == nil {
+		broadcast <- fmt.Sprintf("Ошибка: порт %s не открыт.", request.Port)
+		return
+	}
+
+	// Состояние running status меняется только после успешной записи
+	midiMutex.Lock()
+	defer midiMutex.Unlock()
+
+	status := midiRunningStatus[request.Port]
+	var data []byte
+	for _, text := range request.Messages {
+		var err error
+		data, status, err = encodeMIDIMessage(data, status, text)
+		if err != nil {
+			broadcast <- fmt.Sprintf("Ошибка MIDI в сообщении %q: %v", text, err)
+			return
+		}
+	}
+	if err := writeToPort(request.Port, data); err != nil {
+		delete(midiRunningStatus, request.Port)
+		broadcast <- fmt.Sprintf("Ошибка записи MIDI в порт %s: %v", request.Port, err)
+		return
+	}
+	midiRunningStatus[request.Port] = status
+	broadcast <- fmt.Sprintf("Отправлено MIDI в порт %s: сообщений %d, байтов %d.", request.Port, len(request.Messages), len(data))
+}
+
+// Кодирование сообщения MIDI с учётом running status
+func encodeMIDIMessage(data []byte, status byte, text string) ([]byte, byte, error) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return data, status, errors.New("пустое сообщение")
+	}
+	name, args := fields[0], fields[1:]
+
+	if b, ok := midiRealtimeMessages[name]; ok {
+		// Сообщения реального времени не влияют на running status
+		return append(data, b), status, nil
+	}
+	if name == "raw" {
+		raw, err := hex.DecodeString(strings.Join(args, ""))
+		if err != nil {
+			return data, status, err
+		}
+		for _, b := range raw {
+			switch {
+			case b >= 0xF8:
+			case b >= 0xF0:
+				status = 0
+			case b >= 0x80:
+				status = b
+			}
+		}
+		return append(data, raw...), status, nil
+	}
+
+	msg, ok := midiChannelMessages[name]
+	if !ok {
+		return data, status, fmt.Errorf("неизвестное сообщение %q", name)
+	}
+	if len(args) != msg.dataSize+1 && !(name == "pitch" && len(args) == 2) {
+		return data, status, fmt.Errorf("ожидается канал и %d параметра", msg.dataSize)
+	}
+	channel, err := strconv.Atoi(args[0])
+	if err != nil || channel < 1 || channel > 16 {
+		return data, status, fmt.Errorf("неверный канал %q", args[0])
+	}
+	var values []byte
+	if name == "pitch" && len(args) == 2 {
+		// Изменение высоты тона задаётся одним числом 0..16383
+		bend, err := strconv.Atoi(args[1])
+		if err != nil || bend < 0 || bend > 0x3FFF {
+			return data, status, fmt.Errorf("неверное значение %q", args[1])
+		}
+		values = []byte{byte(bend & 0x7F), byte(bend >> 7)}
+	} else {
+		for _, arg := range args[1:] {
+			v, err := strconv.Atoi(arg)
+			if err != nil || v < 0 || v > 127 {
+				return data, status, fmt.Errorf("неверное значение %q", arg)
+			}
+			values = append(values, byte(v))
+		}
+	}
+
+	b := msg.status | byte(channel-1)
+	if b != status {
+		data = append(data, b)
+		status = b
+	}
+	return append(data, values...), status, nil
+}
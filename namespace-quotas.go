@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"time"
+)
+
+// Открытые порты: основной и дополнительные. Вызывается под managedPortsMutex.
+func openPortNamesLocked() []string {
+	names := make([]string, 0, len(managedPorts)+1)
+	for name := range managedPorts {
+		names = append(names, name)
+	}
+	if serialPort != nil && currentSettings.Port != "" {
+		names = append(names, currentSettings.Port)
+	}
+	return names
+}
+
+// Проверка квоты открытых портов пространства, которому принадлежит порт
+func checkPortQuota(port string, open []string) error {
+	ns := portNamespace(port)
+	if ns == nil || ns.MaxOpenPorts == 0 || stringInSlice(port, open) {
+		return nil
+	}
+	count := 0
+	for _, name := range open {
+		if portNamespace(name) == ns {
+			count++
+		}
+	}
+	if count >= ns.MaxOpenPorts {
+		return fmt.Errorf("превышена квота пространства %s: открыто портов %d из %d, закройте один из них", ns.Name, count, ns.MaxOpenPorts)
+	}
+	return nil
+}
+
+// Проверка квоты перед сменой основного порта. Прежний основной порт
+// закрывается, поэтому не учитывается.
+func checkMainPortQuota(port string) error {
+	managedPortsMutex.Lock()
+	open := openPortNamesLocked()
+	managedPortsMutex.Unlock()
+
+	others := open[:0]
+	for _, name := range open {
+		if name != currentSettings.Port {
+			others = append(others, name)
+		}
+	}
+	return checkPortQuota(port, others)
+}
+
+// Место, занятое файлами пространства: журналами, снимками и отчётами
+func namespaceStorageSize(ns *namespace) int64 {
+	var size int64
+	for _, dir := range storedDataDirs {
+		filepath.WalkDir(dataPath(filepath.Join(dir, ns.Name)), func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+			return nil
+		})
+	}
+	return size
+}
+
+// Проверка квоты места под журналы. Учёт ведётся по записанным строкам, а при
+// превышении место пересчитывается по диску: часть файлов могли удалить.
+func (ns *namespace) checkStorageQuota() error {
+	if ns == nil || ns.MaxLogMB == 0 {
+		return nil
+	}
+	limit := int64(ns.MaxLogMB) * 1024 * 1024
+	if ns.storageUsed.Load() < limit {
+		return nil
+	}
+	used := namespaceStorageSize(ns)
+	ns.storageUsed.Store(used)
+	if used < limit {
+		return nil
+	}
+	return fmt.Errorf("превышена квота хранения пространства %s: занято %.1f МБ из %d МБ", ns.Name, float64(used)/1024/1024, ns.MaxLogMB)
+}
+
+// Учёт данных, передаваемых клиенту пространства. Возвращает, укладывается ли
+// сообщение в квоту, и начало текущего секундного окна.
+func (ns *namespace) takeBandwidth(n int) (bool, time.Time) {
+	ns.bandwidthMutex.Lock()
+	defer ns.bandwidthMutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(ns.bandwidthWindow) >= time.Second {
+		ns.bandwidthWindow = now
+		ns.bandwidthBytes = 0
+	}
+	if ns.MaxBandwidthKBps == 0 || ns.bandwidthBytes+n <= ns.MaxBandwidthKBps*1024 {
+		ns.bandwidthBytes += n
+		return true, ns.bandwidthWindow
+	}
+	return false, ns.bandwidthWindow
+}
+
+// Постановка данных порта в очередь клиента пространства имён с учётом квоты
+// пропускной способности. Сверх квоты сообщения теряются, а клиент один раз
+// за секундное окно получает об этом уведомление.
+func (c *wsClient) enqueueLimited(msg string) {
+	ok, window := c.namespace.takeBandwidth(len(msg))
+	if ok {
+		c.enqueueData(msg)
+		return
+	}
+	if !c.quotaNoticeAt.Equal(window) {
+		c.quotaNoticeAt = window
+		c.enqueue(fmt.Sprintf("Превышена квота пространства %s: поток данных клиентам больше %d КБ/с, часть сообщений пропущена.", c.namespace.Name, c.namespace.MaxBandwidthKBps))
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// Пространство имён: часть сервера, выделенная команде или проекту. Клиенты
+// пространства видят и открывают только его устройства, а журналы его портов
+// хранятся в отдельном каталоге.
+type namespace struct {
+	Name string `json:"name"`
+	// Токены доступа, по которым клиент сразу попадает в пространство
+	Tokens []string `json:"tokens,omitempty"`
+	// Пользователи (по результату проверки подлинности), относящиеся к пространству
+	Users []string `json:"users,omitempty"`
+	// Шаблоны имён разрешённых портов, например "/dev/ttyUSB*" или "COM1?"
+	Devices []string `json:"devices"`
+
+	// Квоты пространства (см. namespace-quotas.go), 0 - без ограничения:
+	// одновременно открытые порты, место под журналы и поток данных клиентам
+	MaxOpenPorts     int `json:"maxOpenPorts,omitempty"`
+	MaxLogMB         int `json:"maxLogMB,omitempty"`
+	MaxBandwidthKBps int `json:"maxBandwidthKBps,omitempty"`
+
+	// Место, занятое файлами пространства, байт
+	storageUsed atomic.Int64
+	// Объём данных, переданных клиентам пространства за текущую секунду
+	bandwidthMutex  sync.Mutex
+	bandwidthWindow time.Time
+	bandwidthBytes  int
+}
+
+// Ключ контекста запроса, под которым хранится пространство имён клиента
+type namespaceKey struct{}
+
+// Строка данных порта, которую получают только клиенты с доступом к порту
+type portMessage struct {
+	port string
+	text string
+	// Строка устройства без оформления, если сообщение - строка данных порта:
+	// клиенты типизированного протокола получают её с меткой и цветом порта
+	line   string
+	isLine bool
+}
+
+var (
+	// Файл с описанием пространств имён
+	namespacesPath string
+	// Пространства имён в порядке описания. Если список пуст, сервер не разделён.
+	namespaces []*namespace
+	// Канал для отправки строк портов подключенным клиентам
+	portMessages = make(chan portMessage)
+
+	// Имена портов из последнего списка, по ним ищутся упоминания чужих портов
+	knownPortNames []string
+	// Мьютекс для синхронизации доступа к knownPortNames
+	knownPortNamesMutex = &sync.Mutex{}
+)
+
+// Загрузка пространств имён при запуске
+func loadNamespaces() {
+	if namespacesPath == "" {
+		return
+	}
+	data, err := os.ReadFile(namespacesPath)
+	if err == nil {
+		err = json.Unmarshal(data, &namespaces)
+	}
+	if err == nil {
+		err = validateNamespaces(namespaces)
+	}
+	if err != nil {
+		log.Fatalf("Ошибка загрузки пространств имён: %v", err)
+	}
+	for _, ns := range namespaces {
+		ns.storageUsed.Store(namespaceStorageSize(ns))
+	}
+	log.Printf("Пространств имён: %d", len(namespaces))
+}
+
+// Проверка описания пространств: имена служат каталогами журналов,
+// а токен должен однозначно определять пространство
+func validateNamespaces(list []*namespace) error {
+	names := make(map[string]bool)
+	tokens := make(map[string]bool)
+	for _, ns := range list {
+		if ns.Name == "" || ns.Name == "." || ns.Name == ".." || unsafeFileChars.MatchString(ns.Name) {
+			return fmt.Errorf("недопустимое имя пространства %q", ns.Name)
+		}
+		if names[ns.Name] {
+			return fmt.Errorf("пространство %s описано дважды", ns.Name)
+		}
+		names[ns.Name] = true
+		for _, pattern := range ns.Devices {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("неверный шаблон устройств %q пространства %s", pattern, ns.Name)
+			}
+		}
+		if ns.MaxOpenPorts < 0 || ns.MaxLogMB < 0 || ns.MaxBandwidthKBps < 0 {
+			return fmt.Errorf("отрицательная квота пространства %s", ns.Name)
+		}
+		for _, token := range ns.Tokens {
+			if token == "" || tokens[token] || token == accessToken {
+				return fmt.Errorf("пустой или повторяющийся токен пространства %s", ns.Name)
+			}
+			tokens[token] = true
+		}
+	}
+	return nil
+}
+
+// Пространство, которому принадлежит токен
+func namespaceByToken(token string) *namespace {
+	if token == "" {
+		return nil
+	}
+	for _, ns := range namespaces {
+		for _, t := range ns.Tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				return ns
+			}
+		}
+	}
+	return nil
+}
+
+// Пространство, к которому отнесён пользователь. Пользователи, не указанные
+// ни в одном пространстве, работают со всем сервером.
+func namespaceByUser(identity string) *namespace {
+	for _, ns := range namespaces {
+		if stringInSlice(identity, ns.Users) {
+			return ns
+		}
+	}
+	return nil
+}
+
+// Сохраняем в контексте запроса, кто его выполняет и в каком пространстве.
+// Имя пользователя пространства дополняется именем пространства, чтобы оно
+// попадало в журнал аудита.
+func withIdentity(r *http.Request, identity string, ns *namespace) *http.Request {
+	ctx := r.Context()
+	if ns != nil {
+		identity = ns.Name + "/" + identity
+		ctx = context.WithValue(ctx, namespaceKey{}, ns)
+	}
+	return r.WithContext(context.WithValue(ctx, identityKey{}, identity))
+}
+
+// Пространство, в котором выполняется запрос, или nil для всего сервера
+func requestNamespace(r *http.Request) *namespace {
+	ns, _ := r.Context().Value(namespaceKey{}).(*namespace)
+	return ns
+}
+
+// Пространство клиента WebSocket
+func clientNamespace(ws *websocket.Conn) *namespace {
+	if client := getWSClient(ws); client != nil {
+		return client.namespace
+	}
+	return nil
+}
+
+// Доступен ли порт пространству. Без пространства доступны все порты.
+func (ns *namespace) allowsPort(port string) bool {
+	if ns == nil {
+		return true
+	}
+	for _, pattern := range ns.Devices {
+		if ok, _ := path.Match(pattern, port); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Пространство, которому принадлежит порт: первое по порядку описания,
+// которому он доступен
+func portNamespace(port string) *namespace {
+	for _, ns := range namespaces {
+		if ns.allowsPort(port) {
+			return ns
+		}
+	}
+	return nil
+}
+
+// Каталог данных для файлов порта: у портов пространства - свой подкаталог
+func namespacedDir(dir, port string) string {
+	if ns := portNamespace(port); ns != nil {
+		return filepath.Join(dir, ns.Name)
+	}
+	return dir
+}
+
+// Доступен ли пространству сохранённый файл (идентификатор вида "sessions/lab/...")
+func (ns *namespace) allowsStoredFile(id string) bool {
+	if ns == nil {
+		return true
+	}
+	for _, dir := range storedDataDirs {
+		if strings.HasPrefix(id, dir+"/"+ns.Name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Запоминаем имена портов из нового списка
+func rememberPortNames(ports []string) {
+	knownPortNamesMutex.Lock()
+	defer knownPortNamesMutex.Unlock()
+
+	knownPortNames = append([]string(nil), ports...)
+}
+
+// Запоминаем имя открытого порта, которого может не быть в списке
+// (например, порт, указанный клиентом вручную)
+func rememberPortName(port string) {
+	knownPortNamesMutex.Lock()
+	defer knownPortNamesMutex.Unlock()
+
+	if !stringInSlice(port, knownPortNames) {
+		knownPortNames = append(knownPortNames, port)
+	}
+}
+
+// Сообщения для клиента пространства вместо общего сообщения. Список портов
+// сокращается до доступных, а сообщения о чужих портах не передаются.
+func (ns *namespace) filterMessage(msg string) []string {
+	if strings.HasPrefix(msg, portListPrefix) {
+		// Текст отправляется вместе с сокращённым списком, который идёт следом
+		return nil
+	}
+	var ports []string
+	if strings.HasPrefix(msg, "[") && json.Unmarshal([]byte(msg), &ports) == nil {
+		allowed := []string{}
+		for _, port := range ports {
+			if ns.allowsPort(port) {
+				allowed = append(allowed, port)
+			}
+		}
+		data, _ := json.Marshal(allowed)
+		if len(allowed) == 0 {
+			return []string{noPortsMessage, string(data)}
+		}
+		return []string{fmt.Sprintf("%s%v", portListPrefix, allowed), string(data)}
+	}
+	var event struct {
+		Type string `json:"type"`
+		Port string `json:"port"`
+	}
+	if strings.HasPrefix(msg, "{") && json.Unmarshal([]byte(msg), &event) == nil {
+		if event.Type == "portMetadata" {
+			return ns.filterPortMetadata(msg)
+		}
+		if event.Port != "" {
+			if ns.allowsPort(event.Port) {
+				return []string{msg}
+			}
+			return nil
+		}
+	}
+
+	knownPortNamesMutex.Lock()
+	defer knownPortNamesMutex.Unlock()
+
+	for _, port := range knownPortNames {
+		if !ns.allowsPort(port) && mentionsPort(msg, port) {
+			return nil
+		}
+	}
+	return []string{msg}
+}
+
+// Упоминается ли порт в тексте. "/dev/ttyUSB1" не считается упомянутым
+// в "/dev/ttyUSB10".
+func mentionsPort(msg, port string) bool {
+	if port == "" {
+		return false
+	}
+	for offset := 0; ; {
+		i := strings.Index(msg[offset:], port)
+		if i < 0 {
+			return false
+		}
+		end := offset + i + len(port)
+		if end == len(msg) {
+			return true
+		}
+		next, _ := utf8.DecodeRuneInString(msg[end:])
+		if !unicode.IsLetter(next) && !unicode.IsDigit(next) {
+			return true
+		}
+		offset = end
+	}
+}
+
+// Метаданные только доступных пространству портов
+func (ns *namespace) filterPortMetadata(msg string) []string {
+	var meta portMetadataMessage
+	if err := json.Unmarshal([]byte(msg), &meta); err != nil {
+		return nil
+	}
+	for port := range meta.Ports {
+		if !ns.allowsPort(port) {
+			delete(meta.Ports, port)
+		}
+	}
+	meta.Devices = groupCompositeDevices(meta.Ports)
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil
+	}
+	return []string{string(data)}
+}
+
+// Действия, которым не нужен основной порт, если порт не указан
+var portlessActions = []string{
+	"hello", "setStreamMode", "listTriggers", "listRedactions", "listProbes",
+	"listShares", "revokeShare", "peripheralProfiles", "getPortMeta", "timelineUnsubscribe",
+	"listReservations", "notifyTest", "setPreference", "getPreferences",
+	"replaySession", "replayStop",
+}
+
+// Проверка, что сообщение клиента пространства касается только его портов
+func checkNamespaceAccess(ns *namespace, message map[string]interface{}) error {
+	if ns == nil {
+		return nil
+	}
+	action, _ := message["action"].(string)
+	for _, field := range []string{"sequenceFile", "reportFile"} {
+		if _, ok := message[field]; ok {
+			return fmt.Errorf("файлы сервера недоступны в пространстве %s", ns.Name)
+		}
+	}
+	if action == "timelineSubscribe" {
+		if ports, _ := message["ports"].([]interface{}); len(ports) == 0 {
+			return fmt.Errorf("в пространстве %s нужно перечислить порты ленты", ns.Name)
+		}
+	}
+
+	for _, port := range targetPorts(message) {
+		if !ns.allowsPort(port) {
+			return fmt.Errorf("порт %s недоступен в пространстве %s", port, ns.Name)
+		}
+	}
+	return nil
+}
+
+// Порты, на которые подействует сообщение клиента. Порядок разбора тот же,
+// что в processSettings: команда без новых настроек всегда уходит в основной порт.
+func targetPorts(message map[string]interface{}) []string {
+	action, _ := message["action"].(string)
+	ports := messagePorts(message)
+	_, hasBaudRate := message["baudRate"]
+	_, hasCommand := message["command"]
+	if hasCommand && (message["port"] == nil || !hasBaudRate) {
+		ports = []string{currentSettings.Port}
+	}
+	if len(ports) == 0 && !stringInSlice(action, portlessActions) {
+		ports = []string{currentSettings.Port}
+	}
+	return ports
+}
+
+// Порты, которых касается сообщение клиента
+func messagePorts(message map[string]interface{}) []string {
+	var ports []string
+	for _, field := range []string{"port", "rxPort"} {
+		if port, ok := message[field].(string); ok && port != "" {
+			ports = append(ports, port)
+		}
+	}
+	if list, ok := message["ports"].([]interface{}); ok {
+		for _, item := range list {
+			if port, ok := item.(string); ok {
+				ports = append(ports, port)
+			}
+		}
+	}
+	if seq, ok := message["sequence"].(map[string]interface{}); ok {
+		if port, ok := seq["port"].(string); ok && port != "" {
+			ports = append(ports, port)
+		}
+	}
+	if group, ok := message["group"].(string); ok {
+		deviceGroupsMutex.Lock()
+		if g := deviceGroups[group]; g != nil {
+			ports = append(ports, g.ports...)
+		}
+		deviceGroupsMutex.Unlock()
+	}
+	return ports
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tarm/serial"
+	"golang.org/x/sys/unix"
+)
+
+// Последовательный порт, настроенный напрямую через termios2. Нужен для того,
+// что не умеет библиотека serial: чётность mark/space, смена чётности на лету и break.
+type nativePort struct {
+	file *os.File
+	fd   int
+	// Мьютекс для синхронизации изменения настроек
+	mutex   sync.Mutex
+	termios unix.Termios
+}
+
+// Скорости, которые умеет устанавливать библиотека serial
+var standardBaudRates = map[int]bool{
+	50: true, 75: true, 110: true, 134: true, 150: true, 200: true, 300: true, 600: true,
+	1200: true, 1800: true, 2400: true, 4800: true, 9600: true, 19200: true, 38400: true,
+	57600: true, 115200: true, 230400: true, 460800: true, 500000: true, 576000: true,
+	921600: true, 1000000: true, 1152000: true, 1500000: true, 2000000: true,
+	2500000: true, 3000000: true, 3500000: true, 4000000: true,
+}
+
+// Нужен ли порту собственный драйвер: для чётности mark/space, нестандартной
+// скорости (DMX512 - 250000, MIDI - 31250) и сигнала break
+func nativePortRequired(baudRate int, f framing) bool {
+	return f.stickParity() || !standardBaudRates[baudRate]
+}
+
+// Открываем порт с заданным форматом кадра
+func openNativePort(name string, baudRate int, f framing, readTimeout time.Duration) (serialConn, error) {
+	file, err := os.OpenFile(name, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0666)
+	if err != nil {
+		return nil, err
+	}
+	p := &nativePort{file: file, fd: int(file.Fd())}
+
+	cflag, err := framingFlags(f)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	p.termios = unix.Termios{
+		Cflag:  unix.CREAD | unix.CLOCAL | unix.BOTHER | cflag,
+		Ispeed: uint32(baudRate),
+		Ospeed: uint32(baudRate),
+	}
+	// Чётность принятых байтов не проверяется: при 9-битной адресации
+	// "ошибка чётности" означает адресный байт, и терять его нельзя
+	if readTimeout > 0 {
+		p.termios.Cc[unix.VMIN] = 0
+		p.termios.Cc[unix.VTIME] = uint8(max(1, min(255, readTimeout/(100*time.Millisecond))))
+	} else {
+		p.termios.Cc[unix.VMIN] = 1
+	}
+
+	if err := unix.IoctlSetTermios(p.fd, unix.TCSETS2, &p.termios); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := unix.SetNonblock(p.fd, false); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// Флаги termios для формата кадра
+func framingFlags(f framing) (uint32, error) {
+	var cflag uint32
+	switch f.DataBits {
+	case 5:
+		cflag |= unix.CS5
+	case 6:
+		cflag |= unix.CS6
+	case 7:
+		cflag |= unix.CS7
+	default:
+		cflag |= unix.CS8
+	}
+	switch f.StopBits {
+	case serial.Stop1:
+	case serial.Stop2:
+		cflag |= unix.CSTOPB
+	default:
+		return 0, serial.ErrBadStopBits
+	}
+	return cflag | parityFlags(f.Parity), nil
+}
+
+// Флаги termios для чётности
+func parityFlags(parity serial.Parity) uint32 {
+	switch parity {
+	case serial.ParityOdd:
+		return unix.PARENB | unix.PARODD
+	case serial.ParityEven:
+		return unix.PARENB
+	case serial.ParityMark:
+		return unix.PARENB | unix.CMSPAR | unix.PARODD
+	case serial.ParitySpace:
+		return unix.PARENB | unix.CMSPAR
+	}
+	return 0
+}
+
+func (p *nativePort) Read(b []byte) (int, error) {
+	return p.file.Read(b)
+}
+
+// Число принятых, но ещё не прочитанных байтов во входной очереди ОС
+func (p *nativePort) inputQueued() (int, error) {
+	return unix.IoctlGetInt(p.fd, unix.TIOCINQ)
+}
+
+func (p *nativePort) Write(b []byte) (int, error) {
+	return p.file.Write(b)
+}
+
+func (p *nativePort) Close() error {
+	return p.file.Close()
+}
+
+// Смена чётности после того, как уже записанные байты ушли в линию
+func (p *nativePort) setParity(parity serial.Parity) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.termios.Cflag &^= unix.PARENB | unix.PARODD | unix.CMSPAR
+	p.termios.Cflag |= parityFlags(parity)
+	return unix.IoctlSetTermios(p.fd, unix.TCSETSW2, &p.termios)
+}
+
+// Смена формата кадра после того, как уже записанные байты ушли в линию
+func (p *nativePort) setFraming(f framing) error {
+	cflag, err := framingFlags(f)
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.termios.Cflag &^= unix.CSIZE | unix.CSTOPB | unix.PARENB | unix.PARODD | unix.CMSPAR
+	p.termios.Cflag |= cflag
+	return unix.IoctlSetTermios(p.fd, unix.TCSETSW2, &p.termios)
+}
+
+// Сигнал break заданной длительности после того, как записанные байты ушли в линию
+func (p *nativePort) sendBreak(d time.Duration) error {
+	if err := unix.IoctlSetInt(p.fd, unix.TCSBRK, 1); err != nil {
+		return err
+	}
+	if err := unix.IoctlSetInt(p.fd, unix.TIOCSBRK, 0); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	return unix.IoctlSetInt(p.fd, unix.TIOCCBRK, 0)
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+
+package main
+
+import (
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+// Нужен ли порту собственный драйвер. Вне Linux все порты открываются библиотекой serial.
+func nativePortRequired(baudRate int, f framing) bool {
+	return f.stickParity()
+}
+
+// Открываем порт с заданным форматом кадра средствами библиотеки serial.
+// Чётность mark/space поддерживается только в Windows.
+func openNativePort(name string, baudRate int, f framing, readTimeout time.Duration) (serialConn, error) {
+	return serial.OpenPort(&serial.Config{
+		Name:        name,
+		Baud:        baudRate,
+		Size:        f.DataBits,
+		Parity:      f.Parity,
+		StopBits:    f.StopBits,
+		ReadTimeout: readTimeout,
+	})
+}
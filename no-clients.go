@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Что делать с данными портов, пока не подключён ни один клиент
+const (
+	// Данные никому не доставляются (прежнее поведение)
+	noClientDiscard = "discard"
+	// Сообщения портов накапливаются и отправляются первому подключившемуся клиенту
+	noClientBuffer = "buffer"
+	// Строки портов записываются в журналы сеансов до подключения клиента
+	noClientLog = "log"
+)
+
+var (
+	// Политика для данных без клиентов (-no-clients)
+	noClientPolicy = noClientDiscard
+	// Сколько последних сообщений портов хранится без клиентов
+	noClientBufferSize = 10000
+
+	// Число подключённых клиентов, не считая клиентов совместного просмотра.
+	// Меняется под clientsMutex, чтобы накопление и выдача сообщений не разошлись.
+	connectedClients atomic.Int32
+	// Сообщения портов, полученные без клиентов, и число вытесненных из-за предела
+	unattendedMessages []portMessage
+	unattendedDropped  int
+	// Журналы, начатые из-за отсутствия клиентов: ключ - имя порта, значение -
+	// путь журнала или "", если начать его не удалось
+	unattendedLogs = make(map[string]string)
+	// Мьютекс для синхронизации доступа к unattendedMessages и unattendedLogs
+	unattendedMutex = &sync.Mutex{}
+)
+
+// Проверка политики при запуске
+func loadNoClientPolicy() {
+	switch noClientPolicy {
+	case noClientDiscard, noClientBuffer, noClientLog:
+	default:
+		log.Fatalf("Неизвестная политика -no-clients %q (discard, buffer, log).", noClientPolicy)
+	}
+	if noClientPolicy == noClientBuffer && noClientBufferSize <= 0 {
+		log.Fatal("Размер -no-clients-buffer должен быть больше нуля.")
+	}
+}
+
+// Сообщение порта, которое некому доставить. Вызывается из handleMessages под clientsMutex.
+func bufferUnattendedMessage(msg portMessage) {
+	if noClientPolicy != noClientBuffer {
+		return
+	}
+	unattendedMutex.Lock()
+	defer unattendedMutex.Unlock()
+
+	unattendedMessages = append(unattendedMessages, msg)
+	if extra := len(unattendedMessages) - noClientBufferSize; extra > 0 {
+		unattendedDropped += extra
+		unattendedMessages = append(unattendedMessages[:0], unattendedMessages[extra:]...)
+	}
+}
+
+// Регистрация клиента и выдача накопленных без клиентов сообщений его портов.
+// Вызывается под clientsMutex, поэтому сообщения не теряются и не меняют порядок.
+func attachClient(ns *namespace) []string {
+	connectedClients.Add(1)
+
+	unattendedMutex.Lock()
+	defer unattendedMutex.Unlock()
+
+	if len(unattendedMessages) == 0 {
+		return nil
+	}
+	var backlog []string
+	var rest []portMessage
+	for _, msg := range unattendedMessages {
+		if ns.allowsPort(msg.port) {
+			backlog = append(backlog, msg.text)
+		} else {
+			rest = append(rest, msg)
+		}
+	}
+	unattendedMessages = rest
+	if len(backlog) == 0 {
+		return nil
+	}
+	header := fmt.Sprintf("Данные портов, полученные без подключённых клиентов: сообщений: %d.", len(backlog))
+	if unattendedDropped > 0 {
+		header = fmt.Sprintf("Данные портов, полученные без подключённых клиентов: сообщений: %d, более ранние вытеснены: %d.", len(backlog), unattendedDropped)
+		unattendedDropped = 0
+	}
+	backlog = append([]string{header}, backlog...)
+	return append(backlog, "Конец данных, полученных без подключённых клиентов.")
+}
+
+// Остановка журналов, начатых из-за отсутствия клиентов. Возвращает пути
+// журналов портов, доступных клиенту.
+func stopUnattendedLogs(ns *namespace) []string {
+	unattendedMutex.Lock()
+	defer unattendedMutex.Unlock()
+
+	var paths []string
+	for port, path := range unattendedLogs {
+		delete(unattendedLogs, port)
+		// Журнал мог заменить пользователь - его не трогаем
+		if path == "" || portLogPath(port) != path {
+			continue
+		}
+		writePortLogComment(port, "Подключился клиент, запись без клиентов остановлена")
+		stopPortLog(port)
+		if ns.allowsPort(port) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Отключение клиента
+func detachClient() {
+	connectedClients.Add(-1)
+}
+
+// Начало журнала порта, если клиентов нет и политика - запись в журнал.
+// Порт, журнал которого уже ведётся, не трогается.
+func startUnattendedLog(port string) {
+	if noClientPolicy != noClientLog || connectedClients.Load() > 0 {
+		return
+	}
+	unattendedMutex.Lock()
+	defer unattendedMutex.Unlock()
+
+	// Клиент мог подключиться, пока ждали мьютекс: stopUnattendedLogs
+	// вызывается после увеличения счётчика и под тем же мьютексом
+	if connectedClients.Load() > 0 {
+		return
+	}
+	if _, ok := unattendedLogs[port]; ok || portLogPath(port) != "" {
+		return
+	}
+	name := fmt.Sprintf("unattended_%s_%s.log",
+		unsafeFileChars.ReplaceAllString(filepath.Base(port), "_"),
+		time.Now().Format("20060102-150405"))
+	if err := startPortLog(port, name); err != nil {
+		// Повторно не пытаемся до подключения клиента, чтобы не засорять журнал сервера
+		log.Printf("Не удалось начать запись порта %s без клиентов: %v", port, err)
+		unattendedLogs[port] = ""
+		return
+	}
+	unattendedLogs[port] = portLogPath(port)
+	writePortLogComment(port, "Клиенты не подключены, данные записываются до подключения клиента")
+	log.Printf("Клиенты не подключены, данные порта %s записываются в %s.", port, unattendedLogs[port])
+}
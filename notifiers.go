@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Настройки отправки оповещений по почте и в Telegram
+type notifyConfig struct {
+	SMTP     *smtpNotifier     `json:"smtp,omitempty"`
+	Telegram *telegramNotifier `json:"telegram,omitempty"`
+	// Наименьший промежуток между одинаковыми оповещениями, например "1m"
+	MinInterval string `json:"minInterval,omitempty"`
+
+	minInterval time.Duration
+}
+
+// Отправка оповещений по почте
+type smtpNotifier struct {
+	// Адрес сервера: "smtp.example.com:587"
+	Addr     string   `json:"addr"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+// Отправка оповещений ботом Telegram
+type telegramNotifier struct {
+	Token  string `json:"token"`
+	ChatID string `json:"chatId"`
+	// Адрес Bot API, по умолчанию https://api.telegram.org
+	APIURL string `json:"apiURL,omitempty"`
+}
+
+// Оповещение: тема и текст
+type alert struct {
+	Subject string
+	Text    string
+}
+
+// Запрос на отправку пробного оповещения
+type notifyTestRequest struct {
+	Text string `json:"text"`
+}
+
+var (
+	// Файл с настройками оповещений
+	notifyConfigPath string
+	// Действующие настройки. Если nil, оповещения не отправляются.
+	notifications *notifyConfig
+	// Очередь оповещений на отправку
+	alerts = make(chan alert, 100)
+	// Когда отправлялось оповещение с такой темой
+	lastAlertAt = make(map[string]time.Time)
+	// Мьютекс для синхронизации доступа к lastAlertAt
+	lastAlertMutex = &sync.Mutex{}
+	// Клиент HTTP для Bot API
+	notifyHTTPClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+func init() {
+	clientActions["notifyTest"] = processNotifyTest
+}
+
+// Загрузка настроек оповещений при запуске
+func loadNotifyConfig() {
+	if notifyConfigPath == "" {
+		return
+	}
+	data, err := os.ReadFile(notifyConfigPath)
+	if err != nil {
+		log.Fatalf("Ошибка чтения настроек оповещений: %v", err)
+	}
+	config := &notifyConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		log.Fatalf("Ошибка разбора настроек оповещений: %v", err)
+	}
+	if err := config.validate(); err != nil {
+		log.Fatalf("Ошибка в настройках оповещений: %v", err)
+	}
+	notifications = config
+	go sendAlerts()
+	log.Printf("Оповещения: %s", strings.Join(config.channels(), ", "))
+}
+
+func (c *notifyConfig) validate() error {
+	var err error
+	if c.minInterval, err = parseOptionalDuration(c.MinInterval); err != nil {
+		return err
+	}
+	if c.MinInterval == "" {
+		c.minInterval = time.Minute
+	}
+	if c.SMTP == nil && c.Telegram == nil {
+		return fmt.Errorf("не указан ни один способ отправки")
+	}
+	if s := c.SMTP; s != nil {
+		if _, _, err := net.SplitHostPort(s.Addr); err != nil {
+			return fmt.Errorf("неверный адрес почтового сервера %q", s.Addr)
+		}
+		if s.From == "" || len(s.To) == 0 {
+			return fmt.Errorf("не указаны отправитель или получатели почты")
+		}
+	}
+	if t := c.Telegram; t != nil {
+		if t.Token == "" || t.ChatID == "" {
+			return fmt.Errorf("не указаны токен бота или чат Telegram")
+		}
+		if t.APIURL == "" {
+			t.APIURL = "https://api.telegram.org"
+		}
+	}
+	return nil
+}
+
+// Названия настроенных способов отправки
+func (c *notifyConfig) channels() []string {
+	var names []string
+	if c.SMTP != nil {
+		names = append(names, "smtp")
+	}
+	if c.Telegram != nil {
+		names = append(names, "telegram")
+	}
+	return names
+}
+
+// Постановка оповещения в очередь. Оповещение с той же темой не чаще,
+// чем раз в minInterval; при переполнении очереди оповещение теряется.
+func notifyAlert(subject, text string) {
+	if notifications == nil {
+		return
+	}
+	lastAlertMutex.Lock()
+	if last, ok := lastAlertAt[subject]; ok && time.Since(last) < notifications.minInterval {
+		lastAlertMutex.Unlock()
+		return
+	}
+	lastAlertAt[subject] = time.Now()
+	lastAlertMutex.Unlock()
+
+	if instanceName != "" {
+		subject = fmt.Sprintf("[%s] %s", instanceName, subject)
+	}
+	select {
+	case alerts <- alert{Subject: subject, Text: text}:
+	default:
+		log.Printf("Очередь оповещений переполнена, оповещение пропущено: %s", subject)
+	}
+}
+
+// Отправка оповещений из очереди всеми настроенными способами
+func sendAlerts() {
+	for a := range alerts {
+		if s := notifications.SMTP; s != nil {
+			if err := s.send(a); err != nil {
+				log.Printf("Ошибка отправки оповещения по почте: %v", err)
+			}
+		}
+		if t := notifications.Telegram; t != nil {
+			if err := t.send(a); err != nil {
+				log.Printf("Ошибка отправки оповещения в Telegram: %v", err)
+			}
+		}
+	}
+}
+
+func (s *smtpNotifier) send(a alert) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, _ := net.SplitHostPort(s.Addr)
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	msg := &bytes.Buffer{}
+	fmt.Fprintf(msg, "From: %s\r\n", s.From)
+	fmt.Fprintf(msg, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", a.Subject))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(a.Text, "\n", "\r\n"))
+	msg.WriteString("\r\n")
+	return smtp.SendMail(s.Addr, auth, s.From, s.To, msg.Bytes())
+}
+
+func (t *telegramNotifier) send(a alert) error {
+	body, err := json.Marshal(map[string]string{
+		"chat_id": t.ChatID,
+		"text":    a.Subject + "\n" + a.Text,
+	})
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/bot%s/sendMessage", strings.TrimSuffix(t.APIURL, "/"), t.Token)
+	resp, err := notifyHTTPClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// Ошибка содержит адрес с токеном бота
+		return fmt.Errorf("%s", strings.ReplaceAll(err.Error(), t.Token, "***"))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Bot API ответил %s", resp.Status)
+	}
+	return nil
+}
+
+// Отправка пробного оповещения, чтобы проверить настройки
+func processNotifyTest(ws *websocket.Conn, message map[string]interface{}) {
+	var request notifyTestRequest
+	if err := decodeAction(message, &request); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неверный формат запроса: %v", err)}
+		return
+	}
+	if notifications == nil {
+		directMessages <- clientMessage{ws, "Ошибка: оповещения не настроены (-notify)."}
+		return
+	}
+	if request.Text == "" {
+		request.Text = "Пробное оповещение монитора последовательного порта."
+	}
+	notifyAlert("Пробное оповещение "+time.Now().Format(time.TimeOnly), request.Text)
+	directMessages <- clientMessage{ws, fmt.Sprintf("Пробное оповещение отправлено: %s.", strings.Join(notifications.channels(), ", "))}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Имя файла с профилями периферийных устройств в каталоге данных
+const peripheralProfilesFile = "peripheral-profiles.json"
+
+// Шаблон запроса к периферийному устройству и разбора его ответа
+type peripheralTemplate struct {
+	// Отправляемые данные: текст или байты в шестнадцатеричном виде
+	Send    string `json:"send,omitempty"`
+	SendHex string `json:"sendHex,omitempty"`
+	// Двоичный ответ фиксированной длины. Если 0, ответом считается строка.
+	ResponseBytes int `json:"responseBytes,omitempty"`
+	// Регулярное выражение строки ответа, по умолчанию - любая непустая строка
+	Expect  string `json:"expect,omitempty"`
+	Timeout string `json:"timeout,omitempty"`
+	// Декодер ответа: escposPrinter, escposOffline, escposError, escposPaper или sics
+	Decoder string `json:"decoder,omitempty"`
+}
+
+// Профиль периферийного устройства: набор шаблонов запросов
+type peripheralProfile struct {
+	Name string `json:"name"`
+	// Встроенный протокол, шаблоны которого дополняет профиль: escpos или sics
+	Protocol string                        `json:"protocol,omitempty"`
+	Requests map[string]peripheralTemplate `json:"requests"`
+}
+
+// Запрос клиента к периферийному устройству
+type peripheralQueryRequest struct {
+	Port    string `json:"port"`
+	Profile string `json:"profile"`
+	Request string `json:"request"`
+}
+
+// Разобранный ответ периферийного устройства
+type peripheralResponse struct {
+	Type    string `json:"type"`
+	Port    string `json:"port"`
+	Profile string `json:"profile"`
+	Request string `json:"request"`
+	// Ответ как есть: строка или байты в шестнадцатеричном виде
+	Raw    string                 `json:"raw,omitempty"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+	Error  string                 `json:"error,omitempty"`
+}
+
+// Встроенные профили: запросы состояния ESC/POS (DLE EOT n) и команды весов Mettler SICS
+var builtinPeripheralProfiles = map[string]*peripheralProfile{
+	"escpos": {
+		Name: "escpos",
+		Requests: map[string]peripheralTemplate{
+			"printerStatus": {SendHex: "100401", ResponseBytes: 1, Decoder: "escposPrinter"},
+			"offlineStatus": {SendHex: "100402", ResponseBytes: 1, Decoder: "escposOffline"},
+			"errorStatus":   {SendHex: "100403", ResponseBytes: 1, Decoder: "escposError"},
+			"paperStatus":   {SendHex: "100404", ResponseBytes: 1, Decoder: "escposPaper"},
+		},
+	},
+	"sics": {
+		Name: "sics",
+		Requests: map[string]peripheralTemplate{
+			"weight":          {Send: "S\r\n", Expect: `^(S|ES|ET|EL)\b`, Decoder: "sics"},
+			"weightImmediate": {Send: "SI\r\n", Expect: `^(S|ES|ET|EL)\b`, Decoder: "sics"},
+			"zero":            {Send: "Z\r\n", Expect: `^(Z|ES|ET|EL)\b`, Decoder: "sics"},
+			"tare":            {Send: "T\r\n", Expect: `^(T|ES|ET|EL)\b`, Decoder: "sics"},
+			"serialNumber":    {Send: "I4\r\n", Expect: `^(I4|ES|ET|EL)\b`, Decoder: "sics"},
+		},
+	},
+}
+
+// Декодеры ответов по имени
+var peripheralDecoders = map[string]func(raw []byte) (map[string]interface{}, error){
+	"escposPrinter": decodeESCPOSStatus(map[string]int{"drawerPin3High": 2, "offline": 3, "waitingOnlineRecovery": 5, "feedButtonPressed": 6}),
+	"escposOffline": decodeESCPOSStatus(map[string]int{"coverOpen": 2, "feedingByButton": 3, "paperEndStop": 5, "errorOccurred": 6}),
+	"escposError":   decodeESCPOSStatus(map[string]int{"mechanicalError": 2, "autocutterError": 3, "unrecoverableError": 5, "autoRecoverableError": 6}),
+	"escposPaper":   decodeESCPOSPaper,
+	"sics":          decodeSICS,
+}
+
+// Значения поля состояния в ответах SICS
+var sicsStatuses = map[string]string{
+	"S": "stable",
+	"D": "dynamic",
+	"A": "done",
+	"I": "busy",
+	"L": "logicalError",
+	"+": "overload",
+	"-": "underload",
+}
+
+// Ответы SICS об ошибке
+var sicsErrors = map[string]string{
+	"ES": "синтаксическая ошибка: команда не распознана",
+	"ET": "ошибка передачи",
+	"EL": "логическая ошибка: команда не может быть выполнена",
+}
+
+var (
+	// Профили из файла, ключ - имя профиля
+	peripheralProfiles = make(map[string]*peripheralProfile)
+	// Мьютекс для синхронизации доступа к peripheralProfiles
+	peripheralProfilesMutex = &sync.Mutex{}
+)
+
+func init() {
+	clientActions["peripheralQuery"] = processPeripheralQuery
+	clientActions["peripheralProfiles"] = processPeripheralProfiles
+}
+
+// Загрузка профилей периферийных устройств при запуске
+func loadPeripheralProfiles() {
+	var saved []*peripheralProfile
+	if err := loadJSONFile(peripheralProfilesFile, &saved); err != nil {
+		log.Printf("Ошибка загрузки профилей периферийных устройств: %v", err)
+		return
+	}
+
+	peripheralProfilesMutex.Lock()
+	defer peripheralProfilesMutex.Unlock()
+
+	for _, profile := range saved {
+		if base := builtinPeripheralProfiles[profile.Protocol]; base != nil {
+			requests := make(map[string]peripheralTemplate)
+			for name, t := range base.Requests {
+				requests[name] = t
+			}
+			for name, t := range profile.Requests {
+				requests[name] = t
+			}
+			profile.Requests = requests
+		} else if profile.Protocol != "" {
+			log.Printf("Профиль %s: неизвестный протокол %q", profile.Name, profile.Protocol)
+			continue
+		}
+		peripheralProfiles[profile.Name] = profile
+	}
+}
+
+// Получаем профиль по имени: из файла или встроенный
+func getPeripheralProfile(name string) *peripheralProfile {
+	peripheralProfilesMutex.Lock()
+	defer peripheralProfilesMutex.Unlock()
+
+	if profile := peripheralProfiles[name]; profile != nil {
+		return profile
+	}
+	return builtinPeripheralProfiles[name]
+}
+
+// Отправка запроса периферийному устройству и разбор ответа
+func processPeripheralQuery(ws *websocket.Conn, message map[string]interface{}) {
+	var request peripheralQueryRequest
+	if err := decodeAction(message, &request); err != nil {
+		broadcast <- fmt.Sprintf("Ошибка: неверный формат запроса к устройству: %v", err)
+		return
+	}
+	if request.Port == "" {
+		request.Port = currentSettings.Port
+	}
+
+	response := peripheralResponse{
+		Type:    "peripheralResponse",
+		Port:    request.Port,
+		Profile: request.Profile,
+		Request: request.Request,
+	}
+	raw, fields, err := queryPeripheral(request)
+	response.Raw = raw
+	response.Fields = fields
+	if err != nil {
+		response.Error = err.Error()
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		broadcast <- fmt.Sprintf("Ошибка при маршалинге ответа устройства: %v", err)
+		return
+	}
+	broadcast <- string(data)
+}
+
+// Выполнение запроса по шаблону профиля
+func queryPeripheral(request peripheralQueryRequest) (string, map[string]interface{}, error) {
+	profile := getPeripheralProfile(request.Profile)
+	if profile == nil {
+		return "", nil, fmt.Errorf("профиль %q не найден", request.Profile)
+	}
+	template, ok := profile.Requests[request.Request]
+	if !ok {
+		return "", nil, fmt.Errorf("в профиле %s нет запроса %q", profile.Name, request.Request)
+	}
+	data := []byte(template.Send)
+	if template.SendHex != "" {
+		var err error
+		if data, err = hex.DecodeString(template.SendHex); err != nil {
+			return "", nil, fmt.Errorf("неверные байты запроса: %v", err)
+		}
+	}
+	timeout, err := parseOptionalDuration(template.Timeout)
+	if err != nil {
+		return "", nil, err
+	}
+	if timeout == 0 {
+		timeout = 2 * time.Second
+	}
+
+	var raw []byte
+	var rawText string
+	if template.ResponseBytes > 0 {
+		if raw, err = queryBinary(request.Port, data, template.ResponseBytes, timeout); err != nil {
+			return "", nil, err
+		}
+		rawText = hex.EncodeToString(raw)
+	} else {
+		expect := template.Expect
+		if expect == "" {
+			expect = "."
+		}
+		re, err := regexp.Compile(expect)
+		if err != nil {
+			return "", nil, fmt.Errorf("неверное выражение ответа: %v", err)
+		}
+		sub := subscribeLines(request.Port)
+		defer sub.close()
+		if err := writeToPort(request.Port, data); err != nil {
+			return "", nil, err
+		}
+		if rawText, _, err = sub.expect(re, timeout); err != nil {
+			return "", nil, err
+		}
+		raw = []byte(rawText)
+	}
+
+	if template.Decoder == "" {
+		return rawText, nil, nil
+	}
+	decode, ok := peripheralDecoders[template.Decoder]
+	if !ok {
+		return rawText, nil, fmt.Errorf("неизвестный декодер %q", template.Decoder)
+	}
+	fields, err := decode(raw)
+	return rawText, fields, err
+}
+
+// Отправка запроса и ожидание двоичного ответа заданной длины
+func queryBinary(port string, data []byte, size int, timeout time.Duration) ([]byte, error) {
+	session := getPortSession(port)
+	if session == nil {
+		return nil, fmt.Errorf("порт %s не открыт", port)
+	}
+	ch := session.subscribeRaw()
+	defer session.unsubscribeRaw(ch)
+
+	if err := writeToPort(port, data); err != nil {
+		return nil, err
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	var response []byte
+	for len(response) < size {
+		select {
+		case chunk := <-ch:
+			response = append(response, chunk...)
+		case <-deadline.C:
+			return response, fmt.Errorf("за %v получено байтов ответа: %d из %d", timeout, len(response), size)
+		}
+	}
+	return response[:size], nil
+}
+
+// Список профилей и их запросов для клиента
+func processPeripheralProfiles(ws *websocket.Conn, message map[string]interface{}) {
+	profiles := make(map[string][]string)
+	collect := func(profile *peripheralProfile) {
+		var names []string
+		for name := range profile.Requests {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		profiles[profile.Name] = names
+	}
+	for _, profile := range builtinPeripheralProfiles {
+		collect(profile)
+	}
+	peripheralProfilesMutex.Lock()
+	for _, profile := range peripheralProfiles {
+		collect(profile)
+	}
+	peripheralProfilesMutex.Unlock()
+
+	data, err := json.Marshal(map[string]interface{}{"type": "peripheralProfiles", "profiles": profiles})
+	if err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка при маршалинге списка профилей: %v", err)}
+		return
+	}
+	directMessages <- clientMessage{ws, string(data)}
+}
+
+// Декодер байта состояния ESC/POS (DLE EOT): каждому полю соответствует номер бита
+func decodeESCPOSStatus(bits map[string]int) func(raw []byte) (map[string]interface{}, error) {
+	return func(raw []byte) (map[string]interface{}, error) {
+		if len(raw) != 1 {
+			return nil, errors.New("ожидается один байт состояния")
+		}
+		b := raw[0]
+		// Биты 1 и 4 всегда равны 1, биты 0 и 7 - 0
+		if b&0x93 != 0x12 {
+			return nil, fmt.Errorf("байт %02x не похож на байт состояния ESC/POS", b)
+		}
+		fields := make(map[string]interface{})
+		for name, bit := range bits {
+			fields[name] = b&(1<<bit) != 0
+		}
+		return fields, nil
+	}
+}
+
+// Декодер состояния датчиков бумаги ESC/POS (DLE EOT 4)
+func decodeESCPOSPaper(raw []byte) (map[string]interface{}, error) {
+	fields, err := decodeESCPOSStatus(nil)(raw)
+	if err != nil {
+		return nil, err
+	}
+	fields["paperNearEnd"] = raw[0]&0x0C != 0
+	fields["paperEnd"] = raw[0]&0x60 != 0
+	return fields, nil
+}
+
+// Декодер ответа SICS: "<команда> <состояние> <значение> <единица>", например "S S     100.00 g"
+func decodeSICS(raw []byte) (map[string]interface{}, error) {
+	tokens := strings.Fields(string(raw))
+	if len(tokens) == 0 {
+		return nil, errors.New("пустой ответ")
+	}
+	fields := map[string]interface{}{"command": tokens[0]}
+	if msg, ok := sicsErrors[tokens[0]]; ok {
+		return fields, errors.New(msg)
+	}
+	if len(tokens) < 2 {
+		return fields, errors.New("в ответе нет состояния")
+	}
+	status, ok := sicsStatuses[tokens[1]]
+	if !ok {
+		status = tokens[1]
+	}
+	fields["status"] = status
+
+	rest := tokens[2:]
+	if len(rest) == 0 {
+		return fields, nil
+	}
+	if value, err := strconv.ParseFloat(rest[0], 64); err == nil {
+		fields["value"] = value
+		if len(rest) > 1 {
+			fields["unit"] = rest[1]
+		}
+		return fields, nil
+	}
+	fields["value"] = strings.Trim(strings.Join(rest, " "), `"`)
+	return fields, nil
+}
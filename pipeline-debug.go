@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Сколько байтов данных показывать в отладочном событии
+const pipelineEventDataLimit = 64
+
+// Отладочное событие цепочки обработки: данные отброшены, изменены или помечены
+type pipelineEvent struct {
+	Type  string    `json:"type"`
+	Port  string    `json:"port"`
+	Time  time.Time `json:"time"`
+	Stage string    `json:"stage"`
+	// "dropped", "transformed", "buffered" или "flagged"
+	Event  string `json:"event"`
+	Detail string `json:"detail"`
+	// Начало данных в шестнадцатеричном виде
+	DataHex string `json:"dataHex,omitempty"`
+}
+
+// Отправка отладочного события, если оно включено для порта. Вызывается под s.mutex.
+// Данные события видят все подписчики отладки, поэтому к ним уже должны быть
+// применены правила скрытия.
+func (s *portSession) debugEvent(stage, event, detail string, data []byte) {
+	if !s.debug {
+		return
+	}
+	message, err := json.Marshal(pipelineEvent{
+		Type:    "pipelineEvent",
+		Port:    s.port,
+		Time:    time.Now(),
+		Stage:   stage,
+		Event:   event,
+		Detail:  detail,
+		DataHex: hex.EncodeToString(data[:min(len(data), pipelineEventDataLimit)]),
+	})
+	if err != nil {
+		log.Printf("Ошибка при маршалинге события обработки: %v", err)
+		return
+	}
+	sendPortMessage(s.port, string(message))
+}
+
+// Пометки строки, которые не мешают её выдаче: неверный UTF-8 и
+// несовпадение контрольной суммы NMEA. Вызывается под s.mutex.
+// Исходные байты строки в событие не попадают: правила скрытия к ним ещё не применены.
+func (s *portSession) debugCheckLine(raw []byte, line string) {
+	if !s.debug {
+		return
+	}
+	if s.charset == nil && !utf8.Valid(raw) {
+		s.debugEvent("encoding", "flagged", "строка содержит байты, недопустимые в UTF-8", nil)
+	}
+	if ok, checked := nmeaChecksumValid(line); checked && !ok {
+		s.debugEvent("checksum", "flagged", "неверная контрольная сумма NMEA", []byte(line))
+	}
+}
+
+// Проверка контрольной суммы строки NMEA ("$GPGGA,...*47"). Второе значение -
+// была ли строка похожа на NMEA с контрольной суммой.
+func nmeaChecksumValid(line string) (bool, bool) {
+	if !strings.HasPrefix(line, "$") && !strings.HasPrefix(line, "!") {
+		return false, false
+	}
+	star := strings.LastIndexByte(line, '*')
+	if star < 0 || len(line)-star != 3 {
+		return false, false
+	}
+	expected, err := strconv.ParseUint(line[star+1:], 16, 8)
+	if err != nil {
+		return false, false
+	}
+	var sum byte
+	for i := 1; i < star; i++ {
+		sum ^= line[i]
+	}
+	return sum == byte(expected), true
+}
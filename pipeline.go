@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Способы разбора данных порта
+const (
+	decoderText   = "text"
+	decoderBinary = "binary"
+	decoderHex    = "hex"
+)
+
+// Кодировка текста по умолчанию
+const defaultEncoding = "utf-8"
+
+// Настройки обработки данных порта. Меняются на лету, без переоткрытия порта,
+// и сохраняются до перезапуска сервера, даже если порт закрывают.
+type pipelineConfig struct {
+	Decoder  string   `json:"decoder"`
+	Encoding string   `json:"encoding"`
+	Include  []string `json:"include,omitempty"`
+	Exclude  []string `json:"exclude,omitempty"`
+	// Отладочные события: что цепочка отбросила, изменила или пометила
+	Debug bool `json:"debug,omitempty"`
+}
+
+// Запрос на изменение обработки. Не указанные поля не меняются.
+type pipelineRequest struct {
+	Port     string    `json:"port"`
+	Decoder  *string   `json:"decoder"`
+	Encoding *string   `json:"encoding"`
+	Include  *[]string `json:"include"`
+	Exclude  *[]string `json:"exclude"`
+	Framing  *string   `json:"framing"`
+	Debug    *bool     `json:"debug"`
+}
+
+// Ступень обработки в описании цепочки
+type pipelineStage struct {
+	Stage string `json:"stage"`
+	Value string `json:"value,omitempty"`
+}
+
+// Описание обработки данных порта для клиента
+type pipelineMessage struct {
+	Type string `json:"type"`
+	Port string `json:"port"`
+	Open bool   `json:"open"`
+	pipelineConfig
+	Framing string `json:"framing,omitempty"`
+	// Ступени в порядке прохождения данных
+	Chain []pipelineStage `json:"chain"`
+}
+
+var (
+	// Настройки обработки портов, ключ - имя порта
+	pipelineConfigs = make(map[string]pipelineConfig)
+	// Мьютекс для синхронизации доступа к pipelineConfigs
+	pipelineConfigsMutex = &sync.Mutex{}
+)
+
+func init() {
+	clientActions["setPipeline"] = processSetPipeline
+	clientActions["getPipeline"] = processGetPipeline
+}
+
+// Настройки обработки порта, по умолчанию - строки текста в UTF-8 без фильтров
+func getPipelineConfig(port string) pipelineConfig {
+	pipelineConfigsMutex.Lock()
+	defer pipelineConfigsMutex.Unlock()
+
+	config, ok := pipelineConfigs[port]
+	if !ok {
+		config = pipelineConfig{Decoder: decoderText, Encoding: defaultEncoding}
+	}
+	return config
+}
+
+func setPipelineConfig(port string, config pipelineConfig) {
+	pipelineConfigsMutex.Lock()
+	defer pipelineConfigsMutex.Unlock()
+
+	pipelineConfigs[port] = config
+}
+
+// Проверка настроек и подготовка кодировки и фильтров
+func (c pipelineConfig) compile() (charset *[128]rune, include, exclude []*regexp.Regexp, err error) {
+	switch c.Decoder {
+	case decoderText, decoderBinary, decoderHex:
+	default:
+		return nil, nil, nil, fmt.Errorf("неизвестный способ разбора %q, ожидается text, binary или hex", c.Decoder)
+	}
+	if c.Encoding != defaultEncoding {
+		if charset = charsetTables[c.Encoding]; charset == nil {
+			return nil, nil, nil, fmt.Errorf("неизвестная кодировка %q", c.Encoding)
+		}
+	}
+	compileAll := func(patterns []string) ([]*regexp.Regexp, error) {
+		var list []*regexp.Regexp
+		for _, pattern := range patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("неверное выражение фильтра %q: %v", pattern, err)
+			}
+			list = append(list, re)
+		}
+		return list, nil
+	}
+	if include, err = compileAll(c.Include); err != nil {
+		return nil, nil, nil, err
+	}
+	if exclude, err = compileAll(c.Exclude); err != nil {
+		return nil, nil, nil, err
+	}
+	return charset, include, exclude, nil
+}
+
+// Применение проверенных настроек к сеансу
+func (s *portSession) applyPipeline(config pipelineConfig) {
+	charset, include, exclude, err := config.compile()
+	if err != nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.charset, s.include, s.exclude = charset, include, exclude
+	s.debug = config.Debug
+	if s.decoder != config.Decoder {
+		s.setDecoder(config.Decoder)
+	}
+}
+
+// Выдача строки, если она проходит фильтры. Вызывается под s.mutex.
+func (s *portSession) deliverFiltered(line string) {
+	if len(s.include) > 0 && firstMatch(s.include, line) == nil {
+		s.debugEvent("include", "dropped", "строка не подходит ни под один фильтр include", []byte(line))
+		return
+	}
+	if re := firstMatch(s.exclude, line); re != nil {
+		s.debugEvent("exclude", "dropped", "строка подходит под фильтр exclude "+re.String(), []byte(line))
+		return
+	}
+	s.deliverLine(line)
+}
+
+// Первое выражение из списка, под которое подходит строка
+func firstMatch(list []*regexp.Regexp, line string) *regexp.Regexp {
+	for _, re := range list {
+		if re.MatchString(line) {
+			return re
+		}
+	}
+	return nil
+}
+
+// Байты в шестнадцатеричном виде через пробел: "48 65 6C"
+func hexDump(data []byte) string {
+	parts := make([]string, len(data))
+	for i, b := range data {
+		parts[i] = hex.EncodeToString([]byte{b})
+	}
+	return strings.Join(parts, " ")
+}
+
+// Изменение обработки данных порта на лету
+func processSetPipeline(ws *websocket.Conn, message map[string]interface{}) {
+	var request pipelineRequest
+	if err := decodeAction(message, &request); err != nil {
+		broadcast <- fmt.Sprintf("Ошибка: неверный формат запроса обработки: %v", err)
+		return
+	}
+	if request.Port == "" {
+		request.Port = currentSettings.Port
+	}
+
+	config := getPipelineConfig(request.Port)
+	if request.Decoder != nil {
+		config.Decoder = *request.Decoder
+	}
+	if request.Encoding != nil {
+		config.Encoding = strings.ToLower(*request.Encoding)
+	}
+	if request.Include != nil {
+		config.Include = *request.Include
+	}
+	if request.Exclude != nil {
+		config.Exclude = *request.Exclude
+	}
+	if request.Debug != nil {
+		config.Debug = *request.Debug
+	}
+	if _, _, _, err := config.compile(); err != nil {
+		broadcast <- fmt.Sprintf("Ошибка: %v", err)
+		return
+	}
+
+	if request.Framing != nil {
+		if _, framingName, ok := getPortSettings(request.Port); ok && framingName != *request.Framing {
+			reopened, err := changePortFraming(request.Port, *request.Framing)
+			if err != nil {
+				broadcast <- fmt.Sprintf("Ошибка смены формата кадра порта %s: %v", request.Port, err)
+				return
+			}
+			if reopened {
+				broadcast <- fmt.Sprintf("Драйвер порта %s не меняет формат кадра на лету, порт переоткрыт.", request.Port)
+			}
+		} else if !ok {
+			broadcast <- fmt.Sprintf("Ошибка: порт %s не открыт, формат кадра задаётся при открытии.", request.Port)
+			return
+		}
+	}
+
+	setPipelineConfig(request.Port, config)
+	if session := getPortSession(request.Port); session != nil {
+		session.applyPipeline(config)
+	}
+	broadcast <- pipelineDescription(request.Port)
+}
+
+// Отправка описания обработки данных порта запросившему клиенту
+func processGetPipeline(ws *websocket.Conn, message map[string]interface{}) {
+	var request pipelineRequest
+	if err := decodeAction(message, &request); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неверный формат запроса: %v", err)}
+		return
+	}
+	if request.Port == "" {
+		request.Port = currentSettings.Port
+	}
+	directMessages <- clientMessage{ws, pipelineDescription(request.Port)}
+}
+
+// Описание действующей цепочки обработки порта в виде JSON-сообщения
+func pipelineDescription(port string) string {
+	config := getPipelineConfig(port)
+	msg := pipelineMessage{Type: "pipeline", Port: port, pipelineConfig: config}
+	_, framingName, open := getPortSettings(port)
+	msg.Open = open
+	if open {
+		msg.Framing = framingName
+		if msg.Framing == "" {
+			msg.Framing = defaultFraming
+		}
+		msg.Chain = append(msg.Chain, pipelineStage{Stage: "framing", Value: msg.Framing})
+	}
+	msg.Chain = append(msg.Chain, pipelineStage{Stage: "decoder", Value: config.Decoder})
+	if config.Decoder == decoderText {
+		msg.Chain = append(msg.Chain,
+			pipelineStage{Stage: "encoding", Value: config.Encoding},
+			pipelineStage{Stage: "lines"})
+		redactionMutex.RLock()
+		rules := len(redactionRules)
+		redactionMutex.RUnlock()
+		if rules > 0 {
+			msg.Chain = append(msg.Chain, pipelineStage{Stage: "redaction", Value: fmt.Sprintf("%d", rules)})
+		}
+	}
+	if config.Decoder != decoderBinary {
+		for _, pattern := range config.Include {
+			msg.Chain = append(msg.Chain, pipelineStage{Stage: "include", Value: pattern})
+		}
+		for _, pattern := range config.Exclude {
+			msg.Chain = append(msg.Chain, pipelineStage{Stage: "exclude", Value: pattern})
+		}
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Sprintf("Ошибка при маршалинге описания обработки: %v", err)
+	}
+	return string(data)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Наибольший объём и наибольшее время слива данных, накопившихся в буфере ОС
+// до открытия порта
+const (
+	maxPreSessionBytes = 64 << 10
+	maxPreSessionDrain = 250 * time.Millisecond
+)
+
+// Сливать ли при открытии порта данные, накопившиеся до начала сеанса.
+// Действует только для портов, которые сообщают размер входной очереди ОС.
+var preSessionDrain = true
+
+// Порт, который сообщает, сколько байтов ждёт во входной очереди ОС
+type inputQueuer interface {
+	inputQueued() (int, error)
+}
+
+// Первый этап чтения открытого порта: байты, принятые ОС до начала сеанса
+// (остатки прошлого сеанса, вывод устройства до открытия), выдаются отдельным
+// помеченным сообщением и не попадают в разбор строк, чтобы не испортить
+// первую строку сеанса.
+//
+// Возвращает число слитых байтов.
+//
+// Читается ровно входная очередь в момент открытия. Порт, который не
+// сообщает её размер, не сливается: отличить накопленные байты от вывода
+// устройства сразу после открытия (например, сообщений при загрузке) нельзя,
+// и они остаются данными сеанса.
+func drainPreSession(conn serialConn, session *portSession) int {
+	if !preSessionDrain || conn == nil {
+		return 0
+	}
+	q, ok := conn.(inputQueuer)
+	if !ok {
+		return 0
+	}
+	n, err := q.inputQueued()
+	if err != nil || n == 0 {
+		return 0
+	}
+	want := min(n, maxPreSessionBytes)
+
+	var data []byte
+	buf := make([]byte, 4096)
+	deadline := time.Now().Add(maxPreSessionDrain)
+	for len(data) < want && time.Now().Before(deadline) {
+		n, err := conn.Read(buf[:min(len(buf), want-len(data))])
+		data = append(data, buf[:n]...)
+		if n == 0 || err != nil {
+			break
+		}
+	}
+	if len(data) > 0 {
+		session.feedPreSession(data)
+	}
+	return len(data)
+}
+
+// Выдача данных, накопившихся до начала сеанса: они сохраняются самописцем
+// и записью порции данных, а клиентам и в журнал идут одним помеченным сообщением
+func (s *portSession) feedPreSession(data []byte) {
+	now := time.Now()
+	s.mutex.Lock()
+	s.lastDataAt = now
+	recordFlight(s.port, data, now)
+	recordCapture(s.port, data)
+	s.mutex.Unlock()
+
+	text := escapeFlightLine(redactBytes(data))
+	sendPortMessage(s.port, fmt.Sprintf("Данные из буфера ОС до начала сеанса порта %s (байтов: %d): %s", s.port, len(data), text))
+	writePortLogComment(s.port, fmt.Sprintf("Данные из буфера ОС до начала сеанса (байтов: %d): %s", len(data), text))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// Узел дерева ioreg: "  | +-o Имя@14200000  <class IOUSBHostDevice, ...>"
+	ioregNode = regexp.MustCompile(`^([ |]*)\+-o .*<class (\w+)`)
+	// Свойство узла: "  |   "locationID" = 337641472"
+	ioregProperty = regexp.MustCompile(`"([^"]+)" = (.+)$`)
+)
+
+// Устройство USB из вывода ioreg
+type ioregUSBDevice struct {
+	indent     int
+	locationID uint32
+	product    string
+	// Интерфейс устройства, узел которого выведен последним
+	iface     string
+	ifaceName string
+}
+
+// Расположение портов по данным ioreg. Порты - потомки устройств USB в дереве
+// IOService, а locationID устройства содержит номер шины и цепочку портов хабов.
+func portLocations() map[string]*portLocation {
+	locations := make(map[string]*portLocation)
+
+	out, err := exec.Command("ioreg", "-l", "-w0", "-r", "-c", "IOUSBHostDevice").Output()
+	if err != nil {
+		return locations
+	}
+
+	// Цепочка устройств USB от корня до текущего узла
+	var stack []*ioregUSBDevice
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := ioregNode.FindStringSubmatch(line); m != nil {
+			indent := len(m[1])
+			for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+				stack = stack[:len(stack)-1]
+			}
+			switch m[2] {
+			case "IOUSBHostDevice", "IOUSBDevice":
+				stack = append(stack, &ioregUSBDevice{indent: indent})
+			case "IOUSBHostInterface", "IOUSBInterface":
+				if len(stack) > 0 {
+					stack[len(stack)-1].iface = ""
+					stack[len(stack)-1].ifaceName = ""
+				}
+			}
+			continue
+		}
+		m := ioregProperty.FindStringSubmatch(line)
+		if m == nil || len(stack) == 0 {
+			continue
+		}
+		device := stack[len(stack)-1]
+		switch m[1] {
+		case "locationID":
+			if device.locationID == 0 {
+				id, _ := strconv.ParseUint(m[2], 10, 32)
+				device.locationID = uint32(id)
+			}
+		case "USB Product Name":
+			if device.product == "" {
+				device.product = strings.Trim(m[2], `"`)
+			}
+		case "bInterfaceNumber":
+			device.iface = m[2]
+		case "kUSBString":
+			device.ifaceName = strings.Trim(m[2], `"`)
+		case "IOCalloutDevice", "IODialinDevice":
+			topology := usbTopologyFromLocationID(device.locationID)
+			locations[strings.Trim(m[2], `"`)] = &portLocation{
+				FriendlyName: device.product,
+				BusPath:      topology.String(),
+				InstanceID:   "0x" + strconv.FormatUint(uint64(device.locationID), 16),
+				Device:       topology.String(),
+				Interface:    device.iface,
+				Channel:      device.ifaceName,
+				USB:          topology,
+			}
+		}
+	}
+	return locations
+}
+
+// Разбор locationID: старший байт - шина, далее по полубайту на порт каждого
+// хаба от корня, пока не встретится ноль (0x14230000 - шина 0x14, порты 2 и 3)
+func usbTopologyFromLocationID(id uint32) *usbTopology {
+	topology := &usbTopology{Bus: int(id >> 24)}
+	for shift := 20; shift >= 0; shift -= 4 {
+		port := int(id>>shift) & 0xf
+		if port == 0 {
+			break
+		}
+		topology.Ports = append(topology.Ports, port)
+	}
+	return topology
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Имя интерфейса USB в sysfs: <шина>-<порты через точку>:<конфигурация>.<интерфейс>
+var usbInterfaceName = regexp.MustCompile(`^(\d+)-([\d.]+):\d+\.(\d+)$`)
+
+// Расположение портов по данным sysfs: устройство tty поднимается до
+// интерфейса USB, имя которого содержит цепочку портов хабов.
+func portLocations() map[string]*portLocation {
+	locations := make(map[string]*portLocation)
+
+	for _, port := range getPortNames() {
+		device, err := filepath.EvalSymlinks(filepath.Join("/sys/class/tty", filepath.Base(port), "device"))
+		if err != nil {
+			continue
+		}
+		for dir := device; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+			m := usbInterfaceName.FindStringSubmatch(filepath.Base(dir))
+			if m == nil {
+				continue
+			}
+			bus, _ := strconv.Atoi(m[1])
+			topology := &usbTopology{Bus: bus}
+			for _, p := range strings.Split(m[2], ".") {
+				n, _ := strconv.Atoi(p)
+				topology.Ports = append(topology.Ports, n)
+			}
+			// Каталог самого устройства USB - родительский для интерфейса
+			usbDevice := filepath.Dir(dir)
+			locations[port] = &portLocation{
+				FriendlyName: readSysfsString(filepath.Join(usbDevice, "product")),
+				BusPath:      topology.String(),
+				InstanceID:   strings.TrimPrefix(usbDevice, "/sys"),
+				Device:       topology.String(),
+				Interface:    m[3],
+				Channel:      readSysfsString(filepath.Join(dir, "interface")),
+				USB:          topology,
+			}
+			break
+		}
+	}
+	return locations
+}
+
+// Содержимое файла sysfs без завершающего перевода строки
+func readSysfsString(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
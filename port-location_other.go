@@ -0,0 +1,8 @@
+//go:build !windows && !linux && !darwin
+
+package main
+
+// Расположение портов. На этой платформе не определяется.
+func portLocations() map[string]*portLocation {
+	return nil
+}
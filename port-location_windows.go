@@ -0,0 +1,127 @@
+//go:build windows
+
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// Раздел реестра со сведениями обо всех устройствах
+const enumRegistryPath = `SYSTEM\CurrentControlSet\Enum`
+
+// Расположение портов по данным реестра. Перебираются экземпляры устройств
+// вида Enum\<шина>\<устройство>\<экземпляр>, у которых в "Device Parameters"
+// указан PortName. Ключ результата - имя порта (COM12).
+func portLocations() map[string]*portLocation {
+	locations := make(map[string]*portLocation)
+
+	enum, err := registry.OpenKey(registry.LOCAL_MACHINE, enumRegistryPath, registry.ENUMERATE_SUB_KEYS)
+	if err != nil {
+		return locations
+	}
+	defer enum.Close()
+
+	for _, instance := range registrySubKeyPaths(enum, "", 3) {
+		params, err := registry.OpenKey(enum, instance+`\Device Parameters`, registry.QUERY_VALUE)
+		if err != nil {
+			continue
+		}
+		port, _, err := params.GetStringValue("PortName")
+		params.Close()
+		if err != nil || !strings.HasPrefix(port, "COM") {
+			continue
+		}
+
+		location := &portLocation{InstanceID: instance, Device: instance}
+		location.FriendlyName, location.BusPath = registryDeviceNames(enum, instance)
+		if parent, channel := ftdiParentInstance(instance); parent != "" {
+			location.Device, location.Interface = parent, channel
+			// У порта FTDI расположение указано у родительского устройства USB
+			if location.BusPath == "" {
+				_, location.BusPath = registryDeviceNames(enum, parent)
+			}
+		} else if parent, iface := compositeParentInstance(instance); parent != "" {
+			location.Device, location.Interface = parent, iface
+		}
+		locations[port] = location
+	}
+	return locations
+}
+
+// Пути всех подразделов заданной глубины
+func registrySubKeyPaths(root registry.Key, path string, depth int) []string {
+	if depth == 0 {
+		return []string{path}
+	}
+	key := root
+	if path != "" {
+		var err error
+		if key, err = registry.OpenKey(root, path, registry.ENUMERATE_SUB_KEYS); err != nil {
+			return nil
+		}
+		defer key.Close()
+	}
+	names, err := key.ReadSubKeyNames(-1)
+	if err != nil {
+		return nil
+	}
+
+	var paths []string
+	for _, name := range names {
+		if path != "" {
+			name = path + `\` + name
+		}
+		paths = append(paths, registrySubKeyPaths(root, name, depth-1)...)
+	}
+	return paths
+}
+
+// Понятное имя устройства ("USB Serial Port (COM12)") и его расположение
+// на шине ("Port_#0002.Hub_#0004")
+func registryDeviceNames(enum registry.Key, instance string) (string, string) {
+	key, err := registry.OpenKey(enum, instance, registry.QUERY_VALUE)
+	if err != nil {
+		return "", ""
+	}
+	defer key.Close()
+
+	friendlyName, _, _ := key.GetStringValue("FriendlyName")
+	busPath, _, _ := key.GetStringValue("LocationInformation")
+	return friendlyName, busPath
+}
+
+// Экземпляр устройства USB, которому принадлежит порт драйвера FTDI, и канал:
+// FTDIBUS\VID_0403+PID_6001+A12345A\0000 -> USB\VID_0403&PID_6001\A12345, A
+func ftdiParentInstance(instance string) (string, string) {
+	parts := strings.Split(instance, `\`)
+	if len(parts) != 3 || !strings.EqualFold(parts[0], "FTDIBUS") {
+		return "", ""
+	}
+	ids := strings.Split(parts[1], "+")
+	if len(ids) != 3 || len(ids[2]) < 2 {
+		return "", ""
+	}
+	// Серийный номер FTDI дополняется буквой канала (A, B, ...)
+	serial, channel := ids[2][:len(ids[2])-1], ids[2][len(ids[2])-1:]
+	return `USB\` + ids[0] + "&" + ids[1] + `\` + serial, channel
+}
+
+// Составное устройство USB, которому принадлежит интерфейс, и номер интерфейса:
+// USB\VID_2341&PID_8036&MI_02\6&1A2B3C&0&0002 -> USB\VID_2341&PID_8036\6&1A2B3C&0, 02
+func compositeParentInstance(instance string) (string, string) {
+	parts := strings.Split(instance, `\`)
+	if len(parts) != 3 {
+		return "", ""
+	}
+	device, iface, ok := strings.Cut(parts[1], "&MI_")
+	if !ok {
+		return "", ""
+	}
+	parent := parts[2]
+	if i := strings.LastIndex(parent, "&"); i > 0 {
+		parent = parent[:i]
+	}
+	return parts[0] + `\` + device + `\` + parent, iface
+}
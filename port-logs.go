@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Каталог с журналами сеансов внутри каталога данных
+const sessionsDir = "sessions"
+
+// Формат времени в начале каждой строки журнала
+const logTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// Журнал строк, полученных из порта
+type portLog struct {
+	path  string
+	file  *os.File
+	mutex sync.Mutex
+	// Буфер записи (nil, если -log-buffer не задан)
+	writer *bufio.Writer
+	// Есть записанные, но не сброшенные на диск данные, и время последнего fsync
+	dirty    bool
+	lastSync time.Time
+	// Строки шифруются (см. encryption.go)
+	encrypted bool
+	// Строки сжимаются блоками (см. compressed-logs.go): текущий блок и время его первой и последней строки
+	compressed           bool
+	chunk                bytes.Buffer
+	chunkStart, chunkEnd time.Time
+	// Пространство имён, на квоту хранения которого записывается журнал
+	namespace *namespace
+}
+
+var (
+	// Открытые журналы, ключ - имя порта
+	portLogs = make(map[string]*portLog)
+	// Мьютекс для синхронизации доступа к portLogs
+	portLogsMutex = &sync.Mutex{}
+)
+
+// Путь к файлу журнала. Относительные пути отсчитываются от каталога сеансов
+// (для порта пространства имён - от его подкаталога).
+func sessionLogPath(port, name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return dataPath(filepath.Join(namespacedDir(sessionsDir, port), name))
+}
+
+// Начинаем запись строк порта в файл. Уже открытый журнал порта закрывается.
+func startPortLog(port, name string) error {
+	return startPortLogPath(port, sessionLogPath(port, name))
+}
+
+// Начинаем запись строк порта в файл по готовому пути
+func startPortLogPath(port, path string) error {
+	if err := checkDiskSpace(); err != nil {
+		return err
+	}
+	if err := diskWriteAllowed(); err != nil {
+		return err
+	}
+	ns := portNamespace(port)
+	if err := ns.checkStorageQuota(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// Продолжая запись в существующий файл, сначала отбрасываем недописанный при сбое хвост.
+	// Если в файл пишет текущий журнал порта, его буфер нужно сбросить раньше.
+	portLogsMutex.Lock()
+	current := portLogs[port]
+	portLogsMutex.Unlock()
+	if current != nil && current.path == path {
+		if err := current.flush(true); err != nil {
+			return err
+		}
+	}
+	if _, err := recoverLogFile(path); err != nil {
+		return err
+	}
+	_, statErr := os.Stat(path)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	compressed := isCompressedLogPath(path)
+	var encrypted bool
+	if compressed {
+		err = prepareCompressedLog(path, file)
+	} else {
+		encrypted, err = prepareLogEncryption(path, file)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if fsyncEnabled() && os.IsNotExist(statErr) {
+		// Новый файл должен пережить сбой вместе с записью о нём в каталоге
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+		if err := syncDir(filepath.Dir(path)); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	portLogsMutex.Lock()
+	old := portLogs[port]
+	l := &portLog{path: path, file: file, encrypted: encrypted, compressed: compressed, namespace: ns, lastSync: time.Now()}
+	if !compressed {
+		l.writer = newLogWriter(file)
+	}
+	portLogs[port] = l
+	portLogsMutex.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+	writePortLogComment(port, clockInfoComment())
+	if tags := getSessionTags(port); tags != nil {
+		writePortLogComment(port, "Идентификаторы сеанса: "+formatSessionTags(tags))
+	}
+	return nil
+}
+
+// Прекращаем запись строк порта в файл
+func stopPortLog(port string) {
+	portLogsMutex.Lock()
+	l := portLogs[port]
+	delete(portLogs, port)
+	portLogsMutex.Unlock()
+
+	if l != nil {
+		l.close()
+	}
+}
+
+// Запись строки порта в его журнал, если он ведётся
+func writePortLog(port, line string) {
+	portLogsMutex.Lock()
+	l := portLogs[port]
+	portLogsMutex.Unlock()
+
+	if l == nil {
+		return
+	}
+	if loggingSuspended.Load() {
+		droppedLogLines.Add(1)
+		return
+	}
+	if err := l.namespace.checkStorageQuota(); err != nil {
+		stopPortLog(port)
+		broadcast <- fmt.Sprintf("Журнал порта %s остановлен: %v", port, err)
+		return
+	}
+	if err := l.write(line); err != nil {
+		logWriteFailures.Add(1)
+		broadcast <- fmt.Sprintf("Ошибка записи журнала порта %s: %v", port, err)
+	}
+}
+
+// Порты, журналы которых сейчас ведутся
+func loggedPorts() []string {
+	portLogsMutex.Lock()
+	defer portLogsMutex.Unlock()
+
+	ports := make([]string, 0, len(portLogs))
+	for port := range portLogs {
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+// Путь к журналу порта, если он ведётся
+func portLogPath(port string) string {
+	portLogsMutex.Lock()
+	defer portLogsMutex.Unlock()
+
+	if l := portLogs[port]; l != nil {
+		return l.path
+	}
+	return ""
+}
+
+// Запись служебной строки в журнал порта. Служебные строки начинаются с "#".
+func writePortLogComment(port, comment string) {
+	writePortLog(port, "# "+comment)
+}
+
+func (l *portLog) write(line string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	record := fmt.Sprintf("%s\t%s\n", now.Format(logTimeFormat), line)
+	if l.compressed {
+		return l.appendChunk(record, now)
+	}
+	if l.encrypted {
+		encrypted, err := encryptRecord([]byte(record))
+		if err != nil {
+			return err
+		}
+		record = encrypted + "\n"
+	}
+	var n int
+	var err error
+	if l.writer != nil {
+		n, err = l.writer.WriteString(record)
+	} else {
+		n, err = l.file.WriteString(record)
+	}
+	if l.namespace != nil {
+		l.namespace.storageUsed.Add(int64(n))
+	}
+	if err != nil {
+		return err
+	}
+	l.dirty = true
+	if fsyncAlways {
+		return l.sync()
+	}
+	return nil
+}
+
+// Сброс буфера в файл и, если пора по политике -fsync, на диск. Блок сжатого
+// журнала записывается, когда его строки ждут дольше -log-chunk-age или
+// пора сбрасывать журнал на диск по периоду -fsync.
+// force - записать блок и сбросить на диск независимо от периода.
+func (l *portLog) flush(force bool) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	syncDue := fsyncInterval > 0 && time.Since(l.lastSync) >= fsyncInterval
+	if l.compressed && l.chunk.Len() > 0 && (force || syncDue || time.Since(l.chunkStart) >= logChunkAge) {
+		if err := l.writeChunk(); err != nil {
+			return err
+		}
+	}
+	if l.writer != nil {
+		if err := l.writer.Flush(); err != nil {
+			return err
+		}
+	}
+	if !l.dirty || !fsyncEnabled() {
+		return nil
+	}
+	if force || time.Since(l.lastSync) >= fsyncInterval {
+		return l.sync()
+	}
+	return nil
+}
+
+// fsync журнала, вызывается под l.mutex
+func (l *portLog) sync() error {
+	if l.writer != nil {
+		if err := l.writer.Flush(); err != nil {
+			return err
+		}
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.dirty = false
+	l.lastSync = time.Now()
+	return nil
+}
+
+func (l *portLog) close() {
+	if err := l.flush(true); err != nil {
+		logWriteFailures.Add(1)
+		log.Printf("Ошибка сброса журнала %s: %v", l.path, err)
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.file.Close()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Имя файла с метаданными портов в каталоге данных
+const portMetadataFile = "port-metadata.json"
+
+// Пользовательские метаданные порта, общие для всех клиентов
+type portMetadata struct {
+	Label string `json:"label,omitempty"`
+	Color string `json:"color,omitempty"`
+}
+
+// Запрос на изменение метаданных порта
+type portMetadataRequest struct {
+	Port  string `json:"port"`
+	Label string `json:"label"`
+	Color string `json:"color"`
+}
+
+// Сведения о порте, рассылаемые клиентам
+type portMetadataEntry struct {
+	portMetadata
+	// Постоянный идентификатор устройства и заметка о нём
+	DeviceID string `json:"deviceId,omitempty"`
+	Note     string `json:"note,omitempty"`
+	// Где физически подключено устройство
+	*portLocation
+	// Кто зарезервировал устройство и до какого времени
+	Reservation *reservation `json:"reservation,omitempty"`
+}
+
+// Расположение порта в системе, помогает различить одинаковые адаптеры
+type portLocation struct {
+	// Имя устройства в системе ("USB Serial Port (COM12)")
+	FriendlyName string `json:"friendlyName,omitempty"`
+	// Расположение на шине ("Port_#0002.Hub_#0004")
+	BusPath string `json:"busPath,omitempty"`
+	// Идентификатор экземпляра устройства в системе
+	InstanceID string `json:"instanceId,omitempty"`
+	// Физическое устройство, которому принадлежит порт. У каналов одного
+	// составного устройства совпадает.
+	Device string `json:"device,omitempty"`
+	// Номер интерфейса (канала) порта на устройстве и его описание
+	Interface string `json:"interface,omitempty"`
+	Channel   string `json:"channel,omitempty"`
+	// Место устройства в дереве хабов USB
+	USB *usbTopology `json:"usb,omitempty"`
+}
+
+// Место устройства USB: шина и номера портов хабов от корневого хаба до
+// устройства. Например, шина 1, порты [2 3] - порт 3 хаба, подключённого
+// к порту 2 корневого хаба.
+type usbTopology struct {
+	Bus   int   `json:"bus"`
+	Ports []int `json:"ports"`
+}
+
+// Запись места устройства в виде, принятом в Linux: "1-2.3"
+func (t *usbTopology) String() string {
+	ports := make([]string, len(t.Ports))
+	for i, p := range t.Ports {
+		ports[i] = strconv.Itoa(p)
+	}
+	return fmt.Sprintf("%d-%s", t.Bus, strings.Join(ports, "."))
+}
+
+// Сообщение со списком метаданных всех портов
+type portMetadataMessage struct {
+	Type  string                       `json:"type"`
+	Ports map[string]portMetadataEntry `json:"ports"`
+	// Устройства с несколькими портами
+	Devices []compositeDevice `json:"devices"`
+}
+
+var (
+	// Метаданные портов, ключ - имя порта
+	portMetadataByName = make(map[string]portMetadata)
+	// Мьютекс для синхронизации доступа к portMetadataByName
+	portMetadataMutex = &sync.Mutex{}
+)
+
+func init() {
+	clientActions["setPortMeta"] = processSetPortMetadata
+	clientActions["getPortMeta"] = processGetPortMetadata
+}
+
+// Загрузка сохранённых метаданных портов при запуске
+func loadPortMetadata() {
+	portMetadataMutex.Lock()
+	defer portMetadataMutex.Unlock()
+
+	if err := loadJSONFile(portMetadataFile, &portMetadataByName); err != nil {
+		log.Printf("Ошибка загрузки метаданных портов: %v", err)
+	}
+}
+
+// Получаем метаданные порта по имени
+func getPortMetadata(port string) portMetadata {
+	portMetadataMutex.Lock()
+	defer portMetadataMutex.Unlock()
+
+	return portMetadataByName[port]
+}
+
+// Изменение метки и цвета порта. Пустые метка и цвет удаляют метаданные.
+func processSetPortMetadata(ws *websocket.Conn, message map[string]interface{}) {
+	var request portMetadataRequest
+	if err := decodeAction(message, &request); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неверный формат запроса метаданных: %v", err)}
+		return
+	}
+	if request.Port == "" {
+		directMessages <- clientMessage{ws, "Ошибка: не указан порт."}
+		return
+	}
+
+	portMetadataMutex.Lock()
+	if request.Label == "" && request.Color == "" {
+		delete(portMetadataByName, request.Port)
+	} else {
+		portMetadataByName[request.Port] = portMetadata{Label: request.Label, Color: request.Color}
+	}
+	err := saveJSONFile(portMetadataFile, portMetadataByName)
+	portMetadataMutex.Unlock()
+
+	if err != nil {
+		broadcast <- fmt.Sprintf("Ошибка сохранения метаданных портов: %v", err)
+	}
+	// Все клиенты должны отображать порт одинаково, поэтому рассылаем изменения всем
+	if data, err := marshalPortMetadata(); err == nil {
+		broadcast <- data
+	}
+}
+
+// Отправка метаданных всех портов запросившему клиенту
+func processGetPortMetadata(ws *websocket.Conn, message map[string]interface{}) {
+	sendPortMetadata(ws)
+}
+
+// Отправка метаданных всех портов клиенту
+func sendPortMetadata(ws *websocket.Conn) {
+	data, err := marshalPortMetadata()
+	if err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка при маршалинге метаданных портов: %v", err)}
+		return
+	}
+	// Клиенту пространства имён - только его порты
+	if ns := clientNamespace(ws); ns != nil {
+		for _, m := range ns.filterPortMetadata(data) {
+			directMessages <- clientMessage{ws, m}
+		}
+		return
+	}
+	directMessages <- clientMessage{ws, data}
+}
+
+// Метаданные всех известных и доступных портов в виде JSON-сообщения
+func marshalPortMetadata() (string, error) {
+	ports := make(map[string]portMetadataEntry)
+
+	portMetadataMutex.Lock()
+	for port, meta := range portMetadataByName {
+		ports[port] = portMetadataEntry{portMetadata: meta}
+	}
+	portMetadataMutex.Unlock()
+
+	locations := portLocations()
+	for _, port := range getPortNames() {
+		entry := ports[port]
+		entry.DeviceID = stableDeviceID(port)
+		entry.Note = getDeviceNote(entry.DeviceID)
+		entry.portLocation = locations[port]
+		entry.Reservation = deviceReservation(entry.DeviceID)
+		ports[port] = entry
+	}
+
+	data, err := json.Marshal(portMetadataMessage{Type: "portMetadata", Ports: ports, Devices: groupCompositeDevices(ports)})
+	return string(data), err
+}
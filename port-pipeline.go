@@ -0,0 +1,351 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Конвейер открытого порта: у каждого порта свои горутины чтения, разбора,
+// рассылки и записи со своими очередями. Зависший или сбойный порт задерживает
+// только себя - чтение, разбор и запись соседних портов идут независимо.
+//
+//	чтение -> reads -> разбор (portSession.feed) -> outgoing -> portMessages
+//	вызывающий -> writes -> запись в порт
+const (
+	// Порции прочитанных байтов, ждущие разбора
+	pipelineReadQueue = 256
+	// Сообщения порта, ждущие рассылки клиентам
+	pipelineSendQueue = 1024
+	// Операции записи, ждущие своей очереди
+	pipelineWriteQueue = 64
+	// Сколько вызывающий ждёт записи сверх времени передачи байтов,
+	// прежде чем считать порт зависшим
+	pipelineWriteTimeout = 5 * time.Second
+)
+
+// Ошибка записи, от которой вызывающий отказался, не дождавшись очереди
+var errWriteCancelled = errors.New("запись отменена: порт не ответил вовремя")
+
+// Операция записи на горутине записи порта. Возвращает число записанных байтов.
+type pipelineWrite struct {
+	op   func(conn serialConn) (int, error)
+	done chan error
+	// Вызывающий перестал ждать - операция, ещё не начатая, не выполняется
+	cancelled atomic.Bool
+}
+
+type portPipeline struct {
+	port     string
+	baudRate int
+	conn     serialConn
+	session  *portSession
+	started  time.Time
+
+	reads    chan []byte
+	outgoing chan portMessage
+	writes   chan *pipelineWrite
+	// Закрывается, когда чтение из порта завершилось
+	stopped chan struct{}
+	// Мьютекс для синхронизации закрытия outgoing с отправкой в неё
+	sendMutex sync.RWMutex
+	sendDone  bool
+
+	// Показатели для самоконтроля
+	bytesRead, bytesWritten, messages          atomic.Int64
+	readStalls, droppedMessages, writeTimeouts atomic.Int64
+	// Время последнего чтения, последней записи и начала идущей записи (UnixNano, 0 - не было)
+	lastReadAt, lastWriteAt, writingSince atomic.Int64
+	// Последняя ошибка записи
+	lastError atomic.Pointer[string]
+}
+
+// Состояние конвейера порта для самоконтроля
+type portPipelineHealth struct {
+	Port string `json:"port"`
+	// running - работает; stalled - разбор или рассылка не успевают;
+	// writeBlocked - запись в порт не завершается
+	State        string    `json:"state"`
+	StartedAt    time.Time `json:"startedAt"`
+	BytesRead    int64     `json:"bytesRead"`
+	BytesWritten int64     `json:"bytesWritten"`
+	Messages     int64     `json:"messages"`
+	// Заполненность очередей разбора, рассылки и записи
+	ReadQueue  int `json:"readQueue"`
+	SendQueue  int `json:"sendQueue"`
+	WriteQueue int `json:"writeQueue"`
+	// Сколько раз чтение ждало разбора, сколько сообщений отброшено из-за
+	// переполненной рассылки и сколько записей не дождались порта
+	ReadStalls      int64      `json:"readStalls"`
+	DroppedMessages int64      `json:"droppedMessages"`
+	WriteTimeouts   int64      `json:"writeTimeouts"`
+	LastReadAt      *time.Time `json:"lastReadAt,omitempty"`
+	LastWriteAt     *time.Time `json:"lastWriteAt,omitempty"`
+	WriteBlockedFor string     `json:"writeBlockedFor,omitempty"`
+	LastError       string     `json:"lastError,omitempty"`
+}
+
+var (
+	// Конвейеры открытых портов, ключ - имя порта
+	portPipelines = make(map[string]*portPipeline)
+	// Мьютекс для синхронизации доступа к portPipelines
+	portPipelinesMutex = &sync.Mutex{}
+)
+
+// Запуск разбора и рассылки открытого порта. Чтение запускает вызывающий:
+// оно начинается с drain, который запускает запись, и заканчивается stop.
+func startPortPipeline(port string, baudRate int, conn serialConn, session *portSession) *portPipeline {
+	p := &portPipeline{
+		port:     port,
+		baudRate: baudRate,
+		conn:     conn,
+		session:  session,
+		started:  time.Now(),
+		reads:    make(chan []byte, pipelineReadQueue),
+		outgoing: make(chan portMessage, pipelineSendQueue),
+		writes:   make(chan *pipelineWrite, pipelineWriteQueue),
+		stopped:  make(chan struct{}),
+	}
+
+	portPipelinesMutex.Lock()
+	portPipelines[port] = p
+	portPipelinesMutex.Unlock()
+
+	go p.parse()
+	go p.send()
+	return p
+}
+
+// Получаем конвейер открытого порта по имени
+func getPortPipeline(port string) *portPipeline {
+	portPipelinesMutex.Lock()
+	defer portPipelinesMutex.Unlock()
+
+	return portPipelines[port]
+}
+
+// Слив данных, накопившихся до начала сеанса, и запуск записи. Запись ждёт
+// слива, чтобы ответы на первые команды не попали в данные до начала сеанса.
+func (p *portPipeline) drain() {
+	if n := drainPreSession(p.conn, p.session); n > 0 {
+		p.bytesRead.Add(int64(n))
+		p.lastReadAt.Store(time.Now().UnixNano())
+	}
+	go p.writeLoop()
+}
+
+// Остановка конвейера после окончания чтения. Вызывается горутиной чтения:
+// уже прочитанные байты разбираются до конца, ждущие записи получают ошибку.
+func (p *portPipeline) stop() {
+	portPipelinesMutex.Lock()
+	// Порт мог быть уже открыт заново с новым конвейером
+	if portPipelines[p.port] == p {
+		delete(portPipelines, p.port)
+	}
+	portPipelinesMutex.Unlock()
+
+	close(p.reads)
+	close(p.stopped)
+}
+
+// Байты, прочитанные из порта. Если разбор не успевает, чтение ждёт - но
+// только своего порта.
+func (p *portPipeline) push(data []byte) {
+	p.bytesRead.Add(int64(len(data)))
+	p.lastReadAt.Store(time.Now().UnixNano())
+	chunk := append([]byte(nil), data...)
+	select {
+	case p.reads <- chunk:
+	default:
+		p.readStalls.Add(1)
+		p.reads <- chunk
+	}
+}
+
+// Разбор прочитанных байтов. Сеанс закрывается, когда разобрано всё прочитанное.
+func (p *portPipeline) parse() {
+	for data := range p.reads {
+		p.session.feed(data)
+	}
+	p.session.close()
+
+	p.sendMutex.Lock()
+	p.sendDone = true
+	close(p.outgoing)
+	p.sendMutex.Unlock()
+}
+
+// Рассылка сообщений порта клиентам
+func (p *portPipeline) send() {
+	for msg := range p.outgoing {
+		portMessages <- msg
+	}
+}
+
+// Постановка сообщения в очередь рассылки без ожидания. Если рассылка не
+// успевает, сообщение отбрасывается: журнал и триггеры порта его уже получили.
+// Возвращает false, если конвейер уже остановлен.
+func (p *portPipeline) enqueue(msg portMessage) bool {
+	p.sendMutex.RLock()
+	defer p.sendMutex.RUnlock()
+
+	if p.sendDone {
+		return false
+	}
+	select {
+	case p.outgoing <- msg:
+		p.messages.Add(1)
+	default:
+		p.droppedMessages.Add(1)
+	}
+	return true
+}
+
+// Выполнение операций записи по очереди
+func (p *portPipeline) writeLoop() {
+	for {
+		select {
+		case w := <-p.writes:
+			if w.cancelled.Load() {
+				w.done <- errWriteCancelled
+				continue
+			}
+			p.writingSince.Store(time.Now().UnixNano())
+			n, err := w.op(p.conn)
+			p.writingSince.Store(0)
+			p.bytesWritten.Add(int64(n))
+			if err != nil {
+				text := err.Error()
+				p.lastError.Store(&text)
+			} else {
+				p.lastWriteAt.Store(time.Now().UnixNano())
+			}
+			w.done <- err
+		case <-p.stopped:
+			return
+		}
+	}
+}
+
+// Выполнение операции записи на горутине записи порта с ожиданием результата.
+// size - число передаваемых байтов, delay - паузы внутри операции: из них
+// складывается время, после которого порт считается зависшим.
+func (p *portPipeline) write(size int, delay time.Duration, op func(conn serialConn) (int, error)) error {
+	timeout := pipelineWriteTimeout + delay
+	if p.baudRate > 0 {
+		// Десять битов на байт: старт, восемь битов данных и стоп
+		timeout += time.Duration(size) * 10 * time.Second / time.Duration(p.baudRate)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	w := &pipelineWrite{op: op, done: make(chan error, 1)}
+	select {
+	case p.writes <- w:
+	case <-p.stopped:
+		return errPortClosed
+	case <-timer.C:
+		p.writeTimeouts.Add(1)
+		return fmt.Errorf("очередь записи в порт %s не освободилась за %s", p.port, timeout)
+	}
+	select {
+	case err := <-w.done:
+		return err
+	case <-p.stopped:
+		w.cancelled.Store(true)
+		return errPortClosed
+	case <-timer.C:
+		w.cancelled.Store(true)
+		p.writeTimeouts.Add(1)
+		return fmt.Errorf("запись в порт %s не завершилась за %s", p.port, timeout)
+	}
+}
+
+// Состояние конвейера для самоконтроля
+func (p *portPipeline) health() portPipelineHealth {
+	h := portPipelineHealth{
+		Port:            p.port,
+		State:           "running",
+		StartedAt:       p.started,
+		BytesRead:       p.bytesRead.Load(),
+		BytesWritten:    p.bytesWritten.Load(),
+		Messages:        p.messages.Load(),
+		ReadQueue:       len(p.reads),
+		SendQueue:       len(p.outgoing),
+		WriteQueue:      len(p.writes),
+		ReadStalls:      p.readStalls.Load(),
+		DroppedMessages: p.droppedMessages.Load(),
+		WriteTimeouts:   p.writeTimeouts.Load(),
+	}
+	if at := p.lastReadAt.Load(); at != 0 {
+		t := time.Unix(0, at)
+		h.LastReadAt = &t
+	}
+	if at := p.lastWriteAt.Load(); at != 0 {
+		t := time.Unix(0, at)
+		h.LastWriteAt = &t
+	}
+	if text := p.lastError.Load(); text != nil {
+		h.LastError = *text
+	}
+	if h.ReadQueue == cap(p.reads) || h.SendQueue == cap(p.outgoing) {
+		h.State = "stalled"
+	}
+	if since := p.writingSince.Load(); since != 0 {
+		if blocked := time.Since(time.Unix(0, since)); blocked > pipelineWriteTimeout {
+			h.State = "writeBlocked"
+			h.WriteBlockedFor = blocked.Round(time.Millisecond).String()
+		}
+	}
+	return h
+}
+
+// Состояние конвейеров всех открытых портов, упорядоченное по имени порта
+func portPipelineStatuses() []portPipelineHealth {
+	portPipelinesMutex.Lock()
+	pipelines := make([]*portPipeline, 0, len(portPipelines))
+	for _, p := range portPipelines {
+		pipelines = append(pipelines, p)
+	}
+	portPipelinesMutex.Unlock()
+
+	statuses := make([]portPipelineHealth, 0, len(pipelines))
+	for _, p := range pipelines {
+		statuses = append(statuses, p.health())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Port < statuses[j].Port })
+	return statuses
+}
+
+// Отправка сообщения порта клиентам через очередь рассылки его конвейера, чтобы
+// медленная рассылка не задерживала разбор. Сообщения портов без конвейера
+// (удалённых мониторов) отправляются напрямую.
+func sendPortMessage(port, text string) {
+	sendPort(portMessage{port: port, text: text})
+}
+
+// Отправка строки устройства: text - строка в виде для клиентов прежнего
+// протокола, line - сама строка
+func sendPortLine(port, text, line string) {
+	sendPort(portMessage{port: port, text: text, line: line, isLine: true})
+}
+
+func sendPort(msg portMessage) {
+	if p := getPortPipeline(msg.port); p != nil && p.enqueue(msg) {
+		return
+	}
+	portMessages <- msg
+}
+
+// Операция с открытым портом на его горутине записи: записи в один порт не
+// перемешиваются, а записи в разные порты не ждут друг друга
+func usePortWriter(name string, size int, delay time.Duration, op func(conn serialConn) (int, error)) error {
+	p := getPortPipeline(name)
+	if p == nil {
+		return fmt.Errorf("порт %s не открыт", name)
+	}
+	return p.write(size, delay, op)
+}
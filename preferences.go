@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Имя файла с настройками клиентов в каталоге данных
+const preferencesFile = "preferences.json"
+
+// Ограничения на настройки одного пользователя: длина имени настройки
+// и общий размер значений, байт
+const (
+	maxPreferenceKeyLength = 100
+	maxPreferencesSize     = 64 * 1024
+)
+
+// Запрос на изменение настройки клиента
+type preferenceRequest struct {
+	// Имя настройки, например "filters", "viewMode", "favoritePorts"
+	Key string `json:"key"`
+	// Значение в любом виде JSON. null или отсутствие значения удаляет настройку.
+	Value json.RawMessage `json:"value"`
+}
+
+var (
+	// Настройки клиентов: ключ - пользователь (после проверки подлинности),
+	// затем имя настройки. Без проверки подлинности все клиенты - "anonymous".
+	preferences = make(map[string]map[string]json.RawMessage)
+	// Мьютекс для синхронизации доступа к preferences
+	preferencesMutex = &sync.Mutex{}
+)
+
+func init() {
+	clientActions["setPreference"] = processSetPreference
+	clientActions["getPreferences"] = processGetPreferences
+	http.HandleFunc("GET /preferences", handleGetPreferences)
+	http.HandleFunc("PUT /preferences/{key}", handleSetPreference)
+	http.HandleFunc("DELETE /preferences/{key}", handleSetPreference)
+}
+
+// Загрузка сохранённых настроек клиентов при запуске
+func loadPreferences() {
+	preferencesMutex.Lock()
+	defer preferencesMutex.Unlock()
+
+	if err := loadJSONFile(preferencesFile, &preferences); err != nil {
+		log.Printf("Ошибка загрузки настроек клиентов: %v", err)
+	}
+}
+
+// Копия настроек пользователя
+func identityPreferences(identity string) map[string]json.RawMessage {
+	preferencesMutex.Lock()
+	defer preferencesMutex.Unlock()
+
+	copied := make(map[string]json.RawMessage, len(preferences[identity]))
+	for key, value := range preferences[identity] {
+		copied[key] = value
+	}
+	return copied
+}
+
+// Изменение или удаление настройки пользователя
+func setPreference(identity, key string, value json.RawMessage) error {
+	if key == "" || len(key) > maxPreferenceKeyLength {
+		return fmt.Errorf("имя настройки должно быть от 1 до %d символов", maxPreferenceKeyLength)
+	}
+	remove := len(value) == 0 || string(value) == "null"
+	if !remove && !json.Valid(value) {
+		return fmt.Errorf("значение настройки %q не является JSON", key)
+	}
+
+	preferencesMutex.Lock()
+	defer preferencesMutex.Unlock()
+
+	saved := preferences[identity]
+	if remove {
+		if _, ok := saved[key]; !ok {
+			return nil
+		}
+		delete(saved, key)
+		if len(saved) == 0 {
+			delete(preferences, identity)
+		}
+		return saveJSONFile(preferencesFile, preferences)
+	}
+
+	size := len(key) + len(value)
+	for k, v := range saved {
+		if k != key {
+			size += len(k) + len(v)
+		}
+	}
+	if size > maxPreferencesSize {
+		return fmt.Errorf("настройки пользователя превышают %d КБ", maxPreferencesSize/1024)
+	}
+	if saved == nil {
+		saved = make(map[string]json.RawMessage)
+		preferences[identity] = saved
+	}
+	saved[key] = value
+	return saveJSONFile(preferencesFile, preferences)
+}
+
+// Сообщение с настройками пользователя
+func marshalPreferences(identity string) (string, error) {
+	data, err := json.Marshal(map[string]interface{}{"type": "preferences", "preferences": identityPreferences(identity)})
+	return string(data), err
+}
+
+// Отправка настроек клиенту: при подключении и по запросу
+func sendPreferences(ws *websocket.Conn) {
+	data, err := marshalPreferences(clientIdentity(ws))
+	if err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка при маршалинге настроек: %v", err)}
+		return
+	}
+	directMessages <- clientMessage{ws, data}
+}
+
+// Изменение настройки клиента. Новые настройки получают все подключения
+// того же пользователя.
+func processSetPreference(ws *websocket.Conn, message map[string]interface{}) {
+	var request preferenceRequest
+	if err := decodeAction(message, &request); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неверный формат запроса настройки: %v", err)}
+		return
+	}
+	identity := clientIdentity(ws)
+	if err := setPreference(identity, request.Key, request.Value); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: %v.", err)}
+		return
+	}
+	notifyPreferences(identity)
+}
+
+// Отправка настроек по запросу клиента
+func processGetPreferences(ws *websocket.Conn, message map[string]interface{}) {
+	sendPreferences(ws)
+}
+
+// Рассылка изменённых настроек всем подключениям пользователя
+func notifyPreferences(identity string) {
+	clientsMutex.Lock()
+	var conns []*websocket.Conn
+	for conn, client := range clients {
+		if client.identity == identity && client.share == nil {
+			conns = append(conns, conn)
+		}
+	}
+	clientsMutex.Unlock()
+
+	for _, conn := range conns {
+		sendPreferences(conn)
+	}
+}
+
+// GET /preferences - настройки пользователя, выполнившего запрос
+func handleGetPreferences(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, identityPreferences(requestIdentity(r)))
+}
+
+// PUT /preferences/{key} - изменение настройки, тело запроса - значение в JSON;
+// DELETE /preferences/{key} - удаление настройки
+func handleSetPreference(w http.ResponseWriter, r *http.Request) {
+	var value json.RawMessage
+	if r.Method == http.MethodPut {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPreferencesSize)).Decode(&value); err != nil {
+			http.Error(w, fmt.Sprintf("неверное значение настройки: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	identity := requestIdentity(r)
+	if err := setPreference(identity, r.PathValue("key"), value); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	notifyPreferences(identity)
+	w.WriteHeader(http.StatusNoContent)
+}
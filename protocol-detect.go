@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Максимальный объём данных, собираемых для определения протокола
+const maxDetectBytes = 64 * 1024
+
+// Подсказка о вероятном протоколе порта
+type protocolHint struct {
+	Type string `json:"type"`
+	Port string `json:"port"`
+	// text, nmea, modbus-rtu, slip или binary
+	Protocol string `json:"protocol"`
+	// Разбиение на кадры: lines, slip, modbus-rtu или raw
+	Framing string `json:"framing"`
+	// Рекомендуемый режим сеанса: text или binary
+	SessionMode string `json:"sessionMode"`
+	// Уверенность от 0 до 1
+	Confidence float64 `json:"confidence"`
+	Bytes      int     `json:"bytes"`
+	Reason     string  `json:"reason"`
+}
+
+// Запрос на определение протокола порта
+type detectRequest struct {
+	Port     string `json:"port"`
+	Duration string `json:"duration"`
+}
+
+// Анализатор первых секунд трафика порта
+type protocolDetector struct {
+	duration time.Duration
+	mutex    sync.Mutex
+	data     []byte
+	started  bool
+	done     bool
+}
+
+// Сколько первых секунд трафика нового сеанса анализировать (0 - не анализировать)
+var protocolDetectDuration time.Duration
+
+func init() {
+	clientActions["detectProtocol"] = processDetectProtocol
+}
+
+// Запуск определения протокола для открытого порта
+func processDetectProtocol(ws *websocket.Conn, message map[string]interface{}) {
+	var request detectRequest
+	if err := decodeAction(message, &request); err != nil {
+		broadcast <- fmt.Sprintf("Ошибка: неверный формат запроса определения протокола: %v", err)
+		return
+	}
+	if request.Port == "" {
+		request.Port = currentSettings.Port
+	}
+	duration, err := parseOptionalDuration(request.Duration)
+	if err != nil {
+		broadcast <- fmt.Sprintf("Ошибка: неверная длительность анализа: %v", err)
+		return
+	}
+	if duration == 0 {
+		duration = 3 * time.Second
+	}
+	session := getPortSession(request.Port)
+	if session == nil {
+		broadcast <- fmt.Sprintf("Ошибка: порт %s не открыт.", request.Port)
+		return
+	}
+
+	session.startDetector(duration)
+	broadcast <- fmt.Sprintf("Определение протокола порта %s: анализируются первые %s трафика.", request.Port, duration)
+}
+
+// Начинаем анализ трафика сеанса
+func (s *portSession) startDetector(duration time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.detector = &protocolDetector{duration: duration}
+}
+
+// Добавляем прочитанные байты к анализируемым. Отсчёт времени анализа
+// начинается с первых полученных байтов.
+func (d *protocolDetector) add(port string, data []byte) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.done {
+		return
+	}
+	if !d.started {
+		d.started = true
+		time.AfterFunc(d.duration, func() { d.finish(port) })
+	}
+	if room := maxDetectBytes - len(d.data); room > 0 {
+		if len(data) > room {
+			data = data[:room]
+		}
+		d.data = append(d.data, data...)
+	}
+}
+
+// Завершаем анализ и отправляем подсказку клиентам
+func (d *protocolDetector) finish(port string) {
+	d.mutex.Lock()
+	d.done = true
+	data := d.data
+	d.mutex.Unlock()
+
+	hint := detectProtocol(data)
+	hint.Type = "protocolHint"
+	hint.Port = port
+	message, err := json.Marshal(hint)
+	if err != nil {
+		log.Printf("Ошибка при маршалинге подсказки протокола: %v", err)
+		return
+	}
+	broadcast <- string(message)
+}
+
+// Определение вероятного протокола по образцу трафика
+func detectProtocol(data []byte) protocolHint {
+	hint := protocolHint{Bytes: len(data)}
+	if len(data) == 0 {
+		hint.Protocol, hint.Framing, hint.SessionMode = "binary", "raw", "binary"
+		hint.Reason = "данные не получены"
+		return hint
+	}
+
+	printable := printableRatio(data)
+	lines := bytes.Split(bytes.TrimRight(data, "\r\n"), []byte("\n"))
+
+	if nmea := nmeaRatio(lines); printable > 0.95 && nmea > 0.5 {
+		hint.Protocol, hint.Framing, hint.SessionMode = "nmea", "lines", "text"
+		hint.Confidence = nmea
+		hint.Reason = fmt.Sprintf("%.0f%% строк - предложения NMEA с верной контрольной суммой", nmea*100)
+		return hint
+	}
+	if printable > 0.95 && bytes.IndexByte(data, '\n') >= 0 {
+		hint.Protocol, hint.Framing, hint.SessionMode = "text", "lines", "text"
+		hint.Confidence = printable
+		hint.Reason = fmt.Sprintf("%.0f%% байтов - печатные символы, есть переводы строк", printable*100)
+		return hint
+	}
+	if slip := slipRatio(data); slip > 0.8 {
+		hint.Protocol, hint.Framing, hint.SessionMode = "slip", "slip", "binary"
+		hint.Confidence = slip
+		hint.Reason = fmt.Sprintf("%.0f%% данных - кадры SLIP с корректным экранированием", slip*100)
+		return hint
+	}
+	if modbus := modbusRTURatio(data); modbus > 0.8 {
+		hint.Protocol, hint.Framing, hint.SessionMode = "modbus-rtu", "modbus-rtu", "binary"
+		hint.Confidence = modbus
+		hint.Reason = fmt.Sprintf("%.0f%% данных - кадры Modbus RTU с верной CRC", modbus*100)
+		return hint
+	}
+
+	hint.Protocol, hint.Framing, hint.SessionMode = "binary", "raw", "binary"
+	hint.Confidence = 1 - printable
+	hint.Reason = fmt.Sprintf("%.0f%% байтов - непечатные, известный протокол не распознан", (1-printable)*100)
+	return hint
+}
+
+// Доля печатных ASCII-символов, включая переводы строк и табуляцию
+func printableRatio(data []byte) float64 {
+	n := 0
+	for _, b := range data {
+		if (b >= 0x20 && b < 0x7f) || b == '\r' || b == '\n' || b == '\t' {
+			n++
+		}
+	}
+	return float64(n) / float64(len(data))
+}
+
+// Доля строк, являющихся предложениями NMEA 0183 с верной контрольной суммой
+func nmeaRatio(lines [][]byte) float64 {
+	total, valid := 0, 0
+	for _, line := range lines {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		total++
+		if isNMEASentence(line) {
+			valid++
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(valid) / float64(total)
+}
+
+// Проверка предложения NMEA: $...*HH, где HH - XOR символов между $ и *
+func isNMEASentence(line []byte) bool {
+	if len(line) < 4 || (line[0] != '$' && line[0] != '!') {
+		return false
+	}
+	star := bytes.LastIndexByte(line, '*')
+	if star < 0 || len(line)-star != 3 {
+		return false
+	}
+	want, err := strconv.ParseUint(string(line[star+1:]), 16, 8)
+	if err != nil {
+		return false
+	}
+	var sum byte
+	for _, b := range line[1:star] {
+		sum ^= b
+	}
+	return sum == byte(want)
+}
+
+// Доля данных, разбираемых как кадры SLIP (RFC 1055)
+func slipRatio(data []byte) float64 {
+	const end, esc, escEnd, escEsc = 0xC0, 0xDB, 0xDC, 0xDD
+
+	if bytes.Count(data, []byte{end}) < 2 {
+		return 0
+	}
+	// Данные до первого разделителя могут быть хвостом кадра, начатого до анализа
+	start := bytes.IndexByte(data, end)
+	stop := bytes.LastIndexByte(data, end)
+	covered := 0
+	frameStart := start
+	for i := start + 1; i <= stop; i++ {
+		switch data[i] {
+		case end:
+			covered += i - frameStart
+			frameStart = i
+		case esc:
+			if i+1 > stop || (data[i+1] != escEnd && data[i+1] != escEsc) {
+				return 0
+			}
+			i++
+		}
+	}
+	return float64(covered) / float64(len(data))
+}
+
+// Доля данных, которые удаётся разбить на кадры Modbus RTU с верной CRC
+func modbusRTURatio(data []byte) float64 {
+	covered := 0
+	for i := 0; i+4 <= len(data); {
+		length := 0
+		for l := 4; l <= 256 && i+l <= len(data); l++ {
+			frame := data[i : i+l]
+			crc := modbusCRC(frame[:l-2])
+			if frame[l-2] == byte(crc) && frame[l-1] == byte(crc>>8) {
+				length = l
+				break
+			}
+		}
+		if length == 0 {
+			i++
+			continue
+		}
+		covered += length
+		i += length
+	}
+	return float64(covered) / float64(len(data))
+}
+
+// Контрольная сумма CRC-16/MODBUS
+func modbusCRC(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
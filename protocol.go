@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Версии протокола обмена с клиентами
+const (
+	// Прежний протокол: служебные сообщения - простые строки, события - JSON.
+	// Оставлен для старых сборок Lapki IDE.
+	protocolLegacy = 1
+	// Типизированный протокол: каждое сообщение - JSON-объект с полем "type"
+	protocolTyped = 2
+)
+
+// Поддерживаемые версии протокола
+var supportedProtocols = []int{protocolLegacy, protocolTyped}
+
+// Запрос на выбор версии протокола
+type helloRequest struct {
+	Protocol int `json:"protocol"`
+}
+
+var (
+	// Версия протокола для клиентов, которые её не запросили
+	defaultProtocol = protocolLegacy
+)
+
+func init() {
+	clientActions["hello"] = processHello
+	// Отдельная точка подключения для клиентов, которые не умеют передавать параметры
+	http.HandleFunc("/serialmonitor/v2", func(w http.ResponseWriter, r *http.Request) {
+		handleConnectionsProtocol(w, r, protocolTyped)
+	})
+}
+
+// Версия протокола, запрошенная при подключении параметром protocol
+func requestedProtocol(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("protocol")
+	if value == "" {
+		return defaultProtocol, nil
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(value, "v"))
+	if err != nil || !intInSlice(version, supportedProtocols) {
+		return 0, fmt.Errorf("неподдерживаемая версия протокола %q", value)
+	}
+	return version, nil
+}
+
+func intInSlice(v int, list []int) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Выбор версии протокола после подключения
+func processHello(ws *websocket.Conn, message map[string]interface{}) {
+	var request helloRequest
+	if err := decodeAction(message, &request); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неверный формат запроса: %v", err)}
+		return
+	}
+	c := getWSClient(ws)
+	if c == nil {
+		return
+	}
+	if request.Protocol != 0 {
+		if !intInSlice(request.Protocol, supportedProtocols) {
+			directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неподдерживаемая версия протокола %d.", request.Protocol)}
+			return
+		}
+		c.protocol.Store(int32(request.Protocol))
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"type":      "hello",
+		"protocol":  c.protocol.Load(),
+		"supported": supportedProtocols,
+	})
+	if err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка при маршалинге ответа: %v", err)}
+		return
+	}
+	directMessages <- clientMessage{ws, string(data)}
+}
+
+// Преобразование сообщения прежнего протокола в типизированное. JSON-объекты
+// с полем "type" передаются как есть, массив (или null) - это список портов, простые
+// строки оборачиваются.
+func typedMessage(msg string) string {
+	var envelope map[string]interface{}
+	switch {
+	case strings.HasPrefix(msg, "{"):
+		var object map[string]json.RawMessage
+		if json.Unmarshal([]byte(msg), &object) == nil {
+			if _, ok := object["type"]; ok {
+				return msg
+			}
+			envelope = map[string]interface{}{"type": "data", "data": object}
+		}
+	case strings.HasPrefix(msg, "[") || msg == "null":
+		var ports []string
+		if json.Unmarshal([]byte(msg), &ports) == nil {
+			if ports == nil {
+				ports = []string{}
+			}
+			envelope = map[string]interface{}{"type": "ports", "ports": ports}
+		}
+	}
+	if envelope == nil {
+		envelope = map[string]interface{}{"type": "text", "text": msg}
+		if text, ok := strings.CutPrefix(msg, "Ошибка: "); ok {
+			envelope = map[string]interface{}{"type": "error", "text": text}
+		}
+	}
+	data, _ := json.Marshal(envelope)
+	return string(data)
+}
+
+// Строка данных порта для клиентов типизированного протокола
+type portLineMessage struct {
+	Type string `json:"type"`
+	Port string `json:"port"`
+	// Метка и цвет порта, заданные пользователем (setPortMeta)
+	Label string `json:"label,omitempty"`
+	Color string `json:"color,omitempty"`
+	Line  string `json:"line"`
+}
+
+// Строка данных порта с его меткой и цветом
+func (msg portMessage) typedLine() string {
+	meta := getPortMetadata(msg.port)
+	data, _ := json.Marshal(portLineMessage{
+		Type:  "portLine",
+		Port:  msg.port,
+		Label: meta.Label,
+		Color: meta.Color,
+		Line:  msg.line,
+	})
+	return string(data)
+}
+
+// Пачка сообщений для клиента с типизированным протоколом
+func typedBatch(messages []string) string {
+	batch := make([]json.RawMessage, len(messages))
+	for i, msg := range messages {
+		batch[i] = json.RawMessage(typedMessage(msg))
+	}
+	data, _ := json.Marshal(map[string]interface{}{"type": "batch", "messages": batch})
+	return string(data)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// Любое сообщение сервера превращается в JSON-объект известного типа, а
+// объекты с полем type передаются без изменений
+func FuzzTypedMessage(f *testing.F) {
+	for _, seed := range []string{
+		"Подключение к последовательному порту /dev/ttyUSB0 со скоростью 9600 успешно!",
+		"Ошибка: порт не открыт.",
+		`["/dev/ttyUSB0", "/dev/ttyACM0"]`,
+		"null",
+		`[1, 2]`,
+		`{"type": "binary", "port": "/dev/ttyUSB0", "data": "AAE="}`,
+		`{"port": "/dev/ttyUSB0"}`,
+		`{"type"`,
+		"\xff\xfe",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, msg string) {
+		typed := typedMessage(msg)
+		var envelope map[string]interface{}
+		if err := json.Unmarshal([]byte(typed), &envelope); err != nil {
+			t.Fatalf("%q: результат %q - не JSON-объект: %v", msg, typed, err)
+		}
+		kind, _ := envelope["type"].(string)
+		if _, ok := envelope["type"]; !ok {
+			t.Fatalf("%q: нет поля type: %s", msg, typed)
+		}
+		if typed == msg {
+			return
+		}
+		if !stringInSlice(kind, typedMessageTypes) {
+			t.Fatalf("%q: неизвестный тип %q", msg, kind)
+		}
+		if kind == "text" && strings.HasPrefix(msg, "Ошибка: ") {
+			t.Fatalf("%q: ошибка выдана как текст", msg)
+		}
+
+		var batch struct {
+			Type     string            `json:"type"`
+			Messages []json.RawMessage `json:"messages"`
+		}
+		if err := json.Unmarshal([]byte(typedBatch([]string{msg, msg})), &batch); err != nil || batch.Type != "batch" || len(batch.Messages) != 2 {
+			t.Fatalf("%q: неверная пачка: %v", msg, err)
+		}
+	})
+}
+
+// Строка порта приходит клиентам типизированного протокола с меткой и цветом порта
+func TestTypedPortLine(t *testing.T) {
+	const port = "/dev/ttyTEST2"
+	portMetadataMutex.Lock()
+	portMetadataByName[port] = portMetadata{Label: "Стенд", Color: "#ff0000"}
+	portMetadataMutex.Unlock()
+	t.Cleanup(func() {
+		portMetadataMutex.Lock()
+		delete(portMetadataByName, port)
+		portMetadataMutex.Unlock()
+	})
+
+	msg := portMessage{port: port, text: "[" + port + "] TEMP 23.5", line: "TEMP 23.5", isLine: true}
+	typed := typedMessage(msg.typedLine())
+	var got portLineMessage
+	if err := json.Unmarshal([]byte(typed), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := portLineMessage{Type: "portLine", Port: port, Label: "Стенд", Color: "#ff0000", Line: "TEMP 23.5"}
+	if got != want {
+		t.Errorf("получено %+v, ожидалось %+v", got, want)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Имя файла с правилами скрытия данных в каталоге данных
+const redactionRulesFile = "redaction-rules.json"
+
+// Замена по умолчанию для скрытых данных
+const defaultRedactionReplacement = "***"
+
+// Правило скрытия: всё, что совпадает с регулярным выражением, заменяется
+// до записи в журнал и отправки клиентам. В двоичном и шестнадцатеричном
+// режимах правила применяются к каждой прочитанной порции построчно:
+// совпадение, разорванное между порциями, не скрывается.
+//
+// Правила общие для всего сервера, поэтому клиентам пространств имён менять
+// их нельзя.
+type redactionRule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	// Замена, может ссылаться на группы выражения ($1). По умолчанию "***".
+	Replacement string `json:"replacement,omitempty"`
+
+	re *regexp.Regexp
+}
+
+var (
+	// Действующие правила скрытия в порядке добавления
+	redactionRules []*redactionRule
+	// Мьютекс для синхронизации доступа к redactionRules
+	redactionMutex = &sync.RWMutex{}
+)
+
+func init() {
+	clientActions["addRedaction"] = processAddRedaction
+	clientActions["removeRedaction"] = processRemoveRedaction
+	clientActions["listRedactions"] = processListRedactions
+}
+
+// Загрузка сохранённых правил скрытия при запуске
+func loadRedactionRules() {
+	var saved []*redactionRule
+	if err := loadJSONFile(redactionRulesFile, &saved); err != nil {
+		log.Printf("Ошибка загрузки правил скрытия: %v", err)
+		return
+	}
+
+	redactionMutex.Lock()
+	defer redactionMutex.Unlock()
+
+	for _, rule := range saved {
+		if err := rule.compile(); err != nil {
+			log.Printf("Ошибка загрузки правила скрытия %s: %v", rule.Name, err)
+			continue
+		}
+		redactionRules = append(redactionRules, rule)
+	}
+}
+
+func (rule *redactionRule) compile() error {
+	if rule.Name == "" {
+		return fmt.Errorf("не указано имя правила скрытия")
+	}
+	var err error
+	if rule.re, err = regexp.Compile(rule.Pattern); err != nil {
+		return fmt.Errorf("неверное регулярное выражение: %v", err)
+	}
+	if rule.Replacement == "" {
+		rule.Replacement = defaultRedactionReplacement
+	}
+	return nil
+}
+
+// Применение всех правил скрытия к строке
+func redactLine(line string) string {
+	redactionMutex.RLock()
+	defer redactionMutex.RUnlock()
+
+	for _, rule := range redactionRules {
+		line = rule.re.ReplaceAllString(line, rule.Replacement)
+	}
+	return line
+}
+
+// Может ли клиент менять правила скрытия. Отказ клиенту пространства
+// записывается в журнал аудита: так пытаются отключить скрытие для всех.
+func redactionRulesEditable(ws *websocket.Conn, action string) bool {
+	ns := clientNamespace(ws)
+	if ns == nil {
+		return true
+	}
+	auditClientAction(ws, action+"Denied", "", map[string]interface{}{"namespace": ns.Name})
+	directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: правила скрытия общие для сервера и недоступны в пространстве %s.", ns.Name)}
+	return false
+}
+
+// Копия сообщения клиента, в которой правила скрытия применены ко всем
+// строкам: команды и данные действий (command, data, steps) не попадают
+// в журнал аудита в открытом виде
+func redactPayload(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return redactLine(v)
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			out[key] = redactPayload(item)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = redactPayload(item)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// Применение правил скрытия к необработанным байтам порта построчно.
+// Переводы строк и байты вне совпадений сохраняются как есть.
+func redactBytes(data []byte) []byte {
+	redactionMutex.RLock()
+	empty := len(redactionRules) == 0
+	redactionMutex.RUnlock()
+	if empty {
+		return data
+	}
+	out := make([]byte, 0, len(data))
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		body := bytes.TrimRight(line, "\r\n")
+		out = append(out, redactLine(string(body))...)
+		out = append(out, line[len(body):]...)
+	}
+	return out
+}
+
+// Добавление или замена правила скрытия
+func processAddRedaction(ws *websocket.Conn, message map[string]interface{}) {
+	if !redactionRulesEditable(ws, "addRedaction") {
+		return
+	}
+	rule := &redactionRule{}
+	if err := decodeAction(message, rule); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неверный формат правила скрытия: %v", err)}
+		return
+	}
+	if err := rule.compile(); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: %v", err)}
+		return
+	}
+
+	redactionMutex.Lock()
+	replaced := false
+	for i, r := range redactionRules {
+		if r.Name == rule.Name {
+			redactionRules[i] = rule
+			replaced = true
+		}
+	}
+	if !replaced {
+		redactionRules = append(redactionRules, rule)
+	}
+	err := saveJSONFile(redactionRulesFile, redactionRules)
+	redactionMutex.Unlock()
+
+	if err != nil {
+		broadcast <- fmt.Sprintf("Ошибка сохранения правил скрытия: %v", err)
+	}
+	broadcast <- fmt.Sprintf("Правило скрытия %s установлено.", rule.Name)
+}
+
+// Удаление правила скрытия
+func processRemoveRedaction(ws *websocket.Conn, message map[string]interface{}) {
+	if !redactionRulesEditable(ws, "removeRedaction") {
+		return
+	}
+	var request nameRequest
+	if err := decodeAction(message, &request); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неверный формат запроса: %v", err)}
+		return
+	}
+
+	redactionMutex.Lock()
+	removed := false
+	for i, r := range redactionRules {
+		if r.Name == request.Name {
+			redactionRules = append(redactionRules[:i], redactionRules[i+1:]...)
+			removed = true
+			break
+		}
+	}
+	err := saveJSONFile(redactionRulesFile, redactionRules)
+	redactionMutex.Unlock()
+
+	if !removed {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: правило скрытия %s не найдено.", request.Name)}
+		return
+	}
+	if err != nil {
+		broadcast <- fmt.Sprintf("Ошибка сохранения правил скрытия: %v", err)
+	}
+	broadcast <- fmt.Sprintf("Правило скрытия %s удалено.", request.Name)
+}
+
+// Отправка списка правил скрытия запросившему клиенту
+func processListRedactions(ws *websocket.Conn, message map[string]interface{}) {
+	redactionMutex.RLock()
+	data, err := json.Marshal(map[string]interface{}{"type": "redactions", "rules": redactionRules})
+	redactionMutex.RUnlock()
+
+	if err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка при маршалинге правил скрытия: %v", err)}
+		return
+	}
+	directMessages <- clientMessage{ws, string(data)}
+}
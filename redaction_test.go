@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// Команды действий скрываются во всей глубине сообщения, а само сообщение,
+// которое затем получает обработчик действия, не меняется
+func TestRedactPayload(t *testing.T) {
+	useTestRedaction(t, `password=\S+`)
+	message := map[string]interface{}{
+		"action":  "groupCommand",
+		"group":   "bench",
+		"command": "login password=hunter2",
+		"steps":   []interface{}{map[string]interface{}{"send": "password=hunter2"}},
+		"sync":    true,
+	}
+
+	data, err := json.Marshal(redactPayload(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "hunter2") {
+		t.Errorf("пароль попал в журнал аудита: %s", data)
+	}
+	if !strings.Contains(string(data), `"group":"bench"`) || !strings.Contains(string(data), `"sync":true`) {
+		t.Errorf("потеряны поля сообщения: %s", data)
+	}
+	if message["command"] != "login password=hunter2" {
+		t.Errorf("изменено исходное сообщение: %v", message["command"])
+	}
+}
+
+// Клиент пространства имён не может менять общие правила скрытия, а попытка
+// записывается в журнал аудита
+func TestRedactionRulesDeniedInNamespace(t *testing.T) {
+	useTestDataDir(t)
+	useTestRedaction(t, `password=\S+`)
+	ws := registeredTestClient(t, "token", &namespace{Name: "tenant"})
+
+	for action, handler := range map[string]func(*websocket.Conn, map[string]interface{}){
+		"addRedaction":    processAddRedaction,
+		"removeRedaction": processRemoveRedaction,
+	} {
+		reply := actionReply(t, handler, ws, map[string]interface{}{"action": action, "name": "test", "pattern": "x"})
+		if !strings.Contains(reply, "недоступны в пространстве tenant") {
+			t.Errorf("%s: ответ %q", action, reply)
+		}
+	}
+	if len(redactionRules) != 1 || redactionRules[0].Name != "test" || redactionRules[0].Pattern != `password=\S+` {
+		t.Errorf("правила изменены: %+v", redactionRules)
+	}
+	audit, _ := os.ReadFile(dataPath(auditLogFile))
+	if !strings.Contains(string(audit), "addRedactionDenied") || !strings.Contains(string(audit), "removeRedactionDenied") {
+		t.Errorf("отказ не записан в журнал аудита: %s", audit)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Пауза перед повторным подключением к ретранслятору
+const relayReconnectDelay = 5 * time.Second
+
+// адрес центрального ретранслятора для режима обратного подключения
+var relayURL string
+
+// Режим обратного подключения: монитор сам подключается к центральному
+// ретранслятору и обслуживает его как обычного клиента. Нужен, когда монитор
+// находится за NAT и входящие подключения к нему невозможны.
+func runRelayConnection() {
+	if relayURL == "" {
+		return
+	}
+	header := http.Header{}
+	if instanceName != "" {
+		header.Set("X-Monitor-Instance", instanceName)
+	}
+	for {
+		ws, _, err := websocket.DefaultDialer.Dial(relayURL, header)
+		if err != nil {
+			log.Printf("Ошибка подключения к ретранслятору: %v", err)
+			time.Sleep(relayReconnectDelay)
+			continue
+		}
+		log.Printf("Подключение к ретранслятору %s установлено.", relayURL)
+		serveClient(ws, "relay", nil, defaultProtocol)
+		ws.Close()
+		log.Println("Соединение с ретранслятором потеряно.")
+		time.Sleep(relayReconnectDelay)
+	}
+}
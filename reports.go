@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Каталог с отчётами внутри каталога данных
+const reportsDir = "reports"
+
+// Форматы отчётов о выполнении последовательностей
+const (
+	reportFormatJSON  = "json"
+	reportFormatJUnit = "junit"
+)
+
+// Отчёт JUnit XML, понятный системам CI
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Skipped    int             `xml:"skipped,attr"`
+	Time       string          `xml:"time,attr"`
+	Timestamp  string          `xml:"timestamp,attr"`
+	Properties []junitProperty `xml:"properties>property,omitempty"`
+	Cases      []junitTestCase `xml:"testcase"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *struct{}     `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+}
+
+// Длительность в секундах в формате JUnit
+func junitSeconds(ms int64) string {
+	return fmt.Sprintf("%.3f", float64(ms)/1000)
+}
+
+// Преобразование отчётов о последовательностях в JUnit XML, по набору тестов на отчёт
+func marshalJUnitReport(reports ...*sequenceReport) ([]byte, error) {
+	var suites junitTestSuites
+	for _, report := range reports {
+		name := report.Name
+		if len(reports) > 1 {
+			name = fmt.Sprintf("%s [%s]", report.Name, report.Port)
+		}
+		suites.Suites = append(suites.Suites, junitSuite(name, report))
+	}
+
+	data, err := xml.MarshalIndent(suites, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// Набор тестов JUnit для одного отчёта
+func junitSuite(name string, report *sequenceReport) junitTestSuite {
+	suite := junitTestSuite{
+		Name:      name,
+		Tests:     len(report.Steps),
+		Time:      junitSeconds(report.DurationMs),
+		Timestamp: report.StartedAt.Format("2006-01-02T15:04:05"),
+	}
+	// Идентификаторы изделия передаются как свойства набора тестов
+	keys := make([]string, 0, len(report.Tags))
+	for k := range report.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	suite.Properties = append(suite.Properties, junitProperty{Name: "port", Value: report.Port})
+	for _, k := range keys {
+		suite.Properties = append(suite.Properties, junitProperty{Name: k, Value: report.Tags[k]})
+	}
+
+	for _, step := range report.Steps {
+		testCase := junitTestCase{
+			Name:      step.Name,
+			ClassName: report.Name,
+			Time:      junitSeconds(step.DurationMs),
+			SystemOut: step.Received,
+		}
+		switch step.Verdict {
+		case verdictFail:
+			suite.Failures++
+			testCase.Failure = &junitFailure{Message: step.Message}
+		case verdictSkipped:
+			suite.Skipped++
+			testCase.Skipped = &struct{}{}
+		}
+		suite.Cases = append(suite.Cases, testCase)
+	}
+	return suite
+}
+
+// Сводный отчёт о выполнении последовательности на нескольких устройствах
+type farmReport struct {
+	Type       string            `json:"type"`
+	Name       string            `json:"name"`
+	Verdict    string            `json:"verdict"`
+	StartedAt  time.Time         `json:"startedAt"`
+	DurationMs int64             `json:"durationMs"`
+	Passed     int               `json:"passed"`
+	Failed     int               `json:"failed"`
+	Devices    []*sequenceReport `json:"devices"`
+}
+
+// Сведение отчётов отдельных устройств в один
+func newFarmReport(name string, startedAt time.Time, reports []*sequenceReport) *farmReport {
+	farm := &farmReport{
+		Type:       "farmReport",
+		Name:       name,
+		Verdict:    verdictPass,
+		StartedAt:  startedAt,
+		DurationMs: time.Since(startedAt).Milliseconds(),
+		Devices:    reports,
+	}
+	for _, report := range reports {
+		if report.Verdict == verdictPass {
+			farm.Passed++
+		} else {
+			farm.Failed++
+			farm.Verdict = verdictFail
+		}
+	}
+	return farm
+}
+
+// Отчёт о выполнении на одном или нескольких устройствах в указанном формате.
+// Для одного устройства JSON-отчёт не оборачивается в сводный.
+func marshalSequenceReports(reports []*sequenceReport, format string) ([]byte, error) {
+	switch format {
+	case "", reportFormatJSON:
+		if len(reports) == 1 {
+			return json.MarshalIndent(reports[0], "", "  ")
+		}
+		return json.MarshalIndent(newFarmReport(reports[0].Name, reports[0].StartedAt, reports), "", "  ")
+	case reportFormatJUnit:
+		return marshalJUnitReport(reports...)
+	default:
+		return nil, fmt.Errorf("неизвестный формат отчёта %q", format)
+	}
+}
+
+// Сохранение отчёта в файл. Если путь не указан, отчёт сохраняется в каталог отчётов.
+// Возвращает путь к сохранённому файлу.
+func saveSequenceReport(report *sequenceReport, format, path string) (string, error) {
+	return saveSequenceReports([]*sequenceReport{report}, format, path)
+}
+
+// Сохранение отчёта о выполнении на нескольких устройствах в один файл
+func saveSequenceReports(reports []*sequenceReport, format, path string) (string, error) {
+	data, err := marshalSequenceReports(reports, format)
+	if err != nil {
+		return "", err
+	}
+	report := reports[0]
+	if path == "" {
+		ext := ".json"
+		if format == reportFormatJUnit {
+			ext = ".xml"
+		}
+		name := fmt.Sprintf("%s_%s%s",
+			unsafeFileChars.ReplaceAllString(report.Name, "_"),
+			report.StartedAt.Format("20060102-150405"), ext)
+		path = dataPath(filepath.Join(namespacedDir(reportsDir, report.Port), name))
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	return path, writeStoredFile(path, data)
+}
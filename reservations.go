@@ -0,0 +1,464 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Имя файла с резервированиями устройств в каталоге данных
+const reservationsFile = "reservations.json"
+
+// Наибольший срок резервирования и насколько вперёд можно зарезервировать устройство
+const (
+	maxReservationTTL   = 7 * 24 * time.Hour
+	maxReservationAhead = 30 * 24 * time.Hour
+)
+
+// Резервирование устройства: с начала до окончания срока открывать порт
+// устройства и отправлять в него данные может только тот, кто его зарезервировал
+type reservation struct {
+	// Постоянный идентификатор устройства, резервирование следует за ним при смене порта
+	DeviceID string `json:"deviceId"`
+	// Порт, на котором устройство было при резервировании
+	Port string `json:"port"`
+	// Кто зарезервировал (имя пользователя после проверки подлинности)
+	Holder string    `json:"holder"`
+	Note   string    `json:"note,omitempty"`
+	From   time.Time `json:"from"`
+	Until  time.Time `json:"until"`
+}
+
+// Запрос на резервирование устройства или его снятие
+type reservationRequest struct {
+	Port string `json:"port"`
+	// Начало: время суток ("10:00") или момент в формате RFC 3339.
+	// По умолчанию - сейчас.
+	From string `json:"from"`
+	// Окончание: время суток ("15:00") или момент в формате RFC 3339
+	Until string `json:"until"`
+	// Длительность ("2h") от начала, если окончание не указано
+	Duration string `json:"duration"`
+	Note     string `json:"note"`
+}
+
+var (
+	// Действующие и будущие резервирования, ключ - постоянный идентификатор
+	// устройства. Окна резервирований одного устройства не пересекаются и
+	// упорядочены по началу.
+	reservations = make(map[string][]*reservation)
+	// Мьютекс для синхронизации доступа к reservations
+	reservationsMutex = &sync.Mutex{}
+)
+
+// Действия, которые не меняют состояние порта и доступны при чужом резервировании
+var reservationFreeActions = []string{
+	"reserve", "release", "listReservations", "getPipeline", "getPortMeta",
+	"timelineSubscribe", "timelineUnsubscribe",
+}
+
+func init() {
+	clientActions["reserve"] = processReserve
+	clientActions["release"] = processRelease
+	clientActions["listReservations"] = processListReservations
+	http.HandleFunc("GET /reservations", handleListReservations)
+}
+
+// Загрузка сохранённых резервирований при запуске. Файл прежнего формата
+// хранит по одному резервированию на устройство.
+func loadReservations() {
+	reservationsMutex.Lock()
+	defer reservationsMutex.Unlock()
+
+	var saved map[string]json.RawMessage
+	if err := loadJSONFile(reservationsFile, &saved); err != nil {
+		log.Printf("Ошибка загрузки резервирований: %v", err)
+	}
+	now := time.Now()
+	for deviceID, data := range saved {
+		var list []*reservation
+		if err := json.Unmarshal(data, &list); err != nil {
+			var single reservation
+			if err := json.Unmarshal(data, &single); err != nil {
+				log.Printf("Ошибка загрузки резервирования устройства %s: %v", deviceID, err)
+				continue
+			}
+			list = []*reservation{&single}
+		}
+		for _, r := range list {
+			if now.Before(r.Until) {
+				reservations[deviceID] = append(reservations[deviceID], r)
+				scheduleReservation(r)
+			}
+		}
+	}
+	if len(reservations) > 0 && auth == nil {
+		log.Printf("Внимание: проверка подлинности не настроена, резервирования устройств не отличают клиентов друг от друга.")
+	}
+}
+
+// Момент по запросу: время в формате RFC 3339 или время суток. Время суток,
+// которое к моменту after уже прошло, относится к следующему дню.
+func parseReservationTime(value string, after time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	clock, err := time.ParseInLocation("15:04", value, after.Location())
+	if err != nil {
+		return time.Time{}, err
+	}
+	t := time.Date(after.Year(), after.Month(), after.Day(), clock.Hour(), clock.Minute(), 0, 0, after.Location())
+	if !t.After(after) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// Начало резервирования по запросу, по умолчанию - now
+func parseReservationStart(from string, now time.Time) (time.Time, error) {
+	if from == "" {
+		return now, nil
+	}
+	start, err := parseReservationTime(from, now)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("неверное время начала %q", from)
+	}
+	return start, nil
+}
+
+// Окончание резервирования, которое начинается в start
+func parseReservationEnd(until, duration string, start time.Time) (time.Time, error) {
+	switch {
+	case until != "":
+		end, err := parseReservationTime(until, start)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("неверное время окончания %q", until)
+		}
+		return end, nil
+	case duration != "":
+		d, err := parseOptionalDuration(duration)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return start.Add(d), nil
+	}
+	return time.Time{}, fmt.Errorf("не указано окончание резервирования")
+}
+
+// Действующее резервирование устройства по его постоянному идентификатору
+func deviceReservation(deviceID string) *reservation {
+	reservationsMutex.Lock()
+	defer reservationsMutex.Unlock()
+
+	now := time.Now()
+	for _, r := range reservations[deviceID] {
+		if r.activeAt(now) {
+			copied := *r
+			return &copied
+		}
+	}
+	return nil
+}
+
+// Действует ли резервирование в момент t
+func (r *reservation) activeAt(t time.Time) bool {
+	return !t.Before(r.From) && t.Before(r.Until)
+}
+
+// Пересекается ли окно резервирования с окном [from, until)
+func (r *reservation) overlaps(from, until time.Time) bool {
+	return r.From.Before(until) && from.Before(r.Until)
+}
+
+// Действующее резервирование устройства на порту
+func activeReservation(port string) *reservation {
+	reservationsMutex.Lock()
+	empty := len(reservations) == 0
+	reservationsMutex.Unlock()
+	if empty {
+		return nil
+	}
+
+	return deviceReservation(stableDeviceID(port))
+}
+
+// Описание резервирования для сообщений: "зарезервирован пользователем X до 15:00",
+// для будущего окна - "зарезервирован пользователем X с 10:00 до 15:00"
+func (r *reservation) String() string {
+	if r.From.After(time.Now()) {
+		return fmt.Sprintf("зарезервирован пользователем %s с %s до %s", r.Holder, reservationClock(r.From), reservationClock(r.Until))
+	}
+	return fmt.Sprintf("зарезервирован пользователем %s до %s", r.Holder, reservationClock(r.Until))
+}
+
+// Время суток, а для другого дня - ещё и дата
+func reservationClock(t time.Time) string {
+	if y, d := t.YearDay(), time.Now().YearDay(); y != d || t.Year() != time.Now().Year() {
+		return t.Format("02.01 15:04")
+	}
+	return t.Format("15:04")
+}
+
+// Проверка, что сообщение клиента не затрагивает устройства, зарезервированные другими
+func checkReservations(identity string, message map[string]interface{}) error {
+	action, _ := message["action"].(string)
+	if stringInSlice(action, reservationFreeActions) {
+		return nil
+	}
+	for _, port := range targetPorts(message) {
+		if err := checkReservation(identity, port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Проверка резервирования одного порта
+func checkReservation(identity, port string) error {
+	if r := activeReservation(port); r != nil && r.Holder != identity {
+		return fmt.Errorf("порт %s %s", port, r)
+	}
+	return nil
+}
+
+// Резервирование устройства сейчас или на будущее окно. Окна разных
+// пользователей не пересекаются; своё пересекающееся окно владелец заменяет
+// новым, например чтобы продлить резервирование.
+func processReserve(ws *websocket.Conn, message map[string]interface{}) {
+	var request reservationRequest
+	if err := decodeAction(message, &request); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неверный формат запроса резервирования: %v", err)}
+		return
+	}
+	// Без проверки подлинности все клиенты - "anonymous", и резервирование
+	// никого бы не остановило
+	identity := clientIdentity(ws)
+	if auth == nil || identity == "anonymous" {
+		directMessages <- clientMessage{ws, "Ошибка: резервирование устройств требует проверки подлинности (-auth): без неё клиенты неотличимы друг от друга."}
+		return
+	}
+	if request.Port == "" {
+		request.Port = currentSettings.Port
+	}
+	if request.Port == "" {
+		directMessages <- clientMessage{ws, "Ошибка: не указан порт для резервирования."}
+		return
+	}
+	if ns := clientNamespace(ws); !ns.allowsPort(request.Port) {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: порт %s недоступен в пространстве %s.", request.Port, ns.Name)}
+		return
+	}
+	now := time.Now()
+	from, err := parseReservationStart(request.From, now)
+	if err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: %v.", err)}
+		return
+	}
+	if from.Before(now) {
+		from = now
+	}
+	until, err := parseReservationEnd(request.Until, request.Duration, from)
+	if err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: %v.", err)}
+		return
+	}
+	if !until.After(from) || until.Sub(from) > maxReservationTTL {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: резервирование должно заканчиваться после начала и длиться не дольше %s.", maxReservationTTL)}
+		return
+	}
+	if from.Sub(now) > maxReservationAhead {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: резервирование можно начать не позже чем через %s.", maxReservationAhead)}
+		return
+	}
+
+	r := &reservation{
+		DeviceID: stableDeviceID(request.Port),
+		Port:     request.Port,
+		Holder:   identity,
+		Note:     request.Note,
+		From:     from,
+		Until:    until,
+	}
+	reservationsMutex.Lock()
+	var kept []*reservation
+	for _, other := range reservations[r.DeviceID] {
+		switch {
+		case !now.Before(other.Until):
+			// Истёкшее резервирование, которое ещё не снято
+		case !other.overlaps(from, until):
+			kept = append(kept, other)
+		case other.Holder != identity:
+			reservationsMutex.Unlock()
+			directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: порт %s %s.", request.Port, other)}
+			return
+		default:
+			// Своё пересекающееся окно заменяется новым
+		}
+	}
+	kept = append(kept, r)
+	sort.Slice(kept, func(i, j int) bool { return kept[i].From.Before(kept[j].From) })
+	reservations[r.DeviceID] = kept
+	err = saveJSONFile(reservationsFile, reservations)
+	reservationsMutex.Unlock()
+
+	if err != nil {
+		broadcast <- fmt.Sprintf("Ошибка сохранения резервирований: %v", err)
+	}
+	scheduleReservation(r)
+	broadcast <- fmt.Sprintf("Порт %s %s.", r.Port, r)
+	if data, err := marshalPortMetadata(); err == nil {
+		broadcast <- data
+	}
+}
+
+// Снятие резервирования. Снять его может только владелец: снимается его
+// действующее резервирование, а если его нет - ближайшее будущее.
+func processRelease(ws *websocket.Conn, message map[string]interface{}) {
+	var request reservationRequest
+	if err := decodeAction(message, &request); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неверный формат запроса резервирования: %v", err)}
+		return
+	}
+	identity := clientIdentity(ws)
+	if auth == nil || identity == "anonymous" {
+		directMessages <- clientMessage{ws, "Ошибка: резервирование устройств требует проверки подлинности (-auth): без неё клиенты неотличимы друг от друга."}
+		return
+	}
+	if request.Port == "" {
+		request.Port = currentSettings.Port
+	}
+	if ns := clientNamespace(ws); !ns.allowsPort(request.Port) {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: порт %s недоступен в пространстве %s.", request.Port, ns.Name)}
+		return
+	}
+	if r := activeReservation(request.Port); r != nil && r.Holder != identity {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: порт %s %s, снять резервирование может только владелец.", r.Port, r)}
+		return
+	}
+	r := holderReservation(stableDeviceID(request.Port), identity)
+	if r == nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: порт %s не зарезервирован вами.", request.Port)}
+		return
+	}
+	removeReservation(r.DeviceID, r.From, r.Until)
+	broadcast <- fmt.Sprintf("Резервирование порта %s снято.", r.Port)
+}
+
+// Ближайшее действующее или будущее резервирование устройства владельцем
+func holderReservation(deviceID, holder string) *reservation {
+	reservationsMutex.Lock()
+	defer reservationsMutex.Unlock()
+
+	now := time.Now()
+	for _, r := range reservations[deviceID] {
+		if r.Holder == holder && now.Before(r.Until) {
+			copied := *r
+			return &copied
+		}
+	}
+	return nil
+}
+
+// Удаление резервирования, если его не заменили новым
+func removeReservation(deviceID string, from, until time.Time) bool {
+	reservationsMutex.Lock()
+	list := reservations[deviceID]
+	i := slices.IndexFunc(list, func(r *reservation) bool {
+		return r.From.Equal(from) && r.Until.Equal(until)
+	})
+	if i < 0 {
+		reservationsMutex.Unlock()
+		return false
+	}
+	list = slices.Delete(list, i, i+1)
+	if len(list) == 0 {
+		delete(reservations, deviceID)
+	} else {
+		reservations[deviceID] = list
+	}
+	err := saveJSONFile(reservationsFile, reservations)
+	reservationsMutex.Unlock()
+
+	if err != nil {
+		broadcast <- fmt.Sprintf("Ошибка сохранения резервирований: %v", err)
+	}
+	if data, err := marshalPortMetadata(); err == nil {
+		broadcast <- data
+	}
+	return true
+}
+
+// Уведомление о начале будущего окна и снятие резервирования по окончании срока
+func scheduleReservation(r *reservation) {
+	deviceID, port, from, until := r.DeviceID, r.Port, r.From, r.Until
+	if wait := time.Until(from); wait > 0 {
+		time.AfterFunc(wait, func() {
+			if current := deviceReservation(deviceID); current != nil && current.From.Equal(from) {
+				broadcast <- fmt.Sprintf("Началось резервирование: порт %s %s.", port, current)
+				if data, err := marshalPortMetadata(); err == nil {
+					broadcast <- data
+				}
+			}
+		})
+	}
+	time.AfterFunc(time.Until(until), func() {
+		if removeReservation(deviceID, from, until) {
+			broadcast <- fmt.Sprintf("Резервирование порта %s истекло.", port)
+		}
+	})
+}
+
+// Действующие и будущие резервирования, упорядоченные по началу
+func sortedReservations() []*reservation {
+	reservationsMutex.Lock()
+	defer reservationsMutex.Unlock()
+
+	now := time.Now()
+	list := []*reservation{}
+	for _, device := range reservations {
+		for _, r := range device {
+			if now.Before(r.Until) {
+				copied := *r
+				list = append(list, &copied)
+			}
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].From.Before(list[j].From) })
+	return list
+}
+
+// Отправка списка резервирований запросившему клиенту
+func processListReservations(ws *websocket.Conn, message map[string]interface{}) {
+	ns := clientNamespace(ws)
+	list := []*reservation{}
+	for _, r := range sortedReservations() {
+		if ns.allowsPort(r.Port) {
+			list = append(list, r)
+		}
+	}
+	data, err := json.Marshal(map[string]interface{}{"type": "reservations", "reservations": list})
+	if err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка при маршалинге резервирований: %v", err)}
+		return
+	}
+	directMessages <- clientMessage{ws, string(data)}
+}
+
+// GET /reservations - действующие и будущие резервирования
+func handleListReservations(w http.ResponseWriter, r *http.Request) {
+	ns := requestNamespace(r)
+	list := []*reservation{}
+	for _, res := range sortedReservations() {
+		if ns.allowsPort(res.Port) {
+			list = append(list, res)
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Окно будущего резервирования: время суток после начала окна относится
+// к тому же или следующему дню, а длительность отсчитывается от начала
+func TestReservationWindow(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	from, err := parseReservationStart("18:00", now)
+	if err != nil || !from.Equal(time.Date(2026, 10, 16, 18, 0, 0, 0, time.UTC)) {
+		t.Fatalf("начало %v, ошибка %v", from, err)
+	}
+	until, err := parseReservationEnd("09:00", "", from)
+	if err != nil || !until.Equal(time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC)) {
+		t.Fatalf("окончание %v, ошибка %v", until, err)
+	}
+	if until, _ := parseReservationEnd("", "2h", from); !until.Equal(from.Add(2 * time.Hour)) {
+		t.Errorf("окончание по длительности %v", until)
+	}
+	if start, _ := parseReservationStart("", now); !start.Equal(now) {
+		t.Errorf("начало по умолчанию %v", start)
+	}
+	if _, err := parseReservationStart("завтра", now); err == nil {
+		t.Error("принято неверное начало")
+	}
+
+	r := &reservation{From: from, Until: until}
+	if r.activeAt(now) || !r.activeAt(from) || r.activeAt(until) {
+		t.Error("неверно определено действие окна")
+	}
+	if !r.overlaps(now, from.Add(time.Minute)) || r.overlaps(now, from) || r.overlaps(until, until.Add(time.Hour)) {
+		t.Error("неверно определено пересечение окон")
+	}
+}
+
+// Файл резервирований прежнего формата (одно резервирование на устройство) загружается
+func TestLoadLegacyReservations(t *testing.T) {
+	previousDir, previous := dataDir, reservations
+	dataDir, reservations = t.TempDir(), make(map[string][]*reservation)
+	t.Cleanup(func() { dataDir, reservations = previousDir, previous })
+
+	until := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	legacy := fmt.Sprintf(`{"dev1": {"deviceId": "dev1", "port": "/dev/ttyTEST3", "holder": "alice", "from": "2026-01-01T00:00:00Z", "until": %q}}`, until)
+	if err := os.WriteFile(filepath.Join(dataDir, reservationsFile), []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loadReservations()
+
+	r := deviceReservation("dev1")
+	if r == nil || r.Holder != "alice" {
+		t.Fatalf("резервирование не загружено: %+v", r)
+	}
+}
+
+// Без проверки подлинности, анонимно и вне своего пространства нельзя ни
+// зарезервировать порт, ни снять резервирование
+func TestReservationDenied(t *testing.T) {
+	useTestDataDir(t)
+	previousAuth, previous := auth, reservations
+	reservations = make(map[string][]*reservation)
+	t.Cleanup(func() { auth, reservations = previousAuth, previous })
+	// Принятое резервирование объявляется всем клиентам
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		for {
+			select {
+			case <-broadcast:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	const port = "/dev/ttyTEST5"
+	tenant := &namespace{Name: "tenant", Devices: []string{"/dev/ttyUSB*"}}
+	tests := []struct {
+		name     string
+		auth     authBackend
+		identity string
+		ns       *namespace
+		want     string
+	}{
+		{"без проверки подлинности", nil, "alice", nil, "требует проверки подлинности"},
+		{"анонимно", tokenAuth{}, "anonymous", nil, "требует проверки подлинности"},
+		{"чужой порт", tokenAuth{}, "token", tenant, "недоступен в пространстве tenant"},
+	}
+	for _, tt := range tests {
+		auth = tt.auth
+		ws := registeredTestClient(t, tt.identity, tt.ns)
+		for action, handler := range map[string]func(*websocket.Conn, map[string]interface{}){
+			"reserve": processReserve,
+			"release": processRelease,
+		} {
+			reply := actionReply(t, handler, ws, map[string]interface{}{"action": action, "port": port, "duration": "1h"})
+			if !strings.Contains(reply, tt.want) {
+				t.Errorf("%s, %s: ответ %q", tt.name, action, reply)
+			}
+		}
+	}
+	if len(reservations) != 0 {
+		t.Errorf("резервирования изменены: %v", reservations)
+	}
+}
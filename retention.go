@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Каталоги внутри каталога данных, в которых хранятся записи сеансов
+var storedDataDirs = []string{sessionsDir, snapshotsDir, reportsDir, capturesDir}
+
+// Сведения о сохранённом файле сеанса
+type storedSession struct {
+	// Идентификатор - путь относительно каталога данных ("sessions/robot.log")
+	ID       string    `json:"id"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	// Файл хранится зашифрованным
+	Encrypted bool `json:"encrypted,omitempty"`
+	// Файл сжат блоками (см. compressed-logs.go)
+	Compressed bool `json:"compressed,omitempty"`
+}
+
+// Итог очистки хранилища
+type purgeResult struct {
+	Deleted    []string `json:"deleted"`
+	FreedBytes int64    `json:"freedBytes"`
+}
+
+var (
+	// Максимальный возраст сохранённых сеансов, 0 - без ограничения
+	retentionMaxAge time.Duration
+	// Максимальный общий размер сохранённых сеансов в мегабайтах, 0 - без ограничения
+	retentionMaxSizeMB int64
+)
+
+func init() {
+	http.HandleFunc("GET /sessions", handleListSessions)
+	http.HandleFunc("GET /sessions/{id...}", handleDownloadSession)
+	http.HandleFunc("DELETE /sessions/{id...}", handleDeleteSession)
+	http.HandleFunc("POST /purge", handlePurge)
+}
+
+// Периодическое применение правил хранения
+func runRetention() {
+	if retentionMaxAge == 0 && retentionMaxSizeMB == 0 {
+		return
+	}
+	for {
+		result, err := applyRetention(retentionMaxAge, retentionMaxSizeMB*1024*1024)
+		if err != nil {
+			log.Printf("Ошибка очистки хранилища: %v", err)
+		} else if len(result.Deleted) > 0 {
+			log.Printf("Удалено устаревших файлов сеансов: %d (%d байт)", len(result.Deleted), result.FreedBytes)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// Список сохранённых сеансов, от старых к новым
+func listStoredSessions() ([]storedSession, error) {
+	var sessions []storedSession
+	for _, dir := range storedDataDirs {
+		err := filepath.WalkDir(dataPath(dir), func(path string, d fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			if err != nil || d.IsDir() {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dataDir, path)
+			if err != nil {
+				return err
+			}
+			encrypted, _ := isEncryptedFile(path)
+			compressed, _ := isCompressedFile(path)
+			sessions = append(sessions, storedSession{
+				ID:         filepath.ToSlash(rel),
+				Size:       info.Size(),
+				Modified:   info.ModTime(),
+				Encrypted:  encrypted,
+				Compressed: compressed,
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Modified.Before(sessions[j].Modified) })
+	return sessions, nil
+}
+
+// Путь к файлу сеанса по идентификатору. Идентификаторы вне каталогов сеансов отвергаются.
+func storedSessionPath(id string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(id))
+	for _, dir := range storedDataDirs {
+		if strings.HasPrefix(clean, dir+string(filepath.Separator)) && !strings.Contains(clean, "..") {
+			return dataPath(clean), nil
+		}
+	}
+	return "", fmt.Errorf("неверный идентификатор сеанса %q", id)
+}
+
+// Проверяем, ведётся ли сейчас запись в файл
+func isActiveLogFile(path string) bool {
+	portLogsMutex.Lock()
+	defer portLogsMutex.Unlock()
+
+	for _, l := range portLogs {
+		if filepath.Clean(l.path) == filepath.Clean(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Удаление сеансов старше maxAge, а затем самых старых, пока общий размер
+// превышает maxSize. Файлы, в которые идёт запись, не удаляются.
+func applyRetention(maxAge time.Duration, maxSize int64) (purgeResult, error) {
+	result := purgeResult{Deleted: []string{}}
+	sessions, err := listStoredSessions()
+	if err != nil {
+		return result, err
+	}
+
+	var total int64
+	for _, s := range sessions {
+		total += s.Size
+	}
+	now := time.Now()
+	for _, s := range sessions {
+		expired := maxAge > 0 && now.Sub(s.Modified) > maxAge
+		oversize := maxSize > 0 && total > maxSize
+		if !expired && !oversize {
+			continue
+		}
+		path := dataPath(filepath.FromSlash(s.ID))
+		if isActiveLogFile(path) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return result, err
+		}
+		total -= s.Size
+		result.Deleted = append(result.Deleted, s.ID)
+		result.FreedBytes += s.Size
+	}
+	return result, nil
+}
+
+// Ответ в формате JSON
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// GET /sessions - список сохранённых сеансов
+func handleListSessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := listStoredSessions()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Клиенту пространства имён - только файлы его пространства
+	ns := requestNamespace(r)
+	visible := []storedSession{}
+	for _, s := range sessions {
+		if ns.allowsStoredFile(s.ID) {
+			visible = append(visible, s)
+		}
+	}
+	writeJSON(w, http.StatusOK, visible)
+}
+
+// GET /sessions/{id} - выгрузка файла сеанса. Зашифрованный файл выгружается
+// расшифрованным, с параметром raw=1 - в том виде, в котором хранится.
+func handleDownloadSession(w http.ResponseWriter, r *http.Request) {
+	path, err := storedSessionPath(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	encrypted, err := isEncryptedFile(path)
+	if errors.Is(err, os.ErrNotExist) || !requestNamespace(r).allowsStoredFile(r.PathValue("id")) {
+		http.Error(w, "сеанс не найден", http.StatusNotFound)
+		return
+	}
+	if !encrypted || r.URL.Query().Get("raw") == "1" {
+		http.ServeFile(w, r, path)
+		return
+	}
+
+	file, err := openStoredFile(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	defer file.Close()
+
+	auditLog(requestIdentity(r), r.RemoteAddr, "decryptSession", "", map[string]interface{}{"id": r.PathValue("id")})
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := io.Copy(w, file); err != nil {
+		log.Printf("Ошибка расшифровки сеанса %s: %v", r.PathValue("id"), err)
+	}
+}
+
+// DELETE /sessions/{id} - удаление файла сеанса
+func handleDeleteSession(w http.ResponseWriter, r *http.Request) {
+	path, err := storedSessionPath(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !requestNamespace(r).allowsStoredFile(r.PathValue("id")) {
+		http.Error(w, "сеанс не найден", http.StatusNotFound)
+		return
+	}
+	if isActiveLogFile(path) {
+		http.Error(w, "в файл сеанса идёт запись", http.StatusConflict)
+		return
+	}
+	if err := os.Remove(path); errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "сеанс не найден", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Удалён сеанс %s", r.PathValue("id"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /purge - немедленная очистка по правилам хранения. Параметры maxAge ("24h")
+// и maxSizeMB переопределяют настройки сервера.
+func handlePurge(w http.ResponseWriter, r *http.Request) {
+	if ns := requestNamespace(r); ns != nil {
+		http.Error(w, fmt.Sprintf("очистка недоступна в пространстве %s", ns.Name), http.StatusForbidden)
+		return
+	}
+	maxAge, maxSizeMB := retentionMaxAge, retentionMaxSizeMB
+	if v := r.URL.Query().Get("maxAge"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, "неверное значение maxAge", http.StatusBadRequest)
+			return
+		}
+		maxAge = d
+	}
+	if v := r.URL.Query().Get("maxSizeMB"); v != "" {
+		if _, err := fmt.Sscan(v, &maxSizeMB); err != nil {
+			http.Error(w, "неверное значение maxSizeMB", http.StatusBadRequest)
+			return
+		}
+	}
+	result, err := applyRetention(maxAge, maxSizeMB*1024*1024)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
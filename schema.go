@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Структуры запросов действий клиента. По ним строится описание протокола,
+// поэтому новое действие с параметрами нужно добавить и сюда. Действия без
+// параметров можно не указывать.
+var actionRequests = map[string]interface{}{
+	"timingCapture":     timingRequest{},
+	"setStreamMode":     streamModeRequest{},
+	"groupOpen":         groupOpenRequest{},
+	"groupCommand":      groupRequest{},
+	"groupClose":        groupRequest{},
+	"setDeviceNote":     deviceNoteRequest{},
+	"setPreference":     preferenceRequest{},
+	"dmxSet":            dmxRequest{},
+	"dmxStop":           dmxRequest{},
+	"sendFrame":         frameRequest{},
+	"verifyStart":       verifyRequest{},
+	"verifyStop":        verifyRequest{},
+	"addProbe":          keepAliveProbe{},
+	"removeProbe":       keepAliveProbe{},
+	"stressStart":       stressRequest{},
+	"stressStop":        stressRequest{},
+	"loopbackTest":      loopbackRequest{},
+	"midiSend":          midiRequest{},
+	"notifyTest":        notifyTestRequest{},
+	"peripheralQuery":   peripheralQueryRequest{},
+	"setPipeline":       pipelineRequest{},
+	"getPipeline":       pipelineRequest{},
+	"setPortMeta":       portMetadataRequest{},
+	"detectProtocol":    detectRequest{},
+	"hello":             helloRequest{},
+	"addRedaction":      redactionRule{},
+	"removeRedaction":   nameRequest{},
+	"reserve":           reservationRequest{},
+	"release":           reservationRequest{},
+	"runSequence":       runSequenceRequest{},
+	"flightDump":        flightDumpRequest{},
+	"capture":           captureRequest{},
+	"captureStop":       captureRequest{},
+	"replaySession":     replayRequest{},
+	"sessionMode":       sessionModeRequest{},
+	"setSessionTags":    sessionTagsRequest{},
+	"createShare":       shareRequest{},
+	"revokeShare":       shareRequest{},
+	"timelineSubscribe": timelineRequest{},
+	"addTrigger":        trigger{},
+	"removeTrigger":     nameRequest{},
+}
+
+// Типы сообщений сервера в типизированном протоколе (см. typedMessage)
+var typedMessageTypes = []string{"text", "error", "ports", "portLine", "data", "batch", "hello", "capabilities"}
+
+func init() {
+	http.HandleFunc("GET /schema", handleSchema)
+}
+
+// Построение JSON Schema по типам Go. Именованные структуры выносятся
+// в $defs и подключаются ссылками.
+type schemaBuilder struct {
+	defs map[string]interface{}
+}
+
+func (b *schemaBuilder) typeSchema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(json.RawMessage{}):
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// encoding/json передаёт []byte в base64
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": b.typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.typeSchema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		if _, ok := b.defs[t.Name()]; !ok {
+			// Заглушка на случай рекурсивных типов
+			b.defs[t.Name()] = nil
+			b.defs[t.Name()] = b.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+// Схема структуры с полями, которые видит encoding/json
+func (b *schemaBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	b.addFields(t, properties)
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+func (b *schemaBuilder) addFields(t reflect.Type, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				b.addFields(embedded, properties)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = b.typeSchema(field.Type)
+	}
+}
+
+// Схема действия: поле "action" и поля структуры запроса
+func (b *schemaBuilder) actionSchema(action string, request interface{}) map[string]interface{} {
+	properties := make(map[string]interface{})
+	if request != nil {
+		b.addFields(reflect.TypeOf(request), properties)
+	}
+	properties["action"] = map[string]interface{}{"const": action}
+	return map[string]interface{}{
+		"title":      action,
+		"type":       "object",
+		"properties": properties,
+		"required":   []string{"action"},
+	}
+}
+
+// Описание протокола обмена через WebSocket
+func buildProtocolSchema() map[string]interface{} {
+	b := &schemaBuilder{defs: make(map[string]interface{})}
+
+	actions := make([]string, 0, len(clientActions))
+	for action := range clientActions {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+
+	settings := b.structSchema(reflect.TypeOf(SerialSettings{}))
+	// Скорость передачи приходит от клиента строкой
+	settings["properties"].(map[string]interface{})["baudRate"] = map[string]interface{}{"type": "string", "pattern": "^[0-9]+$"}
+	settings["title"] = "settings"
+	settings["required"] = []string{"port", "baudRate"}
+
+	messages := []interface{}{
+		settings,
+		map[string]interface{}{
+			"title":      "command",
+			"type":       "object",
+			"properties": map[string]interface{}{"command": map[string]interface{}{"type": "string"}},
+			"required":   []string{"command"},
+		},
+	}
+	for _, action := range actions {
+		messages = append(messages, b.actionSchema(action, actionRequests[action]))
+	}
+
+	return map[string]interface{}{
+		"$schema":     "https://json-schema.org/draft/2020-12/schema",
+		"title":       "Сообщения клиента монитора последовательного порта",
+		"description": "Клиент отправляет JSON-объекты: настройки порта, команду для основного порта или действие (поле action).",
+		"oneOf":       messages,
+		"$defs":       b.defs,
+		"actions":     actions,
+		"protocols":   supportedProtocols,
+		"serverMessage": map[string]interface{}{
+			"description": "Сообщение сервера в типизированном протоколе (protocol=2)",
+			"type":        "object",
+			"properties": map[string]interface{}{
+				"type": map[string]interface{}{"type": "string", "examples": typedMessageTypes},
+			},
+			"required": []string{"type"},
+		},
+	}
+}
+
+// GET /schema - описание протокола в формате JSON Schema
+func handleSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	json.NewEncoder(w).Encode(buildProtocolSchema())
+}
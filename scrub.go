@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Ограничения окна записей, по умолчанию и наибольшее
+const (
+	defaultScrubBefore = 20
+	defaultScrubAfter  = 100
+	maxScrubWindow     = 1000
+)
+
+// Участок файла, который при поиске по времени просматривается подряд
+const scrubLinearScan = 64 * 1024
+
+// Наибольшая пауза между строками при воспроизведении: длинные перерывы
+// в записи пропускаются
+const maxReplayGap = 5 * time.Second
+
+// Запись журнала сеанса с её положением в файле
+type scrubRecord struct {
+	// Смещение записи в файле (в сжатом журнале - в распакованных данных).
+	// По нему можно продолжить просмотр или воспроизведение.
+	Cursor int64     `json:"cursor"`
+	Time   time.Time `json:"time"`
+	Line   string    `json:"line"`
+}
+
+// Окно записей вокруг момента времени
+type scrubWindow struct {
+	ID string `json:"id"`
+	// Время первой и последней записи файла
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Size  int64     `json:"size"`
+	// Положение, к которому выполнен переход
+	Cursor  int64         `json:"cursor"`
+	Records []scrubRecord `json:"records"`
+	// Курсоры для запроса предыдущего и следующего окна. next отсутствует в конце файла.
+	Prev int64  `json:"prev"`
+	Next *int64 `json:"next,omitempty"`
+}
+
+// Запрос на воспроизведение записи сеанса
+type replayRequest struct {
+	ID string `json:"id"`
+	// Момент начала (RFC 3339) или курсор, полученный при просмотре
+	At     string `json:"at"`
+	Cursor int64  `json:"cursor"`
+	// Скорость воспроизведения, 1 - в реальном времени
+	Speed float64 `json:"speed"`
+}
+
+// Чтение журнала сеанса с произвольного места. Зашифрованные журналы
+// тоже состоят из строк, поэтому переход работает и для них. Сжатый журнал
+// читается как распакованные данные, распаковываются только нужные блоки.
+type sessionReader struct {
+	file      io.ReaderAt
+	closer    io.Closer
+	size      int64
+	encrypted bool
+	// Начало первой записи (после заголовка зашифрованного файла)
+	dataStart int64
+	// Оглавление сжатого журнала, nil для обычного файла
+	chunked *chunkedLog
+}
+
+var (
+	// Идущие воспроизведения, ключ - соединение клиента
+	replays = make(map[*websocket.Conn]chan struct{})
+	// Мьютекс для синхронизации доступа к replays
+	replaysMutex = &sync.Mutex{}
+)
+
+func init() {
+	http.HandleFunc("GET /scrub/{id...}", handleScrub)
+	clientActions["replaySession"] = processReplaySession
+	clientActions["replayStop"] = processReplayStop
+}
+
+func openSessionReader(path string) (*sessionReader, error) {
+	if compressed, err := isCompressedFile(path); err != nil {
+		return nil, err
+	} else if compressed {
+		l, err := openChunkedLog(path)
+		if err != nil {
+			return nil, err
+		}
+		return &sessionReader{file: l, closer: l, size: l.size, chunked: l}, nil
+	}
+	encrypted, err := isEncryptedFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted && storageCipher == nil {
+		return nil, fmt.Errorf("файл %s зашифрован, а ключ шифрования не задан", path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	r := &sessionReader{file: file, closer: file, size: info.Size(), encrypted: encrypted}
+	if encrypted {
+		r.dataStart = int64(len(encryptedFileMagic) + 1)
+	}
+	return r, nil
+}
+
+func (r *sessionReader) Close() error {
+	return r.closer.Close()
+}
+
+// Последовательное чтение записей с начала строки offset
+func (r *sessionReader) from(offset int64) *bufio.Reader {
+	return bufio.NewReader(io.NewSectionReader(r.file, offset, r.size-offset))
+}
+
+// Чтение записи из буфера. Возвращает запись и начало следующей строки.
+// Недописанная последняя строка не читается (io.EOF).
+func (r *sessionReader) next(reader *bufio.Reader, offset int64) (scrubRecord, int64, error) {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return scrubRecord{}, offset, io.EOF
+	}
+	next := offset + int64(len(line))
+	plain := bytes.TrimRight(line, "\r\n")
+	if r.encrypted {
+		if plain, err = decryptRecord(string(plain)); err != nil {
+			return scrubRecord{}, next, err
+		}
+		plain = bytes.TrimRight(plain, "\r\n")
+	}
+	record := scrubRecord{Cursor: offset, Line: string(plain)}
+	if stamp, text, ok := strings.Cut(record.Line, "\t"); ok {
+		if t, err := time.Parse(logTimeFormat, stamp); err == nil {
+			record.Time, record.Line = t, text
+		}
+	}
+	return record, next, nil
+}
+
+// Начало первой строки, которая начинается не раньше offset
+func (r *sessionReader) lineStartAfter(offset int64) (int64, error) {
+	if offset <= r.dataStart {
+		return r.dataStart, nil
+	}
+	reader := r.from(offset - 1)
+	skipped, err := reader.ReadBytes('\n')
+	if err != nil {
+		return r.size, nil
+	}
+	return offset - 1 + int64(len(skipped)), nil
+}
+
+// Начало строки, которая заканчивается перед offset
+func (r *sessionReader) lineStartBefore(offset int64) (int64, error) {
+	if offset <= r.dataStart {
+		return r.dataStart, nil
+	}
+	// Перевод строки в offset-1 завершает предыдущую строку, ищем перевод перед ней
+	end := offset - 1
+	buf := make([]byte, 4096)
+	for end > r.dataStart {
+		start := end - int64(len(buf))
+		if start < r.dataStart {
+			start = r.dataStart
+		}
+		chunk := buf[:end-start]
+		if _, err := r.file.ReadAt(chunk, start); err != nil {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			return start + int64(i) + 1, nil
+		}
+		end = start
+	}
+	return r.dataStart, nil
+}
+
+// Положение первой записи не раньше момента t: двоичный поиск по файлу,
+// на коротком участке - просмотр подряд. В сжатом журнале поиск сразу
+// сужается до блока по оглавлению.
+func (r *sessionReader) seek(t time.Time) (int64, error) {
+	lo, hi := r.dataStart, r.size
+	if r.chunked != nil {
+		lo, hi = r.chunked.seekRange(t)
+	}
+	for hi-lo > scrubLinearScan {
+		mid := lo + (hi-lo)/2
+		start, err := r.lineStartAfter(mid)
+		if err != nil {
+			return 0, err
+		}
+		if start >= hi {
+			hi = mid
+			continue
+		}
+		record, next, err := r.next(r.from(start), start)
+		if errors.Is(err, io.EOF) {
+			hi = mid
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if record.Time.IsZero() || record.Time.Before(t) {
+			lo = next
+		} else {
+			hi = start
+		}
+	}
+	reader := r.from(lo)
+	offset := lo
+	for {
+		record, next, err := r.next(reader, offset)
+		if errors.Is(err, io.EOF) {
+			return offset, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !record.Time.IsZero() && !record.Time.Before(t) {
+			return offset, nil
+		}
+		offset = next
+	}
+}
+
+// До n записей начиная с offset и начало строки после последней из них
+func (r *sessionReader) forward(offset int64, n int) ([]scrubRecord, int64, error) {
+	records := []scrubRecord{}
+	reader := r.from(offset)
+	for len(records) < n {
+		record, next, err := r.next(reader, offset)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		records = append(records, record)
+		offset = next
+	}
+	return records, offset, nil
+}
+
+// До n записей перед offset, в порядке следования в файле
+func (r *sessionReader) backward(offset int64, n int) ([]scrubRecord, error) {
+	var records []scrubRecord
+	for len(records) < n && offset > r.dataStart {
+		start, err := r.lineStartBefore(offset)
+		if err != nil {
+			return nil, err
+		}
+		record, _, err := r.next(r.from(start), start)
+		offset = start
+		if errors.Is(err, io.EOF) {
+			// Недописанная последняя строка
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records, nil
+}
+
+// Время первой и последней записи файла
+func (r *sessionReader) bounds() (time.Time, time.Time, error) {
+	first, _, err := r.forward(r.dataStart, 1)
+	if err != nil || len(first) == 0 {
+		return time.Time{}, time.Time{}, err
+	}
+	end, err := r.lineStartAfter(r.size)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	last, err := r.backward(end, 1)
+	if err != nil || len(last) == 0 {
+		return first[0].Time, first[0].Time, err
+	}
+	return first[0].Time, last[0].Time, nil
+}
+
+// Окно записей: before записей перед курсором и after записей начиная с него
+func (r *sessionReader) window(id string, cursor int64, before, after int) (*scrubWindow, error) {
+	start, end, err := r.bounds()
+	if err != nil {
+		return nil, err
+	}
+	earlier, err := r.backward(cursor, before)
+	if err != nil {
+		return nil, err
+	}
+	later, next, err := r.forward(cursor, after)
+	if err != nil {
+		return nil, err
+	}
+	w := &scrubWindow{
+		ID:      id,
+		Start:   start,
+		End:     end,
+		Size:    r.size,
+		Cursor:  cursor,
+		Records: append(earlier, later...),
+		Prev:    cursor,
+	}
+	if len(earlier) > 0 {
+		w.Prev = earlier[0].Cursor
+	}
+	if next < r.size {
+		w.Next = &next
+	}
+	return w, nil
+}
+
+// Положение в файле по моменту времени или курсору. Курсор приводится к началу строки.
+func (r *sessionReader) position(at string, cursor int64) (int64, error) {
+	if at != "" {
+		t, err := time.Parse(time.RFC3339Nano, at)
+		if err != nil {
+			return 0, fmt.Errorf("неверный момент времени %q", at)
+		}
+		return r.seek(t)
+	}
+	if cursor < 0 || cursor > r.size {
+		return 0, fmt.Errorf("курсор %d вне файла", cursor)
+	}
+	return r.lineStartAfter(cursor)
+}
+
+// Число записей из параметра запроса
+func windowParam(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 || n > maxScrubWindow {
+		return 0, fmt.Errorf("неверное значение %s (от 0 до %d)", name, maxScrubWindow)
+	}
+	return n, nil
+}
+
+// GET /scrub/{id}?at=2024-05-01T10:00:00Z&before=20&after=100 - переход к моменту
+// записи сеанса и окно записей вокруг него. Вместо at можно передать cursor
+// из предыдущего ответа (prev или next), чтобы листать запись.
+func handleScrub(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	path, err := storedSessionPath(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !requestNamespace(r).allowsStoredFile(id) {
+		http.Error(w, "сеанс не найден", http.StatusNotFound)
+		return
+	}
+	before, err := windowParam(r, "before", defaultScrubBefore)
+	if err == nil {
+		var after int
+		if after, err = windowParam(r, "after", defaultScrubAfter); err == nil {
+			var cursor int64
+			if v := r.URL.Query().Get("cursor"); v != "" {
+				if cursor, err = strconv.ParseInt(v, 10, 64); err != nil {
+					err = fmt.Errorf("неверный курсор %q", v)
+				}
+			}
+			if err == nil {
+				serveScrubWindow(w, r, id, path, cursor, before, after)
+				return
+			}
+		}
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+func serveScrubWindow(w http.ResponseWriter, r *http.Request, id, path string, cursor int64, before, after int) {
+	reader, err := openSessionReader(path)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "сеанс не найден", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	defer reader.Close()
+
+	position, err := reader.position(r.URL.Query().Get("at"), cursor)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	window, err := reader.window(id, position, before, after)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if reader.encrypted {
+		auditLog(requestIdentity(r), r.RemoteAddr, "decryptSession", "", map[string]interface{}{"id": id})
+	}
+	writeJSON(w, http.StatusOK, window)
+}
+
+// Воспроизведение записи сеанса клиенту с исходными паузами между строками
+func processReplaySession(ws *websocket.Conn, message map[string]interface{}) {
+	var request replayRequest
+	if err := decodeAction(message, &request); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неверный формат запроса воспроизведения: %v", err)}
+		return
+	}
+	if request.Speed == 0 {
+		request.Speed = 1
+	}
+	if request.Speed < 0 {
+		directMessages <- clientMessage{ws, "Ошибка: скорость воспроизведения должна быть положительной."}
+		return
+	}
+	path, err := storedSessionPath(request.ID)
+	if err == nil && !clientNamespace(ws).allowsStoredFile(request.ID) {
+		err = errors.New("сеанс не найден")
+	}
+	var reader *sessionReader
+	if err == nil {
+		reader, err = openSessionReader(path)
+	}
+	if err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: %v.", err)}
+		return
+	}
+	position, err := reader.position(request.At, request.Cursor)
+	if err != nil {
+		reader.Close()
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: %v.", err)}
+		return
+	}
+	if reader.encrypted {
+		auditClientAction(ws, "decryptSession", "", map[string]interface{}{"id": request.ID})
+	}
+
+	stop := make(chan struct{})
+	replaysMutex.Lock()
+	if old := replays[ws]; old != nil {
+		close(old)
+	}
+	replays[ws] = stop
+	replaysMutex.Unlock()
+
+	go runReplay(ws, request.ID, reader, position, request.Speed, stop)
+}
+
+// Отправка записей клиенту до конца файла, остановки или отключения клиента
+func runReplay(ws *websocket.Conn, id string, reader *sessionReader, offset int64, speed float64, stop chan struct{}) {
+	defer reader.Close()
+	defer func() {
+		replaysMutex.Lock()
+		if replays[ws] == stop {
+			delete(replays, ws)
+		}
+		replaysMutex.Unlock()
+	}()
+
+	send := func(v map[string]interface{}) {
+		data, err := json.Marshal(v)
+		if err == nil {
+			directMessages <- clientMessage{ws, string(data)}
+		}
+	}
+	send(map[string]interface{}{"type": "replayStarted", "id": id, "cursor": offset, "speed": speed})
+
+	buffered := reader.from(offset)
+	var previous time.Time
+	for {
+		record, next, err := reader.next(buffered, offset)
+		if errors.Is(err, io.EOF) {
+			send(map[string]interface{}{"type": "replayFinished", "id": id, "cursor": offset})
+			return
+		}
+		if err != nil {
+			directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка воспроизведения %s: %v", id, err)}
+			return
+		}
+		if !previous.IsZero() && !record.Time.IsZero() {
+			gap := record.Time.Sub(previous)
+			if gap > maxReplayGap {
+				gap = maxReplayGap
+			}
+			if gap > 0 {
+				select {
+				case <-stop:
+					return
+				case <-time.After(time.Duration(float64(gap) / speed)):
+				}
+			}
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if getWSClient(ws) == nil {
+			return
+		}
+		if !record.Time.IsZero() {
+			previous = record.Time
+		}
+		send(map[string]interface{}{"type": "replay", "id": id, "cursor": record.Cursor, "time": record.Time, "line": record.Line})
+		offset = next
+	}
+}
+
+// Остановка воспроизведения по запросу клиента
+func processReplayStop(ws *websocket.Conn, message map[string]interface{}) {
+	stopReplay(ws)
+	directMessages <- clientMessage{ws, "Воспроизведение остановлено."}
+}
+
+// Остановка воспроизведения клиенту, в том числе при его отключении
+func stopReplay(ws *websocket.Conn) {
+	replaysMutex.Lock()
+	defer replaysMutex.Unlock()
+
+	if stop := replays[ws]; stop != nil {
+		close(stop)
+		delete(replays, ws)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Время ожидания ответа на шаге по умолчанию
+const defaultStepTimeout = 5 * time.Second
+
+// Тестовая последовательность: шаги отправки команд и ожидания ответов
+type testSequence struct {
+	Name  string     `json:"name"`
+	Port  string     `json:"port"`
+	Steps []testStep `json:"steps"`
+	// Внешние идентификаторы изделия, дополняют идентификаторы сеанса порта
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// Шаг тестовой последовательности
+type testStep struct {
+	Name string `json:"name"`
+	// Пауза перед шагом, например "500ms"
+	Delay string `json:"delay,omitempty"`
+	// Команда, отправляемая в порт (перевод строки добавляется автоматически)
+	Send string `json:"send,omitempty"`
+	// Регулярное выражение ожидаемой строки
+	Expect string `json:"expect,omitempty"`
+	// Время ожидания строки, по умолчанию 5s
+	Timeout string `json:"timeout,omitempty"`
+	// Границы значения из первой группы выражения expect
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+}
+
+// Отчёт о выполнении последовательности
+type sequenceReport struct {
+	Type       string    `json:"type"`
+	Name       string    `json:"name"`
+	Port       string    `json:"port"`
+	Verdict    string    `json:"verdict"`
+	StartedAt  time.Time `json:"startedAt"`
+	DurationMs int64     `json:"durationMs"`
+	// Идентификаторы изделия, к которому относится отчёт
+	Tags  map[string]string `json:"tags,omitempty"`
+	Steps []stepResult      `json:"steps"`
+}
+
+// Результат одного шага
+type stepResult struct {
+	Name       string   `json:"name"`
+	Verdict    string   `json:"verdict"`
+	Received   string   `json:"received,omitempty"`
+	Value      *float64 `json:"value,omitempty"`
+	Message    string   `json:"message,omitempty"`
+	DurationMs int64    `json:"durationMs"`
+}
+
+// Запрос на запуск последовательности по WebSocket
+type runSequenceRequest struct {
+	Sequence     *testSequence `json:"sequence"`
+	SequenceFile string        `json:"sequenceFile"`
+	// Сохранение отчёта в файл: формат ("json" или "junit") и путь.
+	// Если указан только формат, файл создаётся в каталоге отчётов.
+	ReportFormat string `json:"reportFormat"`
+	ReportFile   string `json:"reportFile"`
+}
+
+// Вердикты тестов и шагов
+const (
+	verdictPass    = "pass"
+	verdictFail    = "fail"
+	verdictSkipped = "skipped"
+)
+
+func init() {
+	clientActions["runSequence"] = processRunSequence
+	http.HandleFunc("POST /sequences/run", handleRunSequence)
+}
+
+// Чтение последовательности из JSON-файла
+func loadSequenceFile(path string) (*testSequence, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var seq testSequence
+	if err := json.Unmarshal(data, &seq); err != nil {
+		return nil, fmt.Errorf("ошибка разбора последовательности %s: %v", path, err)
+	}
+	return &seq, nil
+}
+
+// Выполнение последовательности. После первого неудачного шага остальные пропускаются.
+func runSequence(seq *testSequence) *sequenceReport {
+	report := &sequenceReport{
+		Type:      "sequenceReport",
+		Name:      seq.Name,
+		Port:      seq.Port,
+		Verdict:   verdictPass,
+		StartedAt: time.Now(),
+		Tags:      getSessionTags(seq.Port),
+		Steps:     []stepResult{},
+	}
+	for k, v := range seq.Tags {
+		if report.Tags == nil {
+			report.Tags = make(map[string]string)
+		}
+		report.Tags[k] = v
+	}
+
+	// Подписываемся заранее, чтобы не пропустить ответ на отправленную команду
+	sub := subscribeLines(seq.Port)
+	defer sub.close()
+
+	for i, step := range seq.Steps {
+		if step.Name == "" {
+			step.Name = fmt.Sprintf("шаг %d", i+1)
+		}
+		if report.Verdict == verdictFail {
+			report.Steps = append(report.Steps, stepResult{Name: step.Name, Verdict: verdictSkipped})
+			continue
+		}
+		result := runStep(sub, seq.Port, step)
+		if result.Verdict == verdictFail {
+			report.Verdict = verdictFail
+		}
+		report.Steps = append(report.Steps, result)
+	}
+
+	report.DurationMs = time.Since(report.StartedAt).Milliseconds()
+	return report
+}
+
+// Выполнение одного шага
+func runStep(sub *lineSubscription, port string, step testStep) stepResult {
+	started := time.Now()
+	result := stepResult{Name: step.Name, Verdict: verdictPass}
+	fail := func(format string, args ...interface{}) stepResult {
+		result.Verdict = verdictFail
+		result.Message = fmt.Sprintf(format, args...)
+		result.DurationMs = time.Since(started).Milliseconds()
+		return result
+	}
+
+	delay, err := parseOptionalDuration(step.Delay)
+	if err != nil {
+		return fail("%v", err)
+	}
+	timeout, err := parseOptionalDuration(step.Timeout)
+	if err != nil {
+		return fail("%v", err)
+	}
+	if timeout == 0 {
+		timeout = defaultStepTimeout
+	}
+	time.Sleep(delay)
+
+	if step.Send != "" {
+		if err := writeToPort(port, []byte(step.Send+"\n")); err != nil {
+			return fail("ошибка отправки команды: %v", err)
+		}
+	}
+
+	if step.Expect != "" {
+		re, err := regexp.Compile(step.Expect)
+		if err != nil {
+			return fail("неверное регулярное выражение: %v", err)
+		}
+		line, match, err := sub.expect(re, timeout)
+		if err != nil {
+			return fail("%v", err)
+		}
+		result.Received = line
+
+		if step.Min != nil || step.Max != nil {
+			if len(match) < 2 {
+				return fail("для проверки границ выражение должно содержать группу")
+			}
+			value, err := strconv.ParseFloat(match[1], 64)
+			if err != nil {
+				return fail("значение %q не является числом", match[1])
+			}
+			result.Value = &value
+			if step.Min != nil && value < *step.Min {
+				return fail("значение %g меньше нижней границы %g", value, *step.Min)
+			}
+			if step.Max != nil && value > *step.Max {
+				return fail("значение %g больше верхней границы %g", value, *step.Max)
+			}
+		}
+	}
+
+	result.DurationMs = time.Since(started).Milliseconds()
+	return result
+}
+
+// Запуск последовательности по WebSocket. Отчёт рассылается всем клиентам.
+func processRunSequence(ws *websocket.Conn, message map[string]interface{}) {
+	var request runSequenceRequest
+	if err := decodeAction(message, &request); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неверный формат последовательности: %v", err)}
+		return
+	}
+	seq := request.Sequence
+	if request.SequenceFile != "" {
+		var err error
+		if seq, err = loadSequenceFile(request.SequenceFile); err != nil {
+			directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: %v", err)}
+			return
+		}
+	}
+	if seq == nil || seq.Port == "" {
+		directMessages <- clientMessage{ws, "Ошибка: не указана последовательность или порт."}
+		return
+	}
+
+	broadcast <- fmt.Sprintf("Запущена тестовая последовательность %s на порту %s.", seq.Name, seq.Port)
+	go func() {
+		report := runSequence(seq)
+		data, err := json.Marshal(report)
+		if err != nil {
+			broadcast <- fmt.Sprintf("Ошибка при маршалинге отчёта: %v", err)
+			return
+		}
+		broadcast <- string(data)
+
+		if request.ReportFormat != "" || request.ReportFile != "" {
+			path, err := saveSequenceReport(report, request.ReportFormat, request.ReportFile)
+			if err != nil {
+				broadcast <- fmt.Sprintf("Ошибка сохранения отчёта: %v", err)
+				return
+			}
+			broadcast <- fmt.Sprintf("Отчёт последовательности %s сохранён: %s", seq.Name, path)
+		}
+	}()
+}
+
+// POST /sequences/run - выполнение последовательности из тела запроса, ответ - отчёт.
+// Параметр format=junit возвращает отчёт в формате JUnit XML.
+func handleRunSequence(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != reportFormatJSON && format != reportFormatJUnit {
+		http.Error(w, "неизвестный формат отчёта", http.StatusBadRequest)
+		return
+	}
+	var seq testSequence
+	if err := json.NewDecoder(r.Body).Decode(&seq); err != nil {
+		http.Error(w, "неверный формат последовательности: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if seq.Port == "" {
+		http.Error(w, "не указан порт", http.StatusBadRequest)
+		return
+	}
+	if ns := requestNamespace(r); !ns.allowsPort(seq.Port) {
+		http.Error(w, fmt.Sprintf("порт %s недоступен в пространстве %s", seq.Port, ns.Name), http.StatusForbidden)
+		return
+	}
+	if err := checkReservation(requestIdentity(r), seq.Port); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	report := runSequence(&seq)
+	if format == reportFormatJUnit {
+		data, err := marshalJUnitReport(report)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(data)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
@@ -1,27 +1,30 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/tarm/serial"
 )
 
 // Структура для хранения настроек порта и скорости передачи
 type SerialSettings struct {
 	Port     string `json:"port"`
 	BaudRate int    `json:"baudRate"`
+	// Формат кадра ("8N1", "7E1", "8M1"), пустая строка - 8N1
+	Framing string `json:"framing,omitempty"`
 }
 
 // Конфигурация для WebSocket
@@ -31,45 +34,187 @@ var (
 		WriteBufferSize: 1024,
 	}
 	// Хранит подключенных клиентов WebSocket
-	clients = make(map[*websocket.Conn]bool)
+	clients = make(map[*websocket.Conn]*wsClient)
 	// Канал для отправки данных из последовательного порта подключенным клиентам
 	broadcast = make(chan string)
+	// Канал для отправки сообщений отдельным клиентам
+	directMessages = make(chan clientMessage)
 	// Канал для отправки сообщений на последовательный порт
 	serialWriteChan = make(chan string)
 	// Мьютекс для синхронизации доступа к serialPort
 	serialPortMutex = &sync.Mutex{}
 	// Глобальная переменная для хранения текущих настроек
 	currentSettings SerialSettings
-	serialPort      *serial.Port
+	serialPort      serialConn
 	// адрес на котором будет работать этот сервер
 	webAddress string
+	// каталог, в котором сервер хранит свои данные
+	dataDir string
+	// Обработчики расширенных действий клиента, ключ - значение поля "action"
+	clientActions = make(map[string]func(ws *websocket.Conn, message map[string]interface{}))
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "run" {
+		os.Exit(runCIMode(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "client" {
+		os.Exit(runClientMode(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(runConfigMode(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "summarize" {
+		os.Exit(runSummarizeMode(os.Args[2:]))
+	}
+
 	flag.StringVar(&webAddress, "address", "localhost:8080", "адрес для подключения")
+	flag.StringVar(&accessToken, "token", "", "токен доступа к серверу (пусто - доступ без токена)")
+	flag.StringVar(&authMode, "auth", "", "способ проверки подлинности: token, oidc, proxy или htpasswd (по умолчанию token, если указан -token)")
+	flag.StringVar(&oidcIssuer, "oidc-issuer", "", "адрес поставщика OpenID Connect для способа oidc")
+	flag.StringVar(&oidcAudience, "oidc-audience", "", "ожидаемый получатель токена OpenID Connect (client id), обязателен для способа oidc")
+	flag.StringVar(&authProxyHeader, "auth-proxy-header", "X-Forwarded-User", "заголовок с именем пользователя для способа proxy")
+	flag.StringVar(&authProxyTrusted, "auth-proxy-trusted", "127.0.0.1/32,::1/128", "сети доверенного обратного прокси через запятую для способа proxy")
+	flag.StringVar(&htpasswdPath, "htpasswd", "", "файл паролей для способа htpasswd")
+	flag.StringVar(&dataDir, "data", "serial-monitor-data", "каталог для хранения данных сервера")
+	flag.IntVar(&defaultProtocol, "protocol", protocolLegacy, "версия протокола для клиентов, не запросивших её явно: 1 - прежние строковые сообщения, 2 - типизированные")
+	flag.StringVar(&encryptionKeyPath, "encryption-key", "", "файл с ключом AES-256 (64 шестнадцатеричных символа) для шифрования журналов, снимков и отчётов")
+	flag.StringVar(&namespacesPath, "namespaces", "", "файл с описанием пространств имён (команд, проектов) со своими устройствами и токенами")
+	flag.StringVar(&notifyConfigPath, "notify", "", "файл с настройками оповещений по почте (SMTP) и в Telegram о триггерах и сбоях")
+	flag.StringVar(&autoOpenRulesPath, "rules", "", "файл с правилами автоматического подключения устройств")
+	flag.DurationVar(&retentionMaxAge, "retention-max-age", 0, "максимальный возраст сохранённых сеансов (0 - без ограничения)")
+	flag.Int64Var(&retentionMaxSizeMB, "retention-max-size", 0, "максимальный общий размер сохранённых сеансов, МБ (0 - без ограничения)")
+	flag.DurationVar(&healthInterval, "health-interval", 0, "период самоконтроля сервера (0 - отключён)")
+	flag.IntVar(&healthMaxGoroutines, "health-max-goroutines", 1000, "порог числа горутин для самоконтроля")
+	flag.IntVar(&healthMaxMemoryMB, "health-max-memory", 512, "порог занятой памяти для самоконтроля, МБ")
+	flag.BoolVar(&healthRestartPipelines, "health-restart", false, "перезапускать порты, чтение из которых прервалось с ошибкой")
+	flag.Uint64Var(&minFreeDiskMB, "min-free-disk", 100, "минимум свободного места для записи журналов, МБ (0 - не проверять)")
+	flag.StringVar(&instanceName, "instance", "", "имя экземпляра монитора для сведения записей с разных узлов")
+	flag.DurationVar(&clockMarkerInterval, "clock-markers", 10*time.Minute, "период записи меток часов в журналы (0 - только в начале журнала)")
+	flag.Var(&remoteMonitorFlags, "remote", "удалённый монитор, порты которого показываются рядом с локальными: имя=ws://адрес/serialmonitor (можно указать несколько раз)")
+	flag.StringVar(&relayURL, "relay", "", "адрес центрального ретранслятора (ws://...), к которому монитор подключается сам")
+	flag.BoolVar(&adaptiveStreaming, "adaptive", false, "подстраивать передачу данных клиентам под задержку соединения")
+	flag.DurationVar(&protocolDetectDuration, "detect-protocol", 0, "сколько первых секунд трафика порта анализировать для подсказки протокола (0 - не анализировать)")
+	flag.StringVar(&chaosSpec, "chaos", "", "отладочные сбои WebSocket для проверки клиентов: disconnect=0.01,delay=0.1,maxDelay=2s,reorder=0.05")
+	flag.DurationVar(&flightWindow, "flight-recorder", 0, "режим самописца: хранить в памяти столько последних данных каждого порта и сохранять их только при срабатывании триггера или отключении устройства (0 - выключен)")
+	flag.Int64Var(&flightMaxMB, "flight-recorder-size", 4, "наибольший объём данных самописца одного порта в памяти, МБ")
+	flag.IntVar(&logBufferKB, "log-buffer", 0, "размер буфера записи журналов, КБ (0 - каждая строка записывается в файл сразу)")
+	flag.DurationVar(&logFlushInterval, "log-flush", logFlushInterval, "наибольшее время, которое строки журнала ждут в буфере")
+	flag.StringVar(&fsyncPolicy, "fsync", fsyncPolicy, "сброс журналов на диск: never (решает ОС), always (после каждой строки; сжатые журналы пишутся блоком на строку) или период, например 5s")
+	flag.IntVar(&logChunkKB, "log-chunk", logChunkKB, "размер блока сжатых журналов (*.gz) до сжатия, КБ")
+	flag.DurationVar(&logChunkAge, "log-chunk-age", logChunkAge, "наибольшее время, которое строки сжатого журнала ждут в памяти до записи блока")
+	flag.StringVar(&redisIngestURL, "ingest-redis", "", "принимать команды для портов из списка Redis: redis://[:пароль@]хост:6379[/база]?list=serial-monitor:commands")
+	flag.StringVar(&natsIngestURL, "ingest-nats", "", "принимать команды для портов из темы NATS: nats://хост:4222?subject=serial-monitor.commands[&queue=группа]")
+	flag.StringVar(&natsPublishURL, "publish-nats", "", "публиковать события в NATS: nats://хост:4222?subject=serial-monitor.events[&jetstream=1]")
+	flag.StringVar(&redisPublishURL, "publish-redis", "", "публиковать события в поток Redis: redis://хост:6379[/база]?stream=serial-monitor:events[&maxlen=100000]")
+	flag.StringVar(&publishEventTypes, "publish-events", publishEventTypes, "публикуемые типы событий через запятую: data, status, trigger")
+	flag.Int64Var(&eventSpoolMaxMB, "publish-spool", eventSpoolMaxMB, "наибольший объём неотправленных событий на диске, МБ")
+	flag.StringVar(&noClientPolicy, "no-clients", noClientPolicy, "что делать с данными портов, пока не подключён ни один клиент: discard (отбрасывать), buffer (накопить и отдать первому клиенту) или log (записывать в журналы сеансов)")
+	flag.IntVar(&noClientBufferSize, "no-clients-buffer", noClientBufferSize, "сколько последних сообщений портов накапливать без клиентов при -no-clients=buffer")
+	flag.BoolVar(&preSessionDrain, "pre-session-drain", preSessionDrain, "при открытии порта выдавать накопленные в буфере ОС данные отдельным помеченным сообщением, не смешивая их с первой строкой сеанса (для портов, сообщающих размер входной очереди ОС)")
+	flag.DurationVar(&historyRetention, "history", historyRetention, "глубина истории строк каждого порта в памяти")
 	flag.Parse()
 
+	if !intInSlice(defaultProtocol, supportedProtocols) {
+		log.Fatalf("Неподдерживаемая версия протокола %d.", defaultProtocol)
+	}
+	logContainerDiagnostics()
+	setupAuth()
+	loadNamespaces()
+	loadEncryptionKey()
+	loadLogSyncPolicy()
+	loadNoClientPolicy()
+	recoverSessionLogs()
+	loadPortMetadata()
+	loadDeviceNotes()
+	loadPreferences()
+	loadReservations()
+	loadAvailability()
+	loadAutoOpenRules()
+	loadNotifyConfig()
+	loadChaos()
+	loadTriggers()
+	loadRedactionRules()
+	loadPeripheralProfiles()
+	loadKeepAliveProbes()
+	loadEventPublisher()
+
 	http.HandleFunc("/serialmonitor", handleConnections)
 
 	go handleMessages()
+	go runRetention()
+	go runHealthSupervisor()
+	go runDiskGuard()
+	go runClockMarkers()
+	go runLogFlusher()
+	flushLogsOnExit()
+	startRemoteMonitors()
+	go runRelayConnection()
+	go runRedisIngest()
+	go runNATSIngest()
+	go runEventPublisher()
 	go manageSerialConnection()
+	go runAvailabilityHeartbeat()
 	go writeToSerial()
 
 	log.Printf("Запускаем сервер %s", webAddress)
-	log.Fatal(http.ListenAndServe(webAddress, nil))
+	log.Fatal(http.ListenAndServe(webAddress, requireAuth(auditHTTP(http.DefaultServeMux))))
+}
+
+// Сообщение, адресованное одному клиенту
+type clientMessage struct {
+	conn *websocket.Conn
+	text string
 }
 
 // Отправление сообщения клиенту
 func handleMessages() {
 	for {
-		msg := <-broadcast
-
-		for client := range clients {
-			err := client.WriteMessage(websocket.TextMessage, []byte(msg))
-			if err != nil {
-				log.Printf("Ошибка записи сообщения клиенту: %v", err)
-				client.Close()
-				delete(clients, client)
+		select {
+		case msg := <-broadcast:
+			clientsMutex.Lock()
+			for _, client := range clients {
+				// Клиенты совместного просмотра получают только строки своего порта
+				if client.share != nil {
+					continue
+				}
+				if client.namespace == nil {
+					client.enqueue(msg)
+					continue
+				}
+				for _, m := range client.namespace.filterMessage(msg) {
+					client.enqueue(m)
+				}
+			}
+			clientsMutex.Unlock()
+		case msg := <-portMessages:
+			clientsMutex.Lock()
+			if connectedClients.Load() == 0 {
+				bufferUnattendedMessage(msg)
+			}
+			// Строка с меткой и цветом порта собирается один раз для всех клиентов
+			typed := ""
+			for _, client := range clients {
+				if client.share != nil || !client.namespace.allowsPort(msg.port) {
+					continue
+				}
+				text := msg.text
+				if msg.isLine && client.protocol.Load() >= protocolTyped {
+					if typed == "" {
+						typed = msg.typedLine()
+					}
+					text = typed
+				}
+				if client.namespace == nil {
+					client.enqueueData(text)
+				} else {
+					client.enqueueLimited(text)
+				}
+			}
+			clientsMutex.Unlock()
+		case msg := <-directMessages:
+			if client := getWSClient(msg.conn); client != nil {
+				client.enqueue(msg.text)
 			}
 		}
 	}
@@ -77,6 +222,16 @@ func handleMessages() {
 
 // Обработчик WebSocket соединений
 func handleConnections(w http.ResponseWriter, r *http.Request) {
+	protocol, err := requestedProtocol(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	handleConnectionsProtocol(w, r, protocol)
+}
+
+// Подключение клиента с выбранной версией протокола
+func handleConnectionsProtocol(w http.ResponseWriter, r *http.Request, protocol int) {
 	websocketUpgrader.CheckOrigin = func(r *http.Request) bool { return true }
 
 	ws, err := websocketUpgrader.Upgrade(w, r, nil)
@@ -86,11 +241,41 @@ func handleConnections(w http.ResponseWriter, r *http.Request) {
 	}
 	defer ws.Close()
 
+	if token := r.URL.Query().Get("share"); token != "" {
+		share := getShareToken(token)
+		if share == nil {
+			ws.WriteMessage(websocket.TextMessage, []byte("Ошибка: ссылка совместного просмотра недействительна или истекла."))
+			return
+		}
+		log.Printf("Клиент подключён по ссылке совместного просмотра порта %s.", share.Port)
+		serveShareClient(ws, share, protocol)
+		return
+	}
+
 	log.Println("Новый клиент подключён.")
-	clients[ws] = true
+	serveClient(ws, requestIdentity(r), requestNamespace(r), protocol)
+}
 
+// Обслуживание клиента WebSocket до его отключения
+func serveClient(ws *websocket.Conn, identity string, ns *namespace, protocol int) {
+	client := newWSClient(ws, identity, protocol)
+	client.namespace = ns
+	clientsMutex.Lock()
+	clients[ws] = client
+	client.backlog = attachClient(ns)
+	clientsMutex.Unlock()
+	go client.run()
+
+	sendCapabilities(ws)
 	//Отправляем первоначальное сообщение о портах
 	sendPortList()
+	sendPortMetadata(ws)
+	if len(identityPreferences(identity)) > 0 {
+		sendPreferences(ws)
+	}
+	if paths := stopUnattendedLogs(ns); len(paths) > 0 {
+		directMessages <- clientMessage{ws, "Пока клиенты не были подключены, данные портов записаны в журналы: " + strings.Join(paths, ", ")}
+	}
 
 	for {
 		_, msg, err := ws.ReadMessage()
@@ -109,14 +294,38 @@ func handleConnections(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		processSettings(message)
+		processSettings(ws, message)
 	}
 
+	clientsMutex.Lock()
 	delete(clients, ws)
+	detachClient()
+	clientsMutex.Unlock()
+	client.stop()
+	unsubscribeTimeline(ws)
+	stopReplay(ws)
 }
 
 // Переопределение настроек и получение команд от клиента
-func processSettings(message map[string]interface{}) {
+func processSettings(ws *websocket.Conn, message map[string]interface{}) {
+	if err := checkNamespaceAccess(clientNamespace(ws), message); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: %v.", err)}
+		return
+	}
+	if err := checkReservations(clientIdentity(ws), message); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: %v.", err)}
+		return
+	}
+	// Действие проверяется первым: его поля (command, port, baudRate) относятся
+	// к нему, а не к основному порту
+	if action, ok := message["action"]; ok {
+		if actionStr, actionOk := action.(string); actionOk {
+			processAction(ws, actionStr, message)
+		} else {
+			broadcast <- "Ошибка: неверный тип данных для действия."
+		}
+		return
+	}
 	port, portOk := message["port"]
 	baudRate, baudRateOk := message["baudRate"]
 
@@ -124,15 +333,40 @@ func processSettings(message map[string]interface{}) {
 		portStr, portValid := port.(string)
 		baudRateStr, baudRateValid := baudRate.(string)
 
+		// Формат кадра необязателен
+		framingStr, framingValid := message["framing"].(string)
+		if _, framingOk := message["framing"]; framingOk && !framingValid {
+			broadcast <- "Ошибка: неверный тип данных для формата кадра."
+			return
+		}
+		if _, err := parseFraming(framingStr); err != nil {
+			broadcast <- fmt.Sprintf("Ошибка: %v", err)
+			return
+		}
+
 		if portValid && baudRateValid {
 			baudRateInt, err := strconv.Atoi(baudRateStr)
 			if err == nil {
-				if currentSettings.Port != portStr || currentSettings.BaudRate != baudRateInt {
+				if currentSettings.Port != portStr || currentSettings.BaudRate != baudRateInt || currentSettings.Framing != framingStr {
+					if err := checkMainPortQuota(portStr); err != nil {
+						directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: %v.", err)}
+						return
+					}
+					auditClientAction(ws, "settings", portStr, map[string]interface{}{"baudRate": baudRateInt, "framing": framingStr})
 					currentSettings = SerialSettings{
 						Port:     portStr,
 						BaudRate: baudRateInt,
+						Framing:  framingStr,
+					}
+					rememberPortName(portStr)
+					if framingStr == "" {
+						broadcast <- fmt.Sprintf("Изменены настройки: порт %s, скорость передачи %d", portStr, baudRateInt)
+					} else {
+						broadcast <- fmt.Sprintf("Изменены настройки: порт %s, скорость передачи %d, формат кадра %s", portStr, baudRateInt, framingStr)
+					}
+					if channel := describeChannel(portStr); channel != "" {
+						broadcast <- channel
 					}
-					broadcast <- fmt.Sprintf("Изменены настройки: порт %s, скорость передачи %d", portStr, baudRateInt)
 					reconnectSerialPort()
 				} else {
 					broadcast <- "Настройки порта и скорости передачи не изменились."
@@ -150,6 +384,7 @@ func processSettings(message map[string]interface{}) {
 		}
 	} else if command, ok := message["command"]; ok {
 		if commandStr, commandOk := command.(string); commandOk {
+			auditClientAction(ws, "command", currentSettings.Port, redactLine(commandStr))
 			serialWriteChan <- commandStr + "\n"
 		} else {
 			broadcast <- "Ошибка: неверный тип данных для команды."
@@ -157,17 +392,48 @@ func processSettings(message map[string]interface{}) {
 	}
 }
 
+// Обработка расширенных действий клиента (поле "action")
+func processAction(ws *websocket.Conn, action string, message map[string]interface{}) {
+	handler, ok := clientActions[action]
+	if !ok {
+		broadcast <- fmt.Sprintf("Ошибка: неизвестное действие %q.", action)
+		return
+	}
+	port, _ := message["port"].(string)
+	auditClientAction(ws, action, port, redactPayload(message))
+	handler(ws, message)
+}
+
+// Преобразование сообщения клиента в структуру запроса конкретного действия
+func decodeAction(message map[string]interface{}, request interface{}) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, request)
+}
+
+// Период опроса списка портов
+const portPollInterval = 2 * time.Second
+
 // Функция для переподключения, а также для обновления данных(список портов и т.д.)
 func manageSerialConnection() {
 	// Получаем текущий список портов
 	lastPortList := getPortNames()
+	recordPresence(lastPortList)
+	applyAutoOpenRules(lastPortList)
 	for {
 		// Получаем текущий список портов
 		portList := getPortNames()
 		if !equalPortLists(portList, lastPortList) {
+			recordPresence(portList)
+			for _, port := range newPorts(lastPortList, portList) {
+				dumpFlightRecorder(port, "устройство отключено")
+			}
 			sendPortList()
 			// Проверяем, если текущий порт больше недоступен, сбрасываем настройки и переподключаемся
-			if !stringInSlice(currentSettings.Port, portList) {
+			_, _, remote := parseRemotePort(currentSettings.Port)
+			if !remote && !stringInSlice(currentSettings.Port, portList) {
 				if len(portList) < len(lastPortList) {
 					currentSettings = SerialSettings{}
 					broadcast <- "Текущий порт больше не доступен. Настройки сброшены."
@@ -175,10 +441,11 @@ func manageSerialConnection() {
 
 				reconnectSerialPort()
 			}
+			applyAutoOpenRules(newPorts(portList, lastPortList))
 			// Обновляем последний известный список портов
 			lastPortList = portList
 		}
-		time.Sleep(2 * time.Second)
+		time.Sleep(portPollPeriod())
 	}
 }
 
@@ -192,6 +459,17 @@ func stringInSlice(str string, list []string) bool {
 	return false
 }
 
+// Функция для получения портов, которых не было в предыдущем списке
+func newPorts(portList, lastPortList []string) []string {
+	var added []string
+	for _, port := range portList {
+		if !stringInSlice(port, lastPortList) {
+			added = append(added, port)
+		}
+	}
+	return added
+}
+
 // Функция для проверки наличия списка портов в слайсе
 func equalPortLists(a, b []string) bool {
 	if len(a) != len(b) {
@@ -211,6 +489,7 @@ func reconnectSerialPort() {
 
 	if serialPort != nil {
 		serialPort.Close()
+		auditLog("system", "", "portClose", currentSettings.Port, nil)
 	}
 
 	// Небольшая пауза перед повторной попыткой открыть порт
@@ -226,82 +505,154 @@ func openSerialPort() {
 		broadcast <- "Порт не выбран."
 		return
 	}
-	c := &serial.Config{Name: currentSettings.Port, Baud: currentSettings.BaudRate}
+	if remote, port, ok := parseRemotePort(currentSettings.Port); ok {
+		serialPort = nil
+		if err := remote.openPort(port, currentSettings.BaudRate); err != nil {
+			broadcast <- fmt.Sprintf("Ошибка: %v", err)
+			return
+		}
+		broadcast <- fmt.Sprintf("Запрошено подключение к порту %s удалённого монитора %s.", port, remote.name)
+		return
+	}
 	var err error
-	serialPort, err = serial.OpenPort(c)
+	// Чтение с таймаутом, чтобы переоткрытие порта не ждало прихода данных
+	serialPort, err = openSerialConn(currentSettings.Port, currentSettings.BaudRate, currentSettings.Framing, portReadTimeout)
 	if err != nil {
+		recordPortError(currentSettings.Port)
 		broadcast <- "Ошибка: не удалось открыть последовательный порт. Проверьте настройки и переподключитесь к порту."
 		return
 	}
+	auditLog("system", "", "portOpen", currentSettings.Port, map[string]interface{}{"baudRate": currentSettings.BaudRate, "framing": currentSettings.Framing})
+	rememberPortName(currentSettings.Port)
+	recordPortOpen(currentSettings.Port, true)
+
+	// Сеанс регистрируется сразу, чтобы режим можно было сменить до начала чтения
+	port := currentSettings.Port
+	session := newPortSession(port, func(line string) {
+		// Отправляем сообщение клиентам
+		sendPortLine(port, line, line)
+		processPortLine(port, line)
+	})
+	pipeline := startPortPipeline(port, currentSettings.BaudRate, serialPort, session)
 	go func() {
-		readFromSerial()
+		readFromSerial(pipeline)
 	}()
 	broadcast <- fmt.Sprintf("Подключение к последовательному порту %s со скоростью %d успешно!", currentSettings.Port, currentSettings.BaudRate)
 }
 
 // Получаем ответ из последовательного порта
-func readFromSerial() error {
+func readFromSerial(pipeline *portPipeline) error {
+	defer pipeline.stop()
+
 	// Проверяем наличие порта
-	if serialPort == nil {
+	if pipeline.conn == nil {
 		broadcast <- "Ошибка: последовательный порт не открыт."
 		return errors.New("ошибка: последовательный порт не открыт")
 	}
+	// Порт читается через свой конвейер: переоткрытие заменяет serialPort,
+	// но не подменяет порт уже идущему чтению
+	session := pipeline.session
+	pipeline.drain()
 
-	reader := bufio.NewReader(serialPort)
+	buf := make([]byte, 4096)
 	for {
-		// Читаем до символа новой строки
-		receivedMsg, err := reader.ReadString('\n')
+		n, err := pipeline.conn.Read(buf)
+		if n > 0 {
+			pipeline.push(buf[:n])
+		}
+		// Пустое чтение по таймауту - данных пока нет
+		if n == 0 && err == io.EOF {
+			continue
+		}
 		if err != nil {
 			broadcast <- fmt.Sprintf("Ошибка при чтении из последовательного порта: %v", err)
+			// Порт закрыт при переподключении - это не сбой устройства
+			if errors.Is(err, os.ErrClosed) {
+				recordPortOpen(session.port, false)
+			} else {
+				recordPortError(session.port)
+				dumpFlightRecorder(session.port, fmt.Sprintf("ошибка чтения: %v", err))
+			}
 			return err
 		}
-		// Удаляем пробельные символы
-		receivedMsg = strings.TrimSpace(receivedMsg)
-		if receivedMsg != "" {
-			// Отправляем сообщение клиентам
-			broadcast <- receivedMsg
+		// Добавляем небольшую задержку перед чтением новых данных, если не записываются интервалы
+		// между байтами и не идёт проверка линии
+		if !session.fastRead() {
+			time.Sleep(100 * time.Millisecond)
 		}
-		// Добавляем небольшую задержку перед чтением нового сообщения
-		time.Sleep(100 * time.Millisecond)
 	}
 }
 
+// Обработка строки, полученной из любого порта: журнал, общая лента, история, триггеры и сверка
+func processPortLine(port, line string) {
+	now := time.Now()
+	startUnattendedLog(port)
+	writePortLog(port, line)
+	publishEvent(publishedEvent{Type: eventData, Time: now, Port: port, Line: line})
+	publishTimeline(port, line)
+	recordHistory(port, line, now)
+	checkTriggers(port, line, now)
+	checkGoldenVerifier(port, line)
+	dispatchLineSubscriptions(port, line)
+}
+
 // Отправление сообщения от клиента в последовательный порт
 func writeToSerial() {
 	for {
 		msg := <-serialWriteChan
+		if remote, _, ok := parseRemotePort(currentSettings.Port); ok {
+			if err := remote.sendCommand(strings.TrimSuffix(msg, "\n")); err != nil {
+				broadcast <- fmt.Sprintf("Ошибка: %v", err)
+			}
+			continue
+		}
 		if serialPort == nil {
 			broadcast <- "Ошибка: порт не открыт. Сообщение не отправлено."
 			continue
 		}
 
-		_, err := serialPort.Write([]byte(msg))
+		err := writeToPort(currentSettings.Port, []byte(msg))
 		if err != nil {
 			broadcast <- "Ошибка записи в последовательный порт: " + err.Error()
 		} else {
-			broadcast <- "Отправлено на последовательный порт: " + msg
+			// Команда скрывается так же, как строки порта: эхо видят все клиенты
+			sendPortMessage(currentSettings.Port, "Отправлено на последовательный порт: "+redactLine(strings.TrimSuffix(msg, "\n"))+"\n")
 		}
 	}
 }
 
+// Служебные сообщения, которые сопровождают список портов
+const (
+	portListPrefix = "Получен новый список портов: "
+	noPortsMessage = "Доступные последовательные порты отсутствуют."
+)
+
 // Функция для отправки списка портов клиентам по WebSocket
 func sendPortList() error {
-	ports := getPortNames()
+	ports := append(getPortNames(), getRemotePortNames()...)
 	data, err := json.Marshal(ports)
 	if err != nil {
 		broadcast <- fmt.Sprintf("Ошибка при маршалинге списка портов: %v", err)
 		return err
 	}
 
+	rememberPortNames(ports)
+
 	var message string
 	if len(ports) == 0 {
-		message = "Доступные последовательные порты отсутствуют."
+		message = noPortsMessage
 	} else {
-		message = fmt.Sprintf("Получен новый список портов: %v", ports)
+		message = fmt.Sprintf("%s%v", portListPrefix, ports)
 	}
 
 	broadcast <- message
 	broadcast <- string(data)
+	// В контейнере пустой список обычно означает, что устройства не проброшены
+	if len(ports) == 0 {
+		for _, hint := range containerPortHints() {
+			broadcast <- hint
+		}
+	}
 
 	return nil
 }
@@ -314,8 +665,27 @@ func getPortNames() []string {
 	case isWindows():
 		ports = getWindowsPortNames()
 	default:
-		//ports = getUnixPortNames()
+		ports = getUnixPortNames()
+	}
+
+	return ports
+}
+
+// Шаблоны имён последовательных устройств в Linux и macOS
+var unixPortPatterns = []string{"/dev/ttyUSB*", "/dev/ttyACM*", "/dev/ttyAMA*", "/dev/cu.*"}
+
+// Функция для получения списка последовательных портов в Linux и macOS
+func getUnixPortNames() []string {
+	var ports []string
+
+	for _, pattern := range unixPortPatterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			continue
+		}
+		ports = append(ports, matches...)
 	}
+	sort.Strings(ports)
 
 	return ports
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// Пространство, в котором проверяется доступ к портам из сообщений клиента
+var fuzzNamespace = &namespace{Name: "fuzz", Devices: []string{"/dev/ttyUSB*"}}
+
+// Сообщения клиента, с которых начинается перебор: по одному на каждую ветку
+// processSettings и несколько заведомо неверных
+var clientMessageSeeds = []string{
+	`{"port": "/dev/ttyUSB0", "baudRate": "9600"}`,
+	`{"port": "/dev/ttyUSB0", "baudRate": "9600", "framing": "7E1"}`,
+	`{"port": "/dev/ttyACM0", "baudRate": 9600, "framing": 1}`,
+	`{"command": "reset"}`,
+	`{"command": "reset", "port": "/dev/ttyACM0"}`,
+	`{"action": "groupOpen", "group": "g", "ports": ["/dev/ttyUSB0", "/dev/ttyUSB1"], "baudRate": "115200"}`,
+	`{"action": "groupCommand", "group": "g", "command": "start", "sync": true}`,
+	`{"action": "runSequence", "sequence": {"port": "/dev/ttyUSB0", "steps": [{"send": "temp", "expect": "TEMP (\\d+)", "min": 1}]}}`,
+	`{"action": "runSequence", "sequenceFile": "/etc/passwd"}`,
+	`{"action": "timelineSubscribe", "ports": ["/dev/ttyUSB0", 5, null]}`,
+	`{"action": "sendFrame", "port": "/dev/ttyUSB0", "address": "01", "data": "zz", "break": "-1s"}`,
+	`{"action": "capture", "port": "/dev/ttyUSB0", "bytes": -1, "duration": "1h"}`,
+	`{"action": "hello", "protocol": 1e100}`,
+	`{"action": 5}`,
+	`{"port": ["/dev/ttyUSB0"], "baudRate": {}}`,
+	`{"ports": [null, 1, "x"], "rxPort": "../..", "sequence": []}`,
+}
+
+// Разбор сообщения клиента, как в serveClient, и всё, что проходит каждое
+// сообщение до выполнения: проверка пространства, резервирований и разбор
+// запроса любого действия. Ни одно сообщение не должно приводить к панике,
+// а прошедшее проверку пространства - затрагивать чужие порты.
+func FuzzClientMessage(f *testing.F) {
+	for _, seed := range clientMessageSeeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var message map[string]interface{}
+		if json.Unmarshal(data, &message) != nil {
+			return
+		}
+		if err := checkNamespaceAccess(fuzzNamespace, message); err == nil {
+			for _, port := range targetPorts(message) {
+				if !fuzzNamespace.allowsPort(port) {
+					t.Fatalf("сообщение %s прошло проверку пространства, но затрагивает порт %q", data, port)
+				}
+			}
+		}
+		checkReservations("fuzz", message)
+
+		for action, request := range actionRequests {
+			decoded := reflect.New(reflect.TypeOf(request)).Interface()
+			if decodeAction(message, decoded) != nil {
+				continue
+			}
+			// Разбор уже разобранного запроса ничего не меняет
+			first, err := json.Marshal(decoded)
+			if err != nil {
+				t.Fatalf("%s: разобранный запрос не кодируется: %v", action, err)
+			}
+			var again map[string]interface{}
+			if err := json.Unmarshal(first, &again); err != nil {
+				t.Fatalf("%s: %v", action, err)
+			}
+			redecoded := reflect.New(reflect.TypeOf(request)).Interface()
+			if err := decodeAction(again, redecoded); err != nil {
+				t.Fatalf("%s: повторный разбор %s не удался: %v", action, first, err)
+			}
+			if second, _ := json.Marshal(redecoded); string(second) != string(first) {
+				t.Fatalf("%s: повторный разбор изменил запрос:\n%s\n%s", action, first, second)
+			}
+		}
+	})
+}
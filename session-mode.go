@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Максимальная длина строки в текстовом режиме. Более длинные данные без
+// перевода строки выдаются частями.
+const maxSessionLineLength = 64 * 1024
+
+// Сеанс чтения из порта: режим разбора данных и ещё не разобранные байты
+type portSession struct {
+	port string
+	// Обработка строки, полученной в текстовом режиме
+	deliverLine func(line string)
+	// Мьютекс для синхронизации режима и буфера
+	mutex sync.Mutex
+	// Разбор данных: "text" - строки, "binary" - порции как есть, "hex" - порции
+	// в шестнадцатеричном виде
+	decoder string
+	// Кодировка текста, nil - UTF-8
+	charset *[128]rune
+	// Фильтры строк: выдаются строки, подходящие под любое из include
+	// (если они заданы) и не подходящие ни под одно из exclude
+	include, exclude []*regexp.Regexp
+	// Отправлять ли отладочные события обработки (см. pipeline-debug.go)
+	debug bool
+	// Полученные, но ещё не выданные байты (неполная строка)
+	pending []byte
+	// Анализатор протокола, если он запущен
+	detector *protocolDetector
+	// Подписчики на необработанные байты порта
+	rawSubscribers map[chan []byte]bool
+	// Запись интервалов между байтами, если она включена
+	timing *byteTiming
+	// Время получения последних данных
+	lastDataAt time.Time
+	// Идёт проверка линии (см. loopback.go)
+	linkTest bool
+}
+
+// Порция данных, полученная из порта в двоичном режиме
+type binaryChunk struct {
+	Type string    `json:"type"`
+	Port string    `json:"port"`
+	Time time.Time `json:"time"`
+	// Данные в кодировке base64
+	Data string `json:"data"`
+}
+
+// Запрос на смену режима сеанса
+type sessionModeRequest struct {
+	Port string `json:"port"`
+	// "text" или "binary"
+	Mode string `json:"mode"`
+}
+
+var (
+	// Сеансы открытых портов, ключ - имя порта
+	portSessions = make(map[string]*portSession)
+	// Мьютекс для синхронизации доступа к portSessions
+	portSessionsMutex = &sync.Mutex{}
+)
+
+func init() {
+	clientActions["sessionMode"] = processSessionMode
+}
+
+// Начинаем сеанс чтения из порта в текстовом режиме
+func newPortSession(port string, deliverLine func(line string)) *portSession {
+	s := &portSession{port: port, deliverLine: deliverLine, decoder: decoderText}
+	// Настройки обработки порта сохраняются между открытиями
+	s.applyPipeline(getPipelineConfig(port))
+	if protocolDetectDuration > 0 {
+		s.detector = &protocolDetector{duration: protocolDetectDuration}
+	}
+
+	portSessionsMutex.Lock()
+	portSessions[port] = s
+	portSessionsMutex.Unlock()
+
+	return s
+}
+
+// Завершаем сеанс чтения из порта
+func (s *portSession) close() {
+	portSessionsMutex.Lock()
+	defer portSessionsMutex.Unlock()
+
+	// Порт мог быть уже открыт заново с новым сеансом
+	if portSessions[s.port] == s {
+		delete(portSessions, s.port)
+		endCapture(s.port, nil, captureByClose)
+	}
+}
+
+// Получаем сеанс открытого порта по имени
+func getPortSession(port string) *portSession {
+	portSessionsMutex.Lock()
+	defer portSessionsMutex.Unlock()
+
+	return portSessions[port]
+}
+
+// Обработка байтов, прочитанных из порта, в текущем режиме сеанса
+func (s *portSession) feed(data []byte) {
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastDataAt = now
+	recordFlight(s.port, data, now)
+	recordCapture(s.port, data)
+	if s.timing != nil {
+		s.timing.record(s.port, data, now)
+	}
+	if s.detector != nil {
+		s.detector.add(s.port, data)
+	}
+	for ch := range s.rawSubscribers {
+		select {
+		case ch <- append([]byte(nil), data...):
+		default:
+			s.debugEvent("subscribers", "dropped", "очередь подписчика на необработанные байты переполнена", redactBytes(data))
+		}
+	}
+	// Во время проверки линии данные нужны только ей
+	if s.linkTest {
+		s.debugEvent("linkTest", "dropped", "данные переданы только проверке линии", redactBytes(data))
+		return
+	}
+	switch s.decoder {
+	case decoderBinary:
+		s.pending = append(s.pending, data...)
+		s.flushBinary()
+		return
+	case decoderHex:
+		s.deliverFiltered(hexDump(redactBytes(data)))
+		return
+	}
+	s.pending = append(s.pending, data...)
+	for {
+		i := bytes.IndexByte(s.pending, '\n')
+		if i < 0 || i >= maxSessionLineLength {
+			if i < 0 && len(s.pending) < maxSessionLineLength {
+				if len(s.pending) > 0 {
+					s.debugEvent("lines", "buffered", fmt.Sprintf("неполная строка ждёт перевода строки: байтов %d", len(s.pending)), nil)
+				}
+				return
+			}
+			i = maxSessionLineLength - 1
+			s.debugEvent("lines", "transformed", fmt.Sprintf("строка длиннее %d байтов выдана частями", maxSessionLineLength), nil)
+		}
+		raw := s.pending[:i+1]
+		s.pending = s.pending[i+1:]
+		// Удаляем пробельные символы и скрываем конфиденциальные данные
+		text := strings.TrimSpace(decodeCharset(s.charset, raw))
+		if text == "" {
+			s.debugEvent("lines", "dropped", "пустая строка", redactBytes(raw))
+			continue
+		}
+		line := redactLine(text)
+		if line != text {
+			// Исходная строка не показывается: в ней конфиденциальные данные
+			s.debugEvent("redaction", "transformed", "часть строки скрыта правилами скрытия", nil)
+		}
+		s.debugCheckLine(raw, line)
+		s.deliverFiltered(line)
+	}
+}
+
+// Время получения последних данных из порта
+func (s *portSession) lastData() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.lastDataAt
+}
+
+// Подписка на необработанные байты порта, в каком бы режиме ни был сеанс
+func (s *portSession) subscribeRaw() chan []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ch := make(chan []byte, lineSubscriptionBuffer)
+	if s.rawSubscribers == nil {
+		s.rawSubscribers = make(map[chan []byte]bool)
+	}
+	s.rawSubscribers[ch] = true
+	return ch
+}
+
+// Отмена подписки на необработанные байты порта
+func (s *portSession) unsubscribeRaw(ch chan []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.rawSubscribers, ch)
+}
+
+// Выдача всех накопленных байтов одной двоичной порцией
+func (s *portSession) flushBinary() {
+	if len(s.pending) == 0 {
+		return
+	}
+	data := redactBytes(s.pending)
+	s.pending = nil
+
+	chunk := binaryChunk{
+		Type: "binary",
+		Port: s.port,
+		Time: time.Now(),
+		Data: base64.StdEncoding.EncodeToString(data),
+	}
+	message, err := json.Marshal(chunk)
+	if err != nil {
+		log.Printf("Ошибка при маршалинге двоичных данных: %v", err)
+		return
+	}
+	sendPortMessage(s.port, string(message))
+	writePortLog(s.port, "bin "+hex.EncodeToString(data))
+}
+
+// Смена разбора данных. Накопленные байты не теряются: неполная строка при
+// переходе в двоичный режим выдаётся двоичной порцией. Вызывается под s.mutex.
+func (s *portSession) setDecoder(decoder string) {
+	s.decoder = decoder
+	switch decoder {
+	case decoderBinary:
+		s.flushBinary()
+	case decoderHex:
+		if len(s.pending) > 0 {
+			s.deliverFiltered(hexDump(redactBytes(s.pending)))
+			s.pending = nil
+		}
+	}
+}
+
+// Переключение сеанса порта между текстовым и двоичным режимами без закрытия порта
+func processSessionMode(ws *websocket.Conn, message map[string]interface{}) {
+	var request sessionModeRequest
+	if err := decodeAction(message, &request); err != nil {
+		broadcast <- fmt.Sprintf("Ошибка: неверный формат запроса режима сеанса: %v", err)
+		return
+	}
+	if request.Port == "" {
+		request.Port = currentSettings.Port
+	}
+	if request.Mode != "text" && request.Mode != "binary" {
+		broadcast <- fmt.Sprintf("Ошибка: неизвестный режим сеанса %q.", request.Mode)
+		return
+	}
+	session := getPortSession(request.Port)
+	if session == nil {
+		broadcast <- fmt.Sprintf("Ошибка: порт %s не открыт.", request.Port)
+		return
+	}
+
+	config := getPipelineConfig(request.Port)
+	config.Decoder = request.Mode
+	setPipelineConfig(request.Port, config)
+	session.applyPipeline(config)
+	if request.Mode == "binary" {
+		broadcast <- fmt.Sprintf("Порт %s переключён в двоичный режим.", request.Port)
+	} else {
+		broadcast <- fmt.Sprintf("Порт %s переключён в текстовый режим.", request.Port)
+	}
+}
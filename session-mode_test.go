@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// Сеанс, строки которого складываются в список, без регистрации порта
+func testSession(decoder string) (*portSession, *[]string) {
+	lines := &[]string{}
+	s := &portSession{port: "fuzz", decoder: decoder}
+	s.deliverLine = func(line string) {
+		*lines = append(*lines, line)
+	}
+	return s, lines
+}
+
+// Разбор не зависит от того, какими порциями пришли байты, а выданные строки
+// непустые, без переводов строки и не длиннее предела
+func FuzzSessionFeed(f *testing.F) {
+	f.Add([]byte("TEMP 23.5\r\nECHO hello\r\n"), 3)
+	f.Add([]byte("\n\n  \r\n\x00\xff\xfe partial"), 0)
+	f.Add([]byte("$GPGGA,1*00\nnext"), 7)
+	f.Fuzz(func(t *testing.T, data []byte, split int) {
+		if split < 0 {
+			split = -split
+		}
+		split %= len(data) + 1
+
+		whole, wholeLines := testSession(decoderText)
+		whole.feed(data)
+		parts, partLines := testSession(decoderText)
+		parts.feed(data[:split])
+		parts.feed(data[split:])
+
+		if strings.Join(*wholeLines, "\n") != strings.Join(*partLines, "\n") || !bytes.Equal(whole.pending, parts.pending) {
+			t.Fatalf("разбор зависит от деления на порции (%d): %q и %q", split, *wholeLines, *partLines)
+		}
+		for _, line := range *wholeLines {
+			if line == "" || strings.ContainsRune(line, '\n') || line != strings.TrimSpace(line) || len(line) > maxSessionLineLength {
+				t.Fatalf("недопустимая строка %q", line)
+			}
+		}
+
+		// В шестнадцатеричном режиме из строк восстанавливаются все полученные байты
+		hexed, hexLines := testSession(decoderHex)
+		hexed.feed(data[:split])
+		hexed.feed(data[split:])
+		var restored []byte
+		for _, line := range *hexLines {
+			b, err := hex.DecodeString(strings.ReplaceAll(line, " ", ""))
+			if err != nil {
+				t.Fatalf("строка %q не разбирается: %v", line, err)
+			}
+			restored = append(restored, b...)
+		}
+		if !bytes.Equal(restored, data) {
+			t.Fatalf("шестнадцатеричный режим потерял байты: %x и %x", data, restored)
+		}
+	})
+}
+
+// Данные без перевода строки выдаются частями не длиннее предела, даже если
+// пришли одной порцией
+func TestSessionFeedLongLine(t *testing.T) {
+	data := append(bytes.Repeat([]byte("x"), 2*maxSessionLineLength+10), '\n')
+	for _, chunk := range []int{len(data), 4096, 1} {
+		s, lines := testSession(decoderText)
+		for i := 0; i < len(data); i += chunk {
+			s.feed(data[i:min(i+chunk, len(data))])
+		}
+		if len(*lines) != 3 || len(s.pending) != 0 {
+			t.Fatalf("порции по %d: строк %d, осталось байтов %d", chunk, len(*lines), len(s.pending))
+		}
+		for i, want := range []int{maxSessionLineLength, maxSessionLineLength, 10} {
+			if len((*lines)[i]) != want {
+				t.Fatalf("порции по %d: строка %d длиной %d", chunk, i, len((*lines)[i]))
+			}
+		}
+	}
+}
+
+// Данные отладочных событий о пропущенных байтах скрываются правилами скрытия
+func TestDebugEventsRedacted(t *testing.T) {
+	useTestRedaction(t, `password=\S+`)
+	s, _ := testSession(decoderText)
+	s.debug = true
+	s.linkTest = true
+
+	events := make(chan string, 1)
+	go func() { events <- (<-portMessages).text }()
+	s.feed([]byte("login password=hunter2\n"))
+
+	event := <-events
+	if !strings.Contains(event, `"stage":"linkTest"`) {
+		t.Fatalf("нет события проверки линии: %s", event)
+	}
+	if strings.Contains(event, hex.EncodeToString([]byte("hunter2"))) {
+		t.Errorf("пароль попал в событие отладки: %s", event)
+	}
+}
+
+// В шестнадцатеричном режиме правила скрытия применяются до преобразования
+func TestHexDecoderRedacts(t *testing.T) {
+	useTestRedaction(t, `password=\S+`)
+	s, lines := testSession(decoderHex)
+	s.feed([]byte("login password=hunter2\n"))
+
+	dump := strings.Join(*lines, "\n")
+	if dump == "" {
+		t.Fatal("нет выданных строк")
+	}
+	for _, secret := range []string{"hunter2", hex.EncodeToString([]byte("hunter2")), "68 75 6e 74"} {
+		if strings.Contains(dump, secret) {
+			t.Errorf("пароль попал в шестнадцатеричный вид: %s", dump)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Запрос на привязку внешних идентификаторов к сеансу порта
+type sessionTagsRequest struct {
+	Port string            `json:"port"`
+	Tags map[string]string `json:"tags"`
+}
+
+var (
+	// Внешние идентификаторы сеансов (штрихкод, заказ-наряд), ключ - имя порта
+	sessionTags = make(map[string]map[string]string)
+	// Мьютекс для синхронизации доступа к sessionTags
+	sessionTagsMutex = &sync.Mutex{}
+)
+
+func init() {
+	clientActions["setSessionTags"] = processSetSessionTags
+}
+
+// Привязка идентификаторов к сеансу порта. Пустой набор удаляет привязку.
+func processSetSessionTags(ws *websocket.Conn, message map[string]interface{}) {
+	var request sessionTagsRequest
+	if err := decodeAction(message, &request); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неверный формат идентификаторов сеанса: %v", err)}
+		return
+	}
+	if request.Port == "" {
+		directMessages <- clientMessage{ws, "Ошибка: не указан порт."}
+		return
+	}
+
+	sessionTagsMutex.Lock()
+	if len(request.Tags) == 0 {
+		delete(sessionTags, request.Port)
+	} else {
+		sessionTags[request.Port] = request.Tags
+	}
+	sessionTagsMutex.Unlock()
+
+	// Отмечаем смену изделия в журнале, чтобы последующие строки относились к нему
+	writePortLogComment(request.Port, "Идентификаторы сеанса: "+formatSessionTags(request.Tags))
+	broadcast <- fmt.Sprintf("Идентификаторы сеанса порта %s: %s", request.Port, formatSessionTags(request.Tags))
+}
+
+// Копия идентификаторов сеанса порта
+func getSessionTags(port string) map[string]string {
+	sessionTagsMutex.Lock()
+	defer sessionTagsMutex.Unlock()
+
+	tags := sessionTags[port]
+	if len(tags) == 0 {
+		return nil
+	}
+	copied := make(map[string]string, len(tags))
+	for k, v := range tags {
+		copied[k] = v
+	}
+	return copied
+}
+
+// Идентификаторы в виде строки "barcode=123, workOrder=WO-7" в порядке ключей
+func formatSessionTags(tags map[string]string) string {
+	if len(tags) == 0 {
+		return "нет"
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "=" + tags[k]
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Идентификаторы в виде JSON для заголовков файлов
+func sessionTagsJSON(port string) string {
+	data, _ := json.Marshal(getSessionTags(port))
+	return string(data)
+}
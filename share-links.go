@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Срок действия ссылки по умолчанию и наибольший допустимый срок
+const (
+	defaultShareTTL = time.Hour
+	maxShareTTL     = 7 * 24 * time.Hour
+)
+
+// Токен совместного просмотра: даёт только чтение строк одного порта до истечения срока
+type shareToken struct {
+	Token     string    `json:"token"`
+	Port      string    `json:"port"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// Адрес подключения для коллеги
+	URL string `json:"url"`
+}
+
+// Запрос на создание или отзыв ссылки
+type shareRequest struct {
+	Port string `json:"port"`
+	// Срок действия, например "2h"
+	TTL   string `json:"ttl"`
+	Token string `json:"token"`
+}
+
+var (
+	// Действующие токены совместного просмотра, ключ - токен
+	shareTokens = make(map[string]*shareToken)
+	// Мьютекс для синхронизации доступа к shareTokens
+	shareTokensMutex = &sync.Mutex{}
+)
+
+func init() {
+	clientActions["createShare"] = processCreateShare
+	clientActions["revokeShare"] = processRevokeShare
+	clientActions["listShares"] = processListShares
+}
+
+// Создание ссылки совместного просмотра порта
+func processCreateShare(ws *websocket.Conn, message map[string]interface{}) {
+	var request shareRequest
+	if err := decodeAction(message, &request); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неверный формат запроса ссылки: %v", err)}
+		return
+	}
+	if request.Port == "" {
+		request.Port = currentSettings.Port
+	}
+	if request.Port == "" {
+		directMessages <- clientMessage{ws, "Ошибка: не указан порт для совместного просмотра."}
+		return
+	}
+	ttl, err := parseOptionalDuration(request.TTL)
+	if err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: %v", err)}
+		return
+	}
+	if ttl == 0 {
+		ttl = defaultShareTTL
+	}
+	if ttl > maxShareTTL {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: срок действия ссылки не может превышать %s.", maxShareTTL)}
+		return
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка создания токена: %v", err)}
+		return
+	}
+	now := time.Now()
+	share := &shareToken{
+		Token:     hex.EncodeToString(buf),
+		Port:      request.Port,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	share.URL = fmt.Sprintf("ws://%s/serialmonitor?share=%s", webAddress, url.QueryEscape(share.Token))
+
+	shareTokensMutex.Lock()
+	shareTokens[share.Token] = share
+	shareTokensMutex.Unlock()
+
+	data, err := json.Marshal(map[string]interface{}{"type": "share", "share": share})
+	if err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка при маршалинге ссылки: %v", err)}
+		return
+	}
+	directMessages <- clientMessage{ws, string(data)}
+	broadcast <- fmt.Sprintf("Создана ссылка совместного просмотра порта %s до %s.", share.Port, share.ExpiresAt.Format(time.DateTime))
+}
+
+// Отзыв ссылки совместного просмотра. Подключённые по ней клиенты отключаются.
+func processRevokeShare(ws *websocket.Conn, message map[string]interface{}) {
+	var request shareRequest
+	if err := decodeAction(message, &request); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неверный формат запроса ссылки: %v", err)}
+		return
+	}
+
+	ns := clientNamespace(ws)
+	shareTokensMutex.Lock()
+	share, ok := shareTokens[request.Token]
+	// Ссылки на чужие порты для клиента пространства имён не существуют
+	if ok && !ns.allowsPort(share.Port) {
+		ok = false
+	}
+	if ok {
+		delete(shareTokens, request.Token)
+	}
+	shareTokensMutex.Unlock()
+
+	if !ok {
+		directMessages <- clientMessage{ws, "Ошибка: ссылка не найдена."}
+		return
+	}
+	broadcast <- fmt.Sprintf("Ссылка совместного просмотра порта %s отозвана.", share.Port)
+}
+
+// Отправка списка действующих ссылок запросившему клиенту
+func processListShares(ws *websocket.Conn, message map[string]interface{}) {
+	ns := clientNamespace(ws)
+	shareTokensMutex.Lock()
+	list := make([]*shareToken, 0, len(shareTokens))
+	for _, share := range shareTokens {
+		if time.Now().Before(share.ExpiresAt) && ns.allowsPort(share.Port) {
+			list = append(list, share)
+		}
+	}
+	shareTokensMutex.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+
+	data, err := json.Marshal(map[string]interface{}{"type": "shares", "shares": list})
+	if err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка при маршалинге ссылок: %v", err)}
+		return
+	}
+	directMessages <- clientMessage{ws, string(data)}
+}
+
+// Действующий токен совместного просмотра. Просроченные токены удаляются.
+func getShareToken(token string) *shareToken {
+	shareTokensMutex.Lock()
+	defer shareTokensMutex.Unlock()
+
+	share := shareTokens[token]
+	if share != nil && !time.Now().Before(share.ExpiresAt) {
+		delete(shareTokens, token)
+		return nil
+	}
+	return share
+}
+
+// Обслуживание клиента, подключённого по ссылке совместного просмотра: он
+// получает только строки одного порта и не может ничего менять
+func serveShareClient(ws *websocket.Conn, share *shareToken, protocol int) {
+	client := newWSClient(ws, "share", protocol)
+	client.share = share
+	clientsMutex.Lock()
+	clients[ws] = client
+	clientsMutex.Unlock()
+	go client.run()
+
+	timelineMutex.Lock()
+	timelineSubscribers[ws] = map[string]bool{share.Port: true}
+	timelineMutex.Unlock()
+	directMessages <- clientMessage{ws, fmt.Sprintf("Совместный просмотр порта %s до %s, только чтение.", share.Port, share.ExpiresAt.Format(time.DateTime))}
+
+	// Отключаем клиента, когда ссылка истекает или её отзывают
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if getShareToken(share.Token) == nil {
+					log.Printf("Ссылка совместного просмотра порта %s больше не действует, клиент отключён.", share.Port)
+					ws.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			break
+		}
+		directMessages <- clientMessage{ws, "Ошибка: совместный просмотр доступен только для чтения."}
+	}
+
+	close(done)
+	clientsMutex.Lock()
+	delete(clients, ws)
+	clientsMutex.Unlock()
+	client.stop()
+	unsubscribeTimeline(ws)
+}
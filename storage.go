@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Путь к файлу внутри каталога данных сервера
+func dataPath(name string) string {
+	return filepath.Join(dataDir, name)
+}
+
+// Чтение JSON-файла из каталога данных. Отсутствие файла ошибкой не считается.
+func loadJSONFile(name string, v interface{}) error {
+	data, err := os.ReadFile(dataPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Запись JSON-файла в каталог данных. Файл сначала пишется во временный,
+// а затем переименовывается, чтобы при сбое не остался наполовину записанный файл.
+func saveJSONFile(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := dataPath(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := writeFileSynced(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	if fsyncEnabled() {
+		return syncDir(filepath.Dir(path))
+	}
+	return nil
+}
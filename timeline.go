@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Сообщение общей ленты: строки всех портов в едином порядке
+type timelineEvent struct {
+	Type string    `json:"type"`
+	Seq  uint64    `json:"seq"`
+	Port string    `json:"port"`
+	Time time.Time `json:"time"`
+	Data string    `json:"data"`
+	// Метка и цвет порта, назначенные пользователем
+	Label string `json:"label,omitempty"`
+	Color string `json:"color,omitempty"`
+}
+
+// Запрос на подписку на общую ленту
+type timelineRequest struct {
+	// Порты, строки которых попадают в ленту. Пустой список - все порты.
+	Ports []string `json:"ports"`
+}
+
+var (
+	// Подписчики общей ленты и порты, на которые они подписаны
+	timelineSubscribers = make(map[*websocket.Conn]map[string]bool)
+	// Сквозной номер последнего сообщения ленты
+	timelineSeq uint64
+	// Мьютекс для синхронизации доступа к ленте. Номер и время сообщения
+	// назначаются под ним, поэтому порядок номеров совпадает с порядком времени.
+	timelineMutex = &sync.Mutex{}
+)
+
+func init() {
+	clientActions["timelineSubscribe"] = processTimelineSubscribe
+	clientActions["timelineUnsubscribe"] = processTimelineUnsubscribe
+}
+
+// Подписка клиента на общую ленту
+func processTimelineSubscribe(ws *websocket.Conn, message map[string]interface{}) {
+	var request timelineRequest
+	if err := decodeAction(message, &request); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неверный формат запроса ленты: %v", err)}
+		return
+	}
+
+	ports := make(map[string]bool)
+	for _, port := range request.Ports {
+		ports[port] = true
+	}
+
+	timelineMutex.Lock()
+	timelineSubscribers[ws] = ports
+	timelineMutex.Unlock()
+
+	if len(request.Ports) == 0 {
+		directMessages <- clientMessage{ws, "Подписка на общую ленту всех портов оформлена."}
+	} else {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Подписка на общую ленту портов %s оформлена.", strings.Join(request.Ports, ", "))}
+	}
+}
+
+// Отписка клиента от общей ленты
+func processTimelineUnsubscribe(ws *websocket.Conn, message map[string]interface{}) {
+	unsubscribeTimeline(ws)
+	directMessages <- clientMessage{ws, "Подписка на общую ленту отменена."}
+}
+
+// Удаляем клиента из подписчиков ленты
+func unsubscribeTimeline(ws *websocket.Conn) {
+	timelineMutex.Lock()
+	defer timelineMutex.Unlock()
+
+	delete(timelineSubscribers, ws)
+}
+
+// Публикация строки порта в общую ленту
+func publishTimeline(port, line string) {
+	timelineMutex.Lock()
+	defer timelineMutex.Unlock()
+
+	if len(timelineSubscribers) == 0 {
+		return
+	}
+
+	meta := getPortMetadata(port)
+	timelineSeq++
+	event := timelineEvent{
+		Type:  "timeline",
+		Seq:   timelineSeq,
+		Port:  port,
+		Time:  time.Now(),
+		Data:  line,
+		Label: meta.Label,
+		Color: meta.Color,
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Ошибка при маршалинге сообщения ленты: %v", err)
+		return
+	}
+
+	for ws, ports := range timelineSubscribers {
+		if len(ports) == 0 || ports[port] {
+			directMessages <- clientMessage{ws, string(data)}
+		}
+	}
+}
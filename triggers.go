@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Имя файла с триггерами в каталоге данных
+const triggersFile = "triggers.json"
+
+// Каталог со снимками триггеров внутри каталога данных
+const snapshotsDir = "snapshots"
+
+// Триггер: регулярное выражение, при совпадении с которым строки порта
+// клиенты получают уведомление, а при необходимости сохраняется снимок
+type trigger struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	// Порт, строки которого проверяются. Пустое значение - все порты.
+	Port string `json:"port,omitempty"`
+	// Отправлять ли оповещение по почте или в Telegram (см. notifiers.go)
+	Notify bool `json:"notify,omitempty"`
+	// Сохранять ли снимок контекста до и после совпадения
+	Snapshot bool   `json:"snapshot,omitempty"`
+	Before   string `json:"before,omitempty"`
+	After    string `json:"after,omitempty"`
+
+	re     *regexp.Regexp
+	before time.Duration
+	after  time.Duration
+}
+
+// Запрос, в котором указано только имя (триггера, правила и т.д.)
+type nameRequest struct {
+	Name string `json:"name"`
+}
+
+var (
+	// Действующие триггеры, ключ - имя триггера
+	triggers = make(map[string]*trigger)
+	// Мьютекс для синхронизации доступа к triggers
+	triggersMutex = &sync.Mutex{}
+	// Символы, недопустимые в именах файлов снимков
+	unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+)
+
+func init() {
+	clientActions["addTrigger"] = processAddTrigger
+	clientActions["removeTrigger"] = processRemoveTrigger
+	clientActions["listTriggers"] = processListTriggers
+}
+
+// Загрузка сохранённых триггеров при запуске
+func loadTriggers() {
+	var saved []*trigger
+	if err := loadJSONFile(triggersFile, &saved); err != nil {
+		log.Printf("Ошибка загрузки триггеров: %v", err)
+		return
+	}
+
+	triggersMutex.Lock()
+	defer triggersMutex.Unlock()
+
+	for _, t := range saved {
+		if err := t.compile(); err != nil {
+			log.Printf("Ошибка загрузки триггера %s: %v", t.Name, err)
+			continue
+		}
+		triggers[t.Name] = t
+	}
+	updateHistoryRequired()
+}
+
+// Подготовка триггера: разбор регулярного выражения и длительностей
+func (t *trigger) compile() error {
+	if t.Name == "" {
+		return fmt.Errorf("не указано имя триггера")
+	}
+	var err error
+	if t.re, err = regexp.Compile(t.Pattern); err != nil {
+		return fmt.Errorf("неверное регулярное выражение: %v", err)
+	}
+	if t.before, err = parseOptionalDuration(t.Before); err != nil {
+		return err
+	}
+	if t.after, err = parseOptionalDuration(t.After); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Разбор длительности, пустая строка означает ноль
+func parseOptionalDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("неверная длительность %q", s)
+	}
+	return d, nil
+}
+
+// Добавление или замена триггера
+func processAddTrigger(ws *websocket.Conn, message map[string]interface{}) {
+	t := &trigger{}
+	if err := decodeAction(message, t); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неверный формат триггера: %v", err)}
+		return
+	}
+	if err := t.compile(); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: %v", err)}
+		return
+	}
+
+	triggersMutex.Lock()
+	triggers[t.Name] = t
+	err := saveTriggers()
+	triggersMutex.Unlock()
+
+	if err != nil {
+		broadcast <- fmt.Sprintf("Ошибка сохранения триггеров: %v", err)
+	}
+	broadcast <- fmt.Sprintf("Триггер %s установлен: %s", t.Name, t.Pattern)
+}
+
+// Удаление триггера
+func processRemoveTrigger(ws *websocket.Conn, message map[string]interface{}) {
+	var request nameRequest
+	if err := decodeAction(message, &request); err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: неверный формат запроса: %v", err)}
+		return
+	}
+
+	triggersMutex.Lock()
+	_, ok := triggers[request.Name]
+	delete(triggers, request.Name)
+	err := saveTriggers()
+	triggersMutex.Unlock()
+
+	if !ok {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка: триггер %s не найден.", request.Name)}
+		return
+	}
+	if err != nil {
+		broadcast <- fmt.Sprintf("Ошибка сохранения триггеров: %v", err)
+	}
+	broadcast <- fmt.Sprintf("Триггер %s удалён.", request.Name)
+}
+
+// Отправка списка триггеров запросившему клиенту
+func processListTriggers(ws *websocket.Conn, message map[string]interface{}) {
+	data, err := json.Marshal(map[string]interface{}{"type": "triggers", "triggers": sortedTriggers()})
+	if err != nil {
+		directMessages <- clientMessage{ws, fmt.Sprintf("Ошибка при маршалинге триггеров: %v", err)}
+		return
+	}
+	directMessages <- clientMessage{ws, string(data)}
+}
+
+// Список триггеров, упорядоченный по имени
+func sortedTriggers() []*trigger {
+	triggersMutex.Lock()
+	defer triggersMutex.Unlock()
+
+	list := make([]*trigger, 0, len(triggers))
+	for _, t := range triggers {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Сохранение триггеров. Вызывается под triggersMutex.
+func saveTriggers() error {
+	updateHistoryRequired()
+	list := make([]*trigger, 0, len(triggers))
+	for _, t := range triggers {
+		list = append(list, t)
+	}
+	return saveJSONFile(triggersFile, list)
+}
+
+// История портов должна быть не короче самого длинного окна снимка.
+// Вызывается под triggersMutex.
+func updateHistoryRequired() {
+	var required time.Duration
+	for _, t := range triggers {
+		if t.Snapshot && t.before+t.after > required {
+			required = t.before + t.after
+		}
+	}
+	setHistoryRequired(required)
+}
+
+// Проверка строки порта на совпадение с триггерами
+func checkTriggers(port, line string, t time.Time) {
+	triggersMutex.Lock()
+	var fired []*trigger
+	for _, tr := range triggers {
+		if (tr.Port == "" || tr.Port == port) && tr.re.MatchString(line) {
+			fired = append(fired, tr)
+		}
+	}
+	triggersMutex.Unlock()
+
+	for _, tr := range fired {
+		broadcast <- fmt.Sprintf("Сработал триггер %s на порту %s: %s", tr.Name, port, line)
+		publishEvent(publishedEvent{Type: eventTrigger, Time: t, Port: port, Line: line, Trigger: tr.Name})
+		if tr.Notify {
+			notifyAlert(fmt.Sprintf("Сработал триггер %s на порту %s", tr.Name, port), line)
+		}
+		dumpFlightRecorder(port, "триггер "+tr.Name)
+		if tr.Snapshot {
+			tr := tr
+			// Снимок сохраняется, когда накопится контекст после совпадения
+			time.AfterFunc(tr.after, func() {
+				saveTriggerSnapshot(tr, port, line, t)
+			})
+		}
+	}
+}
+
+// Сохранение снимка строк порта вокруг совпадения триггера
+func saveTriggerSnapshot(tr *trigger, port, line string, matchedAt time.Time) {
+	name := fmt.Sprintf("%s_%s_%s.log",
+		unsafeFileChars.ReplaceAllString(tr.Name, "_"),
+		unsafeFileChars.ReplaceAllString(filepath.Base(port), "_"),
+		matchedAt.Format("20060102-150405.000"))
+	path := dataPath(filepath.Join(namespacedDir(snapshotsDir, port), name))
+
+	if err := writeSnapshotFile(path, tr, port, line, matchedAt); err != nil {
+		broadcast <- fmt.Sprintf("Ошибка сохранения снимка триггера %s: %v", tr.Name, err)
+		return
+	}
+	broadcast <- fmt.Sprintf("Снимок триггера %s сохранён: %s", tr.Name, path)
+}
+
+func writeSnapshotFile(path string, tr *trigger, port, line string, matchedAt time.Time) error {
+	if err := diskWriteAllowed(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	w := &bytes.Buffer{}
+	fmt.Fprintf(w, "# Триггер: %s (%s)\n", tr.Name, tr.Pattern)
+	fmt.Fprintf(w, "# Порт: %s\n", port)
+	fmt.Fprintf(w, "# Идентификаторы сеанса: %s\n", sessionTagsJSON(port))
+	fmt.Fprintf(w, "# Совпадение: %s %s\n", matchedAt.Format(logTimeFormat), line)
+	for _, l := range historyWindow(port, matchedAt.Add(-tr.before), matchedAt.Add(tr.after)) {
+		fmt.Fprintf(w, "%s\t%s\n", l.Time.Format(logTimeFormat), l.Line)
+	}
+	return writeStoredFile(path, w.Bytes())
+}